@@ -0,0 +1,315 @@
+// Package client is a kvstore.Store backed by a served store, so code
+// written against an embedded KvStore can use a remote one unchanged.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shimanekb/project1-C/server"
+	"github.com/shimanekb/project1-C/store"
+)
+
+const (
+	DEFAULT_TIMEOUT        time.Duration = 5 * time.Second
+	DEFAULT_RETRIES        int           = 3
+	DEFAULT_BACKOFF        time.Duration = 100 * time.Millisecond
+	DEFAULT_MAX_BACKOFF    time.Duration = 2 * time.Second
+	DEFAULT_MAX_IDLE_CONNS int           = 16
+	IDLE_CONN_TIMEOUT      time.Duration = 90 * time.Second
+)
+
+// StatusError is an answer from the server that is not one of the store's
+// errors.
+type StatusError struct {
+	Addr    string
+	Code    int
+	Message string
+}
+
+func (s *StatusError) Error() string {
+	return fmt.Sprintf("%s answered %d %s: %s", s.Addr, s.Code, http.StatusText(s.Code),
+		s.Message)
+}
+
+type Options struct {
+	// Timeout bounds each attempt at a request, zero leaves them unbounded.
+	Timeout time.Duration
+	// Retries is how many times a request is sent again after it could not
+	// reach the server or the server was unavailable, waiting Backoff
+	// before the first retry and twice as long before each next one, up to
+	// MaxBackoff.
+	Retries    int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// MaxIdleConns is how many connections to the server are kept open for
+	// reuse.
+	MaxIdleConns int
+	// Tls connects over HTTPS when set, its Certificates are sent to servers
+	// that ask for a client certificate.
+	Tls *tls.Config
+	// Token is sent as a bearer token and ClientId as X-Client-Id, when set.
+	Token    string
+	ClientId string
+	// Idempotent sends each Put and Del with an Idempotency-Key, so a retry
+	// of a write the server already applied is not applied again. The
+	// server saves every such key, turn it off to spare it the writes.
+	Idempotent bool
+}
+
+func DefaultOptions() Options {
+	return Options{DEFAULT_TIMEOUT, DEFAULT_RETRIES, DEFAULT_BACKOFF, DEFAULT_MAX_BACKOFF,
+		DEFAULT_MAX_IDLE_CONNS, nil, "", "", true}
+}
+
+// Option tunes one setting for New.
+type Option func(opts *Options)
+
+// Client talks to the server at Addr, a host:port. It is safe for
+// concurrent use and keeps connections open between requests, Close
+// releases them.
+type Client struct {
+	Addr    string
+	options Options
+	http    *http.Client
+}
+
+func New(addr string, opts ...Option) *Client {
+	options := DefaultOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment,
+		MaxIdleConns: options.MaxIdleConns, MaxIdleConnsPerHost: options.MaxIdleConns,
+		IdleConnTimeout: IDLE_CONN_TIMEOUT, TLSClientConfig: options.Tls}
+	return &Client{addr, options, &http.Client{Transport: transport}}
+}
+
+// Close closes the idle connections kept for reuse.
+func (c *Client) Close() error {
+	c.http.CloseIdleConnections()
+	return nil
+}
+
+func (c *Client) url(path string, query url.Values) string {
+	scheme := "http://"
+	if c.options.Tls != nil {
+		scheme = "https://"
+	}
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	return scheme + c.Addr + path
+}
+
+func (c *Client) keyUrl(key string) string {
+	return c.url(server.KEYS_PATH+url.PathEscape(key), nil)
+}
+
+func (c *Client) Put(key string, value string) error {
+	return c.PutContext(context.Background(), key, value)
+}
+
+// PutContext sends the value with its checksum, which the server checks.
+func (c *Client) PutContext(ctx context.Context, key string, value string) error {
+	header := http.Header{}
+	header.Set(server.CHECKSUM_HEADER, fmt.Sprintf("%08x", kvstore.Checksum([]byte(value))))
+	_, _, err := c.do(ctx, http.MethodPut, c.keyUrl(key), value, header)
+	return err
+}
+
+func (c *Client) Get(key string) (string, error) {
+	return c.GetContext(context.Background(), key)
+}
+
+// GetContext checks the value read against the checksum the server sent
+// with it.
+func (c *Client) GetContext(ctx context.Context, key string) (string, error) {
+	body, header, err := c.do(ctx, http.MethodGet, c.keyUrl(key), "", nil)
+	if err != nil {
+		return "", err
+	}
+
+	if sum := header.Get(server.CHECKSUM_HEADER); sum != "" {
+		checksum, err := strconv.ParseUint(sum, 16, 32)
+		if err != nil || uint32(checksum) != kvstore.Checksum(body) {
+			return "", kvstore.ErrChecksumMismatch
+		}
+	}
+
+	return string(body), nil
+}
+
+func (c *Client) Del(key string) error {
+	return c.DelContext(context.Background(), key)
+}
+
+func (c *Client) DelContext(ctx context.Context, key string) error {
+	_, _, err := c.do(ctx, http.MethodDelete, c.keyUrl(key), "", nil)
+	return err
+}
+
+// MGet reads several keys in one request, keys that are not stored are left
+// out of the map.
+func (c *Client) MGet(keys ...string) (map[string]string, error) {
+	body, _, err := c.do(context.Background(), http.MethodGet,
+		c.url(server.MGET_PATH, url.Values{"key": keys}), "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	return values, json.Unmarshal(body, &values)
+}
+
+// Scan pages through the server's keys like KvStore.Scan.
+func (c *Client) Scan(cursor string, count int) ([]string, string, error) {
+	query := url.Values{"cursor": {cursor}, "count": {strconv.Itoa(count)}}
+	body, _, err := c.do(context.Background(), http.MethodGet, c.url(server.SCAN_PATH, query),
+		"", nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var page server.ScanResponse
+	if err := json.Unmarshal(body, &page); err != nil {
+		return nil, "", err
+	}
+
+	return page.Keys, page.Cursor, nil
+}
+
+// do sends a request, retrying it when it may succeed later.
+func (c *Client) do(ctx context.Context, method string, target string, body string,
+	header http.Header) ([]byte, http.Header, error) {
+	if header == nil {
+		header = http.Header{}
+	}
+	if c.options.Token != "" {
+		header.Set("Authorization", server.BEARER_PREFIX+c.options.Token)
+	}
+	if c.options.ClientId != "" {
+		header.Set(server.CLIENT_ID_HEADER, c.options.ClientId)
+	}
+	if c.options.Idempotent && (method == http.MethodPut || method == http.MethodDelete) {
+		token, err := idempotencyKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		header.Set(server.IDEMPOTENCY_HEADER, token)
+	}
+
+	backoff := c.options.Backoff
+	for attempt := 0; ; attempt++ {
+		data, responseHeader, err := c.attempt(ctx, method, target, body, header)
+		if err == nil || attempt >= c.options.Retries || !retryable(err) || ctx.Err() != nil {
+			return data, responseHeader, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if c.options.MaxBackoff > 0 && backoff > c.options.MaxBackoff {
+			backoff = c.options.MaxBackoff
+		}
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, method string, target string, body string,
+	header http.Header) ([]byte, http.Header, error) {
+	if c.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.options.Timeout)
+		defer cancel()
+	}
+
+	var reader io.Reader
+	if method == http.MethodPut {
+		reader = strings.NewReader(body)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+
+	response, err := c.http.Do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if response.StatusCode >= 300 {
+		return nil, nil, c.statusError(response.StatusCode, data)
+	}
+
+	return data, response.Header, nil
+}
+
+// statusError turns an answer the server gave into the error the store
+// would have returned, where there is one.
+func (c *Client) statusError(code int, body []byte) error {
+	switch code {
+	case http.StatusNotFound:
+		return kvstore.ErrKeyNotFound
+	case http.StatusUnauthorized:
+		return server.ErrUnauthorized
+	case http.StatusForbidden:
+		return server.ErrForbidden
+	case http.StatusInsufficientStorage:
+		return kvstore.ErrQuotaExceeded
+	}
+
+	return &StatusError{c.Addr, code, string(bytes.TrimSpace(body))}
+}
+
+// retryable is whether a failed request may succeed when sent again: it did
+// not reach the server, the server was unavailable or an earlier attempt
+// at the same write was still being applied.
+func retryable(err error) bool {
+	status, ok := err.(*StatusError)
+	if !ok {
+		_, isUrl := err.(*url.Error)
+		return isUrl
+	}
+
+	switch status.Code {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout,
+		http.StatusConflict:
+		return true
+	}
+
+	return false
+}
+
+func idempotencyKey() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(token), nil
+}
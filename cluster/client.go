@@ -0,0 +1,153 @@
+package cluster
+
+import (
+	"errors"
+	"sync"
+)
+
+const MIGRATE_SCAN_COUNT int = 500
+
+var ErrNoNodes error = errors.New("Cluster has no nodes.")
+
+// Client partitions keys over store servers with a consistent hash Ring and
+// is itself a kvstore.Store.
+type Client struct {
+	sync.RWMutex
+	ring   *Ring
+	stores map[string]*RemoteStore
+}
+
+func NewClient(addrs ...string) *Client {
+	client := &Client{sync.RWMutex{}, NewRing(DEFAULT_VIRTUAL_NODES),
+		make(map[string]*RemoteStore)}
+	for _, addr := range addrs {
+		client.ring.Add(addr)
+		client.stores[addr] = NewRemoteStore(addr)
+	}
+
+	return client
+}
+
+func (c *Client) store(key string) (*RemoteStore, error) {
+	c.RLock()
+	defer c.RUnlock()
+	node := c.ring.Node(key)
+	if node == "" {
+		return nil, ErrNoNodes
+	}
+
+	return c.stores[node], nil
+}
+
+func (c *Client) Put(key string, value string) error {
+	store, err := c.store(key)
+	if err != nil {
+		return err
+	}
+
+	return store.Put(key, value)
+}
+
+func (c *Client) Get(key string) (string, error) {
+	store, err := c.store(key)
+	if err != nil {
+		return "", err
+	}
+
+	return store.Get(key)
+}
+
+func (c *Client) Del(key string) error {
+	store, err := c.store(key)
+	if err != nil {
+		return err
+	}
+
+	return store.Del(key)
+}
+
+func (c *Client) Nodes() []string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.ring.Nodes()
+}
+
+// AddNode puts addr on the ring and moves the keys it now owns over from the
+// other nodes. Writes made while it runs may land on either node.
+func (c *Client) AddNode(addr string) error {
+	c.Lock()
+	if _, ok := c.stores[addr]; ok {
+		c.Unlock()
+		return nil
+	}
+
+	sources := make([]*RemoteStore, 0, len(c.stores))
+	for _, store := range c.stores {
+		sources = append(sources, store)
+	}
+	c.ring.Add(addr)
+	c.stores[addr] = NewRemoteStore(addr)
+	c.Unlock()
+
+	for _, source := range sources {
+		if err := c.migrate(source); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoveNode takes addr off the ring and moves its keys to the nodes that now
+// own them, so addr must still be reachable.
+func (c *Client) RemoveNode(addr string) error {
+	c.Lock()
+	source, ok := c.stores[addr]
+	if !ok {
+		c.Unlock()
+		return nil
+	}
+
+	c.ring.Remove(addr)
+	delete(c.stores, addr)
+	c.Unlock()
+
+	return c.migrate(source)
+}
+
+// migrate moves every key of source that the ring no longer places on it.
+func (c *Client) migrate(source *RemoteStore) error {
+	cursor := ""
+	for {
+		keys, next, err := source.Scan(cursor, MIGRATE_SCAN_COUNT)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			target, err := c.store(key)
+			if err != nil {
+				return err
+			}
+			if target.Addr == source.Addr {
+				continue
+			}
+
+			value, err := source.Get(key)
+			if err != nil {
+				return err
+			}
+			if err := target.Put(key, value); err != nil {
+				return err
+			}
+			if err := source.Del(key); err != nil {
+				return err
+			}
+		}
+
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
@@ -0,0 +1,12 @@
+package cluster
+
+import (
+	"github.com/shimanekb/project1-C/client"
+)
+
+// RemoteStore is a Store backed by a server's HTTP API at Addr.
+type RemoteStore = client.Client
+
+func NewRemoteStore(addr string) *RemoteStore {
+	return client.New(addr)
+}
@@ -0,0 +1,98 @@
+package cluster
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+const DEFAULT_VIRTUAL_NODES int = 128
+
+type point struct {
+	hash uint32
+	node string
+}
+
+// Ring places every node at VirtualNodes points on a hash ring, a key belongs
+// to the first node point at or after its own hash. Adding or removing a node
+// only moves the keys between its points and their neighbours.
+type Ring struct {
+	VirtualNodes int
+	points       []point
+	nodes        map[string]bool
+}
+
+func NewRing(virtualNodes int) *Ring {
+	if virtualNodes <= 0 {
+		virtualNodes = DEFAULT_VIRTUAL_NODES
+	}
+
+	return &Ring{virtualNodes, make([]point, 0), make(map[string]bool)}
+}
+
+// hashKey takes ring positions from md5 like ketama, fnv places the points
+// of similar node names too close together to spread keys evenly.
+func hashKey(key string) uint32 {
+	sum := md5.Sum([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+func (r *Ring) Add(node string) {
+	if r.nodes[node] {
+		return
+	}
+	r.nodes[node] = true
+
+	for i := 0; i < r.VirtualNodes; i++ {
+		r.points = append(r.points, point{hashKey(node + "#" + strconv.Itoa(i)), node})
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].node < r.points[j].node
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+}
+
+func (r *Ring) Remove(node string) {
+	if !r.nodes[node] {
+		return
+	}
+	delete(r.nodes, node)
+
+	points := r.points[:0]
+	for _, p := range r.points {
+		if p.node != node {
+			points = append(points, p)
+		}
+	}
+	r.points = points
+}
+
+// Node is the node owning key, empty when the ring has no nodes.
+func (r *Ring) Node(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	hash := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.points[i].node
+}
+
+func (r *Ring) Nodes() []string {
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	return nodes
+}
@@ -0,0 +1,272 @@
+// Command kvctl runs commands files against a store and reads, writes,
+// maintains and serves it from the command line:
+//
+//	kvctl [-store url] [-config file] <command> [arguments]
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/shimanekb/project1-C/config"
+	"github.com/shimanekb/project1-C/controller"
+	"github.com/shimanekb/project1-C/server"
+	"github.com/shimanekb/project1-C/store"
+	log "github.com/sirupsen/logrus"
+)
+
+const usage string = `Usage: kvctl [-store url] [-config file] [-logs] <command> [arguments]
+
+Commands:
+  run <commands.csv> <output.txt>  replay a commands file
+  get <key>                        print the value of a key
+  put <key> <value>                store a value
+  del <key>                        delete a key
+  scan [cursor] [count]            list a page of keys
+  compact                          drop overwritten and deleted records
+  stats                            print store stats
+  describe <key>                   print the size, versions, last write
+                                   time and source of a key
+  repair                           repair the data log and rebuild the index
+  serve [addr]                     serve the store over HTTP, on the
+                                   config file's server addr by default
+
+compact, stats, describe, repair and serve need a file: store that is not open, kept
+by the log engine. compact also merges a hash engine store.
+`
+
+var ErrUsage error = errors.New("Wrong arguments.")
+
+var storeFlag *string = flag.String("store", controller.DEFAULT_STORE_URL, "Store to use, file:./storage or http://host:port")
+var configFlag *string = flag.String("config", "", "YAML, TOML or JSON file of store, server and log settings")
+var logFlag *bool = flag.Bool("logs", false, "Log to stderr")
+
+var configFile config.File
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+	if *logFlag {
+		log.SetOutput(os.Stderr)
+	} else {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *configFlag != "" {
+		var err error
+		if configFile, err = config.Load(*configFlag); err == nil {
+			err = configFile.ApplyLog()
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "kvctl:", err)
+			os.Exit(1)
+		}
+	}
+	controller.RegisterStore(controller.FILE_SCHEME, controller.FileStoreOpener(
+		func(opts *kvstore.Options) { *opts = configFile.StoreOptions(*opts) }))
+
+	err := runCommand(flag.Arg(0), flag.Args()[1:])
+	if err == ErrUsage {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "kvctl:", err)
+		os.Exit(1)
+	}
+}
+
+func runCommand(name string, args []string) error {
+	switch name {
+	case "run":
+		if len(args) != 2 {
+			return ErrUsage
+		}
+		controller.ReadCsvCommandsTo(args[0], args[1], *storeFlag)
+		return nil
+	case "get", "put", "del", "scan":
+		return runStoreCommand(name, args)
+	case "compact", "stats", "describe", "repair", "serve":
+		return runLocalCommand(name, args)
+	}
+
+	return ErrUsage
+}
+
+// runStoreCommand runs a command that works on any store.
+func runStoreCommand(name string, args []string) error {
+	store, closeStore, err := controller.OpenStore(*storeFlag)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	switch {
+	case name == "get" && len(args) == 1:
+		value, err := store.Get(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println(value)
+		return nil
+	case name == "put" && len(args) == 2:
+		return store.Put(args[0], args[1])
+	case name == "del" && len(args) == 1:
+		return store.Del(args[0])
+	case name == "scan" && len(args) <= 2:
+		return scan(store, args)
+	}
+
+	return ErrUsage
+}
+
+func scan(store kvstore.Store, args []string) error {
+	scanner, ok := store.(kvstore.ScanStore)
+	if !ok {
+		return fmt.Errorf("Store %s cannot be scanned.", *storeFlag)
+	}
+
+	cursor, count := "", kvstore.DEFAULT_SCAN_COUNT
+	if len(args) > 0 {
+		cursor = args[0]
+	}
+	if len(args) > 1 {
+		var err error
+		if count, err = strconv.Atoi(args[1]); err != nil {
+			return err
+		}
+	}
+
+	keys, next, err := scanner.Scan(cursor, count)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		fmt.Println(key)
+	}
+	if next != "" {
+		fmt.Fprintln(os.Stderr, "next cursor:", next)
+	}
+
+	return nil
+}
+
+// runLocalCommand runs a command that needs the directory of a local store.
+func runLocalCommand(name string, args []string) error {
+	dir, err := controller.LocalDir(*storeFlag)
+	if err != nil {
+		return err
+	}
+
+	opts := kvstore.DefaultOptions()
+	opts.Dir = dir
+	opts.Logger = log.StandardLogger()
+	opts = configFile.StoreOptions(opts)
+	if opts.Engine == kvstore.ENGINE_HASH && name == "compact" && len(args) == 0 {
+		return merge(opts)
+	}
+	if opts.Engine != "" && opts.Engine != kvstore.ENGINE_LOG {
+		return fmt.Errorf("%s needs the log engine, the store uses %s.", name, opts.Engine)
+	}
+
+	switch {
+	case name == "compact" && len(args) == 0:
+		report, err := kvstore.Compact(dir, opts, nil)
+		if err != nil {
+			return err
+		}
+		return printJson(report)
+	case name == "repair" && len(args) == 0:
+		report, err := kvstore.RepairWithOptions(dir, opts)
+		if err != nil {
+			return err
+		}
+		return printJson(report)
+	case name == "stats" && len(args) == 0:
+		store, err := kvstore.OpenKvStoreWithOptions(opts)
+		if err != nil {
+			return err
+		}
+		defer store.Shutdown()
+
+		stats, err := store.StatsV1()
+		if err != nil {
+			return err
+		}
+		return printJson(stats)
+	case name == "describe" && len(args) == 1:
+		store, err := kvstore.OpenKvStoreWithOptions(opts)
+		if err != nil {
+			return err
+		}
+		defer store.Shutdown()
+
+		info, err := store.Describe(args[0])
+		if err != nil {
+			return err
+		}
+		return printJson(info)
+	case name == "serve" && len(args) == 1:
+		return serve(args[0], opts)
+	case name == "serve" && len(args) == 0 && configFile.Server.Addr != nil:
+		return serve(*configFile.Server.Addr, opts)
+	}
+
+	return ErrUsage
+}
+
+// merge compacts a hash engine store.
+func merge(opts kvstore.Options) error {
+	store, err := kvstore.OpenHashStore(opts)
+	if err != nil {
+		return err
+	}
+	defer store.Shutdown()
+
+	report, err := store.Merge()
+	if err != nil {
+		return err
+	}
+	return printJson(report)
+}
+
+// serve serves the store on addr until interrupted.
+func serve(addr string, opts kvstore.Options) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	store, err := kvstore.OpenKvStoreWithOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	srv := server.NewServer(store, addr)
+	configFile.ApplyServer(srv)
+	summary, err := srv.Serve(ctx)
+	fmt.Fprintln(os.Stderr, summary)
+	return err
+}
+
+func printJson(value interface{}) error {
+	return json.NewEncoder(os.Stdout).Encode(value)
+}
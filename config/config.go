@@ -0,0 +1,315 @@
+// Package config loads the settings of a store, its server and its logging
+// from one YAML, TOML or JSON file, with environment variable overrides.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/shimanekb/project1-C/server"
+	"github.com/shimanekb/project1-C/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// ENV_PREFIX starts the environment variables that override a setting,
+// KV_ then the section and the setting in upper snake case, like
+// KV_STORE_CACHE_MAX_BYTES=64MB or KV_SERVER_ADDR=:8080.
+const ENV_PREFIX string = "KV"
+
+// File is a config file. Its store section takes the settings of a
+// kvstore.Config, settings left out keep their defaults.
+type File struct {
+	Store  kvstore.Config `json:"store"`
+	Server Server         `json:"server"`
+	Tls    Tls            `json:"tls"`
+	Log    Log            `json:"log"`
+}
+
+type Server struct {
+	Addr *string `json:"addr"`
+	// Auth is backend:path like the auth flag, tokens:users.txt.
+	Auth         *string           `json:"auth"`
+	DrainTimeout *kvstore.Duration `json:"drainTimeout"`
+	Replicate    *string           `json:"replicate"`
+	Follow       *string           `json:"follow"`
+	// Acl is the file of key prefix rules, like the acl flag.
+	Acl *string `json:"acl"`
+	// Audit is the file to audit key requests to, like the audit flag.
+	Audit        *string       `json:"audit"`
+	AuditGets    *bool         `json:"auditGets"`
+	AuditMaxSize *kvstore.Size `json:"auditMaxSize"`
+	AuditFiles   *int          `json:"auditFiles"`
+}
+
+type Log struct {
+	// Level is a logrus level, like debug or warn.
+	Level *string `json:"level"`
+}
+
+// Load reads the config file at path by its extension, .yaml, .yml, .toml
+// or .json, then applies the KV_ environment variables over it. A JSON file
+// without sections is the store section. YAML and TOML files are read as
+// sections of plain settings, like:
+//
+//	store:
+//	  cacheMaxBytes: 64MB
+//	  logSampling:
+//	    index: 100
+//	server:
+//	  addr: ":8080"
+func Load(path string) (File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return File{}, err
+	}
+
+	var file File
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = parseJson(data, &file)
+	case ".yaml", ".yml":
+		err = file.setSections(parseYaml(string(data)))
+	case ".toml":
+		err = file.setSections(parseToml(string(data)))
+	default:
+		err = fmt.Errorf("Unknown config file type %q.", filepath.Ext(path))
+	}
+	if err != nil {
+		return File{}, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return file, file.setEnv(os.LookupEnv)
+}
+
+// parseJson reads a JSON config file, or a plain kvstore.Config written
+// for the store's config flag before files had sections.
+func parseJson(data []byte, file *File) error {
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(data, &sections); err != nil {
+		return err
+	}
+
+	for name := range sections {
+		if _, ok := fieldByTag(reflect.TypeOf(*file), name); ok {
+			return json.Unmarshal(data, file)
+		}
+	}
+
+	return json.Unmarshal(data, &file.Store)
+}
+
+// StoreOptions applies the store section to opts.
+func (f File) StoreOptions(opts kvstore.Options) kvstore.Options {
+	return f.Store.Apply(opts)
+}
+
+// ApplyServer applies the drain timeout and the audit log settings of the
+// server section to srv, the other server settings are read by whoever
+// starts it.
+func (f File) ApplyServer(srv *server.Server) {
+	if f.Server.DrainTimeout != nil {
+		srv.DrainTimeout = time.Duration(*f.Server.DrainTimeout)
+	}
+	if srv.Audit == nil {
+		return
+	}
+	if f.Server.AuditGets != nil {
+		srv.Audit.Gets = *f.Server.AuditGets
+	}
+	if f.Server.AuditMaxSize != nil {
+		srv.Audit.MaxSize = int64(*f.Server.AuditMaxSize)
+	}
+	if f.Server.AuditFiles != nil {
+		srv.Audit.Files = *f.Server.AuditFiles
+	}
+}
+
+// ApplyLog sets the level of the standard logger.
+func (f File) ApplyLog() error {
+	if f.Log.Level == nil {
+		return nil
+	}
+
+	level, err := log.ParseLevel(*f.Log.Level)
+	if err != nil {
+		return err
+	}
+
+	log.SetLevel(level)
+	return nil
+}
+
+// setSections sets the settings of parsed sections, keyed by their dotted
+// path like "store.logSampling".
+func (f *File) setSections(sections map[string]map[string]string, err error) error {
+	if err != nil {
+		return err
+	}
+
+	for name, values := range sections {
+		for key := range values {
+			if !known(reflect.TypeOf(*f), strings.Split(name, "."), key) {
+				return fmt.Errorf("Unknown setting %s.%s.", name, key)
+			}
+		}
+	}
+
+	return set(reflect.ValueOf(f).Elem(), nil, func(path []string, key string) (string, bool) {
+		value, ok := sections[strings.Join(path, ".")][key]
+		return value, ok
+	}, sections)
+}
+
+// setEnv sets the settings that have an environment variable.
+func (f *File) setEnv(lookup func(name string) (string, bool)) error {
+	return set(reflect.ValueOf(f).Elem(), nil, func(path []string, key string) (string, bool) {
+		name := ENV_PREFIX
+		for _, part := range append(path, key) {
+			name += "_" + upperSnake(part)
+		}
+
+		return lookup(name)
+	}, nil)
+}
+
+// known is whether key is a setting of the section at path of typ.
+func known(typ reflect.Type, path []string, key string) bool {
+	for _, part := range path {
+		field, ok := fieldByTag(typ, part)
+		if !ok {
+			return false
+		}
+		typ = field.Type
+	}
+
+	if typ.Kind() == reflect.Map {
+		return true
+	}
+
+	_, ok := fieldByTag(typ, key)
+	return ok && typ.Kind() == reflect.Struct
+}
+
+func fieldByTag(typ reflect.Type, tag string) (reflect.StructField, bool) {
+	if typ.Kind() != reflect.Struct {
+		return reflect.StructField{}, false
+	}
+
+	for i := 0; i < typ.NumField(); i++ {
+		if jsonName(typ.Field(i)) == tag {
+			return typ.Field(i), true
+		}
+	}
+
+	return reflect.StructField{}, false
+}
+
+func jsonName(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("json"), ",")[0]
+}
+
+// set walks the settings of the struct value at path, setting each one
+// lookup finds. Struct fields are sections, map fields take the whole
+// section of their name from sections.
+func set(value reflect.Value, path []string, lookup func(path []string, key string) (string, bool),
+	sections map[string]map[string]string) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		name := jsonName(value.Type().Field(i))
+		switch field.Kind() {
+		case reflect.Struct:
+			if err := set(field, append(path, name), lookup, sections); err != nil {
+				return err
+			}
+		case reflect.Map:
+			section, ok := sections[strings.Join(append(path, name), ".")]
+			if !ok {
+				continue
+			}
+			if err := setMap(field, section); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		case reflect.Ptr:
+			text, ok := lookup(path, name)
+			if !ok {
+				continue
+			}
+			if err := setScalar(field, text); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// setScalar sets a pointer to an int, bool, string or a type with a Set
+// method like kvstore.Size.
+func setScalar(field reflect.Value, text string) error {
+	target := reflect.New(field.Type().Elem())
+	if setter, ok := target.Interface().(interface{ Set(string) error }); ok {
+		if err := setter.Set(text); err != nil {
+			return err
+		}
+		field.Set(target)
+		return nil
+	}
+
+	switch target.Elem().Kind() {
+	case reflect.String:
+		target.Elem().SetString(text)
+	case reflect.Int:
+		number, err := strconv.Atoi(text)
+		if err != nil {
+			return err
+		}
+		target.Elem().SetInt(int64(number))
+	case reflect.Bool:
+		flag, err := strconv.ParseBool(text)
+		if err != nil {
+			return err
+		}
+		target.Elem().SetBool(flag)
+	default:
+		return fmt.Errorf("Unsupported setting type %s.", target.Elem().Type())
+	}
+
+	field.Set(target)
+	return nil
+}
+
+// setMap sets a map[string]int from a section.
+func setMap(field reflect.Value, section map[string]string) error {
+	values := make(map[string]int, len(section))
+	for key, text := range section {
+		number, err := strconv.Atoi(text)
+		if err != nil {
+			return err
+		}
+		values[key] = number
+	}
+
+	field.Set(reflect.ValueOf(values))
+	return nil
+}
+
+// upperSnake turns cacheMaxBytes into CACHE_MAX_BYTES.
+func upperSnake(name string) string {
+	var snake strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) && i > 0 {
+			snake.WriteByte('_')
+		}
+		snake.WriteRune(unicode.ToUpper(r))
+	}
+
+	return snake.String()
+}
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The config files only hold sections of plain settings, so YAML and TOML
+// are read as the subset of each that writes those: nested mappings of
+// scalars in YAML and tables of key = value pairs in TOML. Lists, inline
+// tables and multi-line strings are not supported.
+
+// parseYaml reads nested mappings, indented by spaces, into sections keyed
+// by their dotted path.
+func parseYaml(text string) (map[string]map[string]string, error) {
+	type level struct {
+		indent int
+		path   string
+	}
+
+	sections := make(map[string]map[string]string)
+	stack := []level{{-1, ""}}
+	for number, line := range strings.Split(text, "\n") {
+		content := strings.TrimRight(stripComment(line), " \t\r")
+		if strings.TrimSpace(content) == "" || content == "---" {
+			continue
+		}
+		if strings.Contains(content, "\t") {
+			return nil, fmt.Errorf("Line %d: indent with spaces.", number+1)
+		}
+
+		indent := len(content) - len(strings.TrimLeft(content, " "))
+		for indent <= stack[len(stack)-1].indent {
+			stack = stack[:len(stack)-1]
+		}
+
+		colon := strings.Index(content, ":")
+		if colon < 0 {
+			return nil, fmt.Errorf("Line %d: expected key: value.", number+1)
+		}
+		key := strings.TrimSpace(content[:colon])
+		raw := strings.TrimSpace(content[colon+1:])
+		path := stack[len(stack)-1].path
+		if raw == "" {
+			stack = append(stack, level{indent, joinPath(path, key)})
+			continue
+		}
+
+		value, err := unquote(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", number+1, err)
+		}
+		setValue(sections, path, key, value)
+	}
+
+	return sections, nil
+}
+
+// parseToml reads [table] headers and key = value pairs into sections
+// keyed by the table name.
+func parseToml(text string) (map[string]map[string]string, error) {
+	sections := make(map[string]map[string]string)
+	path := ""
+	for number, line := range strings.Split(text, "\n") {
+		content := strings.TrimSpace(stripComment(line))
+		if content == "" {
+			continue
+		}
+
+		if strings.HasPrefix(content, "[") {
+			if !strings.HasSuffix(content, "]") || strings.HasPrefix(content, "[[") {
+				return nil, fmt.Errorf("Line %d: expected [table].", number+1)
+			}
+			path = strings.TrimSpace(content[1 : len(content)-1])
+			continue
+		}
+
+		equals := strings.Index(content, "=")
+		if equals < 0 {
+			return nil, fmt.Errorf("Line %d: expected key = value.", number+1)
+		}
+
+		value, err := unquote(strings.TrimSpace(content[equals+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", number+1, err)
+		}
+		key := strings.TrimSpace(content[:equals])
+		if dot := strings.LastIndex(key, "."); dot >= 0 {
+			setValue(sections, joinPath(path, key[:dot]), key[dot+1:], value)
+		} else {
+			setValue(sections, path, key, value)
+		}
+	}
+
+	return sections, nil
+}
+
+func setValue(sections map[string]map[string]string, path string, key string, value string) {
+	if sections[path] == nil {
+		sections[path] = make(map[string]string)
+	}
+	sections[path][key] = value
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+// stripComment cuts a # comment that is not inside quotes off a line.
+func stripComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case quote == 0 && r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+
+	return line
+}
+
+// unquote reads a scalar, a double quoted string with escapes, a single
+// quoted string or a bare word.
+func unquote(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		return strconv.Unquote(raw)
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") {
+			return "", fmt.Errorf("Unterminated string %s.", raw)
+		}
+		return strings.Replace(raw[1:len(raw)-1], "''", "'", -1), nil
+	case strings.HasPrefix(raw, "[") || strings.HasPrefix(raw, "{"):
+		return "", fmt.Errorf("Lists and inline tables are not supported, %s.", raw)
+	}
+
+	return raw, nil
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Tls is the tls section, it encrypts the server and replication with the
+// PEM cert and key. With clientAuth clients and followers must present a
+// certificate signed by a CA in the ca bundle, which followers and joining
+// nodes also check their primary or leader against.
+type Tls struct {
+	Cert       *string `json:"cert"`
+	Key        *string `json:"key"`
+	Ca         *string `json:"ca"`
+	ClientAuth *bool   `json:"clientAuth"`
+}
+
+// ServerConfig is the TLS config to serve with, nil without a cert.
+func (t Tls) ServerConfig() (*tls.Config, error) {
+	if t.Cert == nil || *t.Cert == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if err := t.loadCertificate(config); err != nil {
+		return nil, err
+	}
+	if t.ClientAuth == nil || !*t.ClientAuth {
+		return config, nil
+	}
+
+	pool, err := t.loadCa()
+	if err != nil {
+		return nil, err
+	}
+	if pool == nil {
+		return nil, errors.New("Client authentication needs a ca bundle.")
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// ClientConfig is the TLS config to connect to other nodes with, nil
+// without a cert or ca. It presents the cert when there is one.
+func (t Tls) ClientConfig() (*tls.Config, error) {
+	hasCert := t.Cert != nil && *t.Cert != ""
+	if !hasCert && (t.Ca == nil || *t.Ca == "") {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if hasCert {
+		if err := t.loadCertificate(config); err != nil {
+			return nil, err
+		}
+	}
+
+	pool, err := t.loadCa()
+	if err != nil {
+		return nil, err
+	}
+	config.RootCAs = pool
+	return config, nil
+}
+
+func (t Tls) loadCertificate(config *tls.Config) error {
+	if t.Key == nil || *t.Key == "" {
+		return fmt.Errorf("TLS cert %s has no key.", *t.Cert)
+	}
+
+	certificate, err := tls.LoadX509KeyPair(*t.Cert, *t.Key)
+	if err != nil {
+		return err
+	}
+
+	config.Certificates = []tls.Certificate{certificate}
+	return nil
+}
+
+// loadCa reads the ca bundle, nil without one so the system roots are used.
+func (t Tls) loadCa() (*x509.CertPool, error) {
+	if t.Ca == nil || *t.Ca == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(*t.Ca)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates in %s.", *t.Ca)
+	}
+	return pool, nil
+}
@@ -0,0 +1,118 @@
+package consensus
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math"
+
+	"github.com/hashicorp/raft"
+	"github.com/shimanekb/project1-C/store"
+)
+
+type snapshotEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// fsm applies committed raft log entries, each a JSON kvstore.Event, to the
+// local store. Apply returns the store's error as the entry's response.
+type fsm struct {
+	store *kvstore.KvStore
+}
+
+func (f *fsm) Apply(entry *raft.Log) interface{} {
+	var event kvstore.Event
+	if err := json.Unmarshal(entry.Data, &event); err != nil {
+		return err
+	}
+
+	return f.store.Apply(event)
+}
+
+// Snapshot copies every live key and value, raft does not apply entries while
+// it runs so the copy is consistent.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	keys, _, err := f.store.Scan("", math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]snapshotEntry, 0, len(keys))
+	for _, key := range keys {
+		value, err := f.store.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, snapshotEntry{key, value})
+	}
+
+	return &snapshot{entries}, nil
+}
+
+// Restore replaces the store's contents with a snapshot, deleting keys the
+// snapshot does not have.
+func (f *fsm) Restore(reader io.ReadCloser) error {
+	defer reader.Close()
+
+	entries := make(map[string]string)
+	decoder := json.NewDecoder(bufio.NewReader(reader))
+	for {
+		var entry snapshotEntry
+		err := decoder.Decode(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		entries[entry.Key] = entry.Value
+	}
+
+	keys, _, err := f.store.Scan("", math.MaxInt32)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if _, ok := entries[key]; ok {
+			continue
+		}
+		if err := f.store.Apply(kvstore.Event{Type: kvstore.DEL_COMMAND, Key: key}); err != nil {
+			return err
+		}
+	}
+
+	for key, value := range entries {
+		if err := f.store.Apply(kvstore.Event{Type: kvstore.PUT_COMMAND, Key: key, Value: value}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// snapshot is written as one JSON entry per line.
+type snapshot struct {
+	entries []snapshotEntry
+}
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	writer := bufio.NewWriter(sink)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range s.entries {
+		if err := encoder.Encode(entry); err != nil {
+			sink.Cancel()
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {}
@@ -0,0 +1,192 @@
+package consensus
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"github.com/shimanekb/project1-C/store"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	RAFT_DIR              string        = "raft"
+	RAFT_LOG_FILE         string        = "raft.db"
+	RETAIN_SNAPSHOTS      int           = 2
+	MAX_POOL              int           = 3
+	DEFAULT_APPLY_TIMEOUT time.Duration = 5 * time.Second
+)
+
+var ErrNotLeader error = errors.New("Node is not the raft leader.")
+
+type Peer struct {
+	ID   string
+	Addr string
+}
+
+// Config describes a node. Bootstrap starts a new cluster of this node and
+// Peers, it is ignored once the node has raft state in Dir. Other nodes are
+// started without it and added with Join on the leader.
+type Config struct {
+	ID        string
+	BindAddr  string
+	Dir       string
+	Bootstrap bool
+	Peers     []Peer
+}
+
+func DefaultConfig(id string, bindAddr string) Config {
+	dir := filepath.Join(".", kvstore.STORAGE_DIR)
+	return Config{id, bindAddr, filepath.Join(dir, RAFT_DIR), false, nil}
+}
+
+// Node replicates writes to a store through a raft log. Writes are only
+// accepted by the leader and return once a quorum has committed them and
+// they are in the leader's data log, so they are linearizable. The store
+// should be opened with Options.ReadOnly so it is only written through the
+// log.
+type Node struct {
+	Raft         *raft.Raft
+	Store        *kvstore.KvStore
+	ApplyTimeout time.Duration
+	transport    *raft.NetworkTransport
+	logStore     *raftboltdb.BoltStore
+}
+
+func NewNode(store *kvstore.KvStore, config Config) (*Node, error) {
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = raft.ServerID(config.ID)
+	raftConfig.LogOutput = log.StandardLogger().Writer()
+
+	addr, err := net.ResolveTCPAddr("tcp", config.BindAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := raft.NewTCPTransport(config.BindAddr, addr, MAX_POOL,
+		10*time.Second, raftConfig.LogOutput)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := raft.NewFileSnapshotStore(config.Dir, RETAIN_SNAPSHOTS,
+		raftConfig.LogOutput)
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+
+	logStore, err := raftboltdb.NewBoltStore(filepath.Join(config.Dir, RAFT_LOG_FILE))
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+
+	if config.Bootstrap {
+		if err := bootstrap(raftConfig, logStore, snapshots, transport, config); err != nil {
+			transport.Close()
+			logStore.Close()
+			return nil, err
+		}
+	}
+
+	r, err := raft.NewRaft(raftConfig, &fsm{store}, logStore, logStore, snapshots, transport)
+	if err != nil {
+		transport.Close()
+		logStore.Close()
+		return nil, err
+	}
+
+	log.Infof("Raft node %s listening on %s", config.ID, transport.LocalAddr())
+	return &Node{r, store, DEFAULT_APPLY_TIMEOUT, transport, logStore}, nil
+}
+
+func bootstrap(raftConfig *raft.Config, logStore *raftboltdb.BoltStore,
+	snapshots raft.SnapshotStore, transport raft.Transport, config Config) error {
+	existing, err := raft.HasExistingState(logStore, logStore, snapshots)
+	if err != nil || existing {
+		return err
+	}
+
+	servers := []raft.Server{{ID: raftConfig.LocalID, Address: transport.LocalAddr()}}
+	for _, peer := range config.Peers {
+		servers = append(servers, raft.Server{ID: raft.ServerID(peer.ID),
+			Address: raft.ServerAddress(peer.Addr)})
+	}
+
+	return raft.BootstrapCluster(raftConfig, logStore, logStore, snapshots,
+		transport, raft.Configuration{Servers: servers})
+}
+
+func (n *Node) Put(key string, value string) error {
+	return n.apply(kvstore.Event{Type: kvstore.PUT_COMMAND, Key: key, Value: value})
+}
+
+func (n *Node) Del(key string) error {
+	return n.apply(kvstore.Event{Type: kvstore.DEL_COMMAND, Key: key})
+}
+
+func (n *Node) apply(event kvstore.Event) error {
+	if n.Raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	future := n.Raft.Apply(data, n.ApplyTimeout)
+	if err := future.Error(); err != nil {
+		if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+			return ErrNotLeader
+		}
+		return err
+	}
+
+	if err, ok := future.Response().(error); ok {
+		return err
+	}
+
+	return nil
+}
+
+func (n *Node) IsLeader() bool {
+	return n.Raft.State() == raft.Leader
+}
+
+// Leader is the current leader's ID and raft address, both empty while there
+// is none.
+func (n *Node) Leader() (string, string) {
+	addr, id := n.Raft.LeaderWithID()
+	return string(id), string(addr)
+}
+
+// Join adds a voting node to the cluster, only the leader can add one.
+func (n *Node) Join(id string, addr string) error {
+	if !n.IsLeader() {
+		return ErrNotLeader
+	}
+
+	return n.Raft.AddVoter(raft.ServerID(id), raft.ServerAddress(addr), 0,
+		n.ApplyTimeout).Error()
+}
+
+func (n *Node) Shutdown() error {
+	err := n.Raft.Shutdown().Error()
+	n.transport.Close()
+	if closeErr := n.logStore.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -24,6 +24,12 @@ type Command struct {
 }
 
 func ReadCsvCommands(filePath string, outputPath string) {
+	ReadCsvCommandsTo(filePath, outputPath, DEFAULT_STORE_URL)
+}
+
+// ReadCsvCommandsTo replays the commands against the store at storeUrl, see
+// OpenStore.
+func ReadCsvCommandsTo(filePath string, outputPath string, storeUrl string) {
 	csv_file, err := os.Open(filePath)
 
 	log.Infof("Opening csv file %s", filePath)
@@ -39,7 +45,10 @@ func ReadCsvCommands(filePath string, outputPath string) {
 	}
 
 	reader := csv.NewReader(csv_file)
-	kvStore := kvstore.NewKvStore()
+	kvStore, closeStore, err := OpenStore(storeUrl)
+	if err != nil {
+		log.Fatalln("Could not open store.", err)
+	}
 
 	log.Infoln("Reading in csv records.")
 	for {
@@ -63,7 +72,9 @@ func ReadCsvCommands(filePath string, outputPath string) {
 		}
 	}
 
-	kvStore.Shutdown()
+	if shutdownErr := closeStore(); shutdownErr != nil {
+		log.Errorln(shutdownErr)
+	}
 }
 
 func WriteOutputFirstLine(outputPath string) error {
@@ -92,39 +103,46 @@ func WriteOutput(command Command, outcome int, value string, outputPath string)
 }
 
 func ProcessCommand(command Command, storage kvstore.Store, outputPath string) error {
+	outcome, value, err := runCommand(command, storage)
+	if err == errInvalidCommand {
+		return errors.New(fmt.Sprintf("Invalid command given: %s", command))
+	}
+
+	WriteOutput(command, outcome, value, outputPath)
+	return err
+}
+
+var errInvalidCommand error = errors.New("Invalid command.")
+
+// runCommand runs command against storage, returning the outcome and value
+// for its output line.
+func runCommand(command Command, storage kvstore.Store) (outcome int, value string, err error) {
 	switch {
 	case GET_COMMAND == command.Type:
 		log.Infof("Get command given for key: %s, value: %s", command.Key,
 			command.Value)
 		value, err := storage.Get(command.Key)
 		if err == nil {
-			WriteOutput(command, 1, value, outputPath)
 			log.Infof("Get command successful found value: %s, for key: %s",
 				value, command.Key)
-		} else {
-			WriteOutput(command, 0, "", outputPath)
+			return 1, value, nil
 		}
 
-		return err
+		return 0, "", err
 	case PUT_COMMAND == command.Type:
 		log.Infof("Put command given for key: %s, value: %s", command.Key,
 			command.Value)
 
-		WriteOutput(command, 0, "", outputPath)
-		return storage.Put(command.Key, command.Value)
+		return 0, "", storage.Put(command.Key, command.Value)
 	case DEL_COMMAND == command.Type:
 		log.Infof("Del command given for key: %s, value: %s", command.Key,
 			command.Value)
-		err := storage.Del(command.Key)
-
-		if err == nil {
-			WriteOutput(command, 1, "", outputPath)
-		} else {
-			WriteOutput(command, 0, "", outputPath)
+		if err := storage.Del(command.Key); err != nil {
+			return 0, "", err
 		}
 
-		return err
+		return 1, "", nil
 	}
 
-	return errors.New(fmt.Sprintf("Invalid command given: %s", command))
+	return 0, "", errInvalidCommand
 }
@@ -0,0 +1,140 @@
+package controller
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/shimanekb/project1-C/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// Result is the output line of a command run by RunCommands.
+type Result struct {
+	Outcome int
+	Value   string
+	Err     error
+}
+
+// ReadCsvCommandsParallel replays the commands like ReadCsvCommandsTo, but
+// reads them all first and runs them on workers goroutines. Commands on the
+// same key go to the same worker in file order, so each key sees its
+// commands in order while different keys run in parallel. The output is
+// written in file order once every command has run.
+func ReadCsvCommandsParallel(filePath string, outputPath string, storeUrl string, workers int) {
+	log.Infof("Opening csv file %s", filePath)
+	commands, err := readAllCommands(filePath)
+	if err != nil {
+		log.Fatalln("FATAL: Could not read csv file.", err)
+	}
+
+	kvStore, closeStore, err := OpenStore(storeUrl)
+	if err != nil {
+		log.Fatalln("Could not open store.", err)
+	}
+
+	results := RunCommands(commands, kvStore, workers)
+	if shutdownErr := closeStore(); shutdownErr != nil {
+		log.Errorln(shutdownErr)
+	}
+
+	log.Infof("Writing output file.")
+	if err := writeResults(outputPath, commands, results); err != nil {
+		log.Fatal("Could not write output file", err)
+	}
+}
+
+// readAllCommands reads every command of a csv file, skipping the header.
+func readAllCommands(filePath string) ([]Command, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	commands := make([]Command, 0)
+	reader := csv.NewReader(bufio.NewReader(file))
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return commands, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if record[0] == FIRST_LINE_RECORD {
+			continue
+		}
+		commands = append(commands, Command{record[0], record[1], record[3]})
+	}
+}
+
+// RunCommands runs commands against storage on workers goroutines, keeping
+// the order of commands on each key, and returns their results in command
+// order. One worker runs them all in order.
+func RunCommands(commands []Command, storage kvstore.Store, workers int) []Result {
+	if workers < 1 {
+		workers = 1
+	}
+
+	queues := make([][]int, workers)
+	for i, command := range commands {
+		hash := fnv.New32a()
+		hash.Write([]byte(command.Key))
+		worker := hash.Sum32() % uint32(workers)
+		queues[worker] = append(queues[worker], i)
+	}
+
+	results := make([]Result, len(commands))
+	var wait sync.WaitGroup
+	for _, queue := range queues {
+		wait.Add(1)
+		go func(queue []int) {
+			defer wait.Done()
+			for _, i := range queue {
+				outcome, value, err := runCommand(commands[i], storage)
+				results[i] = Result{outcome, value, err}
+			}
+		}(queue)
+	}
+	wait.Wait()
+
+	return results
+}
+
+// writeResults writes the output file of commands, logging failed ones like
+// ReadCsvCommandsTo.
+func writeResults(outputPath string, commands []Command, results []Result) error {
+	file, err := os.OpenFile(outputPath, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	writer.WriteString("type,key1,outcome,values\n")
+	for i, command := range commands {
+		result := results[i]
+		if result.Err == errInvalidCommand {
+			log.Errorln(fmt.Sprintf("Invalid command given: %s", command))
+			continue
+		}
+		if result.Err != nil {
+			log.Errorln(result.Err)
+		}
+
+		fmt.Fprintf(writer, "%s,%s,%d,%s\n", command.Type, command.Key,
+			result.Outcome, result.Value)
+	}
+
+	err = writer.Flush()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
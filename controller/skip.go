@@ -0,0 +1,179 @@
+package controller
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/shimanekb/project1-C/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// RunSummary counts the command rows of a run that skips bad rows.
+type RunSummary struct {
+	Rows    int `json:"rows"`
+	Run     int `json:"run"`
+	Skipped int `json:"skipped"`
+	// Failed is how many commands ran and returned an error, like a get of
+	// a missing key.
+	Failed int `json:"failed"`
+}
+
+// skippingReader reads the commands of a commands file a line at a time,
+// writing rows that fail to parse or validate to an errors file as line,
+// error, row records and skipping them.
+type skippingReader struct {
+	file    *os.File
+	scanner *bufio.Scanner
+	line    int
+	errors  *csv.Writer
+	summary *RunSummary
+}
+
+func newSkippingReader(filePath string, errors io.Writer, summary *RunSummary) (*skippingReader, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, int(kvstore.DEFAULT_MAX_KEY_SIZE+kvstore.DEFAULT_MAX_VALUE_SIZE)*2)
+	writer := csv.NewWriter(errors)
+	writer.Write([]string{"line", "error", "row"})
+	return &skippingReader{file, scanner, 0, writer, summary}, nil
+}
+
+// Next reads the next valid command, io.EOF once there are none.
+func (r *skippingReader) Next() (Command, error) {
+	for r.scanner.Scan() {
+		r.line++
+		text := r.scanner.Text()
+		if text == "" {
+			continue
+		}
+
+		command, header, err := parseCommand(text)
+		if header {
+			continue
+		}
+
+		r.summary.Rows++
+		if err == nil {
+			return command, nil
+		}
+
+		r.summary.Skipped++
+		log.Errorf("Skipping line %d: %v", r.line, err)
+		r.errors.Write([]string{strconv.Itoa(r.line), err.Error(), text})
+		if err := r.errors.Error(); err != nil {
+			return Command{}, err
+		}
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return Command{}, err
+	}
+
+	return Command{}, io.EOF
+}
+
+func (r *skippingReader) Close() error {
+	r.errors.Flush()
+	err := r.errors.Error()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// ReadCsvCommandsSkipping replays the commands like ReadCsvCommandsTo, or
+// ReadCsvCommandsParallel when workers is above zero, but skips rows that
+// fail to parse or validate instead of stopping. Skipped rows are written
+// to errorsPath with their line numbers.
+func ReadCsvCommandsSkipping(filePath string, outputPath string, storeUrl string,
+	errorsPath string, workers int) (RunSummary, error) {
+	summary := RunSummary{}
+	errorsFile, err := os.Create(errorsPath)
+	if err != nil {
+		return summary, err
+	}
+	defer errorsFile.Close()
+
+	reader, err := newSkippingReader(filePath, errorsFile, &summary)
+	if err != nil {
+		return summary, err
+	}
+
+	kvStore, closeStore, err := OpenStore(storeUrl)
+	if err != nil {
+		reader.Close()
+		return summary, err
+	}
+
+	if workers > 0 {
+		err = runSkippingParallel(reader, kvStore, outputPath, workers, &summary)
+	} else {
+		err = runSkipping(reader, kvStore, outputPath, &summary)
+	}
+	if shutdownErr := closeStore(); err == nil {
+		err = shutdownErr
+	}
+	if closeErr := reader.Close(); err == nil {
+		err = closeErr
+	}
+
+	log.Infof("Ran %d of %d commands, skipped %d bad rows.", summary.Run,
+		summary.Rows, summary.Skipped)
+	return summary, err
+}
+
+func runSkipping(reader *skippingReader, kvStore kvstore.Store, outputPath string,
+	summary *RunSummary) error {
+	if err := WriteOutputFirstLine(outputPath); err != nil {
+		return err
+	}
+
+	for {
+		command, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		summary.Run++
+		if err := ProcessCommand(command, kvStore, outputPath); err != nil {
+			summary.Failed++
+			log.Errorln(err)
+		}
+	}
+}
+
+func runSkippingParallel(reader *skippingReader, kvStore kvstore.Store, outputPath string,
+	workers int, summary *RunSummary) error {
+	commands := make([]Command, 0)
+	for {
+		command, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		commands = append(commands, command)
+	}
+
+	results := RunCommands(commands, kvStore, workers)
+	summary.Run = len(commands)
+	for _, result := range results {
+		if result.Err != nil {
+			summary.Failed++
+		}
+	}
+
+	return writeResults(outputPath, commands, results)
+}
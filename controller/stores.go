@@ -0,0 +1,115 @@
+package controller
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/shimanekb/project1-C/client"
+	"github.com/shimanekb/project1-C/store"
+)
+
+const (
+	FILE_SCHEME       string = "file"
+	HTTP_SCHEME       string = "http"
+	HTTPS_SCHEME      string = "https"
+	DEFAULT_STORE_URL string = "file:./storage"
+)
+
+// StoreOpener opens the store a URL points at, close is called once the
+// commands have been replayed.
+type StoreOpener func(storeUrl *url.URL) (store kvstore.Store, close func() error, err error)
+
+var openersLock sync.RWMutex
+var openers map[string]StoreOpener = map[string]StoreOpener{
+	FILE_SCHEME:  FileStoreOpener(),
+	HTTP_SCHEME:  openHttpStore,
+	HTTPS_SCHEME: openHttpStore,
+}
+
+// RegisterStore makes OpenStore use opener for URLs with scheme.
+func RegisterStore(scheme string, opener StoreOpener) {
+	openersLock.Lock()
+	defer openersLock.Unlock()
+	openers[scheme] = opener
+}
+
+// OpenStore opens a store by URL, file:dir for a local store or
+// http://host:port or https://host:port for a served one.
+func OpenStore(rawUrl string) (kvstore.Store, func() error, error) {
+	storeUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	openersLock.RLock()
+	opener, ok := openers[storeUrl.Scheme]
+	openersLock.RUnlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("No store registered for scheme %q.", storeUrl.Scheme)
+	}
+
+	return opener(storeUrl)
+}
+
+// FileStoreOpener opens the local store kept in the URL's directory with
+// opts, using the engine they pick.
+func FileStoreOpener(opts ...kvstore.Option) StoreOpener {
+	return func(storeUrl *url.URL) (kvstore.Store, func() error, error) {
+		store, err := kvstore.OpenEngine(filePath(storeUrl), opts...)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return store, store.Shutdown, nil
+	}
+}
+
+// RebuildIndex rebuilds the index of the local store at a file: URL from its
+// data log, ignoring the index file. The store must not be open.
+func RebuildIndex(rawUrl string) (kvstore.Report, error) {
+	dir, err := LocalDir(rawUrl)
+	if err != nil {
+		return kvstore.Report{}, err
+	}
+
+	return kvstore.RebuildIndex(dir)
+}
+
+// LocalDir is the directory of the local store at a file: URL, for work
+// like repairs that only local stores support.
+func LocalDir(rawUrl string) (string, error) {
+	storeUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+
+	if storeUrl.Scheme != FILE_SCHEME {
+		return "", fmt.Errorf("Only file: stores are supported, not %s.", storeUrl)
+	}
+
+	return filePath(storeUrl), nil
+}
+
+func filePath(storeUrl *url.URL) string {
+	if storeUrl.Opaque != "" {
+		return storeUrl.Opaque
+	}
+
+	return storeUrl.Path
+}
+
+func openHttpStore(storeUrl *url.URL) (kvstore.Store, func() error, error) {
+	if storeUrl.Host == "" {
+		return nil, nil, fmt.Errorf("Store URL %s has no host.", storeUrl)
+	}
+
+	var opts []client.Option
+	if storeUrl.Scheme == HTTPS_SCHEME {
+		opts = append(opts, func(o *client.Options) { o.Tls = &tls.Config{} })
+	}
+
+	store := client.New(storeUrl.Host, opts...)
+	return store, store.Close, nil
+}
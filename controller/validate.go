@@ -0,0 +1,98 @@
+package controller
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/shimanekb/project1-C/store"
+)
+
+// COMMAND_COLUMNS is type, key1, key2 and value.
+const COMMAND_COLUMNS int = 4
+
+var ErrColumnCount error = fmt.Errorf("Command rows have %d columns.", COMMAND_COLUMNS)
+var ErrUnknownCommand error = errors.New("Unknown command type.")
+var ErrEmptyKey error = errors.New("Command has no key.")
+
+// RowError is a command row that failed to parse or validate.
+type RowError struct {
+	Line int    `json:"line"`
+	Row  string `json:"row"`
+	Err  string `json:"err"`
+}
+
+func (e RowError) Error() string {
+	return fmt.Sprintf("Line %d: %s", e.Line, e.Err)
+}
+
+type ValidationReport struct {
+	// Rows is how many command rows were read, the header left out.
+	Rows   int        `json:"rows"`
+	Errors []RowError `json:"errors"`
+}
+
+// parseCommand reads the command on one line of a commands file, header is
+// whether the line is the header row.
+func parseCommand(line string) (command Command, header bool, err error) {
+	record, err := csv.NewReader(strings.NewReader(line)).Read()
+	if err != nil {
+		return Command{}, false, err
+	}
+
+	if record[0] == FIRST_LINE_RECORD {
+		return Command{}, true, nil
+	}
+
+	if len(record) != COMMAND_COLUMNS {
+		return Command{}, false, ErrColumnCount
+	}
+
+	command = Command{record[0], record[1], record[3]}
+	switch {
+	case command.Type != GET_COMMAND && command.Type != PUT_COMMAND &&
+		command.Type != DEL_COMMAND:
+		return Command{}, false, ErrUnknownCommand
+	case command.Key == "":
+		return Command{}, false, ErrEmptyKey
+	case kvstore.Size(len(command.Key)) > kvstore.DEFAULT_MAX_KEY_SIZE:
+		return Command{}, false, kvstore.ErrKeyTooLarge
+	}
+
+	return command, false, nil
+}
+
+// ValidateCsvCommands parses and validates every command of a commands file
+// without opening a store, reporting the line of each bad row.
+func ValidateCsvCommands(filePath string) (ValidationReport, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return ValidationReport{}, err
+	}
+	defer file.Close()
+
+	report := ValidationReport{Errors: make([]RowError, 0)}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, int(kvstore.DEFAULT_MAX_KEY_SIZE+kvstore.DEFAULT_MAX_VALUE_SIZE)*2)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		_, header, err := parseCommand(text)
+		if header {
+			continue
+		}
+
+		report.Rows++
+		if err != nil {
+			report.Errors = append(report.Errors, RowError{line, text, err.Error()})
+		}
+	}
+
+	return report, scanner.Err()
+}
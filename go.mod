@@ -3,7 +3,12 @@ module github.com/shimanekb/project1-C
 go 1.15
 
 require (
+	github.com/hashicorp/go-immutable-radix v1.3.1 // indirect
 	github.com/hashicorp/golang-lru v0.5.4
+	github.com/hashicorp/raft v1.5.0
+	github.com/hashicorp/raft-boltdb v0.0.0-20230125174641-2a8082862702
 	github.com/shimanekb/project1-B v0.0.0-20210217170701-af26c2fdaefe
 	github.com/sirupsen/logrus v1.7.0
+	golang.org/x/sys v0.7.0 // indirect
+	golang.org/x/text v0.3.5
 )
@@ -0,0 +1,41 @@
+#!/bin/bash
+# Replays every command csv in testdata against a fresh store and compares
+# the output with the .golden file next to it. Pass -update to rewrite the
+# golden files from the current behaviour.
+update=0
+if [ "$1" == "-update" ]; then
+    update=1
+fi
+
+# normalize blanks out values that change from run to run, timestamps and
+# latencies, so they never fail a comparison.
+normalize() {
+    sed -E -e 's/[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9:.]+(Z|[+-][0-9:]+)?/<time>/g' \
+        -e 's/[0-9]+(\.[0-9]+)?(ns|us|µs|ms|s)\b/<duration>/g' "$1"
+}
+
+root=$(cd "$(dirname "$0")" && pwd)
+binary=$(mktemp)
+go build -o "$binary" "$root" || exit 1
+
+failed=0
+for input in "$root"/testdata/*.csv; do
+    name=$(basename "$input" .csv)
+    golden="$root/testdata/$name.golden"
+    work=$(mktemp -d)
+    (cd "$work" && "$binary" "$input" output.txt)
+
+    if [ $update -eq 1 ]; then
+        cp "$work/output.txt" "$golden"
+        echo "updated $name"
+    elif diff -u <(normalize "$golden") <(normalize "$work/output.txt"); then
+        echo "ok   $name"
+    else
+        echo "FAIL $name"
+        failed=1
+    fi
+    rm -rf "$work"
+done
+
+rm -f "$binary"
+exit $failed
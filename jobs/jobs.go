@@ -0,0 +1,183 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type State string
+
+const (
+	RUNNING              State = "running"
+	SUCCEEDED            State = "succeeded"
+	FAILED               State = "failed"
+	CANCELLED            State = "cancelled"
+	DEFAULT_HISTORY_SIZE int   = 100
+)
+
+var ErrJobNotFound error = errors.New("Job not found.")
+
+// Job is a snapshot of a long running operation.
+type Job struct {
+	ID       string      `json:"id"`
+	Type     string      `json:"type"`
+	State    State       `json:"state"`
+	Progress float64     `json:"progress"`
+	Started  time.Time   `json:"started"`
+	Finished *time.Time  `json:"finished,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Result   interface{} `json:"result,omitempty"`
+}
+
+// Func does the work of a job, reporting progress between 0 and 1 and
+// returning early once ctx is cancelled.
+type Func func(ctx context.Context, progress func(float64)) (interface{}, error)
+
+type entry struct {
+	job    Job
+	cancel context.CancelFunc
+	done   chan bool
+}
+
+// Manager runs jobs in the background and keeps the most recent finished
+// ones around so their outcome can still be queried.
+type Manager struct {
+	sync.Mutex
+	jobs        map[string]*entry
+	order       []string
+	nextId      uint64
+	historySize int
+}
+
+func NewManager(historySize int) *Manager {
+	if historySize <= 0 {
+		historySize = DEFAULT_HISTORY_SIZE
+	}
+
+	return &Manager{sync.Mutex{}, make(map[string]*entry), make([]string, 0),
+		0, historySize}
+}
+
+func (m *Manager) Start(jobType string, fn Func) string {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	m.Lock()
+	m.nextId++
+	id := fmt.Sprintf("%s-%d", jobType, m.nextId)
+	e := &entry{Job{ID: id, Type: jobType, State: RUNNING, Started: time.Now()},
+		cancel, make(chan bool)}
+	m.jobs[id] = e
+	m.order = append(m.order, id)
+	m.prune()
+	m.Unlock()
+
+	go m.run(ctx, e, fn)
+	return id
+}
+
+func (m *Manager) run(ctx context.Context, e *entry, fn Func) {
+	defer close(e.done)
+	defer e.cancel()
+
+	result, err := fn(ctx, func(progress float64) {
+		m.Lock()
+		e.job.Progress = progress
+		m.Unlock()
+	})
+
+	m.Lock()
+	defer m.Unlock()
+	finished := time.Now()
+	e.job.Finished = &finished
+	e.job.Result = result
+	switch {
+	case ctx.Err() != nil:
+		e.job.State = CANCELLED
+	case err != nil:
+		e.job.State = FAILED
+		e.job.Error = err.Error()
+	default:
+		e.job.State = SUCCEEDED
+		e.job.Progress = 1
+	}
+}
+
+// prune drops the oldest finished jobs beyond the history size, callers hold
+// the lock.
+func (m *Manager) prune() {
+	for len(m.order) > m.historySize {
+		dropped := false
+		for i, id := range m.order {
+			if m.jobs[id].job.State != RUNNING {
+				delete(m.jobs, id)
+				m.order = append(m.order[:i], m.order[i+1:]...)
+				dropped = true
+				break
+			}
+		}
+
+		if !dropped {
+			return
+		}
+	}
+}
+
+func (m *Manager) Get(id string) (Job, bool) {
+	m.Lock()
+	defer m.Unlock()
+	e, ok := m.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+
+	return e.job, true
+}
+
+// List returns jobs oldest first.
+func (m *Manager) List() []Job {
+	m.Lock()
+	defer m.Unlock()
+	list := make([]Job, 0, len(m.order))
+	for _, id := range m.order {
+		list = append(list, m.jobs[id].job)
+	}
+
+	return list
+}
+
+func (m *Manager) Cancel(id string) error {
+	m.Lock()
+	e, ok := m.jobs[id]
+	m.Unlock()
+	if !ok {
+		return ErrJobNotFound
+	}
+
+	e.cancel()
+	return nil
+}
+
+func (m *Manager) CancelAll() {
+	m.Lock()
+	defer m.Unlock()
+	for _, e := range m.jobs {
+		e.cancel()
+	}
+}
+
+// Wait blocks until the job finishes and returns its final state.
+func (m *Manager) Wait(id string) (Job, error) {
+	m.Lock()
+	e, ok := m.jobs[id]
+	m.Unlock()
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+
+	<-e.done
+	job, _ := m.Get(id)
+	return job, nil
+}
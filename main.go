@@ -1,24 +1,171 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"github.com/shimanekb/project1-C/config"
+	"github.com/shimanekb/project1-C/consensus"
 	"github.com/shimanekb/project1-C/controller"
+	"github.com/shimanekb/project1-C/replication"
+	"github.com/shimanekb/project1-C/server"
+	"github.com/shimanekb/project1-C/store"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
 	var logFlag *bool = flag.Bool("logs", false, "Enable logs")
+	var serveFlag *string = flag.String("serve", "", "Serve the store over HTTP on this address")
+	var replicateFlag *string = flag.String("replicate", "", "Stream the store to followers on this address")
+	var followFlag *string = flag.String("follow", "", "Serve a read only replica of the primary at this address")
+	var raftIdFlag *string = flag.String("raft-id", "", "Run as this raft node, writes go through consensus")
+	var raftAddrFlag *string = flag.String("raft-addr", "127.0.0.1:7000", "Address for raft traffic")
+	var bootstrapFlag *bool = flag.Bool("raft-bootstrap", false, "Start a new raft cluster with this node")
+	var joinFlag *string = flag.String("raft-join", "", "Join the cluster through the leader's HTTP address")
+	var authFlag *string = flag.String("auth", "", "Authenticate requests with backend:path, backend is tokens, htpasswd or jwt")
+	var tlsCertFlag *string = flag.String("tls-cert", "", "Serve and replicate over TLS with this PEM certificate")
+	var tlsKeyFlag *string = flag.String("tls-key", "", "PEM key of the TLS certificate")
+	var tlsCaFlag *string = flag.String("tls-ca", "", "PEM bundle that primaries, leaders and, with tls-client-auth, clients are checked against")
+	var tlsClientAuthFlag *bool = flag.Bool("tls-client-auth", false, "Require clients and followers to present a certificate signed by tls-ca")
+	var aclFlag *string = flag.String("acl", "", "Limit the keys each user may read and write with the rules in this file")
+	var auditFlag *string = flag.String("audit", "", "Record every key put and delete to this audit log file")
+	var configFlag *string = flag.String("config", "", "YAML, TOML or JSON file of store, server and log settings, sizes like \"64MB\" and durations like \"250ms\"")
+	var storeFlag *string = flag.String("store", controller.DEFAULT_STORE_URL, "Store to replay commands against, file:./storage or http://host:port")
+	var repairFlag *bool = flag.Bool("repair", false, "Repair the data log and rebuild the index, then exit")
+	var compactFlag *bool = flag.Bool("compact", false, "Drop overwritten and deleted records from the data log, then exit")
+	var rebuildFlag *bool = flag.Bool("rebuild", false, "Rebuild the index of the store from its data log, then exit")
+	var exportFlag *string = flag.String("export", "", "Write every pair to stdout as jsonl or csv, then exit")
+	var importFlag *string = flag.String("import", "", "Put every pair read from stdin as jsonl or csv, then exit")
+	var validateFlag *bool = flag.Bool("validate", false, "Check every command of the input file without running them, then exit")
+	var skipFlag *string = flag.String("skip-errors", "", "Skip bad command rows, writing them to this file, and print a summary")
+	var workersFlag *int = flag.Int("workers", 0, "Replay commands on this many workers, keeping the order of each key's commands")
 	flag.Parse()
 
+	var configFile config.File
+	if *configFlag != "" {
+		var err error
+		if configFile, err = config.Load(*configFlag); err != nil {
+			log.Fatalln("Could not load config.", err)
+		}
+		if err := configFile.ApplyLog(); err != nil {
+			log.Fatalln("Could not load config.", err)
+		}
+
+		settings := configFile.Server
+		if *serveFlag == "" && settings.Addr != nil && flag.NArg() == 0 {
+			*serveFlag = *settings.Addr
+		}
+		setDefault(authFlag, settings.Auth)
+		setDefault(aclFlag, settings.Acl)
+		setDefault(auditFlag, settings.Audit)
+		setDefault(replicateFlag, settings.Replicate)
+		setDefault(followFlag, settings.Follow)
+	}
+
+	setDefault(tlsCertFlag, configFile.Tls.Cert)
+	setDefault(tlsKeyFlag, configFile.Tls.Key)
+	setDefault(tlsCaFlag, configFile.Tls.Ca)
+	configFile.Tls.Cert, configFile.Tls.Key, configFile.Tls.Ca = tlsCertFlag, tlsKeyFlag, tlsCaFlag
+	if *tlsClientAuthFlag {
+		configFile.Tls.ClientAuth = tlsClientAuthFlag
+	}
+
+	storeOpts := []kvstore.Option{func(opts *kvstore.Options) {
+		*opts = configFile.StoreOptions(*opts)
+	}}
 	if *logFlag {
 		file, _ := os.OpenFile("logs.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY,
 			0666)
 		log.SetOutput(file)
+		storeOpts = append(storeOpts, kvstore.WithLogger(log.StandardLogger()))
 	} else {
 		log.SetOutput(ioutil.Discard)
 	}
+	controller.RegisterStore(controller.FILE_SCHEME, controller.FileStoreOpener(storeOpts...))
+
+	if *repairFlag {
+		opts, err := localOptions(*storeFlag, configFile, *logFlag)
+		if err != nil {
+			log.Fatalln("Repair failed.", err)
+		}
+		report, err := kvstore.RepairWithOptions(opts.Dir, opts)
+		if err != nil {
+			log.Fatalln("Repair failed.", err)
+		}
+		json.NewEncoder(os.Stdout).Encode(report)
+		return
+	}
+
+	if *compactFlag {
+		opts, err := localOptions(*storeFlag, configFile, *logFlag)
+		if err != nil {
+			log.Fatalln("Compaction failed.", err)
+		}
+		report, err := kvstore.Compact(opts.Dir, opts, nil)
+		if err != nil {
+			log.Fatalln("Compaction failed.", err)
+		}
+		json.NewEncoder(os.Stdout).Encode(report)
+		return
+	}
+
+	if *rebuildFlag {
+		report, err := controller.RebuildIndex(*storeFlag)
+		if err != nil {
+			log.Fatalln("Rebuild failed.", err)
+		}
+		json.NewEncoder(os.Stdout).Encode(report)
+		return
+	}
+
+	if *exportFlag != "" || *importFlag != "" {
+		opts, err := localOptions(*storeFlag, configFile, *logFlag)
+		if err != nil {
+			log.Fatalln("Dump failed.", err)
+		}
+		if err := dump(opts, *exportFlag, *importFlag); err != nil {
+			log.Fatalln("Dump failed.", err)
+		}
+		return
+	}
+
+	if *serveFlag != "" {
+		opts := kvstore.DefaultOptions()
+		if *logFlag {
+			opts.Logger = log.StandardLogger()
+		}
+		opts = configFile.StoreOptions(opts)
+
+		var raftConfig *consensus.Config
+		if *raftIdFlag != "" {
+			nodeConfig := consensus.DefaultConfig(*raftIdFlag, *raftAddrFlag)
+			nodeConfig.Bootstrap = *bootstrapFlag
+			raftConfig = &nodeConfig
+		}
+		serve(*serveFlag, opts, *replicateFlag, *followFlag, raftConfig, *joinFlag, *authFlag,
+			*aclFlag, *auditFlag, configFile)
+		return
+	}
+
+	if *validateFlag && flag.NArg() > 0 {
+		report, err := controller.ValidateCsvCommands(flag.Arg(0))
+		if err != nil {
+			log.Fatalln("Validation failed.", err)
+		}
+		json.NewEncoder(os.Stdout).Encode(report)
+		if len(report.Errors) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
 
 	args := flag.Args()
 	if flag.NArg() < 2 {
@@ -27,5 +174,170 @@ func main() {
 
 	filePath := args[0]
 	outputPath := args[1]
-	controller.ReadCsvCommands(filePath, outputPath)
+	if *skipFlag != "" {
+		summary, err := controller.ReadCsvCommandsSkipping(filePath, outputPath, *storeFlag,
+			*skipFlag, *workersFlag)
+		if err != nil {
+			log.Fatalln("Could not replay commands.", err)
+		}
+		json.NewEncoder(os.Stdout).Encode(summary)
+		return
+	}
+	if *workersFlag > 0 {
+		controller.ReadCsvCommandsParallel(filePath, outputPath, *storeFlag, *workersFlag)
+		return
+	}
+	controller.ReadCsvCommandsTo(filePath, outputPath, *storeFlag)
+}
+
+func serve(addr string, opts kvstore.Options, replicate string, follow string, raftConfig *consensus.Config,
+	join string, auth string, acl string, audit string, configFile config.File) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	serverTls, err := configFile.Tls.ServerConfig()
+	if err != nil {
+		log.Fatalln("Could not load TLS certificate.", err)
+	}
+	clientTls, err := configFile.Tls.ClientConfig()
+	if err != nil {
+		log.Fatalln("Could not load TLS certificate.", err)
+	}
+
+	opts.ReadOnly = follow != "" || raftConfig != nil
+	store := kvstore.NewKvStoreWithOptions(opts)
+
+	if replicate != "" {
+		primary := replication.NewPrimary(store, replicate)
+		primary.Tls = serverTls
+		go func() {
+			if err := primary.Serve(ctx); err != nil {
+				log.Errorln("Replication failed.", err)
+			}
+		}()
+	}
+
+	if follow != "" {
+		follower := replication.NewFollower(store, follow)
+		follower.Tls = clientTls
+		go follower.Run(ctx)
+	}
+
+	srv := server.NewServer(store, addr)
+	srv.Tls = serverTls
+	if audit != "" {
+		auditLog, err := server.NewAuditLog(audit)
+		if err != nil {
+			log.Fatalln("Could not open audit log.", err)
+		}
+		srv.Audit = auditLog
+	}
+	configFile.ApplyServer(srv)
+	if auth != "" {
+		authenticator, err := server.NewAuthenticator(auth)
+		if err != nil {
+			log.Fatalln("Could not load authentication.", err)
+		}
+		srv.Auth = authenticator
+	}
+	if acl != "" {
+		rules, err := server.LoadAcl(acl)
+		if err != nil {
+			log.Fatalln("Could not load access rules.", err)
+		}
+		srv.Acl = rules
+	}
+
+	if raftConfig != nil {
+		node, err := consensus.NewNode(store, *raftConfig)
+		if err != nil {
+			log.Fatalln("Could not start raft node.", err)
+		}
+		defer node.Shutdown()
+		srv.Cluster = node
+
+		if join != "" {
+			if err := joinCluster(join, raftConfig.ID, raftConfig.BindAddr, clientTls); err != nil {
+				log.Fatalln("Could not join raft cluster.", err)
+			}
+		}
+	}
+
+	if _, err := srv.Serve(ctx); err != nil {
+		log.Fatalln("Server failed.", err)
+	}
+}
+
+// localOptions are the options of the local store storeUrl names, with the
+// store settings of configFile.
+func localOptions(storeUrl string, configFile config.File, logs bool) (kvstore.Options, error) {
+	dir, err := controller.LocalDir(storeUrl)
+	if err != nil {
+		return kvstore.Options{}, err
+	}
+
+	opts := kvstore.DefaultOptions()
+	opts.Dir = dir
+	if logs {
+		opts.Logger = log.StandardLogger()
+	}
+	return configFile.StoreOptions(opts), nil
+}
+
+// setDefault sets an unset string flag to value, when there is one.
+func setDefault(flag *string, value *string) {
+	if *flag == "" && value != nil {
+		*flag = *value
+	}
+}
+
+// joinCluster asks the leader to add this node, over HTTPS when tlsConfig is
+// set.
+func joinCluster(leader string, id string, raftAddr string, tlsConfig *tls.Config) error {
+	query := url.Values{"id": {id}, "addr": {raftAddr}}
+	client, scheme := http.DefaultClient, "http://"
+	if tlsConfig != nil {
+		client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		scheme = "https://"
+	}
+	response, err := client.Post(scheme+leader+server.JOIN_PATH+"?"+query.Encode(), "", nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("Leader answered %s.", response.Status)
+	}
+
+	return nil
+}
+
+// dump exports the local store opened with opts to stdout in exportFormat,
+// or imports stdin into it in importFormat.
+func dump(opts kvstore.Options, exportFormat string, importFormat string) error {
+	store, err := kvstore.OpenKvStoreWithOptions(opts)
+	if err != nil {
+		return err
+	}
+	defer store.Shutdown()
+
+	if exportFormat != "" {
+		format, err := kvstore.ParseFormat(exportFormat)
+		if err != nil {
+			return err
+		}
+		return store.Export(os.Stdout, format)
+	}
+
+	format, err := kvstore.ParseFormat(importFormat)
+	if err != nil {
+		return err
+	}
+	return store.Import(os.Stdin, format)
 }
@@ -0,0 +1,282 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shimanekb/project1-C/store"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DEFAULT_POLL_INTERVAL   time.Duration = 100 * time.Millisecond
+	DEFAULT_RECONNECT_DELAY time.Duration = time.Second
+	OFFSET_FILE             string        = "replication_offset"
+)
+
+// Handshake is the first line a follower sends, the primary streams its log
+// from Since.
+type Handshake struct {
+	Since int64 `json:"since"`
+}
+
+// Record is one committed change sent as a JSON line, Next is the primary's
+// log offset following it and where a follower resumes from.
+type Record struct {
+	kvstore.Event
+	Next int64 `json:"next"`
+}
+
+// Primary streams its store's data log to followers over TCP.
+type Primary struct {
+	Store *kvstore.KvStore
+	Addr  string
+	// PollInterval bounds how long a new change can wait before it is sent
+	// when the store's watch cannot wake the stream.
+	PollInterval time.Duration
+	// Tls encrypts the stream when set, with ClientAuth it also checks the
+	// certificates of followers.
+	Tls *tls.Config
+}
+
+func NewPrimary(store *kvstore.KvStore, addr string) *Primary {
+	return &Primary{store, addr, DEFAULT_POLL_INTERVAL, nil}
+}
+
+func (p *Primary) Serve(ctx context.Context) error {
+	listener, err := net.Listen("tcp", p.Addr)
+	if err != nil {
+		return err
+	}
+
+	return p.ServeListener(ctx, listener)
+}
+
+// ServeListener streams to every follower that connects until ctx is done.
+func (p *Primary) ServeListener(ctx context.Context, listener net.Listener) error {
+	if p.Tls != nil {
+		listener = tls.NewListener(listener, p.Tls)
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	log.Infof("Replicating kv store on %s", listener.Addr())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.stream(ctx, conn)
+		}()
+	}
+}
+
+func (p *Primary) stream(ctx context.Context, conn net.Conn) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	var handshake Handshake
+	if err := json.NewDecoder(conn).Decode(&handshake); err != nil {
+		log.Errorf("Bad handshake from follower %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	log.Infof("Follower %s connected from offset %d", conn.RemoteAddr(), handshake.Since)
+
+	// The watch only wakes the stream, records are always read from the log
+	// so nothing is skipped when the watch falls behind and closes.
+	wake, cancel := p.Store.Watch("")
+	defer cancel()
+	ticker := time.NewTicker(p.PollInterval)
+	defer ticker.Stop()
+
+	writer := bufio.NewWriter(conn)
+	offset := handshake.Since
+	for {
+		var err error
+		offset, err = p.send(writer, offset)
+		if err != nil {
+			log.Infof("Stopped replicating to %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-wake:
+			if !ok {
+				wake = nil
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+// send writes every change from offset on, returning the offset it got to.
+func (p *Primary) send(writer *bufio.Writer, offset int64) (int64, error) {
+	changes, err := p.Store.Changes(offset)
+	if err != nil {
+		return offset, err
+	}
+	defer changes.Close()
+
+	encoder := json.NewEncoder(writer)
+	for changes.Next() {
+		if err := encoder.Encode(Record{changes.Event(), changes.Offset()}); err != nil {
+			return offset, err
+		}
+		offset = changes.Offset()
+	}
+
+	if err := changes.Err(); err != nil {
+		return offset, err
+	}
+
+	return offset, writer.Flush()
+}
+
+// Follower applies a primary's changes to a store, which should be opened
+// with Options.ReadOnly so it only serves reads. The primary offset it has
+// applied up to is saved in OFFSET_FILE in the store's directory, so a
+// restarted follower catches up from where it left off.
+type Follower struct {
+	Store          *kvstore.KvStore
+	Primary        string
+	ReconnectDelay time.Duration
+	// Tls connects to the primary over TLS when set, checking its
+	// certificate against RootCAs and sending Certificates when asked.
+	Tls    *tls.Config
+	offset int64
+}
+
+func NewFollower(store *kvstore.KvStore, primary string) *Follower {
+	return &Follower{store, primary, DEFAULT_RECONNECT_DELAY, nil, readOffset(store.Dir())}
+}
+
+// Offset is the primary log offset applied up to, set it before Run to catch
+// up from elsewhere.
+func (f *Follower) Offset() int64 {
+	return atomic.LoadInt64(&f.offset)
+}
+
+func (f *Follower) SetOffset(offset int64) {
+	atomic.StoreInt64(&f.offset, offset)
+}
+
+// Run follows the primary until ctx is done, reconnecting after
+// ReconnectDelay whenever the connection drops.
+func (f *Follower) Run(ctx context.Context) {
+	for {
+		err := f.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Errorf("Lost primary %s, reconnecting: %v", f.Primary, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(f.ReconnectDelay):
+		}
+	}
+}
+
+func (f *Follower) follow(ctx context.Context) error {
+	var dialer interface {
+		DialContext(ctx context.Context, network string, addr string) (net.Conn, error)
+	} = &net.Dialer{}
+	if f.Tls != nil {
+		dialer = &tls.Dialer{Config: f.Tls}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", f.Primary)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	if err := json.NewEncoder(conn).Encode(Handshake{f.Offset()}); err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(conn))
+	for {
+		var record Record
+		if err := decoder.Decode(&record); err != nil {
+			return err
+		}
+
+		if err := f.Store.Apply(record.Event); err != nil {
+			return err
+		}
+
+		f.SetOffset(record.Next)
+		if err := writeOffset(f.Store.Dir(), record.Next); err != nil {
+			return err
+		}
+	}
+}
+
+func offsetPath(dir string) string {
+	return filepath.Join(dir, OFFSET_FILE)
+}
+
+func readOffset(dir string) int64 {
+	data, err := ioutil.ReadFile(offsetPath(dir))
+	if err != nil {
+		return 0
+	}
+
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		log.Errorf("Ignoring corrupt replication offset file: %v", err)
+		return 0
+	}
+
+	return offset
+}
+
+func writeOffset(dir string, offset int64) error {
+	swap := offsetPath(dir) + ".swap"
+	if err := ioutil.WriteFile(swap, []byte(strconv.FormatInt(offset, 10)), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(swap, offsetPath(dir))
+}
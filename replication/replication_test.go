@@ -0,0 +1,168 @@
+package replication
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shimanekb/project1-C/store"
+)
+
+// caughtUpTimeout bounds how long a follower may take to apply a change.
+const caughtUpTimeout = 5 * time.Second
+
+func openStore(t *testing.T, dir string, readOnly bool) *kvstore.KvStore {
+	t.Helper()
+	store, err := kvstore.OpenKvStore(dir, func(o *kvstore.Options) { o.ReadOnly = readOnly })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store
+}
+
+// startPrimary serves store to followers on addr, a free port when addr is
+// empty, until the returned stop is called.
+func startPrimary(t *testing.T, store *kvstore.KvStore, addr string) (string, func()) {
+	t.Helper()
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	primary := NewPrimary(store, addr)
+	primary.PollInterval = 10 * time.Millisecond
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		primary.ServeListener(ctx, listener)
+	}()
+
+	return listener.Addr().String(), func() {
+		cancel()
+		<-served
+	}
+}
+
+// startFollower runs a follower of primary until the returned stop is
+// called.
+func startFollower(store *kvstore.KvStore, primary string) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	follower := NewFollower(store, primary)
+	follower.ReconnectDelay = 10 * time.Millisecond
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		follower.Run(ctx)
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// waitForValue waits until key reads back as value, or is gone when value is
+// empty.
+func waitForValue(t *testing.T, store *kvstore.KvStore, key string, value string) {
+	t.Helper()
+	deadline := time.Now().Add(caughtUpTimeout)
+	for {
+		got, err := store.Get(key)
+		if (value == "" && err != nil) || (err == nil && got == value) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Follower has %s = %q, %v, want %q.", key, got, err, value)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func putAll(t *testing.T, store *kvstore.KvStore, from int, to int, value string) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if err := store.Put(fmt.Sprintf("key%d", i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestFollowerCatchUp checks a follower applies the writes made before it
+// connected, and a restarted one resumes from the offset in its own
+// directory with the writes made while it was down.
+func TestFollowerCatchUp(t *testing.T) {
+	primaryStore := openStore(t, t.TempDir(), false)
+	defer primaryStore.Shutdown()
+	putAll(t, primaryStore, 0, 20, "before")
+	if err := primaryStore.Del("key0"); err != nil {
+		t.Fatal(err)
+	}
+	addr, stopPrimary := startPrimary(t, primaryStore, "")
+	defer stopPrimary()
+
+	followerDir := filepath.Join(t.TempDir(), "follower")
+	followerStore := openStore(t, followerDir, true)
+	stopFollower := startFollower(followerStore, addr)
+	waitForValue(t, followerStore, "key19", "before")
+	waitForValue(t, followerStore, "key0", "")
+	stopFollower()
+	if err := followerStore.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := readOffset(followerDir)
+	if saved == 0 {
+		t.Fatalf("No offset saved in %s.", followerDir)
+	}
+
+	putAll(t, primaryStore, 10, 30, "while down")
+	followerStore = openStore(t, followerDir, true)
+	defer followerStore.Shutdown()
+	if follower := NewFollower(followerStore, addr); follower.Offset() != saved {
+		t.Errorf("Restarted follower resumes from %d, want %d.", follower.Offset(), saved)
+	}
+	stopFollower = startFollower(followerStore, addr)
+	defer stopFollower()
+	waitForValue(t, followerStore, "key29", "while down")
+	for i := 1; i < 30; i++ {
+		value := "before"
+		if i >= 10 {
+			value = "while down"
+		}
+		waitForValue(t, followerStore, fmt.Sprintf("key%d", i), value)
+	}
+}
+
+// TestFollowerReconnect stops the primary under a running follower and
+// starts it again, the follower must reconnect and apply later writes.
+func TestFollowerReconnect(t *testing.T) {
+	primaryStore := openStore(t, t.TempDir(), false)
+	defer primaryStore.Shutdown()
+	addr, stopPrimary := startPrimary(t, primaryStore, "")
+
+	followerStore := openStore(t, t.TempDir(), true)
+	defer followerStore.Shutdown()
+	stopFollower := startFollower(followerStore, addr)
+	defer stopFollower()
+
+	putAll(t, primaryStore, 0, 5, "first")
+	waitForValue(t, followerStore, "key4", "first")
+
+	stopPrimary()
+	putAll(t, primaryStore, 5, 10, "while away")
+	_, stopPrimary = startPrimary(t, primaryStore, addr)
+	defer stopPrimary()
+
+	putAll(t, primaryStore, 10, 15, "after")
+	waitForValue(t, followerStore, "key9", "while away")
+	waitForValue(t, followerStore, "key14", "after")
+	waitForValue(t, followerStore, "key0", "first")
+}
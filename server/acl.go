@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	ACL_ANYONE   string = "*"
+	ACL_ALL_KEYS string = "*"
+)
+
+var ErrForbidden error = errors.New("Not allowed to access this key.")
+
+// AclRule grants an identity, or ACL_ANYONE, read and write access to the
+// keys starting with Prefix, every key when it is empty.
+type AclRule struct {
+	Identity string
+	Prefix   string
+	Read     bool
+	Write    bool
+}
+
+// Acl decides which keys each identity may read and write. The rule for a
+// key is the one with the longest prefix of it, one naming the identity
+// winning over an ACL_ANYONE rule with the same prefix. Keys no rule covers
+// are denied.
+type Acl struct {
+	rules []AclRule
+}
+
+func NewAcl(rules []AclRule) *Acl {
+	return &Acl{rules}
+}
+
+// LoadAcl reads identity prefix permissions lines, skipping blank lines and
+// # comments. The identity may be ACL_ANYONE, the prefix ACL_ALL_KEYS and
+// the permissions are r, w, rw or - for none:
+//
+//	# identity  prefix   permissions
+//	*           *        r
+//	alice       orders/  rw
+//	bob         *        -
+func LoadAcl(path string) (*Acl, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rules := make([]AclRule, 0)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 3 || strings.Trim(fields[2], "rw") != "" && fields[2] != "-" {
+			return nil, fmt.Errorf("Malformed rule on line %d of %s.", line, path)
+		}
+
+		prefix := fields[1]
+		if prefix == ACL_ALL_KEYS {
+			prefix = ""
+		}
+		rules = append(rules, AclRule{fields[0], prefix, strings.Contains(fields[2], "r"),
+			strings.Contains(fields[2], "w")})
+	}
+
+	return &Acl{rules}, scanner.Err()
+}
+
+func (a *Acl) applies(rule AclRule, identity string) bool {
+	return rule.Identity == identity || rule.Identity == ACL_ANYONE
+}
+
+// rule is the rule for key, false when none covers it.
+func (a *Acl) rule(identity string, key string) (AclRule, bool) {
+	var best AclRule
+	found := false
+	for _, rule := range a.rules {
+		if !a.applies(rule, identity) || !strings.HasPrefix(key, rule.Prefix) {
+			continue
+		}
+
+		longer := len(rule.Prefix) > len(best.Prefix)
+		named := len(rule.Prefix) == len(best.Prefix) && rule.Identity != ACL_ANYONE
+		if !found || longer || named {
+			best, found = rule, true
+		}
+	}
+
+	return best, found
+}
+
+// Allowed is whether identity may read key, or write it when write is set.
+func (a *Acl) Allowed(identity string, key string, write bool) bool {
+	rule, ok := a.rule(identity, key)
+	if write {
+		return ok && rule.Write
+	}
+
+	return ok && rule.Read
+}
+
+// AllowedEverywhere is whether identity may read and write every key, which
+// the endpoints that are not about single keys need.
+func (a *Acl) AllowedEverywhere(identity string) bool {
+	if !a.Allowed(identity, "", true) || !a.Allowed(identity, "", false) {
+		return false
+	}
+
+	for _, rule := range a.rules {
+		if a.applies(rule, identity) && rule.Prefix != "" &&
+			!(a.Allowed(identity, rule.Prefix, true) && a.Allowed(identity, rule.Prefix, false)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+type identityKey struct{}
+
+// requestIdentity is the identity authenticate accepted for r.
+func requestIdentity(r *http.Request) string {
+	identity, _ := r.Context().Value(identityKey{}).(string)
+	return identity
+}
+
+func withIdentity(r *http.Request, identity string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+}
+
+// authorize rejects requests the Acl does not allow before they reach the
+// store. Key requests need read or write access to their key, /mget read
+// access to every key asked for and /health nothing. /scan lists only the
+// keys the identity may read, every other endpoint needs read and write
+// access to every key.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, identity string) bool {
+	if s.Acl == nil || r.URL.Path == HEALTH_PATH || r.URL.Path == SCAN_PATH {
+		return true
+	}
+
+	allowed := false
+	switch {
+	case strings.HasPrefix(r.URL.Path, KEYS_PATH):
+		write := r.Method != http.MethodGet && r.Method != http.MethodHead
+		allowed = s.Acl.Allowed(identity, strings.TrimPrefix(r.URL.Path, KEYS_PATH), write)
+	case r.URL.Path == MGET_PATH:
+		allowed = true
+		for _, key := range r.URL.Query()["key"] {
+			allowed = allowed && s.Acl.Allowed(identity, key, false)
+		}
+	default:
+		allowed = s.Acl.AllowedEverywhere(identity)
+	}
+
+	if !allowed {
+		http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+	}
+	return allowed
+}
+
+// readable drops the keys the request's identity may not read.
+func (s *Server) readable(r *http.Request, keys []string) []string {
+	if s.Acl == nil {
+		return keys
+	}
+
+	identity := requestIdentity(r)
+	allowed := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if s.Acl.Allowed(identity, key, false) {
+			allowed = append(allowed, key)
+		}
+	}
+
+	return allowed
+}
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shimanekb/project1-C/store"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	AUDIT_PATH                string = "/admin/audit"
+	CLIENT_ID_HEADER          string = "X-Client-Id"
+	DEFAULT_AUDIT_MAX_SIZE    int64  = 64 << 20
+	DEFAULT_AUDIT_FILES       int    = 4
+	DEFAULT_AUDIT_QUERY_LIMIT int    = 100
+)
+
+// AuditEntry is one audited request. Actor is the identity the
+// Authenticator accepted, empty without one, and Client the X-Client-Id the
+// caller sent, which nothing checks. Op is kvstore.PUT_COMMAND,
+// DEL_COMMAND or GET_COMMAND and Status the HTTP status it was answered with.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Client string    `json:"client,omitempty"`
+	Remote string    `json:"remote"`
+	Op     string    `json:"op"`
+	Key    string    `json:"key"`
+	Status int       `json:"status"`
+}
+
+// AuditFilter picks the entries AuditLog.Query returns, empty fields match
+// every entry. Limit keeps the newest matches, DEFAULT_AUDIT_QUERY_LIMIT
+// when zero.
+type AuditFilter struct {
+	Actor string
+	Op    string
+	Key   string
+	Since time.Time
+	Until time.Time
+	Limit int
+}
+
+func (f AuditFilter) matches(entry AuditEntry) bool {
+	return (f.Actor == "" || entry.Actor == f.Actor) && (f.Op == "" || entry.Op == f.Op) &&
+		(f.Key == "" || entry.Key == f.Key) &&
+		(f.Since.IsZero() || !entry.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || entry.Time.Before(f.Until))
+}
+
+// AuditLog appends a JSON line for every Put and Del sent to the server,
+// and every Get with Gets set, whether or not it succeeded. Once the file
+// would grow past MaxSize it is renamed with a .1 before its extension,
+// shifting older files up by one, and only the newest Files files are kept.
+type AuditLog struct {
+	sync.Mutex
+	MaxSize int64
+	Files   int
+	Gets    bool
+	path    string
+	size    int64
+}
+
+func NewAuditLog(path string) (*AuditLog, error) {
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		size = info.Size()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return &AuditLog{sync.Mutex{}, DEFAULT_AUDIT_MAX_SIZE, DEFAULT_AUDIT_FILES, false, path,
+		size}, nil
+}
+
+// rotatedPath is the nth newest rotated file, the current one is 0.
+func (a *AuditLog) rotatedPath(n int) string {
+	if n == 0 {
+		return a.path
+	}
+
+	ext := filepath.Ext(a.path)
+	return strings.TrimSuffix(a.path, ext) + "." + strconv.Itoa(n) + ext
+}
+
+func (a *AuditLog) Record(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.Lock()
+	defer a.Unlock()
+	if a.MaxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.MaxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	n, err := file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// files is how many files are kept, at least the current one.
+func (a *AuditLog) files() int {
+	if a.Files < 1 {
+		return 1
+	}
+
+	return a.Files
+}
+
+// rotate drops the oldest file past Files and shifts the rest up by one,
+// the caller holds the lock.
+func (a *AuditLog) rotate() error {
+	files := a.files()
+	if err := os.Remove(a.rotatedPath(files - 1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for n := files - 2; n >= 0; n-- {
+		err := os.Rename(a.rotatedPath(n), a.rotatedPath(n+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	a.size = 0
+	return nil
+}
+
+// Query reads the kept files oldest first, returning the newest
+// filter.Limit entries that match in the order they were recorded.
+func (a *AuditLog) Query(filter AuditFilter) ([]AuditEntry, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DEFAULT_AUDIT_QUERY_LIMIT
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	entries := make([]AuditEntry, 0)
+	for n := a.files() - 1; n >= 0; n-- {
+		file, err := os.Open(a.rotatedPath(n))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		entries, err = readAuditEntries(file, filter, limit, entries)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+func readAuditEntries(file io.Reader, filter AuditFilter, limit int,
+	entries []AuditEntry) ([]AuditEntry, error) {
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return entries, err
+		}
+		if len(line) == 0 {
+			return entries, nil
+		}
+
+		var entry AuditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return entries, fmt.Errorf("Malformed audit log entry: %v", err)
+		}
+		if !filter.matches(entry) {
+			continue
+		}
+
+		entries = append(entries, entry)
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+}
+
+// auditOp is the op a request is audited as, empty for requests that are
+// not audited.
+func (s *Server) auditOp(r *http.Request) string {
+	if s.Audit == nil || !strings.HasPrefix(r.URL.Path, KEYS_PATH) {
+		return ""
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		return kvstore.PUT_COMMAND
+	case http.MethodDelete:
+		return kvstore.DEL_COMMAND
+	case http.MethodGet, http.MethodHead:
+		if s.Audit.Gets {
+			return kvstore.GET_COMMAND
+		}
+	}
+
+	return ""
+}
+
+func (s *Server) audit(r *http.Request, op string, actor string, status int) {
+	if op == "" {
+		return
+	}
+
+	entry := AuditEntry{time.Now().UTC(), actor, r.Header.Get(CLIENT_ID_HEADER), r.RemoteAddr,
+		op, strings.TrimPrefix(r.URL.Path, KEYS_PATH), status}
+	if err := s.Audit.Record(entry); err != nil {
+		log.Errorf("Could not write audit log entry: %v", err)
+	}
+}
+
+// handleAudit answers GET /admin/audit with the newest audit entries as a
+// JSON array, narrowed by the actor, op, key, since, until (RFC 3339) and
+// limit query parameters.
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Audit == nil {
+		http.Error(w, "Audit log is not enabled.", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := AuditFilter{Actor: query.Get("actor"), Op: query.Get("op"), Key: query.Get("key")}
+	for name, at := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if query.Get(name) == "" {
+			continue
+		}
+
+		var err error
+		if *at, err = time.Parse(time.RFC3339, query.Get(name)); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid %s time.", name), http.StatusBadRequest)
+			return
+		}
+	}
+	if query.Get("limit") != "" {
+		var err error
+		filter.Limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || filter.Limit <= 0 {
+			http.Error(w, "Invalid limit.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := s.Audit.Query(filter)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJson(w, entries)
+}
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	TOKENS_AUTH   string = "tokens"
+	HTPASSWD_AUTH string = "htpasswd"
+	JWT_AUTH      string = "jwt"
+	BEARER_PREFIX string = "Bearer "
+	SHA_PREFIX    string = "{SHA}"
+	APR1_PREFIX   string = "$apr1$"
+	APR1_ALPHABET string = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+var ErrUnauthorized error = errors.New("Missing or invalid credentials.")
+var ErrUnknownAuth error = errors.New("Unknown authentication backend.")
+
+// Authenticator checks the credentials of a request, returning the identity
+// it was made by or ErrUnauthorized.
+type Authenticator interface {
+	Authenticate(r *http.Request) (string, error)
+	// Challenge is the WWW-Authenticate header sent with a 401.
+	Challenge() string
+}
+
+// NewAuthenticator builds the backend named in a backend:path spec.
+//
+//	tokens:path    lines of user:token, sent as a bearer token
+//	htpasswd:path  an htpasswd file with $apr1$ or {SHA} hashes, sent with basic auth
+//	jwt:path       a file with the HS256 secret of bearer JWTs, the identity is sub
+func NewAuthenticator(spec string) (Authenticator, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("Authentication spec %q is not backend:path.", spec)
+	}
+
+	switch parts[0] {
+	case TOKENS_AUTH:
+		return LoadStaticTokens(parts[1])
+	case HTPASSWD_AUTH:
+		return LoadHtpasswd(parts[1])
+	case JWT_AUTH:
+		secret, err := ioutil.ReadFile(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		return NewJwtAuth([]byte(strings.TrimSpace(string(secret)))), nil
+	}
+
+	return nil, ErrUnknownAuth
+}
+
+// readPairs reads name:secret lines, skipping blank lines and # comments.
+func readPairs(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	pairs := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Malformed line in %s.", path)
+		}
+		pairs[parts[0]] = parts[1]
+	}
+
+	return pairs, scanner.Err()
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, BEARER_PREFIX) {
+		return "", false
+	}
+
+	return strings.TrimPrefix(header, BEARER_PREFIX), true
+}
+
+// StaticTokens maps bearer tokens to the user they belong to.
+type StaticTokens struct {
+	tokens map[string]string
+}
+
+func LoadStaticTokens(path string) (*StaticTokens, error) {
+	users, err := readPairs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make(map[string]string)
+	for user, token := range users {
+		tokens[token] = user
+	}
+
+	return &StaticTokens{tokens}, nil
+}
+
+func (s *StaticTokens) Authenticate(r *http.Request) (string, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return "", ErrUnauthorized
+	}
+
+	user, ok := s.tokens[token]
+	if !ok {
+		return "", ErrUnauthorized
+	}
+
+	return user, nil
+}
+
+func (s *StaticTokens) Challenge() string {
+	return "Bearer"
+}
+
+// Htpasswd checks basic auth against an htpasswd file. Only the default
+// $apr1$ (MD5) and {SHA} hashes are supported, not bcrypt or crypt.
+type Htpasswd struct {
+	hashes map[string]string
+}
+
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	hashes, err := readPairs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for user, hash := range hashes {
+		if !strings.HasPrefix(hash, APR1_PREFIX) && !strings.HasPrefix(hash, SHA_PREFIX) {
+			return nil, fmt.Errorf("Unsupported password hash for %s.", user)
+		}
+	}
+
+	return &Htpasswd{hashes}, nil
+}
+
+func (h *Htpasswd) Authenticate(r *http.Request) (string, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", ErrUnauthorized
+	}
+
+	hash, ok := h.hashes[user]
+	if !ok {
+		return "", ErrUnauthorized
+	}
+
+	var expected string
+	if strings.HasPrefix(hash, SHA_PREFIX) {
+		sum := sha1.Sum([]byte(password))
+		expected = SHA_PREFIX + base64.StdEncoding.EncodeToString(sum[:])
+	} else {
+		salt := strings.SplitN(strings.TrimPrefix(hash, APR1_PREFIX), "$", 2)[0]
+		expected = apr1(password, salt)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) != 1 {
+		return "", ErrUnauthorized
+	}
+
+	return user, nil
+}
+
+// apr1 is Apache's variant of the MD5 crypt hash, what htpasswd writes by
+// default.
+func apr1(password string, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alternate := md5.Sum([]byte(password + salt + password))
+	hash := md5.New()
+	hash.Write([]byte(password + APR1_PREFIX + salt))
+	for i := len(password); i > 0; i -= 16 {
+		if i > 16 {
+			hash.Write(alternate[:])
+		} else {
+			hash.Write(alternate[:i])
+		}
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			hash.Write([]byte{0})
+		} else {
+			hash.Write([]byte{password[0]})
+		}
+	}
+	sum := hash.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write([]byte(password))
+		} else {
+			round.Write(sum)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write([]byte(password))
+		}
+		if i&1 != 0 {
+			round.Write(sum)
+		} else {
+			round.Write([]byte(password))
+		}
+		sum = round.Sum(nil)
+	}
+
+	var encoded strings.Builder
+	encode := func(value uint, chars int) {
+		for ; chars > 0; chars-- {
+			encoded.WriteByte(APR1_ALPHABET[value&0x3f])
+			value >>= 6
+		}
+	}
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(sum[group[0]])<<16|uint(sum[group[1]])<<8|uint(sum[group[2]]), 4)
+	}
+	encode(uint(sum[11]), 2)
+
+	return APR1_PREFIX + salt + "$" + encoded.String()
+}
+
+func (h *Htpasswd) Challenge() string {
+	return `Basic realm="kvstore"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+type jwtClaims struct {
+	Subject   string `json:"sub"`
+	Issuer    string `json:"iss"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf"`
+}
+
+// JwtAuth accepts bearer JWTs signed with HS256 by Secret, checking exp and
+// nbf and the issuer when Issuer is set. The identity is the sub claim.
+type JwtAuth struct {
+	Secret []byte
+	Issuer string
+	Now    func() time.Time
+}
+
+func NewJwtAuth(secret []byte) *JwtAuth {
+	return &JwtAuth{secret, "", time.Now}
+}
+
+func (j *JwtAuth) Authenticate(r *http.Request) (string, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return "", ErrUnauthorized
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrUnauthorized
+	}
+
+	var header jwtHeader
+	if err := decodeJwtPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return "", ErrUnauthorized
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrUnauthorized
+	}
+
+	mac := hmac.New(sha256.New, j.Secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return "", ErrUnauthorized
+	}
+
+	var claims jwtClaims
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return "", ErrUnauthorized
+	}
+
+	now := j.Now().Unix()
+	if (claims.ExpiresAt != 0 && now >= claims.ExpiresAt) ||
+		(claims.NotBefore != 0 && now < claims.NotBefore) {
+		return "", ErrUnauthorized
+	}
+
+	if claims.Subject == "" || (j.Issuer != "" && claims.Issuer != j.Issuer) {
+		return "", ErrUnauthorized
+	}
+
+	return claims.Subject, nil
+}
+
+func (j *JwtAuth) Challenge() string {
+	return "Bearer"
+}
+
+func decodeJwtPart(part string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, value)
+}
+
+// authenticate rejects requests the Authenticator does not accept,
+// returning the identity of the ones it does.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if s.Auth == nil {
+		return "", true
+	}
+
+	identity, err := s.Auth.Authenticate(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", s.Auth.Challenge())
+		http.Error(w, ErrUnauthorized.Error(), http.StatusUnauthorized)
+		return "", false
+	}
+
+	return identity, true
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"net/http"
+)
+
+const (
+	LEADER_PATH   string = "/cluster/leader"
+	JOIN_PATH     string = "/cluster/join"
+	LEADER_HEADER string = "X-Raft-Leader"
+)
+
+// Cluster replicates writes through consensus, a Server with one sends puts
+// and deletes to it instead of writing to its Store.
+type Cluster interface {
+	Put(key string, value string) error
+	Del(key string) error
+	IsLeader() bool
+	Leader() (id string, addr string)
+	Join(id string, addr string) error
+}
+
+type LeaderResponse struct {
+	ID       string `json:"id"`
+	Addr     string `json:"addr"`
+	IsLeader bool   `json:"isLeader"`
+}
+
+// handleLeader answers GET /cluster/leader with the current leader, so
+// clients can find the node that accepts writes.
+func (s *Server) handleLeader(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.Cluster == nil {
+		http.Error(w, "Not running in a cluster.", http.StatusNotFound)
+		return
+	}
+
+	id, addr := s.Cluster.Leader()
+	writeJson(w, LeaderResponse{id, addr, s.Cluster.IsLeader()})
+}
+
+// handleJoin adds a node with POST /cluster/join?id=i&addr=a, it must be
+// sent to the leader.
+func (s *Server) handleJoin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.Cluster == nil {
+		http.Error(w, "Not running in a cluster.", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("id") == "" || query.Get("addr") == "" {
+		http.Error(w, "Missing id or addr.", http.StatusBadRequest)
+		return
+	}
+
+	if !s.Cluster.IsLeader() {
+		s.writeNotLeader(w)
+		return
+	}
+
+	if err := s.Cluster.Join(query.Get("id"), query.Get("addr")); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeNotLeader rejects a write sent to a follower, naming the leader so the
+// client can retry there.
+func (s *Server) writeNotLeader(w http.ResponseWriter) {
+	id, _ := s.Cluster.Leader()
+	if id != "" {
+		w.Header().Set(LEADER_HEADER, id)
+	}
+	http.Error(w, "Node is not the raft leader.", http.StatusMisdirectedRequest)
+}
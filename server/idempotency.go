@@ -0,0 +1,239 @@
+package server
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/shimanekb/project1-C/store"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	IDEMPOTENCY_HEADER         string = "Idempotency-Key"
+	REPLAYED_HEADER            string = "Idempotent-Replayed"
+	IDEMPOTENCY_FILE           string = "idempotency_keys.csv"
+	DEFAULT_IDEMPOTENCY_WINDOW int    = 10000
+)
+
+var ErrIdempotencyMismatch error = errors.New("Idempotency key was used for a different request.")
+var ErrIdempotencyInFlight error = errors.New("Request with this idempotency key is in progress.")
+
+type idempotentResult struct {
+	Seq    uint64
+	Method string
+	Key    string
+	Status int
+}
+
+// IdempotencyKeys remembers the outcome of the last Window successful writes
+// sent with an Idempotency-Key, so a retried write is answered with the first
+// outcome instead of being applied twice. Each result is appended to a file
+// with its sequence number, the file is rewritten to the newest Window
+// results when it grows past twice that.
+type IdempotencyKeys struct {
+	sync.Mutex
+	Window   int
+	path     string
+	seq      uint64
+	results  map[string]idempotentResult
+	order    []string
+	inFlight map[string]bool
+	lines    int
+}
+
+func NewIdempotencyKeys(path string, window int) (*IdempotencyKeys, error) {
+	keys := &IdempotencyKeys{sync.Mutex{}, window, path, 0,
+		make(map[string]idempotentResult), make([]string, 0), make(map[string]bool), 0}
+	if err := keys.load(); err != nil {
+		return nil, err
+	}
+
+	return keys, keys.rewrite()
+}
+
+// defaultIdempotencyPath keeps the idempotency keys next to the store's data.
+func defaultIdempotencyPath(store *kvstore.KvStore) string {
+	return filepath.Join(store.Dir(), IDEMPOTENCY_FILE)
+}
+
+// load reads seq,token,method,key,status records, they are in sequence order
+// since the file is only appended to.
+func (i *IdempotencyKeys) load() error {
+	file, err := os.Open(i.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(bufio.NewReader(file))
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(record) != 5 {
+			return errors.New("Malformed record in idempotency key file.")
+		}
+
+		seq, seqErr := strconv.ParseUint(record[0], 10, 64)
+		status, statusErr := strconv.Atoi(record[4])
+		if seqErr != nil || statusErr != nil {
+			return errors.New("Malformed record in idempotency key file.")
+		}
+
+		i.remember(record[1], idempotentResult{seq, record[2], record[3], status})
+	}
+}
+
+func (i *IdempotencyKeys) remember(token string, result idempotentResult) {
+	if _, ok := i.results[token]; !ok {
+		i.order = append(i.order, token)
+	}
+	i.results[token] = result
+	if result.Seq > i.seq {
+		i.seq = result.Seq
+	}
+
+	for len(i.order) > i.Window {
+		delete(i.results, i.order[0])
+		i.order = i.order[1:]
+	}
+}
+
+func (i *IdempotencyKeys) rewrite() error {
+	swap := i.path + ".swap"
+	file, err := os.Create(swap)
+	if err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(file)
+	for _, token := range i.order {
+		writer.Write(resultRecord(token, i.results[token]))
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+	i.lines = len(i.order)
+
+	return os.Rename(swap, i.path)
+}
+
+func resultRecord(token string, result idempotentResult) []string {
+	return []string{strconv.FormatUint(result.Seq, 10), token, result.Method,
+		result.Key, strconv.Itoa(result.Status)}
+}
+
+// begin claims token for a request, returning the recorded result when the
+// request was already answered.
+func (i *IdempotencyKeys) begin(token string, method string, key string) (idempotentResult, bool, error) {
+	i.Lock()
+	defer i.Unlock()
+
+	if result, ok := i.results[token]; ok {
+		if result.Method != method || result.Key != key {
+			return idempotentResult{}, false, ErrIdempotencyMismatch
+		}
+		return result, true, nil
+	}
+
+	if i.inFlight[token] {
+		return idempotentResult{}, false, ErrIdempotencyInFlight
+	}
+	i.inFlight[token] = true
+
+	return idempotentResult{}, false, nil
+}
+
+// finish releases token, recording the result of successful requests so
+// failed ones can be retried.
+func (i *IdempotencyKeys) finish(token string, method string, key string, status int) {
+	i.Lock()
+	defer i.Unlock()
+	delete(i.inFlight, token)
+	if status < 200 || status >= 300 {
+		return
+	}
+
+	result := idempotentResult{i.seq + 1, method, key, status}
+	i.remember(token, result)
+	if err := i.append(token, result); err != nil {
+		log.Errorf("Could not save idempotency key: %v", err)
+	}
+}
+
+func (i *IdempotencyKeys) append(token string, result idempotentResult) error {
+	if i.lines >= 2*i.Window {
+		return i.rewrite()
+	}
+
+	file, err := os.OpenFile(i.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	writer.Write(resultRecord(token, result))
+	writer.Flush()
+	i.lines++
+
+	return writer.Error()
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// beginIdempotent answers a retried write from its recorded result. When the
+// write should go ahead it returns the writer to answer it through and a func
+// to call once it has been answered.
+func (s *Server) beginIdempotent(w http.ResponseWriter, r *http.Request, key string,
+	token string) (http.ResponseWriter, func(), bool) {
+	result, replay, err := s.Idempotency.begin(token, r.Method, key)
+	switch err {
+	case ErrIdempotencyMismatch:
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return w, nil, false
+	case ErrIdempotencyInFlight:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return w, nil, false
+	}
+
+	if replay {
+		w.Header().Set(REPLAYED_HEADER, "true")
+		w.WriteHeader(result.Status)
+		return w, nil, false
+	}
+
+	recorder := &statusRecorder{w, http.StatusOK}
+	return recorder, func() {
+		s.Idempotency.finish(token, r.Method, key, recorder.status)
+	}, true
+}
@@ -0,0 +1,550 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/shimanekb/project1-C/jobs"
+	"github.com/shimanekb/project1-C/store"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	KEYS_PATH             string        = "/keys/"
+	MGET_PATH             string        = "/mget"
+	SCAN_PATH             string        = "/scan"
+	JOBS_PATH             string        = "/admin/jobs"
+	FLUSHES_PATH          string        = "/admin/flushes"
+	VERIFY_PATH           string        = "/admin/verify"
+	PREFIXES_PATH         string        = "/admin/prefixes"
+	CHANGES_PATH          string        = "/changes"
+	HEALTH_PATH           string        = "/health"
+	DEFAULT_CHANGES_COUNT int           = 100
+	CHECKSUM_HEADER       string        = "X-Checksum-Crc32c"
+	DEFAULT_DRAIN_TIMEOUT time.Duration = 10 * time.Second
+)
+
+// ShutdownSummary reports how a Serve call wound down.
+type ShutdownSummary struct {
+	Requests  uint64
+	Drained   bool
+	DrainErr  error
+	StoreErr  error
+	Unflushed int
+	Duration  time.Duration
+}
+
+func (s ShutdownSummary) String() string {
+	return fmt.Sprintf("served %d requests, drained: %v, unflushed commands: %d, shutdown took %v",
+		s.Requests, s.Drained, s.Unflushed, s.Duration)
+}
+
+type Server struct {
+	Store        *kvstore.KvStore
+	Addr         string
+	DrainTimeout time.Duration
+	Idempotency  *IdempotencyKeys
+	Cluster      Cluster
+	// Auth checks every request when set.
+	Auth Authenticator
+	// Tls serves HTTPS instead of HTTP when set.
+	Tls *tls.Config
+	// Acl limits the keys each identity may read and write when set.
+	Acl *Acl
+	// Audit records the key requests when set.
+	Audit    *AuditLog
+	requests uint64
+}
+
+func NewServer(store *kvstore.KvStore, addr string) *Server {
+	idempotency, err := NewIdempotencyKeys(defaultIdempotencyPath(store),
+		DEFAULT_IDEMPOTENCY_WINDOW)
+	if err != nil {
+		log.Fatal("Could not load idempotency keys. ", err)
+	}
+
+	return &Server{store, addr, DEFAULT_DRAIN_TIMEOUT, idempotency, nil, nil, nil, nil, nil, 0}
+}
+
+// Serve handles requests until ctx is done, then stops accepting connections,
+// gives in-flight requests DrainTimeout to finish and shuts down the store,
+// which flushes buffered writes and checkpoints the index.
+func (s *Server) Serve(ctx context.Context) (ShutdownSummary, error) {
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return ShutdownSummary{}, err
+	}
+
+	return s.ServeListener(ctx, listener)
+}
+
+func (s *Server) ServeListener(ctx context.Context, listener net.Listener) (ShutdownSummary, error) {
+	if s.Tls != nil {
+		listener = tls.NewListener(listener, s.Tls)
+	}
+
+	httpServer := &http.Server{Handler: s.Handler()}
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Infof("Serving kv store on %s", listener.Addr())
+		serveErr <- httpServer.Serve(listener)
+	}()
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-serveErr:
+		log.Errorln("Server stopped unexpectedly.", err)
+	}
+
+	start := time.Now()
+	log.Info("Draining connections.")
+	drainCtx, cancel := context.WithTimeout(context.Background(), s.DrainTimeout)
+	defer cancel()
+
+	summary := ShutdownSummary{}
+	summary.DrainErr = httpServer.Shutdown(drainCtx)
+	summary.Drained = summary.DrainErr == nil
+
+	log.Info("Shutting down store.")
+	summary.StoreErr = s.Store.Shutdown()
+	var timeoutErr *kvstore.ShutdownTimeoutError
+	if errors.As(summary.StoreErr, &timeoutErr) {
+		summary.Unflushed = len(timeoutErr.Unflushed)
+	}
+
+	summary.Requests = atomic.LoadUint64(&s.requests)
+	summary.Duration = time.Since(start)
+	log.Info(summary)
+
+	if err == http.ErrServerClosed {
+		err = nil
+	}
+
+	return summary, err
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(KEYS_PATH, s.handleKey)
+	mux.HandleFunc(MGET_PATH, s.handleMGet)
+	mux.HandleFunc(SCAN_PATH, s.handleScan)
+	mux.HandleFunc(JOBS_PATH, s.handleJobs)
+	mux.HandleFunc(JOBS_PATH+"/", s.handleJob)
+	mux.HandleFunc(FLUSHES_PATH, s.handleFlushes)
+	mux.HandleFunc(VERIFY_PATH, s.handleVerify)
+	mux.HandleFunc(PREFIXES_PATH, s.handlePrefixes)
+	mux.HandleFunc(CHANGES_PATH, s.handleChanges)
+	mux.HandleFunc(LEADER_PATH, s.handleLeader)
+	mux.HandleFunc(JOIN_PATH, s.handleJoin)
+	mux.Handle(kvstore.STATS_V1_PATH, s.Store.StatsHandler())
+	mux.HandleFunc(HEALTH_PATH, s.handleHealth)
+	mux.HandleFunc(AUDIT_PATH, s.handleAudit)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&s.requests, 1)
+		op := s.auditOp(r)
+		// Load balancers check health without credentials.
+		actor, ok := "", true
+		if r.URL.Path != HEALTH_PATH {
+			actor, ok = s.authenticate(w, r)
+		}
+		if !ok {
+			s.audit(r, op, "", http.StatusUnauthorized)
+			return
+		}
+		if !s.authorize(w, r, actor) {
+			s.audit(r, op, actor, http.StatusForbidden)
+			return
+		}
+		r = withIdentity(r, actor)
+		if op == "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		recorder := &statusRecorder{w, http.StatusOK}
+		mux.ServeHTTP(recorder, r)
+		s.audit(r, op, actor, recorder.status)
+	})
+}
+
+func (s *Server) handleKey(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, KEYS_PATH)
+	if key == "" {
+		http.Error(w, "Missing key.", http.StatusBadRequest)
+		return
+	}
+
+	// A store tracking operation IDs dedupes the write itself, keeping the
+	// token in the data log with it.
+	token, operation := r.Header.Get(IDEMPOTENCY_HEADER), ""
+	if token != "" && s.Cluster == nil && s.Store.TracksOperations() {
+		operation = token
+	} else if token != "" && (r.Method == http.MethodPut || r.Method == http.MethodDelete) {
+		var finish func()
+		var ok bool
+		w, finish, ok = s.beginIdempotent(w, r, key, token)
+		if !ok {
+			return
+		}
+		defer finish()
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		value, err := s.Store.GetContext(r.Context(), key)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set(CHECKSUM_HEADER, fmt.Sprintf("%08x", kvstore.Checksum([]byte(value))))
+		w.Write([]byte(value))
+	case http.MethodHead:
+		exists, err := s.Store.Exists(key)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case http.MethodPut:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if s.Cluster != nil && !s.Cluster.IsLeader() {
+			s.writeNotLeader(w)
+			return
+		}
+
+		if header := r.Header.Get(CHECKSUM_HEADER); header != "" {
+			err = s.putChecksummed(key, body, header, operation)
+		} else if s.Cluster != nil {
+			err = s.Cluster.Put(key, string(body))
+		} else if operation != "" {
+			err = s.Store.PutOnce(operation, key, string(body))
+		} else {
+			err = s.Store.PutContext(r.Context(), key, string(body))
+		}
+
+		if err == kvstore.ErrChecksumMismatch {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if s.Cluster != nil && !s.Cluster.IsLeader() {
+			s.writeNotLeader(w)
+			return
+		}
+
+		var err error
+		if s.Cluster != nil {
+			err = s.Cluster.Del(key)
+		} else if operation != "" {
+			err = s.Store.DelOnce(operation, key)
+		} else {
+			err = s.Store.DelContext(r.Context(), key)
+		}
+
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+type ScanResponse struct {
+	Keys   []string `json:"keys"`
+	Cursor string   `json:"cursor"`
+}
+
+// handleMGet answers GET /mget?key=a&key=b with a JSON object of the keys
+// that are stored.
+func (s *Server) handleMGet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	values, err := s.Store.MGet(r.URL.Query()["key"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJson(w, values)
+}
+
+// handleScan answers GET /scan?cursor=c&count=n with a page of keys and the
+// cursor for the next page, empty once every key was returned.
+func (s *Server) handleScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	count := 0
+	if query.Get("count") != "" {
+		var err error
+		count, err = strconv.Atoi(query.Get("count"))
+		if err != nil {
+			http.Error(w, "Invalid count.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	keys, next, err := s.Store.Scan(query.Get("cursor"), count)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJson(w, ScanResponse{s.readable(r, keys), next})
+}
+
+type ChangesResponse struct {
+	Changes []kvstore.Event `json:"changes"`
+	Next    int64           `json:"next"`
+}
+
+// handleChanges pages through the data log, GET /changes?since=offset&count=n
+// returns up to n changes and the offset to ask for next.
+func (s *Server) handleChanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	var since int64
+	if query.Get("since") != "" {
+		var err error
+		since, err = strconv.ParseInt(query.Get("since"), 10, 64)
+		if err != nil || since < 0 {
+			http.Error(w, "Invalid since offset.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	count := DEFAULT_CHANGES_COUNT
+	if query.Get("count") != "" {
+		var err error
+		count, err = strconv.Atoi(query.Get("count"))
+		if err != nil || count <= 0 {
+			http.Error(w, "Invalid count.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	changes, err := s.Store.Changes(since)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer changes.Close()
+
+	response := ChangesResponse{make([]kvstore.Event, 0, count), since}
+	for len(response.Changes) < count && changes.Next() {
+		response.Changes = append(response.Changes, changes.Event())
+	}
+
+	if err := changes.Err(); err != nil {
+		writeError(w, err)
+		return
+	}
+	response.Next = changes.Offset()
+
+	writeJson(w, response)
+}
+
+// handleJobs lists jobs on GET and starts one with POST /admin/jobs?type=t.
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJson(w, s.Store.Jobs().List())
+	case http.MethodPost:
+		id, err := s.Store.StartJob(r.URL.Query().Get("type"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%v Known types: %s", err,
+				strings.Join(s.Store.JobTypes(), ", ")), http.StatusBadRequest)
+			return
+		}
+
+		job, _ := s.Store.Jobs().Get(id)
+		w.WriteHeader(http.StatusAccepted)
+		writeJson(w, job)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleFlushes dumps the flush journal, oldest flush first.
+func (s *Server) handleFlushes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJson(w, s.Store.FlushJournal())
+}
+
+// handleVerify checks the index against the data log, it answers 500 with
+// the report when there are inconsistencies so it can serve as a health
+// check.
+func (s *Server) handleVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report, err := s.Store.Verify()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", kvstore.JSON_MIME_TYPE)
+	if !report.Ok() {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleHealth answers 503 with the status when the store is unhealthy.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := s.Store.HealthCheck()
+	w.Header().Set("Content-Type", kvstore.JSON_MIME_TYPE)
+	if !status.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+func (s *Server) handlePrefixes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	prefixes, err := s.Store.PrefixStats()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", kvstore.JSON_MIME_TYPE)
+	json.NewEncoder(w).Encode(prefixes)
+}
+
+// handleJob shows a job on GET and cancels it on DELETE.
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, JOBS_PATH+"/")
+	switch r.Method {
+	case http.MethodGet:
+		job, ok := s.Store.Jobs().Get(id)
+		if !ok {
+			http.Error(w, jobs.ErrJobNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		writeJson(w, job)
+	case http.MethodDelete:
+		if err := s.Store.Jobs().Cancel(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJson(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", kvstore.JSON_MIME_TYPE)
+	json.NewEncoder(w).Encode(value)
+}
+
+// putChecksummed writes a value the client sent a hex CRC-32C for, so the
+// store rejects bodies damaged on the way in. A non-empty operation is the
+// operation ID to write it under.
+func (s *Server) putChecksummed(key string, body []byte, header string, operation string) error {
+	checksum, err := strconv.ParseUint(header, 16, 32)
+	if err != nil {
+		return kvstore.ErrChecksumMismatch
+	}
+
+	if s.Cluster != nil || operation != "" {
+		if kvstore.Checksum(body) != uint32(checksum) {
+			return kvstore.ErrChecksumMismatch
+		}
+		if operation != "" {
+			return s.Store.PutOnce(operation, key, string(body))
+		}
+		return s.Cluster.Put(key, string(body))
+	}
+
+	return s.Store.PutWithChecksum(key, string(body), uint32(checksum))
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch err {
+	case kvstore.ErrNotInIndex, kvstore.ErrKeyNotFound:
+		status = http.StatusNotFound
+	case kvstore.ErrStoreClosed, kvstore.ErrRecovering, kvstore.ErrWriteBufferFull:
+		status = http.StatusServiceUnavailable
+	case kvstore.ErrReadOnly:
+		status = http.StatusForbidden
+	case kvstore.ErrKeyTooLarge, kvstore.ErrValueTooLarge:
+		status = http.StatusRequestEntityTooLarge
+	case kvstore.ErrQuotaExceeded:
+		status = http.StatusInsufficientStorage
+	case kvstore.ErrOperationMismatch:
+		status = http.StatusUnprocessableEntity
+	case kvstore.ErrInvalidOperationId:
+		status = http.StatusBadRequest
+	case context.DeadlineExceeded, context.Canceled:
+		status = http.StatusGatewayTimeout
+	}
+
+	http.Error(w, err.Error(), status)
+}
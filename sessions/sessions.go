@@ -0,0 +1,147 @@
+package sessions
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/shimanekb/project1-C/store"
+)
+
+const (
+	KEY_PREFIX    string        = "session:"
+	ID_BYTES      int           = 16
+	SESSION_LOCKS int           = 64
+	DEFAULT_TTL   time.Duration = 30 * time.Minute
+)
+
+var ErrSessionNotFound error = errors.New("Session not found or expired.")
+
+type record struct {
+	Expires time.Time `json:"expires"`
+	Data    []byte    `json:"data"`
+}
+
+// ttlStore is a store that can expire keys itself, like a KvStore.
+type ttlStore interface {
+	PutWithTTL(key string, value string, ttl time.Duration) error
+}
+
+// Sessions keeps opaque session blobs in a store. Each blob is saved with
+// its expiry, checked against Clock, and expired sessions are deleted when
+// they are next read. A store with TTLs turned on is given the ttl as well,
+// so sessions never read again are expired by the store.
+type Sessions struct {
+	Store kvstore.Store
+	Ttl   time.Duration
+	Clock kvstore.Clock
+	locks []sync.Mutex
+}
+
+func New(store kvstore.Store, ttl time.Duration) *Sessions {
+	if ttl <= 0 {
+		ttl = DEFAULT_TTL
+	}
+
+	return &Sessions{store, ttl, kvstore.RealClock{}, make([]sync.Mutex, SESSION_LOCKS)}
+}
+
+// lock keeps a Refresh from overwriting a concurrent Destroy of the same
+// session, the store has no compare and swap to do it for us.
+func (s *Sessions) lock(id string) func() {
+	hash := fnv.New32a()
+	hash.Write([]byte(id))
+	stripe := &s.locks[hash.Sum32()%uint32(len(s.locks))]
+	stripe.Lock()
+	return stripe.Unlock
+}
+
+// Create saves data under a new random session id.
+func (s *Sessions) Create(data []byte) (string, error) {
+	raw := make([]byte, ID_BYTES)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+
+	id := hex.EncodeToString(raw)
+	defer s.lock(id)()
+	return id, s.save(id, data)
+}
+
+func (s *Sessions) Get(id string) ([]byte, error) {
+	defer s.lock(id)()
+	session, err := s.load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return session.Data, nil
+}
+
+// Refresh replaces the data of a live session and restarts its ttl, a nil
+// data keeps the current one.
+func (s *Sessions) Refresh(id string, data []byte) error {
+	defer s.lock(id)()
+	session, err := s.load(id)
+	if err != nil {
+		return err
+	}
+
+	if data == nil {
+		data = session.Data
+	}
+
+	return s.save(id, data)
+}
+
+func (s *Sessions) Destroy(id string) error {
+	defer s.lock(id)()
+	err := s.Store.Del(KEY_PREFIX + id)
+	if err == kvstore.ErrNotInIndex || err == kvstore.ErrKeyNotFound {
+		return ErrSessionNotFound
+	}
+
+	return err
+}
+
+func (s *Sessions) save(id string, data []byte) error {
+	value, err := json.Marshal(record{s.Clock.Now().Add(s.Ttl), data})
+	if err != nil {
+		return err
+	}
+
+	if store, ok := s.Store.(ttlStore); ok {
+		err := store.PutWithTTL(KEY_PREFIX+id, string(value), s.Ttl)
+		if err != kvstore.ErrExpiryDisabled {
+			return err
+		}
+	}
+
+	return s.Store.Put(KEY_PREFIX+id, string(value))
+}
+
+func (s *Sessions) load(id string) (record, error) {
+	value, err := s.Store.Get(KEY_PREFIX + id)
+	if err == kvstore.ErrNotInIndex || err == kvstore.ErrKeyNotFound {
+		return record{}, ErrSessionNotFound
+	}
+	if err != nil {
+		return record{}, err
+	}
+
+	var session record
+	if err := json.Unmarshal([]byte(value), &session); err != nil {
+		return record{}, err
+	}
+
+	if !s.Clock.Now().Before(session.Expires) {
+		s.Store.Del(KEY_PREFIX + id)
+		return record{}, ErrSessionNotFound
+	}
+
+	return session, nil
+}
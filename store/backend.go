@@ -0,0 +1,248 @@
+package kvstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+var ErrBackendReadOnly error = errors.New("Storage backend is read only.")
+
+// BackendFile is an open data log, *os.File is one.
+type BackendFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+// Backend holds the data log. It is given the path the log would have on
+// local disk, and reports a missing log with an error os.IsNotExist accepts.
+// The index, manifest and other small files always stay in Options.Dir.
+type Backend interface {
+	Open(path string) (BackendFile, error)
+	// Append adds data to the end of the log, creating it, and returns the
+	// offset data starts at.
+	Append(path string, data []byte) (offset int64, err error)
+	Size(path string) (int64, error)
+	Sync(path string) error
+	Remove(path string) error
+}
+
+// FileBackend keeps the data log on local disk, it is the default.
+type FileBackend struct{}
+
+func (f FileBackend) Open(path string) (BackendFile, error) {
+	return os.Open(path)
+}
+
+func (f FileBackend) Append(path string, data []byte) (int64, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	length, writeErr := file.Write(data)
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size() - int64(length), writeErr
+}
+
+func (f FileBackend) Size(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+func (f FileBackend) Sync(path string) error {
+	return syncFile(path)
+}
+
+func (f FileBackend) Remove(path string) error {
+	return os.Remove(path)
+}
+
+// MemoryBackend keeps data logs in memory, for tests and throwaway stores.
+type MemoryBackend struct {
+	lock  sync.RWMutex
+	files map[string][]byte
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{sync.RWMutex{}, make(map[string][]byte)}
+}
+
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (m memoryFile) Close() error {
+	return nil
+}
+
+// Open reads the log as it is now, appends made later are not seen.
+func (m *MemoryBackend) Open(path string) (BackendFile, error) {
+	m.lock.RLock()
+	data, ok := m.files[path]
+	m.lock.RUnlock()
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+
+	return memoryFile{bytes.NewReader(data)}, nil
+}
+
+// Append only ever adds bytes past the ones open readers see, so readers
+// can share the slice.
+func (m *MemoryBackend) Append(path string, data []byte) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	offset := int64(len(m.files[path]))
+	m.files[path] = append(m.files[path], data...)
+	return offset, nil
+}
+
+func (m *MemoryBackend) Size(path string) (int64, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	data, ok := m.files[path]
+	if !ok {
+		return 0, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+
+	return int64(len(data)), nil
+}
+
+func (m *MemoryBackend) Sync(path string) error {
+	return nil
+}
+
+func (m *MemoryBackend) Remove(path string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.files[path]; !ok {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+	}
+
+	delete(m.files, path)
+	return nil
+}
+
+// HttpRangeBackend reads a data log uploaded to object storage, such as S3
+// or GCS, with HTTP range requests. It cannot append, so it serves read only
+// stores.
+type HttpRangeBackend struct {
+	// Url is where the log of a local path is fetched from, by default the
+	// base url joined with the log's file name.
+	Url    func(path string) string
+	Client *http.Client
+}
+
+func NewHttpRangeBackend(baseUrl string) *HttpRangeBackend {
+	return &HttpRangeBackend{func(path string) string {
+		return baseUrl + "/" + filepath.Base(path)
+	}, http.DefaultClient}
+}
+
+func (h *HttpRangeBackend) Open(path string) (BackendFile, error) {
+	size, err := h.Size(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := rangeReader{h, h.Url(path), size}
+	return rangeFile{io.NewSectionReader(reader, 0, size)}, nil
+}
+
+func (h *HttpRangeBackend) Append(path string, data []byte) (int64, error) {
+	return 0, ErrBackendReadOnly
+}
+
+func (h *HttpRangeBackend) Size(path string) (int64, error) {
+	response, err := h.Client.Head(h.Url(path))
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusNotFound:
+		return 0, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	case response.StatusCode != http.StatusOK:
+		return 0, fmt.Errorf("Could not stat %s: %s.", path, response.Status)
+	case response.ContentLength < 0:
+		return 0, fmt.Errorf("Could not stat %s: no content length.", path)
+	}
+
+	return response.ContentLength, nil
+}
+
+func (h *HttpRangeBackend) Sync(path string) error {
+	return nil
+}
+
+func (h *HttpRangeBackend) Remove(path string) error {
+	return ErrBackendReadOnly
+}
+
+type rangeFile struct {
+	*io.SectionReader
+}
+
+func (r rangeFile) Close() error {
+	return nil
+}
+
+type rangeReader struct {
+	backend *HttpRangeBackend
+	url     string
+	size    int64
+}
+
+func (r rangeReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	end := off + int64(len(p))
+	if end > r.size {
+		end = r.size
+	}
+
+	request, err := http.NewRequest(http.MethodGet, r.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Range", "bytes="+strconv.FormatInt(off, 10)+"-"+
+		strconv.FormatInt(end-1, 10))
+
+	response, err := r.backend.Client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("Range read of %s failed: %s.", r.url, response.Status)
+	}
+
+	n, err := io.ReadFull(response.Body, p[:end-off])
+	if err == nil && end-off < int64(len(p)) {
+		err = io.EOF
+	}
+
+	return n, err
+}
@@ -0,0 +1,301 @@
+package kvstore
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+const BACKUP_CHUNK_SIZE int64 = 64 * 1024
+
+var ErrRestoreTarget error = errors.New("Restore directory already has a data log.")
+
+// BackupTo writes a tar of the storage directory while writes go on. Writes
+// acknowledged before it is called are flushed to the data log and the
+// index checkpointed first, so the backup holds them all. The index and
+// index log are copied before the data log, so every offset they hold is
+// inside the copied log and records flushed after them are replayed on
+// restore. The log is cut after its last complete record. A rotated log is
+// copied a segment at a file, no segment is removed while the backup runs.
+func (k *KvStore) BackupTo(w io.Writer) error {
+	if err := k.flushBuffer(context.Background(), WRITE_THROUGH_SYNC); err != nil {
+		return err
+	}
+	if err := k.flushIndexBuffer(context.Background()); err != nil {
+		return err
+	}
+
+	segments := []LogSegment{{0, time.Time{}}}
+	if log, ok := k.options.Backend.(*segmentedLog); ok {
+		atomic.AddInt32(&log.pins, 1)
+		defer atomic.AddInt32(&log.pins, -1)
+		segments = log.snapshot()
+	}
+
+	dir := k.options.Dir
+	archive := tar.NewWriter(w)
+	manifest, found, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	if found {
+		if len(segments) > 1 || segments[0].Base > 0 {
+			manifest.Segments = segments
+		}
+		data, err := json.MarshalIndent(manifest, "", " ")
+		if err != nil {
+			return err
+		}
+
+		if err := k.writeBackupEntry(archive, MANIFEST_FILE, int64(len(data)), bytes.NewReader(data)); err != nil {
+			return err
+		}
+	}
+
+	index, indexLog, err := readIndexFiles(dir)
+	if err != nil {
+		return err
+	}
+	if index != nil {
+		if err := k.writeBackupEntry(archive, INDEX_FILE, int64(len(index)), bytes.NewReader(index)); err != nil {
+			return err
+		}
+	}
+	if indexLog != nil {
+		if err := k.writeBackupEntry(archive, INDEX_LOG_FILE, int64(len(indexLog)),
+			bytes.NewReader(indexLog)); err != nil {
+			return err
+		}
+	}
+
+	path := filepath.Join(dir, STORAGE_FILE)
+	dataLog, err := k.options.Backend.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dataLog.Close()
+
+	logSize, err := k.options.Backend.Size(path)
+	if err != nil {
+		return err
+	}
+
+	size, err := completeLength(dataLog, segments[0].Base, logSize)
+	if err != nil {
+		return err
+	}
+
+	// The last segment copied also holds segments rotated in since the
+	// snapshot, offsets run on across segments so they read back the same.
+	for i, segment := range segments {
+		end := size
+		if i < len(segments)-1 {
+			end = segments[i+1].Base
+		}
+
+		name := filepath.Base(segmentPath(STORAGE_FILE, segment.Base))
+		if err := k.writeBackupEntry(archive, name, end-segment.Base,
+			io.NewSectionReader(dataLog, segment.Base, end-segment.Base)); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// readIndexFiles reads the index and the index log appended since it was
+// written, nil for files that do not exist. A checkpoint replacing the index
+// in between starts a new index log, so both are read again then.
+func readIndexFiles(dir string) ([]byte, []byte, error) {
+	for {
+		before, err := statIndex(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		index, err := readOptionalFile(filepath.Join(dir, INDEX_FILE))
+		if err != nil {
+			return nil, nil, err
+		}
+		indexLog, err := readOptionalFile(filepath.Join(dir, INDEX_LOG_FILE))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		after, err := statIndex(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		if before == nil && after == nil || before != nil && after != nil &&
+			os.SameFile(before, after) && before.ModTime().Equal(after.ModTime()) {
+			return index, indexLog, nil
+		}
+	}
+}
+
+func statIndex(dir string) (os.FileInfo, error) {
+	info, err := os.Stat(filepath.Join(dir, INDEX_FILE))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return info, err
+}
+
+func readOptionalFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return data, err
+}
+
+func (k *KvStore) writeBackupEntry(archive *tar.Writer, name string, size int64,
+	reader io.Reader) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: size, ModTime: k.options.Clock.Now()}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(archive, reader)
+	return err
+}
+
+// completeLength is the length of file up to the newline ending its last
+// complete record, leaving out a record still being appended. Records start
+// at from.
+func completeLength(file io.ReaderAt, from int64, size int64) (int64, error) {
+	buffer := make([]byte, BACKUP_CHUNK_SIZE)
+	for end := size; end > from; {
+		start := end - BACKUP_CHUNK_SIZE
+		if start < from {
+			start = from
+		}
+
+		chunk := buffer[:end-start]
+		if _, err := file.ReadAt(chunk, start); err != nil {
+			return 0, err
+		}
+
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			return start + int64(i) + 1, nil
+		}
+		end = start
+	}
+
+	return from, nil
+}
+
+// RestoreFrom unpacks a BackupTo tar into dir, which must not hold a data
+// log yet. Open the store on it as usual, records after the index's last
+// offset are replayed then.
+func RestoreFrom(r io.Reader, dir string) error {
+	if fileExists(filepath.Join(dir, STORAGE_FILE)) {
+		return ErrRestoreTarget
+	}
+	if hasSegmentFiles(dir) {
+		return ErrRestoreTarget
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case header.Name == STORAGE_FILE, header.Name == INDEX_FILE,
+			header.Name == INDEX_LOG_FILE, header.Name == MANIFEST_FILE,
+			isSegmentFile(header.Name):
+		default:
+			return fmt.Errorf("Unexpected file %s in backup.", header.Name)
+		}
+
+		if err := restoreFile(archive, filepath.Join(dir, header.Name)); err != nil {
+			return err
+		}
+	}
+}
+
+func restoreFile(reader io.Reader, path string) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// UploadBackup sends a backup of k with a PUT to url, a pre-signed S3 or GCS
+// object URL. The backup is spooled to a temporary file first since both
+// need the length up front.
+func UploadBackup(k *KvStore, url string, client *http.Client) error {
+	spool, err := ioutil.TempFile("", "kvstore-backup-*.tar")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	if err := k.BackupTo(spool); err != nil {
+		return err
+	}
+
+	size, err := spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPut, url, spool)
+	if err != nil {
+		return err
+	}
+	request.ContentLength = size
+	request.Header.Set("Content-Type", "application/x-tar")
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("Backup upload failed with %s: %s", response.Status, body)
+	}
+
+	return nil
+}
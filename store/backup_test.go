@@ -0,0 +1,92 @@
+package kvstore
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestBackupWhileRunning backs up a store with writes still buffered and
+// checks the restored store reads back every acknowledged put and delete.
+func TestBackupWhileRunning(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenKvStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown()
+
+	for i := 0; i < 200; i++ {
+		if err := store.Put(fmt.Sprintf("key%d", i), "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if i%2 == 0 {
+			err = store.Del(key)
+		} else {
+			err = store.Put(key, "new")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Writes going on during the backup may or may not be in it, but each
+	// one that is must read back whole.
+	stop := make(chan struct{})
+	var writers sync.WaitGroup
+	writers.Add(1)
+	go func() {
+		defer writers.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			store.Put(fmt.Sprintf("busy%d", i%50), fmt.Sprintf("value%d", i%50))
+		}
+	}()
+
+	var backup bytes.Buffer
+	err = store.BackupTo(&backup)
+	close(stop)
+	writers.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restoreDir := filepath.Join(t.TempDir(), "restored")
+	if err := RestoreFrom(&backup, restoreDir); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := OpenKvStore(restoreDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Shutdown()
+
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key%d", i)
+		value, err := restored.Get(key)
+		if i%2 == 0 {
+			if err == nil {
+				t.Errorf("Deleted key %s came back as %q.", key, value)
+			}
+			continue
+		}
+		if err != nil || value != "new" {
+			t.Errorf("Get(%s) = %q, %v, want new.", key, value, err)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("busy%d", i)
+		if value, err := restored.Get(key); err == nil && value != fmt.Sprintf("value%d", i) {
+			t.Errorf("Get(%s) = %q, want value%d.", key, value, i)
+		}
+	}
+}
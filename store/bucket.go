@@ -0,0 +1,124 @@
+package kvstore
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// BUCKET_SEPARATOR ends the bucket name a bucketed key is prefixed with.
+const BUCKET_SEPARATOR string = "\x1f"
+
+var ErrInvalidBucket error = errors.New("Bucket name is empty or contains the bucket separator.")
+
+// Bucket is a namespaced view of a KvStore, its keys are stored as the bucket
+// name, BUCKET_SEPARATOR and the key so buckets sharing a store never see
+// each other's keys.
+type Bucket struct {
+	Name  string
+	store *KvStore
+}
+
+// Bucket returns the view of the named bucket, buckets exist once a key is
+// put in them.
+func (k *KvStore) Bucket(name string) Store {
+	return &Bucket{name, k}
+}
+
+func (b *Bucket) prefix() (string, error) {
+	if b.Name == "" || strings.Contains(b.Name, BUCKET_SEPARATOR) {
+		return "", ErrInvalidBucket
+	}
+
+	return b.Name + BUCKET_SEPARATOR, nil
+}
+
+func (b *Bucket) Put(key string, value string) error {
+	prefix, err := b.prefix()
+	if err != nil {
+		return err
+	}
+
+	return b.store.Put(prefix+key, value)
+}
+
+func (b *Bucket) Get(key string) (string, error) {
+	prefix, err := b.prefix()
+	if err != nil {
+		return "", err
+	}
+
+	return b.store.Get(prefix + key)
+}
+
+func (b *Bucket) Del(key string) error {
+	prefix, err := b.prefix()
+	if err != nil {
+		return err
+	}
+
+	return b.store.Del(prefix + key)
+}
+
+// Keys lists the keys in the bucket in sorted order, without the bucket
+// prefix.
+func (b *Bucket) Keys() ([]string, error) {
+	prefix, err := b.prefix()
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := b.store.liveKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0)
+	for _, key := range all {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, strings.TrimPrefix(key, prefix))
+		}
+	}
+
+	return keys, nil
+}
+
+// ListBuckets names every bucket holding at least one key.
+func (k *KvStore) ListBuckets() ([]string, error) {
+	keys, err := k.liveKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for _, key := range keys {
+		i := strings.Index(key, BUCKET_SEPARATOR)
+		if i <= 0 || seen[key[:i]] {
+			continue
+		}
+
+		seen[key[:i]] = true
+		names = append(names, key[:i])
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// DropBucket deletes every key in the named bucket.
+func (k *KvStore) DropBucket(name string) error {
+	bucket := &Bucket{name, k}
+	keys, err := bucket.Keys()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := bucket.Del(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
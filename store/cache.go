@@ -4,6 +4,7 @@ import (
 	"fmt"
 	lru "github.com/hashicorp/golang-lru"
 	"sync"
+	"sync/atomic"
 )
 
 type Cache interface {
@@ -11,9 +12,43 @@ type Cache interface {
 	Add(key string, value interface{})
 	Remove(key string)
 	Keys() []string
+	Stats() CacheStats
+}
+
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Size      int    `json:"size"`
+}
+
+// cacheCounters is kept first in the cache structs so the 64 bit atomics
+// stay aligned on 32 bit platforms.
+type cacheCounters struct {
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+func (c *cacheCounters) recordGet(ok bool) {
+	if ok {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+}
+
+func (c *cacheCounters) stats(size int) CacheStats {
+	return CacheStats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+		Size:      size,
+	}
 }
 
 type SimpleCache struct {
+	counters cacheCounters
 	sync.RWMutex
 	KvMap map[string]interface{}
 }
@@ -28,6 +63,7 @@ func (s *SimpleCache) Get(key string) (value interface{}, ok bool) {
 	s.RLock()
 	value, ok = s.KvMap[key]
 	s.RUnlock()
+	s.counters.recordGet(ok)
 	return value, ok
 }
 
@@ -48,36 +84,158 @@ func (s *SimpleCache) Keys() []string {
 	return keys
 }
 
+func (s *SimpleCache) Stats() CacheStats {
+	s.RLock()
+	size := len(s.KvMap)
+	s.RUnlock()
+
+	return s.counters.stats(size)
+}
+
 func NewSimpleCache() (Cache, error) {
 	kvMap := make(map[string]interface{})
-	return &SimpleCache{sync.RWMutex{}, kvMap}, nil
+	return &SimpleCache{cacheCounters{}, sync.RWMutex{}, kvMap}, nil
+}
+
+const (
+	ARC_POLICY       string = "arc"
+	LRU_POLICY       string = "lru"
+	TWO_QUEUE_POLICY string = "2q"
+)
+
+// EvictionCache is the part of the golang-lru caches LruCache relies on.
+type EvictionCache interface {
+	Add(key, value interface{})
+	Get(key interface{}) (value interface{}, ok bool)
+	Remove(key interface{})
+	Contains(key interface{}) bool
+	Keys() []interface{}
+	Len() int
+}
+
+type plainLru struct {
+	*lru.Cache
+}
+
+func (p plainLru) Add(key, value interface{}) {
+	p.Cache.Add(key, value)
+}
+
+func (p plainLru) Remove(key interface{}) {
+	p.Cache.Remove(key)
 }
 
+// LruCache bounds entries by count through its eviction policy and, when
+// MaxBytes is set, by the summed size of keys and values.
 type LruCache struct {
-	Lru *lru.ARCCache
+	counters cacheCounters
+	sync.Mutex
+	Lru      EvictionCache
+	MaxBytes int64
+	bytes    int64
+	sizes    map[string]int64
 }
 
 func (l *LruCache) Add(key string, value interface{}) {
+	contained, before := l.Lru.Contains(key), l.Lru.Len()
 	l.Lru.Add(key, value)
+	if !contained && l.Lru.Len() <= before {
+		atomic.AddUint64(&l.counters.evictions, uint64(before+1-l.Lru.Len()))
+	}
+
+	if l.MaxBytes <= 0 {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	l.bytes -= l.sizes[key]
+	l.sizes[key] = int64(len(key) + len(fmt.Sprintf("%v", value)))
+	l.bytes += l.sizes[key]
+
+	if len(l.sizes) > l.Lru.Len() {
+		l.dropEvicted()
+	}
+
+	for l.bytes > l.MaxBytes && l.Lru.Len() > 0 {
+		oldest := l.Lru.Keys()[0].(string)
+		l.Lru.Remove(oldest)
+		l.bytes -= l.sizes[oldest]
+		delete(l.sizes, oldest)
+		atomic.AddUint64(&l.counters.evictions, 1)
+	}
+}
+
+// dropEvicted forgets sizes of keys the policy evicted on its own.
+func (l *LruCache) dropEvicted() {
+	for key, size := range l.sizes {
+		if !l.Lru.Contains(key) {
+			l.bytes -= size
+			delete(l.sizes, key)
+		}
+	}
 }
 
 func (l *LruCache) Get(key string) (value interface{}, ok bool) {
 	var v interface{}
 	v, ok = l.Lru.Get(key)
+	l.counters.recordGet(ok)
 	value = fmt.Sprintf("%v", v)
 	return value, ok
 }
 
 func (l *LruCache) Remove(key string) {
 	l.Lru.Remove(key)
+	if l.MaxBytes <= 0 {
+		return
+	}
+
+	l.Lock()
+	l.bytes -= l.sizes[key]
+	delete(l.sizes, key)
+	l.Unlock()
 }
 
 func (l *LruCache) Keys() []string {
-	return l.Keys()
+	lruKeys := l.Lru.Keys()
+	keys := make([]string, 0, len(lruKeys))
+	for _, k := range lruKeys {
+		keys = append(keys, k.(string))
+	}
+
+	return keys
+}
+
+func (l *LruCache) Stats() CacheStats {
+	return l.counters.stats(l.Lru.Len())
 }
 
 func NewLruCache() (Cache, error) {
-	var cache *lru.ARCCache
-	cache, err := lru.NewARC(1000)
-	return &LruCache{cache}, err
+	return NewPolicyCache(ARC_POLICY, DEFAULT_CACHE_SIZE, 0)
+}
+
+// NewPolicyCache creates a cache holding at most size entries evicted by the
+// given policy, maxBytes of zero leaves the byte size unbounded.
+func NewPolicyCache(policy string, size int, maxBytes int64) (Cache, error) {
+	var cache EvictionCache
+	var err error
+	switch policy {
+	case ARC_POLICY, "":
+		cache, err = lru.NewARC(size)
+	case LRU_POLICY:
+		var c *lru.Cache
+		c, err = lru.New(size)
+		cache = plainLru{c}
+	case TWO_QUEUE_POLICY:
+		cache, err = lru.New2Q(size)
+	default:
+		err = fmt.Errorf("Unknown cache policy %s.", policy)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &LruCache{cacheCounters{}, sync.Mutex{}, cache, maxBytes, 0,
+		make(map[string]int64)}, nil
 }
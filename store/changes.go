@@ -0,0 +1,118 @@
+package kvstore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ChangeIterator walks the committed puts and deletes of the data log in
+// order. A record still being appended ends the iteration, callers tail the
+// log by calling Changes again from Offset.
+type ChangeIterator struct {
+	file   BackendFile
+	reader *bufio.Reader
+	offset int64
+	event  Event
+	err    error
+	opts   Options
+}
+
+// Changes iterates the data log from sinceOffset, which is zero or an
+// Offset returned by an earlier iterator.
+func (k *KvStore) Changes(sinceOffset int64) (*ChangeIterator, error) {
+	path := k.options.path(STORAGE_FILE)
+
+	file, err := k.options.Backend.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := file.Seek(sinceOffset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReaderSize(file, int(k.options.ReadAheadSize))
+	return &ChangeIterator{file, reader, sinceOffset, Event{}, nil, k.options}, nil
+}
+
+func (c *ChangeIterator) Next() bool {
+	if c.err != nil {
+		return false
+	}
+
+	line, err := c.reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		c.err = err
+		return false
+	}
+	if !strings.HasSuffix(line, "\n") {
+		return false
+	}
+
+	record, value, err := parseKvRecord(line)
+	if err != nil {
+		c.err = err
+		return false
+	}
+
+	at, _ := recordTime(record)
+	event := Event{PUT_COMMAND, record[0], "", c.offset, at, recordOperation(record)}
+	if isTombstone(record) {
+		event.Type = DEL_COMMAND
+	} else if event.Value, err = decryptValue(c.opts.Encryption, value); err != nil {
+		c.err = err
+		return false
+	}
+
+	c.event = event
+	c.offset += int64(len(line))
+	return true
+}
+
+// Event is the change Next moved to.
+func (c *ChangeIterator) Event() Event {
+	return c.event
+}
+
+// Offset is where the next change starts, pass it to Changes to resume.
+func (c *ChangeIterator) Offset() int64 {
+	return c.offset
+}
+
+func (c *ChangeIterator) Err() error {
+	return c.err
+}
+
+func (c *ChangeIterator) Close() error {
+	return c.file.Close()
+}
+
+// Apply replays a change read from another store's Changes, waiting until it
+// is in the data log. Read only stores accept it, so replicas can only be
+// written through Apply. A change made under an operation ID keeps it, and
+// is skipped when a store tracking operations has applied it already.
+func (k *KvStore) Apply(event Event) error {
+	if event.Operation != "" && k.operations != nil {
+		return k.once(event.Operation, event.Type, event.Key, func() error {
+			return k.apply(event)
+		})
+	}
+
+	return k.apply(event)
+}
+
+func (k *KvStore) apply(event Event) error {
+	switch event.Type {
+	case PUT_COMMAND:
+		return k.put(context.Background(), event.Key, event.Value, WRITE_THROUGH,
+			formatChecksum(Checksum([]byte(event.Value))), 0, event.Operation)
+	case DEL_COMMAND:
+		return k.del(context.Background(), event.Key, WRITE_THROUGH, 0, event.Operation)
+	}
+
+	return fmt.Errorf("Unknown change type %s.", event.Type)
+}
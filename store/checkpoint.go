@@ -0,0 +1,155 @@
+package kvstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	CHECKPOINT_MAGIC   string = "KVCP"
+	CHECKPOINT_VERSION byte   = 1
+	// checkpointHeaderSize is the magic, version, CRC-32C and length of the
+	// payload.
+	checkpointHeaderSize int = 4 + 1 + 4 + 8
+)
+
+// ErrCorruptIndex is returned for an index file whose checksum or length
+// does not match, or that was written by a newer checkpoint version. The
+// index is then rebuilt from the data log.
+var ErrCorruptIndex error = errors.New("Index file is corrupt.")
+
+// An index file is a checkpoint header followed by the payload, the encoded
+// and possibly encrypted index. Files from before checkpoints had headers
+// are the bare payload and are read without a check.
+func checkpointHeader(checksum uint32, length int64) []byte {
+	header := make([]byte, checkpointHeaderSize)
+	copy(header, CHECKPOINT_MAGIC)
+	header[len(CHECKPOINT_MAGIC)] = CHECKPOINT_VERSION
+	binary.BigEndian.PutUint32(header[5:], checksum)
+	binary.BigEndian.PutUint64(header[9:], uint64(length))
+	return header
+}
+
+// parseCheckpointHeader returns the checksum and length of the payload
+// following header, false when header is not a checkpoint header at all.
+func parseCheckpointHeader(header []byte) (uint32, int64, bool, error) {
+	if !bytes.HasPrefix(header, []byte(CHECKPOINT_MAGIC)) {
+		return 0, 0, false, nil
+	}
+
+	if len(header) < checkpointHeaderSize || header[len(CHECKPOINT_MAGIC)] != CHECKPOINT_VERSION {
+		return 0, 0, true, ErrCorruptIndex
+	}
+
+	return binary.BigEndian.Uint32(header[5:]), int64(binary.BigEndian.Uint64(header[9:])), true, nil
+}
+
+// readCheckpoint checks the index file data and returns its payload.
+func readCheckpoint(data []byte) ([]byte, error) {
+	checksum, length, ok, err := parseCheckpointHeader(data)
+	if !ok || err != nil {
+		return data, err
+	}
+
+	payload := data[checkpointHeaderSize:]
+	if int64(len(payload)) != length || Checksum(payload) != checksum {
+		return nil, ErrCorruptIndex
+	}
+
+	return payload, nil
+}
+
+// writeCheckpoint writes payload as the index file at path and syncs it, so
+// it is whole on disk before it is renamed over the index.
+func writeCheckpoint(path string, payload []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(checkpointHeader(Checksum(payload), int64(len(payload))))
+	if err == nil {
+		_, err = file.Write(payload)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// checkpointWriter streams a payload into a file that begins with room for
+// the checkpoint header, which finish fills in.
+type checkpointWriter struct {
+	file   *os.File
+	crc    hash.Hash32
+	length int64
+}
+
+func newCheckpointWriter(file *os.File) (*checkpointWriter, error) {
+	if _, err := file.Write(make([]byte, checkpointHeaderSize)); err != nil {
+		return nil, err
+	}
+
+	return &checkpointWriter{file, crc32.New(castagnoli), 0}, nil
+}
+
+func (c *checkpointWriter) Write(p []byte) (int, error) {
+	n, err := c.file.Write(p)
+	c.crc.Write(p[:n])
+	c.length += int64(n)
+	return n, err
+}
+
+func (c *checkpointWriter) finish() error {
+	_, err := c.file.WriteAt(checkpointHeader(c.crc.Sum32(), c.length), 0)
+	return err
+}
+
+// checkCheckpointFile reads the index file through once to check its
+// checksum, returning where the payload starts and its length.
+func checkCheckpointFile(file *os.File, size int64) (int64, int64, error) {
+	header := make([]byte, checkpointHeaderSize)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, 0, err
+	}
+
+	checksum, length, ok, err := parseCheckpointHeader(header[:n])
+	if !ok || err != nil {
+		return 0, size, err
+	}
+
+	if length != size-int64(checkpointHeaderSize) {
+		return 0, 0, ErrCorruptIndex
+	}
+
+	crc := crc32.New(castagnoli)
+	if _, err := io.Copy(crc, io.NewSectionReader(file, int64(checkpointHeaderSize), length)); err != nil {
+		return 0, 0, err
+	}
+	if crc.Sum32() != checksum {
+		return 0, 0, ErrCorruptIndex
+	}
+
+	return int64(checkpointHeaderSize), length, nil
+}
+
+// replaceIndex renames the synced swap file over the index and syncs the
+// directory, so the rename itself survives a crash.
+func replaceIndex(swap string, path string) error {
+	if err := os.Rename(swap, path); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
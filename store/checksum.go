@@ -0,0 +1,57 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+)
+
+var ErrChecksumMismatch error = errors.New("Value does not match its checksum.")
+
+var castagnoli *crc32.Table = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksum is the CRC-32C of a value, clients compute it to hand to
+// PutWithChecksum and to check values they read back.
+func Checksum(value []byte) uint32 {
+	return crc32.Checksum(value, castagnoli)
+}
+
+// PutWithChecksum writes a key only if value matches checksum. The checksum is
+// kept in the data log record and checked again whenever the value is read
+// back from disk.
+func (k *KvStore) PutWithChecksum(key string, value string, checksum uint32) error {
+	if k.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if Checksum([]byte(value)) != checksum {
+		return ErrChecksumMismatch
+	}
+
+	return k.put(context.Background(), key, value, k.options.WriteMode, formatChecksum(checksum), 0, "")
+}
+
+func formatChecksum(checksum uint32) string {
+	return fmt.Sprintf("%08x", checksum)
+}
+
+// verifyChecksum checks a value read from disk against the checksum stored
+// with it, records written before checksums existed have none.
+func verifyChecksum(value string, stored string) error {
+	if stored == "" {
+		return nil
+	}
+
+	checksum, err := strconv.ParseUint(stored, 16, 32)
+	if err != nil {
+		return err
+	}
+
+	if Checksum([]byte(value)) != uint32(checksum) {
+		return ErrChecksumMismatch
+	}
+
+	return nil
+}
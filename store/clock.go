@@ -0,0 +1,158 @@
+package kvstore
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Clock is the time source of the background flushers. RealClock is the
+// default, SimClock only moves when Advance is called so time based behaviour
+// can be driven step by step.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type RealClock struct{}
+
+func (r RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (r RealClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (r realTicker) C() <-chan time.Time {
+	return r.Ticker.C
+}
+
+// SimClock keeps its tickers in the order they were made, ticks due at the
+// same time fire in that order.
+type SimClock struct {
+	sync.Mutex
+	now     time.Time
+	tickers []*simTicker
+}
+
+func NewSimClock(start time.Time) *SimClock {
+	return &SimClock{sync.Mutex{}, start, make([]*simTicker, 0)}
+}
+
+func (s *SimClock) Now() time.Time {
+	s.Lock()
+	defer s.Unlock()
+	return s.now
+}
+
+func (s *SimClock) NewTicker(d time.Duration) Ticker {
+	s.Lock()
+	defer s.Unlock()
+	ticker := &simTicker{s, make(chan time.Time, 1), d, s.now.Add(d)}
+	s.tickers = append(s.tickers, ticker)
+	return ticker
+}
+
+// Advance moves the clock forward by d, firing every ticker that comes due,
+// the earliest tick first. Like time.Ticker, a tick nobody has received yet
+// is not queued twice.
+func (s *SimClock) Advance(d time.Duration) {
+	s.advance(d, nil)
+}
+
+// advance is Advance, and when settle is set it waits for each tick to be
+// received and calls settle before firing the next one, with the clock
+// showing the time of the tick.
+func (s *SimClock) advance(d time.Duration, settle func()) {
+	s.Lock()
+	end := s.now.Add(d)
+	for {
+		ticker := s.nextDue(end)
+		if ticker == nil {
+			break
+		}
+		s.now = ticker.next
+		ticker.next = ticker.next.Add(ticker.period)
+		select {
+		case ticker.c <- s.now:
+		default:
+		}
+
+		if settle != nil {
+			s.Unlock()
+			ticker.received()
+			settle()
+			s.Lock()
+		}
+	}
+	s.now = end
+	s.Unlock()
+}
+
+// nextDue is the ticker with the earliest tick due by end, nil when none is.
+// The caller holds the lock.
+func (s *SimClock) nextDue(end time.Time) *simTicker {
+	var due *simTicker
+	for _, ticker := range s.tickers {
+		if ticker.next.After(end) {
+			continue
+		}
+		if due == nil || ticker.next.Before(due.next) {
+			due = ticker
+		}
+	}
+
+	return due
+}
+
+type simTicker struct {
+	clock  *SimClock
+	c      chan time.Time
+	period time.Duration
+	next   time.Time
+}
+
+func (s *simTicker) C() <-chan time.Time {
+	return s.c
+}
+
+func (s *simTicker) Stop() {
+	s.clock.Lock()
+	defer s.clock.Unlock()
+	for i, ticker := range s.clock.tickers {
+		if ticker == s {
+			s.clock.tickers = append(s.clock.tickers[:i], s.clock.tickers[i+1:]...)
+			return
+		}
+	}
+}
+
+// received waits until the tick fired last has been taken from the channel,
+// or the ticker is stopped.
+func (s *simTicker) received() {
+	for len(s.c) > 0 && s.running() {
+		runtime.Gosched()
+	}
+}
+
+func (s *simTicker) running() bool {
+	s.clock.Lock()
+	defer s.clock.Unlock()
+	for _, ticker := range s.clock.tickers {
+		if ticker == s {
+			return true
+		}
+	}
+
+	return false
+}
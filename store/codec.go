@@ -0,0 +1,380 @@
+package kvstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+const (
+	INDEX_MAGIC           string = "KVIX"
+	JSON_INDEX_FORMAT     byte   = 1
+	CSV_INDEX_FORMAT      byte   = 2
+	BINARY_INDEX_FORMAT   byte   = 3
+	PROTOBUF_INDEX_FORMAT byte   = 4
+	TABLE_INDEX_FORMAT    byte   = 5
+	CSV_LAST_OFFSET       string = "lastOffset"
+)
+
+// IndexCodec serializes the persisted index. Every index file starts with
+// INDEX_MAGIC and the codec's format byte, so an index written by one codec
+// can still be read after the store is configured with another.
+type IndexCodec interface {
+	Format() byte
+	Encode(index Index) ([]byte, error)
+	Decode(data []byte) (Index, error)
+}
+
+var codecLock sync.RWMutex = sync.RWMutex{}
+var indexCodecs map[byte]IndexCodec = map[byte]IndexCodec{
+	JSON_INDEX_FORMAT:     JsonIndexCodec{},
+	CSV_INDEX_FORMAT:      CsvIndexCodec{},
+	BINARY_INDEX_FORMAT:   BinaryIndexCodec{},
+	PROTOBUF_INDEX_FORMAT: ProtobufIndexCodec{},
+	TABLE_INDEX_FORMAT:    TableIndexCodec{},
+}
+
+func RegisterIndexCodec(codec IndexCodec) {
+	codecLock.Lock()
+	indexCodecs[codec.Format()] = codec
+	codecLock.Unlock()
+}
+
+func EncodeIndex(codec IndexCodec, index Index) ([]byte, error) {
+	payload, err := codec.Encode(index)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, len(INDEX_MAGIC)+1+len(payload))
+	data = append(data, INDEX_MAGIC...)
+	data = append(data, codec.Format())
+	return append(data, payload...), nil
+}
+
+// DecodeIndex picks the codec from the format marker, files without one are
+// from before codecs existed and are read as JSON.
+func DecodeIndex(data []byte) (Index, error) {
+	if !bytes.HasPrefix(data, []byte(INDEX_MAGIC)) || len(data) <= len(INDEX_MAGIC) {
+		return JsonIndexCodec{}.Decode(data)
+	}
+
+	format := data[len(INDEX_MAGIC)]
+	codecLock.RLock()
+	codec, ok := indexCodecs[format]
+	codecLock.RUnlock()
+	if !ok {
+		return Index{}, fmt.Errorf("Unknown index format %d.", format)
+	}
+
+	return codec.Decode(data[len(INDEX_MAGIC)+1:])
+}
+
+type JsonIndexCodec struct{}
+
+func (j JsonIndexCodec) Format() byte {
+	return JSON_INDEX_FORMAT
+}
+
+func (j JsonIndexCodec) Encode(index Index) ([]byte, error) {
+	return json.MarshalIndent(index, "", " ")
+}
+
+func (j JsonIndexCodec) Decode(data []byte) (Index, error) {
+	var index Index
+	err := json.Unmarshal(data, &index)
+	return index, err
+}
+
+// CsvIndexCodec writes a lastOffset record followed by one record per
+// partial key holding the key and its offsets.
+type CsvIndexCodec struct{}
+
+func (c CsvIndexCodec) Format() byte {
+	return CSV_INDEX_FORMAT
+}
+
+func (c CsvIndexCodec) Encode(index Index) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	writer.Write([]string{CSV_LAST_OFFSET, strconv.FormatInt(index.LastOffset, 10)})
+	for _, keyOffset := range index.KeyOffsets {
+		record := make([]string, 0, len(keyOffset.Offsets)+1)
+		record = append(record, keyOffset.Key)
+		for _, off := range keyOffset.Offsets {
+			record = append(record, strconv.FormatInt(off, 10))
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+
+	return buffer.Bytes(), writer.Error()
+}
+
+func (c CsvIndexCodec) Decode(data []byte) (Index, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return Index{}, err
+	}
+
+	if len(records) == 0 || len(records[0]) != 2 || records[0][0] != CSV_LAST_OFFSET {
+		return Index{}, errors.New("CSV index is missing last offset record.")
+	}
+
+	lastOffset, err := strconv.ParseInt(records[0][1], 10, 64)
+	if err != nil {
+		return Index{}, err
+	}
+
+	index := Index{lastOffset, make([]KeyOffset, 0, len(records)-1)}
+	for _, record := range records[1:] {
+		offsets := make([]int64, 0, len(record)-1)
+		for _, field := range record[1:] {
+			off, err := strconv.ParseInt(field, 10, 64)
+			if err != nil {
+				return Index{}, err
+			}
+			offsets = append(offsets, off)
+		}
+		index.KeyOffsets = append(index.KeyOffsets, KeyOffset{record[0], offsets})
+	}
+
+	return index, nil
+}
+
+// BinaryIndexCodec writes the index as varints: last offset, key count, then
+// for each key its length, bytes, offset count and offsets.
+type BinaryIndexCodec struct{}
+
+func (b BinaryIndexCodec) Format() byte {
+	return BINARY_INDEX_FORMAT
+}
+
+func (b BinaryIndexCodec) Encode(index Index) ([]byte, error) {
+	data := make([]byte, 0, 16*len(index.KeyOffsets)+binary.MaxVarintLen64)
+	data = appendVarint(data, index.LastOffset)
+	data = appendUvarint(data, uint64(len(index.KeyOffsets)))
+	for _, keyOffset := range index.KeyOffsets {
+		data = appendUvarint(data, uint64(len(keyOffset.Key)))
+		data = append(data, keyOffset.Key...)
+		data = appendUvarint(data, uint64(len(keyOffset.Offsets)))
+		for _, off := range keyOffset.Offsets {
+			data = appendVarint(data, off)
+		}
+	}
+
+	return data, nil
+}
+
+func (b BinaryIndexCodec) Decode(data []byte) (Index, error) {
+	reader := bytes.NewReader(data)
+	lastOffset, err := binary.ReadVarint(reader)
+	if err != nil {
+		return Index{}, err
+	}
+
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return Index{}, err
+	}
+
+	if count > uint64(len(data)) {
+		return Index{}, errors.New("Binary index key count is corrupt.")
+	}
+
+	index := Index{lastOffset, make([]KeyOffset, 0, count)}
+	for i := uint64(0); i < count; i++ {
+		keyLen, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return Index{}, err
+		}
+
+		if keyLen > uint64(reader.Len()) {
+			return Index{}, io.ErrUnexpectedEOF
+		}
+
+		key := make([]byte, keyLen)
+		if _, err := io.ReadFull(reader, key); err != nil {
+			return Index{}, err
+		}
+
+		n, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return Index{}, err
+		}
+
+		if n > uint64(reader.Len()) {
+			return Index{}, io.ErrUnexpectedEOF
+		}
+
+		offsets := make([]int64, 0, n)
+		for j := uint64(0); j < n; j++ {
+			off, err := binary.ReadVarint(reader)
+			if err != nil {
+				return Index{}, err
+			}
+			offsets = append(offsets, off)
+		}
+
+		index.KeyOffsets = append(index.KeyOffsets, KeyOffset{string(key), offsets})
+	}
+
+	return index, nil
+}
+
+// ProtobufIndexCodec writes protobuf wire format for the messages
+//
+//	message Index { int64 last_offset = 1; repeated KeyOffset key_offsets = 2; }
+//	message KeyOffset { string key = 1; repeated int64 offsets = 2; }
+//
+// so the index can be read by other tools without linking this package.
+type ProtobufIndexCodec struct{}
+
+const (
+	pbVarint  uint64 = 0
+	pbFixed64 uint64 = 1
+	pbBytes   uint64 = 2
+	pbFixed32 uint64 = 5
+)
+
+func (p ProtobufIndexCodec) Format() byte {
+	return PROTOBUF_INDEX_FORMAT
+}
+
+func (p ProtobufIndexCodec) Encode(index Index) ([]byte, error) {
+	data := make([]byte, 0, 16*len(index.KeyOffsets)+binary.MaxVarintLen64)
+	data = appendUvarint(data, 1<<3|pbVarint)
+	data = appendUvarint(data, uint64(index.LastOffset))
+	for _, keyOffset := range index.KeyOffsets {
+		msg := make([]byte, 0, len(keyOffset.Key)+8*len(keyOffset.Offsets)+4)
+		msg = appendUvarint(msg, 1<<3|pbBytes)
+		msg = appendUvarint(msg, uint64(len(keyOffset.Key)))
+		msg = append(msg, keyOffset.Key...)
+
+		packed := make([]byte, 0, 8*len(keyOffset.Offsets))
+		for _, off := range keyOffset.Offsets {
+			packed = appendUvarint(packed, uint64(off))
+		}
+		msg = appendUvarint(msg, 2<<3|pbBytes)
+		msg = appendUvarint(msg, uint64(len(packed)))
+		msg = append(msg, packed...)
+
+		data = appendUvarint(data, 2<<3|pbBytes)
+		data = appendUvarint(data, uint64(len(msg)))
+		data = append(data, msg...)
+	}
+
+	return data, nil
+}
+
+func (p ProtobufIndexCodec) Decode(data []byte) (Index, error) {
+	var index Index
+	err := readProtoFields(data, func(field uint64, wire uint64, value uint64, bytes []byte) error {
+		switch {
+		case field == 1 && wire == pbVarint:
+			index.LastOffset = int64(value)
+		case field == 2 && wire == pbBytes:
+			keyOffset, err := decodeProtoKeyOffset(bytes)
+			if err != nil {
+				return err
+			}
+			index.KeyOffsets = append(index.KeyOffsets, keyOffset)
+		}
+		return nil
+	})
+
+	return index, err
+}
+
+func decodeProtoKeyOffset(data []byte) (KeyOffset, error) {
+	keyOffset := KeyOffset{"", make([]int64, 0, 1)}
+	err := readProtoFields(data, func(field uint64, wire uint64, value uint64, packed []byte) error {
+		switch {
+		case field == 1 && wire == pbBytes:
+			keyOffset.Key = string(packed)
+		case field == 2 && wire == pbVarint:
+			keyOffset.Offsets = append(keyOffset.Offsets, int64(value))
+		case field == 2 && wire == pbBytes:
+			for len(packed) > 0 {
+				off, n := binary.Uvarint(packed)
+				if n <= 0 {
+					return errors.New("Protobuf index has a corrupt offset.")
+				}
+				keyOffset.Offsets = append(keyOffset.Offsets, int64(off))
+				packed = packed[n:]
+			}
+		}
+		return nil
+	})
+
+	return keyOffset, err
+}
+
+// readProtoFields walks the fields of one message, skipping fixed width
+// fields it has no use for.
+func readProtoFields(data []byte, visit func(field uint64, wire uint64, value uint64, bytes []byte) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("Protobuf index has a corrupt tag.")
+		}
+		data = data[n:]
+		field, wire := tag>>3, tag&7
+
+		var value uint64
+		var payload []byte
+		switch wire {
+		case pbVarint:
+			value, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New("Protobuf index has a corrupt varint.")
+			}
+			data = data[n:]
+		case pbBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return io.ErrUnexpectedEOF
+			}
+			payload = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case pbFixed64:
+			if len(data) < 8 {
+				return io.ErrUnexpectedEOF
+			}
+			data = data[8:]
+		case pbFixed32:
+			if len(data) < 4 {
+				return io.ErrUnexpectedEOF
+			}
+			data = data[4:]
+		default:
+			return fmt.Errorf("Protobuf index has unsupported wire type %d.", wire)
+		}
+
+		if err := visit(field, wire, value, payload); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func appendUvarint(data []byte, value uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], value)
+	return append(data, buf[:n]...)
+}
+
+func appendVarint(data []byte, value int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], value)
+	return append(data, buf[:n]...)
+}
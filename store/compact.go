@@ -0,0 +1,220 @@
+package kvstore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+type FilterDecision int
+
+const (
+	FILTER_KEEP   FilterDecision = 0
+	FILTER_DROP   FilterDecision = 1
+	FILTER_CHANGE FilterDecision = 2
+)
+
+var ErrDamagedLog error = errors.New("Data log has damaged records, repair it before compacting.")
+
+// CompactionFilter is asked about every record Compact would keep, with its
+// decrypted value. FILTER_CHANGE keeps the key with the returned value
+// instead, for scrubbing or upgrading values in place.
+type CompactionFilter interface {
+	Filter(key string, value string) (FilterDecision, string)
+}
+
+type CompactionFilterFunc func(key string, value string) (FilterDecision, string)
+
+func (f CompactionFilterFunc) Filter(key string, value string) (FilterDecision, string) {
+	return f(key, value)
+}
+
+type CompactionReport struct {
+	// Records were read from the log and Kept written back, Dropped and
+	// Changed count what the filter did with the live ones.
+	Records     int   `json:"records"`
+	Kept        int   `json:"kept"`
+	Dropped     int   `json:"dropped"`
+	Changed     int   `json:"changed"`
+	BytesBefore int64 `json:"bytesBefore"`
+	BytesAfter  int64 `json:"bytesAfter"`
+}
+
+// Compact rewrites the data log in dir with only the latest put of each live
+// key, or its Options.RetainVersions latest puts, in log order, passing each
+// through filter when it is not nil. The index is then rebuilt, and a
+// rotated log is left as a single segment. The store must not be open, and
+// a log with damaged records has to be repaired first.
+func Compact(dir string, opts Options, filter CompactionFilter) (report CompactionReport, err error) {
+	_, span := opts.startSpan(context.Background(), SPAN_COMPACT)
+	defer func() {
+		span.SetAttribute("records", report.Records)
+		span.SetAttribute("kept", report.Kept)
+		endSpan(span, err)
+	}()
+
+	return compact(dir, opts, filter)
+}
+
+func compact(dir string, opts Options, filter CompactionFilter) (CompactionReport, error) {
+	if opts.Encryption == nil {
+		opts.Encryption = NoEncryption{}
+	}
+	if opts.IndexCodec == nil {
+		opts.IndexCodec = JsonIndexCodec{}
+	}
+	if opts.Logger == nil {
+		opts.Logger = NopLogger{}
+	}
+	if opts.Backend == nil {
+		opts.Backend = FileBackend{}
+	}
+	opts.Dir = dir
+
+	lock, err := lockDir(dir)
+	if err != nil {
+		return CompactionReport{}, err
+	}
+	defer unlockDir(lock)
+
+	logPath := filepath.Join(dir, STORAGE_FILE)
+	file, err := openLocalLog(dir)
+	if err != nil {
+		return CompactionReport{}, err
+	}
+
+	report := CompactionReport{}
+	lines := make([]string, 0)
+	// latest holds the lines of the newest RetainVersions puts of each
+	// live key, newest last.
+	keep := opts.RetainVersions
+	if keep < 1 {
+		keep = 1
+	}
+	latest := make(map[string][]int)
+	reader := bufio.NewReader(file)
+	for {
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			file.Close()
+			return report, readErr
+		}
+		if line == "" {
+			break
+		}
+
+		record, ok := checkRecord(line, opts)
+		if !ok || !strings.HasSuffix(line, "\n") {
+			file.Close()
+			return report, ErrDamagedLog
+		}
+
+		report.Records++
+		report.BytesBefore += int64(len(line))
+		if isTombstone(record) {
+			delete(latest, record[0])
+		} else {
+			versions := append(latest[record[0]], len(lines))
+			if len(versions) > keep {
+				versions = versions[len(versions)-keep:]
+			}
+			latest[record[0]] = versions
+		}
+		lines = append(lines, line)
+	}
+	file.Close()
+
+	live := make(map[int]bool, len(latest))
+	for _, versions := range latest {
+		for _, i := range versions {
+			live[i] = true
+		}
+	}
+
+	// Encrypted values are written again under the current key, so records
+	// from before a key rotation move to the new key.
+	_, plain := opts.Encryption.(NoEncryption)
+	kept := make([]string, 0, len(live))
+	for i, line := range lines {
+		if !live[i] {
+			continue
+		}
+
+		if filter != nil || !plain {
+			line, err = filterRecord(line, filter, opts, &report)
+			if err != nil {
+				return report, err
+			}
+			if line == "" {
+				continue
+			}
+		}
+
+		report.Kept++
+		report.BytesAfter += int64(len(line))
+		kept = append(kept, line)
+	}
+
+	opts.Logger.Infof("Compacting data log from %d to %d bytes.", report.BytesBefore,
+		report.BytesAfter)
+	if err := rewriteLog(logPath, kept); err != nil {
+		return report, err
+	}
+	if file.rotated() {
+		if err := file.flatten(dir); err != nil {
+			return report, err
+		}
+	}
+
+	return report, rebuildIndex(dir, logPath, opts)
+}
+
+// filterRecord returns the line to keep for a put record, empty when the
+// filter drops it. Values are encrypted again, under the current key, unless
+// the store is not encrypted and the filter keeps them as they are.
+func filterRecord(line string, filter CompactionFilter, opts Options,
+	report *CompactionReport) (string, error) {
+	record, value, err := parseKvRecord(line)
+	if err != nil {
+		return "", err
+	}
+
+	plain, err := decryptValue(opts.Encryption, value)
+	if err != nil {
+		return "", err
+	}
+
+	decision := FILTER_KEEP
+	if filter != nil {
+		decision, value = filter.Filter(record[0], plain)
+	}
+	switch decision {
+	case FILTER_DROP:
+		report.Dropped++
+		return "", nil
+	case FILTER_CHANGE:
+		report.Changed++
+		plain = value
+	default:
+		if _, ok := opts.Encryption.(NoEncryption); ok {
+			return line, nil
+		}
+	}
+
+	encrypted, err := encryptValue(opts.Encryption, plain)
+	if err != nil {
+		return "", err
+	}
+
+	checksum := formatChecksum(Checksum([]byte(plain)))
+	changedRecord := putRecord(record[0], encrypted, checksum)
+	if at, ok := recordTime(record); ok {
+		changedRecord = operationRecord(expireRecord(stampRecord(changedRecord, at),
+			recordExpires(record)), recordOperation(record))
+	}
+	data, err := formatRecord(changedRecord)
+	return string(data), err
+}
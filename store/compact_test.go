@@ -0,0 +1,132 @@
+package kvstore
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestDeleteSurvivesCompaction deletes keys, restarts, compacts and restarts
+// again, the keys must stay deleted throughout. Two of the keys share an
+// index key with one still live.
+func TestDeleteSurvivesCompaction(t *testing.T) {
+	for _, maxLogSize := range []Size{0, 256} {
+		t.Run(fmt.Sprintf("maxLogSize%d", maxLogSize), func(t *testing.T) {
+			testDeleteSurvivesCompaction(t, maxLogSize)
+		})
+	}
+}
+
+func testDeleteSurvivesCompaction(t *testing.T, maxLogSize Size) {
+	dir := t.TempDir()
+	withLogSize := func(o *Options) { o.MaxLogSize = maxLogSize }
+	store, err := OpenKvStore(dir, withLogSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{"deleted", "deleted twice", "live", "a long shared prefix 1",
+		"a long shared prefix 2", "a long shared prefix 3"}
+	for _, key := range keys {
+		if err := store.Put(key, "value of "+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"deleted", "deleted twice", "a long shared prefix 1"} {
+		if err := store.Del(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Put("deleted twice", "again"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Del("deleted twice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Del("a long shared prefix 3"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"live": "value of live",
+		"a long shared prefix 2": "value of a long shared prefix 2"}
+
+	check := func(store *KvStore) {
+		t.Helper()
+		for _, key := range keys {
+			checkKey(t, store, key, want)
+		}
+	}
+	check(store)
+	store = reopen(t, store, false)
+	check(store)
+	if err := store.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultOptions()
+	opts.MaxLogSize = maxLogSize
+	report, err := Compact(dir, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Kept != len(want) {
+		t.Errorf("Compaction kept %d records, want %d.", report.Kept, len(want))
+	}
+
+	store, err = OpenKvStore(dir, withLogSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(store)
+	for _, rebuild := range []bool{false, true} {
+		store = reopen(t, store, rebuild)
+		check(store)
+	}
+	store.Shutdown()
+}
+
+// TestCompactRotatesKey compacts a store after rotating its encryption key,
+// the compacted store must read back with only the new key.
+func TestCompactRotatesKey(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, newKey := []byte(strings.Repeat("o", 32)), []byte(strings.Repeat("n", 32))
+	keys := NewStaticKeyProvider(1, oldKey)
+	withKeys := func(keys KeyProvider) Option {
+		return func(o *Options) { o.Encryption = NewAesGcmEncryption(keys) }
+	}
+	store, err := OpenKvStore(dir, withKeys(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i)
+		want[key] = fmt.Sprintf("value %d,\n", i)
+		if err := store.Put(key, want[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys.Rotate(2, newKey)
+	opts := DefaultOptions()
+	withKeys(keys)(&opts)
+	report, err := Compact(dir, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Kept != len(want) {
+		t.Errorf("Compaction kept %d records, want %d.", report.Kept, len(want))
+	}
+
+	store, err = OpenKvStore(dir, withKeys(NewStaticKeyProvider(2, newKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown()
+	for key := range want {
+		checkKey(t, store, key, want)
+	}
+}
@@ -0,0 +1,132 @@
+package kvstore
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+const DEFAULT_COMPACTION_SAMPLE_SIZE int = 100
+
+// CompactionEstimate is what a compaction of the data log would likely
+// reclaim. Byte and dead record counts are extrapolated from a sample of
+// live records, so they are estimates rather than exact figures.
+type CompactionEstimate struct {
+	LogBytes             int64   `json:"logBytes"`
+	LiveRecords          int64   `json:"liveRecords"`
+	SampledRecords       int     `json:"sampledRecords"`
+	AverageRecordBytes   float64 `json:"averageRecordBytes"`
+	EstimatedLiveBytes   int64   `json:"estimatedLiveBytes"`
+	EstimatedDeadRecords int64   `json:"estimatedDeadRecords"`
+	ReclaimableBytes     int64   `json:"reclaimableBytes"`
+}
+
+func (k *KvStore) EstimateCompaction() (CompactionEstimate, error) {
+	return k.estimateCompaction(context.Background(), func(float64) {})
+}
+
+func (k *KvStore) estimateCompaction(ctx context.Context, progress func(float64)) (CompactionEstimate, error) {
+	var estimate CompactionEstimate
+	if err := k.awaitRecovery(ctx); err != nil {
+		return estimate, err
+	}
+
+	path := k.options.path(STORAGE_FILE)
+
+	size, err := k.options.Backend.Size(path)
+	if os.IsNotExist(err) {
+		return estimate, nil
+	}
+	if err != nil {
+		return estimate, err
+	}
+	estimate.LogBytes = size - logStart(k.options.Backend, path)
+
+	offsets := liveOffsets(k.IndexCache)
+	estimate.LiveRecords = int64(len(offsets))
+	if len(offsets) == 0 {
+		estimate.ReclaimableBytes = estimate.LogBytes
+		return estimate, nil
+	}
+
+	sampleSize := k.options.CompactionSampleSize
+	if sampleSize <= 0 {
+		sampleSize = DEFAULT_COMPACTION_SAMPLE_SIZE
+	}
+
+	step := len(offsets) / sampleSize
+	if step < 1 {
+		step = 1
+	}
+
+	samples := make([]int64, 0, len(offsets)/step+1)
+	for i := 0; i < len(offsets); i += step {
+		samples = append(samples, offsets[i])
+	}
+
+	var sampledBytes, sampled int64
+	err = parallelChunks(k.options.CompactionWorkers, len(samples), func(start int, end int) error {
+		storeFile, err := k.options.Backend.Open(path)
+		if err != nil {
+			return err
+		}
+		defer storeFile.Close()
+
+		reader := bufio.NewReaderSize(storeFile, int(k.options.ReadAheadSize))
+		for _, off := range samples[start:end] {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			if _, err := storeFile.Seek(off, io.SeekStart); err != nil {
+				return err
+			}
+			reader.Reset(storeFile)
+
+			_, _, _, length, err := readKvRecord(reader)
+			if err != nil {
+				return err
+			}
+			atomic.AddInt64(&sampledBytes, int64(length))
+			progress(float64(atomic.AddInt64(&sampled, 1)) / float64(len(samples)))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return estimate, err
+	}
+	estimate.SampledRecords = len(samples)
+
+	estimate.AverageRecordBytes = float64(sampledBytes) / float64(estimate.SampledRecords)
+	estimate.EstimatedLiveBytes = int64(estimate.AverageRecordBytes * float64(estimate.LiveRecords))
+	if estimate.EstimatedLiveBytes > estimate.LogBytes {
+		estimate.EstimatedLiveBytes = estimate.LogBytes
+	}
+
+	estimate.ReclaimableBytes = estimate.LogBytes - estimate.EstimatedLiveBytes
+	estimatedRecords := int64(float64(estimate.LogBytes) / estimate.AverageRecordBytes)
+	if estimatedRecords > estimate.LiveRecords {
+		estimate.EstimatedDeadRecords = estimatedRecords - estimate.LiveRecords
+	}
+
+	return estimate, nil
+}
+
+func liveOffsets(indexCache Cache) []int64 {
+	keys := indexCache.Keys()
+	offsets := make([]int64, 0, len(keys))
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+
+		values, _ := indexCache.Get(key)
+		offs, _ := unpackOffsets(values)
+		offsets = append(offsets, offs...)
+	}
+
+	return offsets
+}
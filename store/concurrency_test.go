@@ -0,0 +1,235 @@
+package kvstore
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	concurrentWorkers = 8
+	concurrentRounds  = 200
+	sharedKeys        = 4
+)
+
+// TestConcurrentPutGetDel runs Puts, Gets, Dels and Flushes from many
+// goroutines, run it with go test -race. Each worker owns some keys and must
+// read its own writes back at once, all of them also write a few shared keys.
+// The store must then agree with itself after a restart.
+func TestConcurrentPutGetDel(t *testing.T) {
+	for _, mode := range []WriteMode{WRITE_BACK, WRITE_THROUGH} {
+		t.Run(fmt.Sprintf("mode%d", mode), func(t *testing.T) {
+			testConcurrentPutGetDel(t, mode)
+		})
+	}
+}
+
+func testConcurrentPutGetDel(t *testing.T, mode WriteMode) {
+	dir := t.TempDir()
+	withMode := func(o *Options) { o.WriteMode = mode }
+	store, err := OpenKvStore(dir, withMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	flushed := make(chan struct{})
+	go func() {
+		defer close(flushed)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := store.Flush(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	var workers sync.WaitGroup
+	for w := 0; w < concurrentWorkers; w++ {
+		workers.Add(1)
+		go func(w int) {
+			defer workers.Done()
+			for i := 0; i < concurrentRounds; i++ {
+				key := fmt.Sprintf("worker%d/key%d", w, i%10)
+				value := fmt.Sprintf("%d-%d", w, i)
+				if err := store.Put(key, value); err != nil {
+					t.Error(err)
+					return
+				}
+				if got, err := store.Get(key); err != nil || got != value {
+					t.Errorf("Get(%s) = %q, %v right after putting %q.", key, got, err, value)
+					return
+				}
+				if i%7 == 0 {
+					if err := store.Del(key); err != nil {
+						t.Error(err)
+						return
+					}
+					if got, err := store.Get(key); err == nil {
+						t.Errorf("Get(%s) = %q right after deleting it.", key, got)
+						return
+					}
+				}
+
+				shared := fmt.Sprintf("shared%d", i%sharedKeys)
+				var err error
+				if i%5 == 0 {
+					err = store.Del(shared)
+				} else {
+					err = store.Put(shared, value)
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				store.Get(shared)
+			}
+		}(w)
+	}
+	workers.Wait()
+	close(stop)
+	<-flushed
+
+	want := make(map[string]string)
+	for w := 0; w < concurrentWorkers; w++ {
+		for i := concurrentRounds - 10; i < concurrentRounds; i++ {
+			key := fmt.Sprintf("worker%d/key%d", w, i%10)
+			want[key] = fmt.Sprintf("%d-%d", w, i)
+			if i%7 == 0 {
+				delete(want, key)
+			}
+		}
+	}
+	// The last writer of each shared key is not known, but the value the
+	// running store answers with must be the one the data log holds.
+	for i := 0; i < sharedKeys; i++ {
+		key := fmt.Sprintf("shared%d", i)
+		if value, err := store.Get(key); err == nil {
+			want[key] = value
+		}
+	}
+	if err := store.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenKvStore(dir, withMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Shutdown()
+	for w := 0; w < concurrentWorkers; w++ {
+		for i := 0; i < 10; i++ {
+			checkKey(t, reopened, fmt.Sprintf("worker%d/key%d", w, i), want)
+		}
+	}
+	for i := 0; i < sharedKeys; i++ {
+		checkKey(t, reopened, fmt.Sprintf("shared%d", i), want)
+	}
+}
+
+// checkKey checks key reads back as in want, or is missing when want has
+// no value for it.
+func checkKey(t *testing.T, store *KvStore, key string, want map[string]string) {
+	t.Helper()
+	value, err := store.Get(key)
+	expected, ok := want[key]
+	switch {
+	case !ok && err == nil:
+		t.Errorf("Get(%s) = %q, want it deleted.", key, value)
+	case ok && (err != nil || value != expected):
+		t.Errorf("Get(%s) = %q, %v, want %q.", key, value, err, expected)
+	}
+}
+
+// TestConcurrentShutdown shuts the store down while writers are still
+// putting keys, every write either succeeds or fails with ErrStoreClosed.
+func TestConcurrentShutdown(t *testing.T) {
+	store, err := OpenKvStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var workers sync.WaitGroup
+	for w := 0; w < concurrentWorkers; w++ {
+		workers.Add(1)
+		go func(w int) {
+			defer workers.Done()
+			for i := 0; ; i++ {
+				err := store.Put(fmt.Sprintf("worker%d", w), fmt.Sprint(i))
+				if err == ErrStoreClosed {
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	if err := store.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	workers.Wait()
+}
+
+// stalledBackend holds every append to the data log until release is closed.
+type stalledBackend struct {
+	FileBackend
+	release chan struct{}
+}
+
+func (b stalledBackend) Append(path string, data []byte) (int64, error) {
+	<-b.release
+	return b.FileBackend.Append(path, data)
+}
+
+// TestShutdownTimeout times out a shutdown while the data log is stalled,
+// the store must finish closing and unlock its directory once it drains.
+func TestShutdownTimeout(t *testing.T) {
+	dir := t.TempDir()
+	backend := stalledBackend{release: make(chan struct{})}
+	store, err := OpenKvStore(dir, func(o *Options) { o.Backend = backend })
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"key": "value"}
+	if err := store.Put("key", want["key"]); err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.ShutdownTimeout(10 * time.Millisecond)
+	if _, ok := err.(*ShutdownTimeoutError); !ok {
+		t.Fatalf("ShutdownTimeout() = %v, want a ShutdownTimeoutError.", err)
+	}
+	if state := store.State(); state != STATE_DRAINING {
+		t.Errorf("State after the timeout = %v, want %v.", state, STATE_DRAINING)
+	}
+	if err := store.ShutdownTimeout(10 * time.Millisecond); err == nil {
+		t.Error("ShutdownTimeout() succeeded with the data log still stalled.")
+	}
+
+	close(backend.release)
+	if err := store.ShutdownTimeout(0); err != nil {
+		t.Fatal(err)
+	}
+	if state := store.State(); state != STATE_CLOSED {
+		t.Errorf("State after draining = %v, want %v.", state, STATE_CLOSED)
+	}
+	if err := store.Shutdown(); err != ErrStoreClosed {
+		t.Errorf("Shutdown() of a closed store = %v, want ErrStoreClosed.", err)
+	}
+
+	store, err = OpenKvStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown()
+	checkKey(t, store, "key", want)
+}
@@ -0,0 +1,200 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+// Config is the JSON file form of the Options that make sense outside code.
+// Sizes and durations are written like "64MB" and "250ms", fields left out
+// keep the value of the Options the file is applied to.
+type Config struct {
+	CacheSize            *int      `json:"cacheSize"`
+	CachePolicy          *string   `json:"cachePolicy"`
+	CacheMaxBytes        *Size     `json:"cacheMaxBytes"`
+	NegativeCacheSize    *int      `json:"negativeCacheSize"`
+	ReadAheadSize        *Size     `json:"readAheadSize"`
+	MaxKeySize           *Size     `json:"maxKeySize"`
+	MaxValueSize         *Size     `json:"maxValueSize"`
+	FlushInterval        *Duration `json:"flushInterval"`
+	ReadTimeout          *Duration `json:"readTimeout"`
+	ShutdownTimeout      *Duration `json:"shutdownTimeout"`
+	ReadRetries          *int      `json:"readRetries"`
+	FlushJournalSize     *int      `json:"flushJournalSize"`
+	CompactionSampleSize *int      `json:"compactionSampleSize"`
+	// LogSampling is merged into Options.LogSampling, like
+	// {"index": 100, "getMiss": -1}.
+	LogSampling    map[string]int `json:"logSampling"`
+	PrefixDepth    *int           `json:"prefixDepth"`
+	MaxLogSize     *Size          `json:"maxLogSize"`
+	RetainSegments *int           `json:"retainSegments"`
+	RetainAge      *Duration      `json:"retainAge"`
+	// IndexMemoryBudget like "16MB" keeps the index on disk as a table.
+	IndexMemoryBudget   *Size `json:"indexMemoryBudget"`
+	SparseIndexInterval *int  `json:"sparseIndexInterval"`
+	IndexLogBatches     *int  `json:"indexLogBatches"`
+	RetainVersions      *int  `json:"retainVersions"`
+	IndexKeyHash        *bool `json:"indexKeyHash"`
+	// LazyRecovery serves writes while the index loads.
+	LazyRecovery        *bool `json:"lazyRecovery"`
+	ScanWhileRecovering *bool `json:"scanWhileRecovering"`
+	// Engine is "log", "lsm" or "hash", memtableSize like "4MB".
+	Engine           *string `json:"engine"`
+	MemtableSize     *Size   `json:"memtableSize"`
+	LsmLevelSegments *int    `json:"lsmLevelSegments"`
+	// ExpiryScanInterval like "1s" turns on TTLs.
+	ExpiryScanInterval *Duration `json:"expiryScanInterval"`
+	ExpiryBatchSize    *int      `json:"expiryBatchSize"`
+	// Backpressure is "block" or "fail".
+	WriteBufferSize    *int      `json:"writeBufferSize"`
+	Backpressure       *string   `json:"backpressure"`
+	WriteBufferTimeout *Duration `json:"writeBufferTimeout"`
+	SlowThreshold      *Duration `json:"slowThreshold"`
+	// MinFreeSpace like "1GB" and HealthDeadline like "2s" tune HealthCheck.
+	MinFreeSpace   *Size     `json:"minFreeSpace"`
+	HealthDeadline *Duration `json:"healthDeadline"`
+	// MaxDiskSize like "10GB" caps the store, quotaPolicy is "refuse" or
+	// "reclaim".
+	MaxDiskSize *Size   `json:"maxDiskSize"`
+	QuotaPolicy *string `json:"quotaPolicy"`
+	// OperationWindow turns on operation IDs, remembering that many.
+	OperationWindow *int `json:"operationWindow"`
+}
+
+// LoadConfig applies the config file at path to opts.
+func LoadConfig(path string, opts Options) (Options, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return opts, err
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return opts, err
+	}
+
+	return config.Apply(opts), nil
+}
+
+func (c Config) Apply(opts Options) Options {
+	if c.CacheSize != nil {
+		opts.CacheSize = *c.CacheSize
+	}
+	if c.CachePolicy != nil {
+		opts.CachePolicy = *c.CachePolicy
+	}
+	if c.CacheMaxBytes != nil {
+		opts.CacheMaxBytes = *c.CacheMaxBytes
+	}
+	if c.NegativeCacheSize != nil {
+		opts.NegativeCacheSize = *c.NegativeCacheSize
+	}
+	if c.ReadAheadSize != nil {
+		opts.ReadAheadSize = *c.ReadAheadSize
+	}
+	if c.MaxKeySize != nil {
+		opts.MaxKeySize = *c.MaxKeySize
+	}
+	if c.MaxValueSize != nil {
+		opts.MaxValueSize = *c.MaxValueSize
+	}
+	if c.FlushInterval != nil {
+		opts.FlushInterval = time.Duration(*c.FlushInterval)
+	}
+	if c.ReadTimeout != nil {
+		opts.ReadTimeout = time.Duration(*c.ReadTimeout)
+	}
+	if c.ShutdownTimeout != nil {
+		opts.ShutdownTimeout = time.Duration(*c.ShutdownTimeout)
+	}
+	if c.ReadRetries != nil {
+		opts.ReadRetries = *c.ReadRetries
+	}
+	if c.FlushJournalSize != nil {
+		opts.FlushJournalSize = *c.FlushJournalSize
+	}
+	if c.CompactionSampleSize != nil {
+		opts.CompactionSampleSize = *c.CompactionSampleSize
+	}
+	if c.PrefixDepth != nil {
+		opts.PrefixDepth = *c.PrefixDepth
+	}
+	if c.MaxLogSize != nil {
+		opts.MaxLogSize = *c.MaxLogSize
+	}
+	if c.RetainSegments != nil {
+		opts.RetainSegments = *c.RetainSegments
+	}
+	if c.RetainAge != nil {
+		opts.RetainAge = time.Duration(*c.RetainAge)
+	}
+	if c.IndexMemoryBudget != nil {
+		opts.IndexMemoryBudget = *c.IndexMemoryBudget
+	}
+	if c.SparseIndexInterval != nil {
+		opts.SparseIndexInterval = *c.SparseIndexInterval
+	}
+	if c.IndexLogBatches != nil {
+		opts.IndexLogBatches = *c.IndexLogBatches
+	}
+	if c.SlowThreshold != nil {
+		opts.SlowThreshold = time.Duration(*c.SlowThreshold)
+	}
+	if c.RetainVersions != nil {
+		opts.RetainVersions = *c.RetainVersions
+	}
+	if c.LazyRecovery != nil {
+		opts.LazyRecovery = *c.LazyRecovery
+	}
+	if c.ScanWhileRecovering != nil {
+		opts.ScanWhileRecovering = *c.ScanWhileRecovering
+	}
+	if c.IndexKeyHash != nil {
+		opts.IndexKeyHash = *c.IndexKeyHash
+	}
+	if c.Engine != nil {
+		opts.Engine = *c.Engine
+	}
+	if c.MemtableSize != nil {
+		opts.MemtableSize = *c.MemtableSize
+	}
+	if c.LsmLevelSegments != nil {
+		opts.LsmLevelSegments = *c.LsmLevelSegments
+	}
+	if c.ExpiryScanInterval != nil {
+		opts.ExpiryScanInterval = time.Duration(*c.ExpiryScanInterval)
+	}
+	if c.ExpiryBatchSize != nil {
+		opts.ExpiryBatchSize = *c.ExpiryBatchSize
+	}
+	if c.WriteBufferSize != nil {
+		opts.WriteBufferSize = *c.WriteBufferSize
+	}
+	if c.Backpressure != nil {
+		opts.Backpressure = *c.Backpressure
+	}
+	if c.WriteBufferTimeout != nil {
+		opts.WriteBufferTimeout = time.Duration(*c.WriteBufferTimeout)
+	}
+	if c.MinFreeSpace != nil {
+		opts.MinFreeSpace = *c.MinFreeSpace
+	}
+	if c.HealthDeadline != nil {
+		opts.HealthDeadline = time.Duration(*c.HealthDeadline)
+	}
+	if c.MaxDiskSize != nil {
+		opts.MaxDiskSize = *c.MaxDiskSize
+	}
+	if c.QuotaPolicy != nil {
+		opts.QuotaPolicy = *c.QuotaPolicy
+	}
+	if c.OperationWindow != nil {
+		opts.OperationWindow = *c.OperationWindow
+	}
+	for op, every := range c.LogSampling {
+		WithLogSampling(op, every)(&opts)
+	}
+
+	return opts
+}
@@ -0,0 +1,163 @@
+package kvstore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Where a Get finds a value, the source attribute of its span.
+const (
+	SOURCE_PENDING string = "pending"
+	SOURCE_CACHE   string = "cache"
+	SOURCE_DISK    string = "disk"
+)
+
+// KeyInfo describes the stored value of a key, see KvStore.Describe.
+type KeyInfo struct {
+	Key string `json:"key"`
+	// Size is the length of the value in bytes.
+	Size int `json:"size"`
+	// Versions is how many values of the key the data log retains, one
+	// unless Options.RetainVersions keeps more, and Offset where the
+	// newest of them starts, -1 when none has been flushed.
+	Versions int   `json:"versions"`
+	Offset   int64 `json:"offset"`
+	// Modified is when the newest record of the key was flushed, zero for
+	// records written before commit times. Expires is zero without a TTL.
+	Modified time.Time `json:"modified"`
+	Expires  time.Time `json:"expires"`
+	// Source is where a Get reads the value from, SOURCE_PENDING while the
+	// write is buffered, SOURCE_CACHE or SOURCE_DISK.
+	Source string `json:"source"`
+}
+
+// Describe reports the size, retained versions, last write time and source
+// of the value of key, failing with ErrNotInIndex like Get when it is not
+// stored. It reads the key's newest record from the data log even when the
+// value is cached.
+func (k *KvStore) Describe(key string) (KeyInfo, error) {
+	if err := k.awaitRecovery(context.Background()); err != nil {
+		return KeyInfo{}, err
+	}
+
+	k.closeLock.RLock()
+	closed := k.closed
+	k.closeLock.RUnlock()
+	if closed {
+		return KeyInfo{}, ErrStoreClosed
+	}
+
+	key = k.normalizeKey(key)
+	if k.expiries.isExpired(key, k.options.Clock.Now()) {
+		return KeyInfo{}, ErrNotInIndex
+	}
+
+	info := KeyInfo{key, 0, 0, -1, time.Time{}, time.Time{}, SOURCE_DISK}
+	if expires := k.expiries.get(key); expires != 0 {
+		info.Expires = time.Unix(0, expires)
+	}
+
+	cmd, pending := k.pending.Lookup(key)
+	if pending && cmd.Type == DEL_COMMAND {
+		return KeyInfo{}, ErrNotInIndex
+	}
+
+	value, cached := k.Cache.Get(key)
+	offset, record, err := k.findRecord(key)
+	if err != nil && err != ErrKeyNotFound {
+		return KeyInfo{}, err
+	}
+	found := err == nil
+
+	switch {
+	case pending:
+		info.Source, info.Size = SOURCE_PENDING, len(cmd.Value)
+	case cached:
+		info.Source, info.Size = SOURCE_CACHE, len(fmt.Sprintf("%v", value))
+	case found:
+		plain, err := decryptValue(k.options.Encryption, record[1])
+		if err != nil {
+			return KeyInfo{}, err
+		}
+		info.Size = len(plain)
+	default:
+		return KeyInfo{}, ErrNotInIndex
+	}
+
+	if found {
+		info.Offset = offset
+		info.Modified, _ = recordTime(record)
+		info.Versions = 1
+		if k.versions != nil {
+			info.Versions = k.retainedVersions(key)
+		}
+	}
+
+	return info, nil
+}
+
+// retainedVersions is how many of the offsets the VersionIndex keeps for key
+// are still in the data log.
+func (k *KvStore) retainedVersions(key string) int {
+	start := logStart(k.options.Backend, k.options.path(STORAGE_FILE))
+	retained := 0
+	for _, offset := range k.versions.get(key) {
+		if offset >= start {
+			retained++
+		}
+	}
+
+	return retained
+}
+
+// findRecord reads the data log record the index points at for key, with
+// its value decoded from the log encoding but still encrypted.
+func (k *KvStore) findRecord(key string) (int64, []string, error) {
+	partialKey := k.options.indexKey(key)
+	unlock := rlockIndexKey(k.IndexCache, partialKey)
+	packed, ok := k.IndexCache.Get(partialKey)
+	unlock()
+	if !ok {
+		return 0, nil, ErrKeyNotFound
+	}
+
+	unpacked, ok := unpackOffsets(packed)
+	if !ok {
+		return 0, nil, ErrKeyNotFound
+	}
+	offsets := append([]int64(nil), unpacked...)
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] > offsets[j] })
+
+	file, err := k.options.Backend.Open(k.options.path(STORAGE_FILE))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, int(k.options.ReadAheadSize))
+	for _, offset := range offsets {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return 0, nil, err
+		}
+		reader.Reset(file)
+
+		line, err := reader.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return 0, nil, err
+		}
+		record, value, err := parseKvRecord(line)
+		if err != nil {
+			return 0, nil, err
+		}
+		if record[0] == key {
+			record[1] = value
+			return offset, record, nil
+		}
+	}
+
+	return 0, nil, ErrKeyNotFound
+}
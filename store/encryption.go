@@ -0,0 +1,174 @@
+package kvstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const KEY_ID_SIZE int = 4
+
+type EncryptionProvider interface {
+	Encrypt(plaintext []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// KeyProvider supplies the current key used for new writes and looks up
+// older keys by id so data written before a rotation can still be read.
+type KeyProvider interface {
+	CurrentKey() (id uint32, key []byte, err error)
+	Key(id uint32) ([]byte, error)
+}
+
+type NoEncryption struct{}
+
+func (n NoEncryption) Encrypt(plaintext []byte) ([]byte, error) {
+	return plaintext, nil
+}
+
+func (n NoEncryption) Decrypt(ciphertext []byte) ([]byte, error) {
+	return ciphertext, nil
+}
+
+type StaticKeyProvider struct {
+	sync.RWMutex
+	currentId uint32
+	keys      map[uint32][]byte
+}
+
+func (s *StaticKeyProvider) CurrentKey() (id uint32, key []byte, err error) {
+	s.RLock()
+	defer s.RUnlock()
+	key, ok := s.keys[s.currentId]
+	if !ok {
+		return 0, nil, errors.New("No current encryption key set.")
+	}
+
+	return s.currentId, key, nil
+}
+
+func (s *StaticKeyProvider) Key(id uint32) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	key, ok := s.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("Encryption key %d not found.", id)
+	}
+
+	return key, nil
+}
+
+// Rotate makes the given key current for new writes, keeping older keys
+// available for reads.
+func (s *StaticKeyProvider) Rotate(id uint32, key []byte) {
+	s.Lock()
+	s.keys[id] = key
+	s.currentId = id
+	s.Unlock()
+}
+
+func NewStaticKeyProvider(id uint32, key []byte) *StaticKeyProvider {
+	keys := make(map[uint32][]byte)
+	keys[id] = key
+	return &StaticKeyProvider{sync.RWMutex{}, id, keys}
+}
+
+type AesGcmEncryption struct {
+	Keys KeyProvider
+}
+
+func (a *AesGcmEncryption) Encrypt(plaintext []byte) ([]byte, error) {
+	id, key, err := a.Keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, KEY_ID_SIZE+gcm.NonceSize())
+	binary.BigEndian.PutUint32(out, id)
+	nonce := out[KEY_ID_SIZE:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(out, nonce, plaintext, nil), nil
+}
+
+func (a *AesGcmEncryption) Decrypt(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < KEY_ID_SIZE {
+		return nil, errors.New("Ciphertext too short.")
+	}
+
+	id := binary.BigEndian.Uint32(ciphertext)
+	key, err := a.Keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data := ciphertext[KEY_ID_SIZE:]
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("Ciphertext too short.")
+	}
+
+	nonce, sealed := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, nil)
+}
+
+func NewAesGcmEncryption(keys KeyProvider) EncryptionProvider {
+	return &AesGcmEncryption{keys}
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func encryptValue(enc EncryptionProvider, value string) (string, error) {
+	if _, ok := enc.(NoEncryption); ok {
+		return value, nil
+	}
+
+	sealed, err := enc.Encrypt([]byte(value))
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptValue(enc EncryptionProvider, value string) (string, error) {
+	if _, ok := enc.(NoEncryption); ok {
+		return value, nil
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+
+	plain, err := enc.Decrypt(sealed)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plain), nil
+}
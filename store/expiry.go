@@ -0,0 +1,229 @@
+package kvstore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const DEFAULT_EXPIRY_BATCH_SIZE int = 100
+
+var ErrExpiryDisabled error = errors.New("Key expiration is off, set Options.ExpiryScanInterval.")
+
+// errExpiryChanged is a janitor delete skipped as the key was written again.
+var errExpiryChanged error = errors.New("Key expiry changed.")
+
+// ExpiryIndex holds when each key put with a TTL expires, in unix
+// nanoseconds. The expiry is kept as a sixth column of the put record, after
+// the commit time, so the index is rebuilt from the data log on open. A nil
+// ExpiryIndex keeps nothing.
+type ExpiryIndex struct {
+	lock    sync.Mutex
+	expires map[string]int64
+}
+
+// newExpiryIndex is nil when interval turns key expiration off.
+func newExpiryIndex(interval time.Duration) *ExpiryIndex {
+	if interval <= 0 {
+		return nil
+	}
+
+	return &ExpiryIndex{sync.Mutex{}, make(map[string]int64)}
+}
+
+// set records when key expires, zero for never.
+func (e *ExpiryIndex) set(key string, expires int64) {
+	if e == nil {
+		return
+	}
+
+	e.lock.Lock()
+	if expires == 0 {
+		delete(e.expires, key)
+	} else {
+		e.expires[key] = expires
+	}
+	e.lock.Unlock()
+}
+
+func (e *ExpiryIndex) get(key string) int64 {
+	if e == nil {
+		return 0
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.expires[key]
+}
+
+// isExpired is whether key has expired at now.
+func (e *ExpiryIndex) isExpired(key string, now time.Time) bool {
+	expires := e.get(key)
+	return expires != 0 && expires <= now.UnixNano()
+}
+
+// due lists at most limit keys expired at now, with their expiry.
+func (e *ExpiryIndex) due(now time.Time, limit int) map[string]int64 {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	keys := make(map[string]int64)
+	for key, expires := range e.expires {
+		if len(keys) == limit {
+			break
+		}
+		if expires <= now.UnixNano() {
+			keys[key] = expires
+		}
+	}
+
+	return keys
+}
+
+// load reads the expiry of every key from the whole data log.
+func (e *ExpiryIndex) load(opts Options) error {
+	if e == nil {
+		return nil
+	}
+
+	path := opts.path(STORAGE_FILE)
+	file, err := opts.Backend.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(logStart(opts.Backend, path), io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReaderSize(file, int(opts.ReadAheadSize))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line == "" {
+			return nil
+		}
+
+		if record, _, parseErr := parseKvRecord(line); parseErr == nil {
+			if isTombstone(record) {
+				e.set(record[0], 0)
+			} else {
+				e.set(record[0], recordExpires(record))
+			}
+		}
+	}
+}
+
+// expireRecord adds the expiry column to a stamped put record, when the
+// put expires.
+func expireRecord(record []string, expires int64) []string {
+	if expires == 0 {
+		return record
+	}
+
+	return append(record, strconv.FormatInt(expires, 10))
+}
+
+// recordExpires is when a data log record expires in unix nanoseconds, zero
+// for never.
+func recordExpires(record []string) int64 {
+	if len(record) < 6 {
+		return 0
+	}
+
+	expires, err := strconv.ParseInt(record[5], 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return expires
+}
+
+// PutWithTTL stores a value that expires after ttl. Get no longer finds it
+// once it has expired, and the expiry janitor then deletes it, so scans and
+// iterators see it until the janitor's next run.
+func (k *KvStore) PutWithTTL(key string, value string, ttl time.Duration) error {
+	if k.options.ReadOnly {
+		return ErrReadOnly
+	}
+	if k.expiries == nil {
+		return ErrExpiryDisabled
+	}
+
+	expires := k.options.Clock.Now().Add(ttl).UnixNano()
+	return k.put(context.Background(), key, value, k.options.WriteMode,
+		formatChecksum(Checksum([]byte(value))), expires, "")
+}
+
+// syncExpiry waits until the expiry janitor has finished with the keys it was
+// expiring, if it runs.
+func (k *KvStore) syncExpiry() error {
+	if k.expiries == nil {
+		return nil
+	}
+
+	done := make(chan struct{})
+	select {
+	case k.syncJanitor <- done:
+		<-done
+		return nil
+	case <-k.stopJanitor:
+		return ErrStoreClosed
+	}
+}
+
+// expireKeys deletes expired keys every Options.ExpiryScanInterval, at most
+// Options.ExpiryBatchSize per run, until stop is closed. The deletes are
+// written like any other, so followers and watchers see them and the index
+// drops the keys.
+func (k *KvStore) expireKeys(stop chan struct{}, ticker Ticker) {
+	defer ticker.Stop()
+
+	batch := k.options.ExpiryBatchSize
+	if batch <= 0 {
+		batch = DEFAULT_EXPIRY_BATCH_SIZE
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case done := <-k.syncJanitor:
+			close(done)
+			continue
+		case <-ticker.C():
+		}
+
+		due := k.expiries.due(k.options.Clock.Now(), batch)
+		expired := 0
+		for key, expires := range due {
+			err := k.del(context.Background(), key, WRITE_BACK, expires, "")
+			if err == ErrStoreClosed {
+				return
+			}
+			if err == errExpiryChanged {
+				continue
+			}
+			if err != nil {
+				k.options.Logger.Errorf("Could not expire key %s: %v", key, err)
+				continue
+			}
+			expired++
+		}
+
+		if expired > 0 {
+			k.options.Logger.Infof("Expired %d keys.", expired)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package kvstore
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// Format is how Export writes and Import reads the key value pairs of a
+// dump, independent of the storage directory layout.
+type Format int
+
+const (
+	// JSONL_FORMAT writes one JSON object per line, {"key": k, "value": v},
+	// values that are not UTF-8 are base64 encoded and marked "base64": true.
+	JSONL_FORMAT Format = 0
+	// CSV_FORMAT writes a key,value record per pair. CSV readers turn a
+	// \r\n inside a value into \n, JSONL keeps values exactly.
+	CSV_FORMAT Format = 1
+)
+
+// ParseFormat reads a format name, jsonl or csv.
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "jsonl":
+		return JSONL_FORMAT, nil
+	case "csv":
+		return CSV_FORMAT, nil
+	}
+
+	return 0, fmt.Errorf("Unknown dump format %q.", name)
+}
+
+type dumpRecord struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Base64 bool   `json:"base64,omitempty"`
+}
+
+// Export writes every stored pair to w in key order, as the store was when
+// it was called.
+func (k *KvStore) Export(w io.Writer, format Format) error {
+	if format != JSONL_FORMAT && format != CSV_FORMAT {
+		return fmt.Errorf("Unknown dump format %d.", format)
+	}
+
+	it, err := k.NewIterator()
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	writer := csv.NewWriter(buffered)
+	for it.Next() {
+		value, err := it.Value()
+		if err != nil {
+			return err
+		}
+
+		if format == CSV_FORMAT {
+			err = writer.Write([]string{it.Key(), value})
+		} else if utf8.ValidString(value) {
+			err = encoder.Encode(dumpRecord{it.Key(), value, false})
+		} else {
+			err = encoder.Encode(dumpRecord{it.Key(), base64.StdEncoding.EncodeToString([]byte(value)), true})
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+
+	return buffered.Flush()
+}
+
+// Import puts every pair read from r, a dump written by Export or another
+// store in the same format. The puts are buffered and flushed once at the
+// end, a failed import leaves the pairs before the bad record stored.
+func (k *KvStore) Import(r io.Reader, format Format) error {
+	var next func() (string, string, error)
+	switch format {
+	case JSONL_FORMAT:
+		decoder := json.NewDecoder(r)
+		next = func() (string, string, error) {
+			var record dumpRecord
+			if err := decoder.Decode(&record); err != nil {
+				return "", "", err
+			}
+			if !record.Base64 {
+				return record.Key, record.Value, nil
+			}
+
+			value, err := base64.StdEncoding.DecodeString(record.Value)
+			return record.Key, string(value), err
+		}
+	case CSV_FORMAT:
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = 2
+		next = func() (string, string, error) {
+			record, err := reader.Read()
+			if err != nil {
+				return "", "", err
+			}
+			return record[0], record[1], nil
+		}
+	default:
+		return fmt.Errorf("Unknown dump format %d.", format)
+	}
+
+	for {
+		key, value, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := k.PutWithMode(key, value, WRITE_BACK); err != nil {
+			return err
+		}
+	}
+
+	return k.Flush()
+}
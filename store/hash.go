@@ -0,0 +1,635 @@
+package kvstore
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	ENGINE_HASH string = "hash"
+
+	HASH_DIR                    string = "hash"
+	HASH_DATA_EXT               string = ".data"
+	HASH_HINT_EXT               string = ".hint"
+	DEFAULT_HASH_DATA_FILE_SIZE Size   = 64 * MB
+)
+
+// hashLocation is where the newest record of a key is.
+type hashLocation struct {
+	file   int64
+	offset int64
+	size   int64
+}
+
+// HashStore keeps keys Bitcask style under Options.Dir/hash: records are
+// appended to numbered data files, the active one rotating once it holds
+// Options.MaxLogSize bytes, and an in-memory hash of every full key points
+// at its newest record, so a Get is one read. Merge rewrites the live
+// records of the inactive files with a hint file each, the keys and
+// locations of a data file, which opening reads instead of the data file.
+type HashStore struct {
+	lock    sync.RWMutex
+	options Options
+	dir     string
+	keydir  map[string]hashLocation
+	files   map[int64]*os.File
+	active  *os.File
+	// activeId numbers the active data file, activeSize is its size.
+	activeId   int64
+	activeSize int64
+	closed     bool
+	dirLock    *os.File
+	merging    sync.Mutex
+}
+
+// HashMergeReport sums up a Merge.
+type HashMergeReport struct {
+	Files     int   `json:"files"`
+	Keys      int   `json:"keys"`
+	Bytes     int64 `json:"bytes"`
+	Reclaimed int64 `json:"reclaimed"`
+}
+
+// OpenHashStore opens the hash store in opts.Dir, loading the keys of each
+// data file from its hint file when it has one and from the data file
+// otherwise. Reading a data file stops at a torn record, which a crash can
+// leave at the end of the active file, and writes go to a new data file.
+func OpenHashStore(opts Options) (*HashStore, error) {
+	if opts.Logger == nil {
+		opts.Logger = NopLogger{}
+	}
+	if opts.Dir == "" {
+		opts.Dir = DEFAULT_DIR
+	}
+	if opts.Encryption == nil {
+		opts.Encryption = NoEncryption{}
+	}
+	if opts.ReadAheadSize <= 0 {
+		opts.ReadAheadSize = DEFAULT_READ_AHEAD_SIZE
+	}
+	if opts.MaxLogSize <= 0 {
+		opts.MaxLogSize = DEFAULT_HASH_DATA_FILE_SIZE
+	}
+	if opts.MaxKeySize <= 0 {
+		opts.MaxKeySize = DEFAULT_MAX_KEY_SIZE
+	}
+	if opts.MaxValueSize <= 0 {
+		opts.MaxValueSize = DEFAULT_MAX_VALUE_SIZE
+	}
+
+	dir := filepath.Join(opts.Dir, HASH_DIR)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	dirLock, err := lockDir(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &HashStore{sync.RWMutex{}, opts, dir, make(map[string]hashLocation),
+		make(map[int64]*os.File), nil, 0, 0, false, dirLock, sync.Mutex{}}
+	if err := h.open(); err != nil {
+		h.closeFiles()
+		return nil, err
+	}
+
+	opts.Logger.Infof("Opened hash store with %d keys in %d data files.", len(h.keydir), len(h.files))
+	return h, nil
+}
+
+func (h *HashStore) open() error {
+	ids, err := fileIds(h.dir, HASH_DATA_EXT)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		file, err := os.Open(h.path(id, HASH_DATA_EXT))
+		if err != nil {
+			return err
+		}
+		h.files[id] = file
+
+		if err := h.loadHints(id); err != nil {
+			if !os.IsNotExist(err) {
+				h.options.Logger.Errorf("Rebuilding keys of data file %d, its hint file is unreadable: %v", id, err)
+			}
+			if err := h.loadData(id, file); err != nil {
+				return err
+			}
+		}
+		h.activeId = id
+	}
+
+	// Hint files left by a merge that removed their data file, or that
+	// did not finish writing them.
+	hints, err := fileIds(h.dir, HASH_HINT_EXT)
+	if err != nil {
+		return err
+	}
+	for _, id := range hints {
+		if _, ok := h.files[id]; !ok {
+			os.Remove(h.path(id, HASH_HINT_EXT))
+		}
+	}
+	unfinished, err := filepath.Glob(filepath.Join(h.dir, "*"+HASH_HINT_EXT+".tmp"))
+	if err != nil {
+		return err
+	}
+	for _, name := range unfinished {
+		os.Remove(name)
+	}
+
+	return h.rotate(h.activeId + 1)
+}
+
+// loadHints adds the keys of hint file id to the key directory. A hint
+// file only lists live keys, merges drop deletes.
+func (h *HashStore) loadHints(id int64) error {
+	file, err := os.Open(h.path(id, HASH_HINT_EXT))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	locations := make(map[string]hashLocation)
+	reader := csv.NewReader(bufio.NewReaderSize(file, int(h.options.ReadAheadSize)))
+	reader.FieldsPerRecord = 3
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		offset, err := strconv.ParseInt(record[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		size, err := strconv.ParseInt(record[2], 10, 64)
+		if err != nil {
+			return err
+		}
+		locations[record[0]] = hashLocation{id, offset, size}
+	}
+
+	for key, location := range locations {
+		h.keydir[key] = location
+	}
+	return nil
+}
+
+// loadData reads the keys of data file id from its records.
+func (h *HashStore) loadData(id int64, file *os.File) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReaderSize(file, int(h.options.ReadAheadSize))
+	offset := int64(0)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line == "" {
+			return nil
+		}
+
+		key, entry, parseErr := readEntry(line, h.options)
+		if parseErr != nil || !strings.HasSuffix(line, "\n") {
+			h.options.Logger.Errorf("Stopped reading data file %d at torn record at offset %d.", id, offset)
+			return nil
+		}
+
+		if entry.deleted {
+			delete(h.keydir, key)
+		} else {
+			h.keydir[key] = hashLocation{id, offset, int64(len(line))}
+		}
+		offset += int64(len(line))
+	}
+}
+
+// rotate starts a new active data file numbered id.
+func (h *HashStore) rotate(id int64) error {
+	if h.active != nil {
+		if err := h.active.Sync(); err != nil {
+			return err
+		}
+		h.active.Close()
+	}
+
+	active, err := os.OpenFile(h.path(id, HASH_DATA_EXT), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	reader, err := os.Open(h.path(id, HASH_DATA_EXT))
+	if err != nil {
+		active.Close()
+		return err
+	}
+
+	h.active = active
+	h.activeId = id
+	h.activeSize = 0
+	h.files[id] = reader
+	return nil
+}
+
+func (h *HashStore) path(id int64, ext string) string {
+	return filepath.Join(h.dir, fmt.Sprintf("%08d%s", id, ext))
+}
+
+// fileIds lists the numbers of the files in dir ending in ext, in order.
+func fileIds(dir string, ext string) ([]int64, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, 0, len(names))
+	for _, name := range names {
+		id, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(name), ext), 10, 64)
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (h *HashStore) Get(key string) (string, error) {
+	key = h.normalizeKey(key)
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if h.closed {
+		return "", ErrStoreClosed
+	}
+
+	location, ok := h.keydir[key]
+	if !ok {
+		return "", ErrNotInIndex
+	}
+
+	line := make([]byte, location.size)
+	if _, err := h.files[location.file].ReadAt(line, location.offset); err != nil {
+		return "", err
+	}
+
+	found, entry, err := readEntry(string(line), h.options)
+	if err != nil {
+		return "", err
+	}
+	if found != key || entry.deleted {
+		return "", fmt.Errorf("Data file %d has no record of %s at offset %d.",
+			location.file, key, location.offset)
+	}
+
+	return entry.value, nil
+}
+
+func (h *HashStore) Put(key string, value string) error {
+	if h.options.ReadOnly {
+		return ErrReadOnly
+	}
+	if Size(len(value)) > h.options.MaxValueSize {
+		return ErrValueTooLarge
+	}
+
+	return h.write(key, lsmEntry{value, false})
+}
+
+func (h *HashStore) Del(key string) error {
+	if h.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return h.write(key, lsmEntry{"", true})
+}
+
+// write appends entry to the active data file and points the key
+// directory at it.
+func (h *HashStore) write(key string, entry lsmEntry) error {
+	key = h.normalizeKey(key)
+	if Size(len(key)) > h.options.MaxKeySize {
+		return ErrKeyTooLarge
+	}
+
+	line, err := lsmRecord(key, entry, h.options)
+	if err != nil {
+		return err
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return ErrStoreClosed
+	}
+
+	if h.activeSize > 0 && Size(h.activeSize+int64(len(line))) > h.options.MaxLogSize {
+		if err := h.rotate(h.activeId + 1); err != nil {
+			return err
+		}
+	}
+
+	if _, err := h.active.Write(line); err != nil {
+		return err
+	}
+	if h.options.WriteMode == WRITE_THROUGH_SYNC {
+		if err := h.active.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if entry.deleted {
+		delete(h.keydir, key)
+	} else {
+		h.keydir[key] = hashLocation{h.activeId, h.activeSize, int64(len(line))}
+	}
+	h.activeSize += int64(len(line))
+	return nil
+}
+
+// Merge rewrites the live records of every inactive data file into new
+// data files, each with a hint file, then removes the old files. Writes go
+// on to a new active file meanwhile, numbered after the merged files so
+// they stay newer.
+func (h *HashStore) Merge() (HashMergeReport, error) {
+	h.merging.Lock()
+	defer h.merging.Unlock()
+
+	h.lock.Lock()
+	if h.closed {
+		h.lock.Unlock()
+		return HashMergeReport{}, ErrStoreClosed
+	}
+
+	old := make([]int64, 0, len(h.files))
+	oldBytes := h.activeSize
+	for id := range h.files {
+		old = append(old, id)
+	}
+	live := make(map[string]hashLocation, len(h.keydir))
+	liveBytes := int64(0)
+	for key, location := range h.keydir {
+		live[key] = location
+		liveBytes += location.size
+	}
+	for _, id := range old {
+		if id != h.activeId {
+			if info, err := h.files[id].Stat(); err == nil {
+				oldBytes += info.Size()
+			}
+		}
+	}
+
+	// Every full merged file holds at least MaxLogSize bytes, so this
+	// many numbers are enough for them.
+	first := h.activeId + 1
+	reserved := liveBytes/int64(h.options.MaxLogSize) + 1
+	if err := h.rotate(first + reserved); err != nil {
+		h.lock.Unlock()
+		return HashMergeReport{}, err
+	}
+	h.lock.Unlock()
+
+	keys := make([]string, 0, len(live))
+	for key := range live {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	merger := &hashMerger{store: h, next: first}
+	moved := make(map[string]hashLocation, len(keys))
+	for _, key := range keys {
+		location := live[key]
+		line := make([]byte, location.size)
+		h.lock.RLock()
+		_, err := h.files[location.file].ReadAt(line, location.offset)
+		h.lock.RUnlock()
+		if err != nil {
+			merger.abort()
+			return HashMergeReport{}, err
+		}
+
+		if moved[key], err = merger.add(key, line); err != nil {
+			merger.abort()
+			return HashMergeReport{}, err
+		}
+	}
+	if err := merger.finish(); err != nil {
+		merger.abort()
+		return HashMergeReport{}, err
+	}
+
+	h.lock.Lock()
+	for key, location := range moved {
+		if h.keydir[key] == live[key] {
+			h.keydir[key] = location
+		}
+	}
+	for _, file := range merger.files {
+		reader, err := os.Open(file)
+		if err != nil {
+			h.lock.Unlock()
+			return HashMergeReport{}, err
+		}
+		id, _ := strconv.ParseInt(strings.TrimSuffix(filepath.Base(file), HASH_DATA_EXT), 10, 64)
+		h.files[id] = reader
+	}
+	for _, id := range old {
+		h.files[id].Close()
+		delete(h.files, id)
+	}
+	h.lock.Unlock()
+
+	for _, id := range old {
+		os.Remove(h.path(id, HASH_DATA_EXT))
+		os.Remove(h.path(id, HASH_HINT_EXT))
+	}
+
+	report := HashMergeReport{len(merger.files), len(keys), merger.bytes, oldBytes - merger.bytes}
+	h.options.Logger.Infof("Merged %d data files into %d, reclaiming %d bytes.",
+		len(old), report.Files, report.Reclaimed)
+	return report, nil
+}
+
+// hashMerger writes merged records into data files numbered from next,
+// each with its hint file.
+type hashMerger struct {
+	store      *HashStore
+	next       int64
+	files      []string
+	bytes      int64
+	data       *os.File
+	hints      *os.File
+	size       int64
+	dataWriter *bufio.Writer
+	hintWriter *csv.Writer
+}
+
+func (m *hashMerger) add(key string, line []byte) (hashLocation, error) {
+	if m.data == nil {
+		data, err := os.Create(m.store.path(m.next, HASH_DATA_EXT))
+		if err != nil {
+			return hashLocation{}, err
+		}
+		hints, err := os.Create(m.store.path(m.next, HASH_HINT_EXT) + ".tmp")
+		if err != nil {
+			data.Close()
+			return hashLocation{}, err
+		}
+		m.data, m.hints, m.size = data, hints, 0
+		m.dataWriter = bufio.NewWriter(data)
+		m.hintWriter = csv.NewWriter(hints)
+	}
+
+	location := hashLocation{m.next, m.size, int64(len(line))}
+	if _, err := m.dataWriter.Write(line); err != nil {
+		return hashLocation{}, err
+	}
+	err := m.hintWriter.Write([]string{key, strconv.FormatInt(location.offset, 10),
+		strconv.FormatInt(location.size, 10)})
+	if err != nil {
+		return hashLocation{}, err
+	}
+
+	m.size += location.size
+	m.bytes += location.size
+	if Size(m.size) >= m.store.options.MaxLogSize {
+		return location, m.finish()
+	}
+
+	return location, nil
+}
+
+// finish syncs the data file being written, then its hint file, which is
+// only renamed into place once complete.
+func (m *hashMerger) finish() error {
+	if m.data == nil {
+		return nil
+	}
+
+	data, hints := m.data, m.hints
+	m.data, m.hints = nil, nil
+	m.files = append(m.files, data.Name())
+	m.next++
+
+	err := m.dataWriter.Flush()
+	if err == nil {
+		err = data.Sync()
+	}
+	data.Close()
+	if err != nil {
+		hints.Close()
+		return err
+	}
+
+	m.hintWriter.Flush()
+	err = m.hintWriter.Error()
+	if err == nil {
+		err = hints.Sync()
+	}
+	hints.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(hints.Name(), strings.TrimSuffix(hints.Name(), ".tmp"))
+}
+
+// abort removes the files written so far, the old ones still hold every
+// record.
+func (m *hashMerger) abort() {
+	if m.data != nil {
+		m.data.Close()
+		m.hints.Close()
+		m.files = append(m.files, m.data.Name())
+		os.Remove(m.hints.Name())
+	}
+	for _, file := range m.files {
+		os.Remove(file)
+		os.Remove(strings.TrimSuffix(file, HASH_DATA_EXT) + HASH_HINT_EXT)
+	}
+}
+
+// Scan pages through keys in sorted order like KvStore.Scan.
+func (h *HashStore) Scan(cursor string, count int) (keys []string, next string, err error) {
+	if count <= 0 {
+		count = DEFAULT_SCAN_COUNT
+	}
+
+	h.lock.RLock()
+	all := make([]string, 0, len(h.keydir))
+	for key := range h.keydir {
+		if cursor == "" || key > cursor {
+			all = append(all, key)
+		}
+	}
+	h.lock.RUnlock()
+
+	sort.Strings(all)
+	end := count
+	if len(all) > 0 && all[0] == "" && end == 1 {
+		end++
+	}
+	if len(all) > end {
+		return all[:end], all[end-1], nil
+	}
+
+	return all, "", nil
+}
+
+// Len is how many keys the store holds.
+func (h *HashStore) Len() int {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return len(h.keydir)
+}
+
+// Shutdown syncs the active data file and closes the store.
+func (h *HashStore) Shutdown() error {
+	h.merging.Lock()
+	defer h.merging.Unlock()
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return ErrStoreClosed
+	}
+
+	h.closed = true
+	err := h.active.Sync()
+	h.closeFiles()
+	h.options.Logger.Info("Hash store shut down.")
+	return err
+}
+
+func (h *HashStore) closeFiles() {
+	if h.active != nil {
+		h.active.Close()
+	}
+	for _, file := range h.files {
+		file.Close()
+	}
+	unlockDir(h.dirLock)
+}
+
+func (h *HashStore) normalizeKey(key string) string {
+	if h.options.KeyNormalizer == nil {
+		return key
+	}
+
+	return h.options.KeyNormalizer.Normalize(key)
+}
@@ -0,0 +1,102 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const HEALTH_PROBE_FILE string = "health_probe"
+
+// HealthStatus is what HealthCheck found, Problems lists every failed check
+// and is empty when Healthy.
+type HealthStatus struct {
+	Healthy bool   `json:"healthy"`
+	State   string `json:"state"`
+	// Flushers is how many of the log and index flushers are running.
+	Flushers int  `json:"flushers"`
+	Writable bool `json:"writable"`
+	// FreeBytes is the free space of the storage disk, -1 when unknown.
+	FreeBytes int64 `json:"freeBytes"`
+	// FlushTime is how long the log flusher took to write out its buffer.
+	FlushTime time.Duration `json:"flushTimeNs"`
+	Problems  []string      `json:"problems,omitempty"`
+}
+
+// HealthCheck reports whether the store can take writes, for load balancers:
+// it is serving, both flushers are running, the storage directory can be
+// written, the disk has Options.MinFreeSpace free, the store is within
+// Options.MaxDiskSize and the log flusher writes out its buffer within
+// Options.HealthDeadline. A read only store skips the writable check.
+func (k *KvStore) HealthCheck() HealthStatus {
+	opts := k.options
+	status := HealthStatus{State: k.State().String(), FreeBytes: -1}
+	problem := func(format string, args ...interface{}) {
+		status.Problems = append(status.Problems, fmt.Sprintf(format, args...))
+	}
+
+	if k.State() != STATE_SERVING {
+		problem("Store is %s.", status.State)
+	}
+
+	status.Flushers = int(atomic.LoadInt32(&k.flushers))
+	if status.Flushers < 2 && k.State() == STATE_SERVING {
+		problem("Only %d of 2 flushers are running.", status.Flushers)
+	}
+
+	if opts.ReadOnly {
+		status.Writable = true
+	} else if err := probeWrite(opts.path(HEALTH_PROBE_FILE)); err != nil {
+		problem("Storage directory is not writable: %v", err)
+	} else {
+		status.Writable = true
+	}
+
+	if free, err := freeSpace(opts.Dir); err != nil {
+		problem("Could not read free disk space: %v", err)
+	} else {
+		status.FreeBytes = free
+		if free >= 0 && opts.MinFreeSpace > 0 && Size(free) < opts.MinFreeSpace {
+			problem("Only %d bytes of disk space are free.", free)
+		}
+	}
+
+	if k.quota != nil {
+		if used, err := k.quota.usage(true); err != nil {
+			problem("Could not measure the storage directory: %v", err)
+		} else if Size(used) > opts.MaxDiskSize {
+			problem("Store takes up %d bytes, over its %d byte quota.", used, opts.MaxDiskSize)
+		}
+	}
+
+	if k.State() == STATE_SERVING {
+		deadline := opts.HealthDeadline
+		if deadline <= 0 {
+			deadline = DEFAULT_HEALTH_DEADLINE
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), deadline)
+		start := time.Now()
+		err := k.flushBuffer(ctx, WRITE_THROUGH)
+		cancel()
+		status.FlushTime = time.Since(start)
+		if err != nil {
+			problem("Log flush did not finish: %v", err)
+		}
+	}
+
+	status.Healthy = len(status.Problems) == 0
+	return status
+}
+
+// probeWrite writes and removes a file at path.
+func probeWrite(path string) error {
+	if err := ioutil.WriteFile(path, []byte("ok"), 0644); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,74 @@
+package kvstore
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Identity tells stores apart in logs and stats, Uuid and Version come from
+// the manifest.
+type Identity struct {
+	Uuid    string `json:"uuid"`
+	Dir     string `json:"dir"`
+	Version int    `json:"version"`
+}
+
+func (k *KvStore) Identity() Identity {
+	return k.identity
+}
+
+func (i Identity) fields() log.Fields {
+	return log.Fields{"store": i.Uuid, "dir": i.Dir, "version": i.Version}
+}
+
+// withIdentity tags everything logged through logger with the store's
+// identity, as fields for a logrus logger and as a prefix otherwise.
+func withIdentity(logger Logger, identity Identity) Logger {
+	if fieldLogger, ok := logger.(log.FieldLogger); ok {
+		return fieldLogger.WithFields(identity.fields())
+	}
+	if _, ok := logger.(NopLogger); ok {
+		return logger
+	}
+
+	return prefixLogger{logger, fmt.Sprintf("store=%s dir=%s version=%d ",
+		identity.Uuid, identity.Dir, identity.Version)}
+}
+
+type prefixLogger struct {
+	Logger
+	prefix string
+}
+
+func (p prefixLogger) Debug(args ...interface{}) {
+	p.Logger.Debug(p.prefix + fmt.Sprint(args...))
+}
+
+func (p prefixLogger) Debugf(format string, args ...interface{}) {
+	p.Logger.Debug(p.prefix + fmt.Sprintf(format, args...))
+}
+
+func (p prefixLogger) Info(args ...interface{}) {
+	p.Logger.Info(p.prefix + fmt.Sprint(args...))
+}
+
+func (p prefixLogger) Infof(format string, args ...interface{}) {
+	p.Logger.Info(p.prefix + fmt.Sprintf(format, args...))
+}
+
+func (p prefixLogger) Error(args ...interface{}) {
+	p.Logger.Error(p.prefix + fmt.Sprint(args...))
+}
+
+func (p prefixLogger) Errorf(format string, args ...interface{}) {
+	p.Logger.Error(p.prefix + fmt.Sprintf(format, args...))
+}
+
+func (p prefixLogger) Fatal(args ...interface{}) {
+	p.Logger.Fatal(p.prefix + fmt.Sprint(args...))
+}
+
+func (p prefixLogger) Fatalf(format string, args ...interface{}) {
+	p.Logger.Fatal(p.prefix + fmt.Sprintf(format, args...))
+}
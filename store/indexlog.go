@@ -0,0 +1,150 @@
+package kvstore
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	INDEX_LOG_FILE            string = "index_log.bin"
+	DEFAULT_INDEX_LOG_BATCHES int    = 16
+	// indexLogFrameHeader is the length and CRC-32C of a frame's payload.
+	indexLogFrameHeader int = 8
+)
+
+// The index log holds the index changes flushed since the last checkpoint,
+// so a flush writes only the keys it changed. Each flush appends a frame,
+// a header then a payload encoded like BinaryIndexCodec and encrypted like
+// the index: the flush's last offset and the current offsets of each
+// changed key, none for a key that was removed.
+
+// appendIndexLog appends a frame for keys, as they are now in cache, and
+// syncs it.
+func appendIndexLog(path string, lastOffset int64, keys []string, cache Cache,
+	opts Options) error {
+	index := Index{lastOffset, make([]KeyOffset, 0, len(keys))}
+	for _, key := range keys {
+		value, _ := cache.Get(key)
+		offsets, _ := unpackOffsets(value)
+		index.KeyOffsets = append(index.KeyOffsets, KeyOffset{key, offsets})
+	}
+
+	payload, err := BinaryIndexCodec{}.Encode(index)
+	if err != nil {
+		return err
+	}
+
+	payload, err = opts.Encryption.Encrypt(payload)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, indexLogFrameHeader, indexLogFrameHeader+len(payload))
+	binary.BigEndian.PutUint32(frame[0:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], Checksum(payload))
+	frame = append(frame, payload...)
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(frame)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// replayIndexLog applies the frames of the index log to cache, returning
+// the last offset they reach and false when there are none. A frame torn
+// by a crash ends the log and is cut off, so later frames follow whole
+// ones.
+func replayIndexLog(cache Cache, path string, opts Options) (int64, bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	var lastOffset int64
+	found, position := false, 0
+	for len(data)-position >= indexLogFrameHeader {
+		length := int(binary.BigEndian.Uint32(data[position:]))
+		checksum := binary.BigEndian.Uint32(data[position+4:])
+		start := position + indexLogFrameHeader
+		if length > len(data)-start || Checksum(data[start:start+length]) != checksum {
+			break
+		}
+
+		payload, err := opts.Encryption.Decrypt(data[start : start+length])
+		if err != nil {
+			return 0, false, err
+		}
+
+		index, err := BinaryIndexCodec{}.Decode(payload)
+		if err != nil {
+			return 0, false, err
+		}
+
+		for _, kv := range index.KeyOffsets {
+			if len(kv.Offsets) > 0 {
+				cache.Add(kv.Key, packOffsets(kv.Offsets))
+			} else {
+				cache.Remove(kv.Key)
+			}
+		}
+		if index.LastOffset > lastOffset {
+			lastOffset = index.LastOffset
+		}
+		found, position = true, start+length
+	}
+
+	if position < len(data) {
+		opts.Logger.Infof("Cutting torn index log frame at %d.", position)
+		if err := os.Truncate(path, int64(position)); err != nil {
+			return 0, false, err
+		}
+	}
+
+	return lastOffset, found, nil
+}
+
+// removeIndexLog drops the index log once a checkpoint covers it. It goes
+// before the checkpoint is renamed into place, a crash in between leaves
+// the old checkpoint, and the data log after it is replayed.
+func removeIndexLog(dir string) error {
+	err := os.Remove(filepath.Join(dir, INDEX_LOG_FILE))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// changedKeys is the index keys of a batch of flushed pairs.
+func changedKeys(pairs []KvPair, opts Options) []string {
+	seen := make(map[string]bool, len(pairs))
+	keys := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		key := opts.indexKey(pair.Key)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+
+	return keys
+}
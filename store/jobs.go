@@ -0,0 +1,45 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+
+	"github.com/shimanekb/project1-C/jobs"
+)
+
+const JOB_ESTIMATE_COMPACTION string = "estimate-compaction"
+
+var ErrUnknownJob error = errors.New("Unknown job type.")
+
+// Jobs gives access to long running operations started on this store.
+func (k *KvStore) Jobs() *jobs.Manager {
+	return k.jobs
+}
+
+// StartJob runs a long operation of the given type in the background and
+// returns its job id.
+func (k *KvStore) StartJob(jobType string) (string, error) {
+	fn, ok := k.jobFuncs()[jobType]
+	if !ok {
+		return "", ErrUnknownJob
+	}
+
+	return k.jobs.Start(jobType, fn), nil
+}
+
+func (k *KvStore) JobTypes() []string {
+	types := make([]string, 0)
+	for jobType := range k.jobFuncs() {
+		types = append(types, jobType)
+	}
+
+	return types
+}
+
+func (k *KvStore) jobFuncs() map[string]jobs.Func {
+	return map[string]jobs.Func{
+		JOB_ESTIMATE_COMPACTION: func(ctx context.Context, progress func(float64)) (interface{}, error) {
+			return k.estimateCompaction(ctx, progress)
+		},
+	}
+}
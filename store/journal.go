@@ -0,0 +1,94 @@
+package kvstore
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	LOG_FLUSHER      string = "log"
+	INDEX_FLUSHER    string = "index"
+	REASON_THRESHOLD string = "threshold"
+	REASON_INTERVAL  string = "interval"
+	REASON_WAITED    string = "writeThrough"
+	REASON_SHUTDOWN  string = "shutdown"
+)
+
+// FlushDecision records one flush of the log or index buffer, why it ran and
+// where in the data log it left off.
+type FlushDecision struct {
+	Time        time.Time     `json:"time"`
+	Flusher     string        `json:"flusher"`
+	Reason      string        `json:"reason"`
+	BatchSize   int           `json:"batchSize"`
+	Duration    time.Duration `json:"durationNs"`
+	FirstOffset int64         `json:"firstOffset"`
+	LastOffset  int64         `json:"lastOffset"`
+}
+
+// FlushJournal keeps the most recent flush decisions in a ring buffer. A nil
+// journal records nothing.
+type FlushJournal struct {
+	sync.Mutex
+	entries []FlushDecision
+	next    int
+	full    bool
+}
+
+func NewFlushJournal(size int) *FlushJournal {
+	if size <= 0 {
+		return nil
+	}
+
+	return &FlushJournal{sync.Mutex{}, make([]FlushDecision, size), 0, false}
+}
+
+func (f *FlushJournal) Record(decision FlushDecision) {
+	if f == nil {
+		return
+	}
+
+	f.Lock()
+	f.entries[f.next] = decision
+	f.next = (f.next + 1) % len(f.entries)
+	if f.next == 0 {
+		f.full = true
+	}
+	f.Unlock()
+}
+
+// Entries returns the recorded decisions oldest first.
+func (f *FlushJournal) Entries() []FlushDecision {
+	if f == nil {
+		return []FlushDecision{}
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	if !f.full {
+		return append([]FlushDecision{}, f.entries[:f.next]...)
+	}
+
+	entries := make([]FlushDecision, 0, len(f.entries))
+	entries = append(entries, f.entries[f.next:]...)
+	return append(entries, f.entries[:f.next]...)
+}
+
+func flushReason(ok bool, waited bool, ticked bool) string {
+	switch {
+	case !ok:
+		return REASON_SHUTDOWN
+	case waited:
+		return REASON_WAITED
+	case ticked:
+		return REASON_INTERVAL
+	}
+
+	return REASON_THRESHOLD
+}
+
+// FlushJournal returns the recent flush decisions, empty unless
+// Options.FlushJournalSize is set.
+func (k *KvStore) FlushJournal() []FlushDecision {
+	return k.journal.Entries()
+}
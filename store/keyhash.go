@@ -0,0 +1,116 @@
+package kvstore
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"math/bits"
+)
+
+// Index key schemes recorded in the manifest.
+const (
+	INDEX_KEYS_PARTIAL  string = ""
+	INDEX_KEYS_XXHASH64 string = "xxhash64"
+)
+
+// EMPTY_INDEX_KEY is the index key of the empty key, an empty index key
+// means no key to the caches.
+const EMPTY_INDEX_KEY string = `""`
+
+// indexKey is the key the index files key under, its first 15 characters
+// or with Options.IndexKeyHash its xxhash64. Keys sharing an index key are
+// told apart by reading their records, either way.
+func (o Options) indexKey(key string) string {
+	if !o.IndexKeyHash && key == "" {
+		return EMPTY_INDEX_KEY
+	}
+	if !o.IndexKeyHash {
+		return getPartialKey(key)
+	}
+
+	return hashIndexKey(key)
+}
+
+func (o Options) indexKeys() string {
+	if o.IndexKeyHash {
+		return INDEX_KEYS_XXHASH64
+	}
+
+	return INDEX_KEYS_PARTIAL
+}
+
+// hashIndexKey is the xxhash64 of key in 11 characters of unpadded
+// base64, safe in the JSON and CSV index files.
+func hashIndexKey(key string) string {
+	var sum [8]byte
+	binary.BigEndian.PutUint64(sum[:], xxhash64([]byte(key)))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// The XXH64 primes are variables so the sums of them wrap at run time.
+var (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// xxhash64 is the XXH64 hash of data with a zero seed.
+func xxhash64(data []byte) uint64 {
+	n := len(data)
+	var h uint64
+	if n >= 32 {
+		v1 := xxPrime1 + xxPrime2
+		v2 := xxPrime2
+		v3 := uint64(0)
+		v4 := -xxPrime1
+		for ; len(data) >= 32; data = data[32:] {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(data[0:8]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(data[8:16]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(data[16:24]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(data[24:32]))
+		}
+
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) +
+			bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = xxPrime5
+	}
+
+	h += uint64(n)
+	for ; len(data) >= 8; data = data[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(data))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(data) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(data)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		data = data[4:]
+	}
+	for _, b := range data {
+		h ^= uint64(b) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func xxRound(acc uint64, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc uint64, value uint64) uint64 {
+	acc ^= xxRound(0, value)
+	return acc*xxPrime1 + xxPrime4
+}
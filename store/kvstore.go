@@ -1,22 +1,31 @@
 package kvstore
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/csv"
-	"encoding/json"
 	"errors"
 	"fmt"
-	log "github.com/sirupsen/logrus"
+	"github.com/shimanekb/project1-C/jobs"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 const (
 	INDEX_FLUSH_THRESHOLD int    = 100
 	LOG_FLUSH_THRESHOLD   int    = 10
+	WRITE_LOCK_STRIPES    int    = 256
 	STORAGE_DIR           string = "storage"
 	STORAGE_FILE          string = "data_records.csv"
 	INDEX_FILE            string = "index_file.json"
@@ -24,10 +33,19 @@ const (
 	GET_COMMAND           string = "get"
 	PUT_COMMAND           string = "put"
 	DEL_COMMAND           string = "del"
+	FLUSH_COMMAND         string = "flush"
+	SYNC_COMMAND          string = "sync"
 	TOMB_FLAG             string = "Tomb"
+	PUT_FLAG              string = ""
+	BINARY_FLAG           string = "B64"
 )
 
-var flushLock sync.RWMutex = sync.RWMutex{}
+var ErrKeyNotFound error = errors.New("Unable to read key value.")
+var ErrStoreClosed error = errors.New("Store has been shut down.")
+var ErrNotInIndex error = errors.New("Offsets not in index!.")
+var ErrKeyTooLarge error = errors.New("Key is larger than the maximum key size.")
+var ErrValueTooLarge error = errors.New("Value is larger than the maximum value size.")
+var ErrReadOnly error = errors.New("Store is read only.")
 
 type Index struct {
 	LastOffset int64       `json:"lastOffset"`
@@ -49,15 +67,34 @@ type Command struct {
 	Type  string
 	Key   string
 	Value string
+	// Checksum is the hex CRC-32C of Value stored with a put record.
+	Checksum string
+	Mode     WriteMode
+	// Done receives the flush result for write through commands.
+	Done chan error
+	// Expires is when a put expires in unix nanoseconds, zero for never.
+	Expires int64
+	// Operation is the operation ID a PutOnce or DelOnce was made under.
+	Operation string
 }
 
 type KvPair struct {
 	Key    string
 	Tomb   bool
 	Offset int64
+	// Done marks a request, with an empty Key, to the index flusher. It
+	// checkpoints the index at once when Checkpoint is set, otherwise it
+	// only confirms the pairs before it were taken in. Done receives the
+	// result.
+	Done       chan error
+	Checkpoint bool
 }
 
-// Add error if shutdown.
+// KvStore is safe to use from many goroutines. Writes of one key are
+// ordered: the value cache, secondary indexes and data log see them in the
+// order their Put or Del calls took the key's write lock, and a Get sees a
+// write as soon as its call has returned. Writes of different keys do not
+// wait on each other.
 type KvStore struct {
 	LastLineOffset     int64
 	Cache              Cache
@@ -65,85 +102,601 @@ type KvStore struct {
 	indexBufferChannel chan KvPair
 	logBufferChannel   chan Command
 	shutdownChannel    chan bool
+	options            Options
+	pending            *PendingCommands
+	closeLock          sync.RWMutex
+	closed             bool
+	negativeCache      Cache
+	jobs               *jobs.Manager
+	state              int32
+	recovered          chan struct{}
+	indexLock          sync.RWMutex
+	secondaryIndexes   map[string]*SecondaryIndex
+	journal            *FlushJournal
+	watchers           *Watchers
+	identity           Identity
+	writeLocks         []sync.Mutex
+	prefixes           *prefixTracker
+	lock               *os.File
+	// flushers is how many of the log and index flushers are running.
+	flushers int32
+	versions *VersionIndex
+	expiries *ExpiryIndex
+	// stopJanitor stops the expiry janitor on shutdown, syncJanitor takes
+	// a channel it closes once done with the keys it was expiring.
+	stopJanitor chan struct{}
+	syncJanitor chan chan struct{}
+	quota       *diskQuota
+	operations  *OperationIds
+	// drained is closed once a shutdown has saved everything and released
+	// the storage directory.
+	drained chan struct{}
 }
 
-func (k *KvStore) Shutdown() {
+// Dir is the directory the store keeps its files in.
+func (k *KvStore) Dir() string {
+	return k.options.Dir
+}
+
+func (k *KvStore) Shutdown() error {
+	return k.ShutdownTimeout(k.options.ShutdownTimeout)
+}
+
+// ShutdownTimeout drains the log and index buffers, waiting at most timeout
+// for them to reach disk. A zero timeout waits until everything is saved.
+// When it times out the store stays STATE_DRAINING until the flushers are
+// done, then it is closed and its directory unlocked in the background.
+// Calling ShutdownTimeout again meanwhile waits for that once more, after
+// that it fails with ErrStoreClosed.
+func (k *KvStore) ShutdownTimeout(timeout time.Duration) error {
+	k.closeLock.Lock()
+	if k.closed {
+		k.closeLock.Unlock()
+		if k.State() == STATE_CLOSED {
+			return ErrStoreClosed
+		}
+		return k.awaitDrained(timeout)
+	}
+	k.closed = true
+	k.setState(STATE_DRAINING)
+	close(k.stopJanitor)
 	close(k.logBufferChannel)
-	log.Info("Shutting down kvStore saving any remaining data.")
-	<-k.shutdownChannel
-	log.Info("All data saved.")
+	k.closeLock.Unlock()
+	k.jobs.CancelAll()
+	k.options.Logger.Info("Shutting down kvStore saving any remaining data.")
+
+	go func() {
+		<-k.shutdownChannel
+		k.saveIndexes()
+		k.closeIndex()
+		k.setState(STATE_CLOSED)
+		unlockDir(k.lock)
+		k.options.Logger.Info("All data saved.")
+		close(k.drained)
+	}()
+
+	return k.awaitDrained(timeout)
+}
+
+// awaitDrained waits at most timeout, or forever when it is zero, for a
+// shutdown to finish.
+func (k *KvStore) awaitDrained(timeout time.Duration) error {
+	if timeout <= 0 {
+		<-k.drained
+		return nil
+	}
+
+	select {
+	case <-k.drained:
+		return nil
+	case <-time.After(timeout):
+		err := &ShutdownTimeoutError{k.pending.Snapshot()}
+		k.options.Logger.Error(err)
+		return err
+	}
+}
+
+type StoreCacheStats struct {
+	Cache         CacheStats `json:"cache"`
+	IndexCache    CacheStats `json:"indexCache"`
+	NegativeCache CacheStats `json:"negativeCache"`
+}
+
+// CacheStats reports hit and eviction counts for the value cache and the
+// partial key index cache.
+func (k *KvStore) CacheStats() StoreCacheStats {
+	stats := StoreCacheStats{k.Cache.Stats(), k.IndexCache.Stats(), CacheStats{}}
+	if k.negativeCache != nil {
+		stats.NegativeCache = k.negativeCache.Stats()
+	}
+
+	return stats
 }
 
 func (k *KvStore) Put(key string, value string) error {
+	return k.PutWithMode(key, value, k.options.WriteMode)
+}
+
+// PutWithMode writes a key using mode instead of the store's WriteMode, so
+// single writes can wait for the data log even in a write back store.
+func (k *KvStore) PutWithMode(key string, value string, mode WriteMode) error {
+	if k.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return k.put(context.Background(), key, value, mode, formatChecksum(Checksum([]byte(value))), 0, "")
+}
+
+// PutContext is Put with a context, which parents its trace span and bounds
+// the wait for recovery.
+func (k *KvStore) PutContext(ctx context.Context, key string, value string) error {
+	if k.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return k.put(ctx, key, value, k.options.WriteMode, formatChecksum(Checksum([]byte(value))), 0, "")
+}
+
+func (k *KvStore) put(ctx context.Context, key string, value string, mode WriteMode,
+	checksum string, expires int64, operation string) (err error) {
+	ctx, span := k.startOp(ctx, SPAN_PUT, key)
+	defer func() { endSpan(span, err) }()
+
+	if err := k.awaitWriteRecovery(ctx); err != nil {
+		return err
+	}
+
+	k.closeLock.RLock()
+	if k.closed {
+		k.closeLock.RUnlock()
+		return ErrStoreClosed
+	}
+
+	key = k.normalizeKey(key)
+	if err := k.checkSize(key, value); err != nil {
+		k.closeLock.RUnlock()
+		return err
+	}
+
+	if err := k.checkQuota(key, value); err != nil {
+		k.closeLock.RUnlock()
+		return err
+	}
+
+	if err := k.pending.reserve(k.options.Backpressure, k.options.WriteBufferTimeout); err != nil {
+		k.closeLock.RUnlock()
+		return err
+	}
+
+	k.countWrite(key)
+	unlock := k.lockWrite(key)
 	k.Cache.Add(key, value)
-	k.logBufferChannel <- Command{PUT_COMMAND, key, value}
+	if k.negativeCache != nil {
+		k.negativeCache.Remove(key)
+	}
+	k.expiries.set(key, expires)
+	done := k.enqueue(Command{PUT_COMMAND, key, value, checksum, mode, nil, expires, operation})
+	k.closeLock.RUnlock()
+	k.updateIndexes(key, &value)
+	unlock()
+
+	return waitForWrite(done)
+}
+
+// lockWrite serializes writes of key, so two writers cannot leave the cache
+// holding one value and the data log the other.
+func (k *KvStore) lockWrite(key string) func() {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	stripe := &k.writeLocks[hash.Sum32()%uint32(len(k.writeLocks))]
+	stripe.Lock()
+	return stripe.Unlock
+}
+
+func (k *KvStore) checkSize(key string, value string) error {
+	if Size(len(key)) > k.options.MaxKeySize {
+		return ErrKeyTooLarge
+	}
+
+	if Size(len(value)) > k.options.MaxValueSize {
+		return ErrValueTooLarge
+	}
 
 	return nil
 }
 
-func ReadGet(path string, key string, offsets []int64) (string, string, error) {
-	for _, off := range offsets {
-		k, v, err := ReadKvItem(path, off)
+// PutBytes stores an arbitrary byte value, values with line breaks or
+// invalid UTF-8 are base64 encoded in the data log.
+func (k *KvStore) PutBytes(key string, value []byte) error {
+	return k.Put(key, string(value))
+}
+
+// enqueue buffers a command for the log flusher, returning the channel its
+// flush result arrives on for write through modes.
+func (k *KvStore) enqueue(command Command) chan error {
+	if command.Mode != WRITE_BACK {
+		command.Done = make(chan error, 1)
+	}
+
+	k.pending.Add(command)
+	k.logBufferChannel <- command
+	return command.Done
+}
+
+// Flush writes every command buffered before it to the data log and syncs
+// the log, so a write back store can make its writes durable on demand.
+func (k *KvStore) Flush() error {
+	return k.flushBuffer(context.Background(), WRITE_THROUGH_SYNC)
+}
+
+// flushBuffer has the log flusher write out its buffer, syncing it when mode
+// is WRITE_THROUGH_SYNC, and waits until it has or ctx is done.
+func (k *KvStore) flushBuffer(ctx context.Context, mode WriteMode) error {
+	return k.signalLog(ctx, Command{FLUSH_COMMAND, "", "", "", mode, nil, 0, ""})
+}
+
+// syncLog waits until the log flusher has taken in the commands already
+// buffered, without flushing them.
+func (k *KvStore) syncLog(ctx context.Context) error {
+	return k.signalLog(ctx, Command{SYNC_COMMAND, "", "", "", WRITE_BACK, nil, 0, ""})
+}
+
+// signalLog sends a flush or sync command to the log flusher and waits for
+// its answer.
+func (k *KvStore) signalLog(ctx context.Context, command Command) error {
+	if err := k.awaitRecovery(ctx); err != nil {
+		return err
+	}
+
+	k.closeLock.RLock()
+	if k.closed {
+		k.closeLock.RUnlock()
+		return ErrStoreClosed
+	}
+
+	// The command marks a point in the buffer, it is not pending.
+	command.Done = make(chan error, 1)
+	select {
+	case k.logBufferChannel <- command:
+	case <-ctx.Done():
+		k.closeLock.RUnlock()
+		return ctx.Err()
+	}
+	k.closeLock.RUnlock()
+
+	select {
+	case err := <-command.Done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flushIndexBuffer has the index flusher checkpoint the index, after the
+// pairs already buffered, and waits until it has or ctx is done. Commands
+// still in the log buffer are not in it, flushBuffer first to include them.
+func (k *KvStore) flushIndexBuffer(ctx context.Context) error {
+	return k.signalIndex(ctx, true)
+}
+
+// syncIndex waits until the index flusher has taken in the pairs already
+// buffered, without flushing them.
+func (k *KvStore) syncIndex(ctx context.Context) error {
+	return k.signalIndex(ctx, false)
+}
+
+func (k *KvStore) signalIndex(ctx context.Context, checkpoint bool) error {
+	if err := k.awaitRecovery(ctx); err != nil {
+		return err
+	}
+
+	k.closeLock.RLock()
+	if k.closed {
+		k.closeLock.RUnlock()
+		return ErrStoreClosed
+	}
+
+	done := make(chan error, 1)
+	select {
+	case k.indexBufferChannel <- KvPair{"", false, 0, done, checkpoint}:
+	case <-ctx.Done():
+		k.closeLock.RUnlock()
+		return ctx.Err()
+	}
+	k.closeLock.RUnlock()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func waitForWrite(done chan error) error {
+	if done == nil {
+		return nil
+	}
+
+	return <-done
+}
+
+// ReadGet scans the offsets of a partial key bucket for the full key. Offsets
+// are visited in file order through one read-ahead buffer, so records close
+// to each other are read without seeking again.
+func ReadGet(path string, key string, offsets []int64, readAhead int) (string, string, error) {
+	value, _, err := readGet(FileBackend{}, path, key, offsets, readAhead)
+	if err != nil {
+		return "", "", err
+	}
+
+	return key, value, nil
+}
+
+// readGet finds key among the records at offsets, returning its value and
+// stored checksum.
+func readGet(backend Backend, path string, key string, offsets []int64,
+	readAhead int) (value string, checksum string, err error) {
+	storeFile, openErr := backend.Open(path)
+	if openErr != nil {
+		return "", "", openErr
+	}
+	defer storeFile.Close()
+
+	sorted := make([]int64, len(offsets))
+	copy(sorted, offsets)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	reader := bufio.NewReaderSize(storeFile, readAhead)
+	var position int64 = -1
+	for _, off := range sorted {
+		skip := off - position
+		if position >= 0 && skip >= 0 && skip <= int64(reader.Buffered()) {
+			reader.Discard(int(skip))
+		} else {
+			if _, err := storeFile.Seek(off, io.SeekStart); err != nil {
+				return "", "", err
+			}
+			reader.Reset(storeFile)
+		}
+
+		k, v, sum, length, err := readKvRecord(reader)
 		if err != nil {
 			return "", "", err
 		}
+		position = off + int64(length)
 
 		if k == key {
-			value := fmt.Sprintf("%v", v)
-			return key, value, nil
+			return v, sum, nil
 		}
 	}
 
-	return "", "", errors.New("Unable to read key value.")
+	return "", "", ErrKeyNotFound
+}
+
+func (k *KvStore) GetBytes(key string) ([]byte, error) {
+	value, err := k.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(value), nil
+}
+
+func (k *KvStore) Get(key string) (string, error) {
+	ctx := context.Background()
+	if k.options.ReadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, k.options.ReadTimeout)
+		defer cancel()
+	}
+
+	return k.GetContext(ctx, key)
+}
+
+// GetContext reads a key, giving up on disk reads once ctx is done. Failed
+// disk reads are retried up to Options.ReadRetries times. Like an Iterator,
+// it layers unflushed commands over the data log, the newest write wins.
+func (k *KvStore) GetContext(ctx context.Context, key string) (value string, err error) {
+	ctx, span := k.startOp(ctx, SPAN_GET, key)
+	defer func() { endSpan(span, err) }()
+
+	return k.getContext(ctx, key, span)
 }
 
-func (k KvStore) Get(key string) (string, error) {
+func (k *KvStore) getContext(ctx context.Context, key string, span Span) (string, error) {
+	if k.options.LazyRecovery && k.State() == STATE_RECOVERING {
+		return k.getRecovering(ctx, key, span)
+	}
+	if err := k.awaitRecovery(ctx); err != nil {
+		return "", err
+	}
+
+	k.closeLock.RLock()
+	closed := k.closed
+	k.closeLock.RUnlock()
+	if closed {
+		return "", ErrStoreClosed
+	}
+
+	return k.read(ctx, k.normalizeKey(key), span)
+}
+
+// read looks up a normalized key in the write buffer, cache and data log,
+// once the store has recovered.
+func (k *KvStore) read(ctx context.Context, key string, span Span) (string, error) {
+	k.countRead(key)
+	if k.expiries.isExpired(key, k.options.Clock.Now()) {
+		span.SetAttribute("source", "expired")
+		return "", ErrNotInIndex
+	}
+	if cmd, ok := k.pending.Lookup(key); ok {
+		span.SetAttribute("source", SOURCE_PENDING)
+		if cmd.Type == DEL_COMMAND {
+			return "", ErrNotInIndex
+		}
+
+		return cmd.Value, nil
+	}
+
 	value, cacheOk := k.Cache.Get(key)
 
 	if cacheOk {
+		span.SetAttribute("source", SOURCE_CACHE)
 		return fmt.Sprintf("%v", value), nil
 	}
 
-	log.Infof("Read for key %s was not in cache, reading disk", key)
-	partialKey := getPartialKey(key)
-	flushLock.RLock()
+	if k.negativeCache != nil {
+		if _, missing := k.negativeCache.Get(key); missing {
+			return "", ErrNotInIndex
+		}
+	}
+
+	if k.options.logs(LOG_GET_MISS) {
+		k.options.Logger.Debugf("Read for key %s was not in cache, reading disk", key)
+	}
+	partialKey := k.options.indexKey(key)
+	unlock := rlockIndexKey(k.IndexCache, partialKey)
 	offsets, ok := k.IndexCache.Get(partialKey)
-	flushLock.RUnlock()
+	unlock()
 
 	if !ok {
-		return "", errors.New("Offsets not in index!.")
+		k.rememberMissing(key)
+		return "", ErrNotInIndex
 	}
-	offs, check := offsets.([]int64)
+	offs, check := unpackOffsets(offsets)
 	if !check {
 		return "", errors.New("Offset is in inproper format.")
 	}
+	span.SetAttribute("source", SOURCE_DISK)
+	span.SetAttribute("offsets", offs)
+
+	path := k.options.path(STORAGE_FILE)
+	var v, checksum string
+	var err error
+	for attempt := 0; attempt <= k.options.ReadRetries; attempt++ {
+		v, checksum, err = readGetContext(ctx, k.options.Backend, path, key, offs,
+			int(k.options.ReadAheadSize),
+			k.options.ReadWorkers)
+		if err == nil || err == ErrKeyNotFound || ctx.Err() != nil {
+			break
+		}
+
+		k.options.Logger.Infof("Disk read for key %s failed, attempt %d: %v", key, attempt+1, err)
+	}
+
+	if err == ErrKeyNotFound {
+		k.rememberMissing(key)
+	}
+
+	if err != nil {
+		return "", err
+	}
 
-	path := filepath.Join(".", STORAGE_DIR)
-	path = filepath.Join(path, STORAGE_FILE)
-	_, v, err := ReadGet(path, key, offs)
+	v, err = decryptValue(k.options.Encryption, v)
 	if err != nil {
 		return "", err
 	}
 
+	if err := verifyChecksum(v, checksum); err != nil {
+		k.options.Logger.Errorf("Value of key %s failed its checksum: %v", key, err)
+		return "", err
+	}
+
 	return v, nil
 }
 
+func (k *KvStore) rememberMissing(key string) {
+	if k.negativeCache != nil {
+		k.negativeCache.Add(key, true)
+	}
+}
+
+func readGetContext(ctx context.Context, backend Backend, path string, key string, offsets []int64,
+	readAhead int, workers int) (string, string, error) {
+	type result struct {
+		value    string
+		checksum string
+		err      error
+	}
+
+	results := make(chan result, 1)
+	go func() {
+		v, sum, err := readGetParallel(backend, path, key, offsets, readAhead, workers)
+		results <- result{v, sum, err}
+	}()
+
+	select {
+	case res := <-results:
+		return res.value, res.checksum, res.err
+	case <-ctx.Done():
+		return "", "", ctx.Err()
+	}
+}
+
 func (k *KvStore) Del(key string) error {
+	if k.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return k.del(context.Background(), key, k.options.WriteMode, 0, "")
+}
+
+// DelContext is Del with a context, like PutContext.
+func (k *KvStore) DelContext(ctx context.Context, key string) error {
+	if k.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return k.del(ctx, key, k.options.WriteMode, 0, "")
+}
+
+// del deletes key. A non-zero guard only deletes it while it still expires
+// at guard, so the expiry janitor cannot delete a key written again since
+// its scan.
+func (k *KvStore) del(ctx context.Context, key string, mode WriteMode, guard int64,
+	operation string) (err error) {
+	ctx, span := k.startOp(ctx, SPAN_DEL, key)
+	defer func() { endSpan(span, err) }()
+
+	if err := k.awaitWriteRecovery(ctx); err != nil {
+		return err
+	}
+
+	k.closeLock.RLock()
+	if k.closed {
+		k.closeLock.RUnlock()
+		return ErrStoreClosed
+	}
+
+	if err := k.pending.reserve(k.options.Backpressure, k.options.WriteBufferTimeout); err != nil {
+		k.closeLock.RUnlock()
+		return err
+	}
+
+	key = k.normalizeKey(key)
+	k.countWrite(key)
+	unlock := k.lockWrite(key)
+	if guard != 0 && k.expiries.get(key) != guard {
+		unlock()
+		k.pending.release()
+		k.closeLock.RUnlock()
+		return errExpiryChanged
+	}
+	k.expiries.set(key, 0)
 	k.Cache.Remove(key)
-	RemoveIndexItem(k.IndexCache, key)
-	offsets, ok := k.IndexCache.Get(getPartialKey(key))
-	if ok {
-		offs, ok := offsets.([]int64)
-		if len(offs) > 0 && ok {
-			log.Infof("After removing off for key %s, %d", key, offs[0])
-		} else if ok {
-			log.Infof("After removing off for key %s, %d", key, -1)
-		}
+	if k.negativeCache != nil {
+		k.negativeCache.Add(key, true)
+	}
+	if k.options.logs(LOG_WRITE) {
+		k.options.Logger.Debugf("Delete called for key %s", key)
 	}
-	log.Infof("Delete called for key %s", key)
-	k.logBufferChannel <- Command{DEL_COMMAND, key, ""}
+	done := k.enqueue(Command{DEL_COMMAND, key, "", "", mode, nil, 0, operation})
+	k.closeLock.RUnlock()
+	k.updateIndexes(key, nil)
+	unlock()
 
-	return nil
+	return waitForWrite(done)
 }
 
 func getPartialKey(key string) string {
@@ -155,89 +708,304 @@ func getPartialKey(key string) string {
 	return partialKey
 }
 
-func NewKvStore() *KvStore {
-	log.Info("Creating new Kv Store.")
+// NewKvStore opens the store kept in dir, tuned by opts on top of
+// DefaultOptions.
+func NewKvStore(dir string, opts ...Option) *KvStore {
+	return NewKvStoreWithOptions(applyOptions(dir, opts))
+}
+
+func OpenKvStore(dir string, opts ...Option) (*KvStore, error) {
+	return OpenKvStoreWithOptions(applyOptions(dir, opts))
+}
+
+func applyOptions(dir string, opts []Option) Options {
+	options := DefaultOptions()
+	options.Dir = dir
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return options
+}
+
+// NewKvStoreWithOptions opens a store like OpenKvStoreWithOptions, exiting
+// when it cannot.
+func NewKvStoreWithOptions(opts Options) *KvStore {
+	k, err := OpenKvStoreWithOptions(opts)
+	if err != nil {
+		if opts.Logger == nil {
+			opts.Logger = NopLogger{}
+		}
+		opts.Logger.Fatal("Could not open kv store. ", err)
+	}
+
+	return k
+}
+
+// OpenKvStoreWithOptions opens the store in opts.Dir, returning
+// ErrStoreLocked when another store, in this process or another, has it
+// open.
+func OpenKvStoreWithOptions(opts Options) (*KvStore, error) {
+	if opts.Logger == nil {
+		opts.Logger = NopLogger{}
+	}
+	opts.sampler = newLogSampler(opts.LogSampling)
+
+	opts.Logger.Info("Creating new Kv Store.")
+
+	if opts.Dir == "" {
+		opts.Dir = DEFAULT_DIR
+	}
+
+	if opts.Encryption == nil {
+		opts.Encryption = NoEncryption{}
+	}
+
+	if opts.IndexCodec == nil {
+		opts.IndexCodec = JsonIndexCodec{}
+	}
+
+	if opts.Clock == nil {
+		opts.Clock = RealClock{}
+	}
+
+	if opts.Backend == nil {
+		opts.Backend = FileBackend{}
+	}
+
+	if opts.CacheSize <= 0 {
+		opts.CacheSize = DEFAULT_CACHE_SIZE
+	}
+
+	if opts.ReadAheadSize <= 0 {
+		opts.ReadAheadSize = DEFAULT_READ_AHEAD_SIZE
+	}
+
+	if opts.FlushWorkers <= 0 {
+		opts.FlushWorkers = defaultWorkers()
+	}
+
+	if opts.CompactionWorkers <= 0 {
+		opts.CompactionWorkers = defaultCompactionWorkers()
+	}
+
+	if opts.ReadWorkers <= 0 {
+		opts.ReadWorkers = defaultWorkers()
+	}
+
+	if opts.MaxKeySize <= 0 {
+		opts.MaxKeySize = DEFAULT_MAX_KEY_SIZE
+	}
+
+	if opts.MaxValueSize <= 0 {
+		opts.MaxValueSize = DEFAULT_MAX_VALUE_SIZE
+	}
 
-	log.Info("Creating storage directory if does not exist.")
-	newpath := filepath.Join(".", STORAGE_DIR)
+	opts.Logger.Info("Creating storage directory if does not exist.")
+	newpath := opts.Dir
 	err := os.MkdirAll(newpath, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	opts.Logger.Info("Created storage directory.")
 
+	lock, err := lockDir(newpath)
 	if err != nil {
-		log.Fatalf("Cannot create directory for storage at %s", STORAGE_DIR)
+		return nil, err
 	}
-	log.Info("Created storage directory.")
 
-	indexCache, cErr := NewSimpleCache()
-	if cErr != nil {
-		log.Fatal("Could not create cache for kv store.")
+	manifest, err := checkManifest(newpath, opts)
+	if err != nil {
+		unlockDir(lock)
+		return nil, err
 	}
+	identity := Identity{manifest.Uuid, newpath, manifest.Version}
+	opts.Logger = withIdentity(opts.Logger, identity)
 
-	path := filepath.Join(".", STORAGE_DIR)
-	path = filepath.Join(path, STORAGE_FILE)
-	offset, loadErr := LoadIndex(indexCache)
+	if opts.MaxLogSize > 0 || len(manifest.Segments) > 0 {
+		opts.Backend = newSegmentedLog(opts, manifest.Segments)
+	} else if opts.MaxDiskSize > 0 && opts.QuotaPolicy == QUOTA_RECLAIM {
+		opts.Logger.Info("Data log does not rotate, the disk quota can only refuse writes.")
+	}
 
-	if loadErr != nil {
-		log.Fatal("Could not load data into offset cache.")
+	indexCache, err := NewShardedCache(opts.IndexShards)
+	if err != nil {
+		unlockDir(lock)
+		return nil, err
+	}
+	if opts.IndexMemoryBudget > 0 || opts.SparseIndexInterval > 0 {
+		if _, plain := opts.Encryption.(NoEncryption); plain {
+			indexCache = NewTableIndex(opts.IndexMemoryBudget, opts.SparseIndexInterval)
+		} else {
+			opts.Logger.Info("Encrypted indexes are loaded whole, ignoring the index memory budget.")
+		}
+	}
+
+	cache, err := NewPolicyCache(opts.CachePolicy, opts.CacheSize,
+		int64(opts.CacheMaxBytes))
+	if err != nil {
+		unlockDir(lock)
+		return nil, err
+	}
+	var negativeCache Cache
+	if opts.NegativeCacheSize > 0 {
+		negativeCache, err = NewPolicyCache(LRU_POLICY, opts.NegativeCacheSize, 0)
+		if err != nil {
+			unlockDir(lock)
+			return nil, err
+		}
 	}
 
-	cache, _ := NewLruCache()
 	indexBuffer := make(chan KvPair, INDEX_FLUSH_THRESHOLD)
 	logBuffer := make(chan Command, LOG_FLUSH_THRESHOLD)
-	done := make(chan bool)
+	done := make(chan bool, 1)
+	pending := newBoundedPendingCommands(opts.WriteBufferSize)
+
+	k := &KvStore{0, cache, indexCache, indexBuffer, logBuffer, done,
+		opts, pending, sync.RWMutex{}, false, negativeCache,
+		jobs.NewManager(opts.JobHistorySize), int32(STATE_RECOVERING),
+		make(chan struct{}), sync.RWMutex{}, make(map[string]*SecondaryIndex),
+		NewFlushJournal(opts.FlushJournalSize), NewWatchers(), identity,
+		make([]sync.Mutex, WRITE_LOCK_STRIPES), newPrefixTracker(opts), lock, 0,
+		NewVersionIndex(opts.RetainVersions), newExpiryIndex(opts.ExpiryScanInterval),
+		make(chan struct{}), make(chan chan struct{}), newDiskQuota(opts),
+		newOperationIds(opts.OperationWindow), make(chan struct{})}
+
+	if opts.BackgroundRecovery || opts.LazyRecovery {
+		go k.recover()
+	} else {
+		k.recover()
+	}
+
+	return k, nil
+}
+
+func FlushIndex(initCache Cache, indexBuffer chan KvPair, done chan bool,
+	opts Options, journal *FlushJournal) {
+	flushIndex(initCache, indexBuffer, done, opts, journal, newFlushTicker(opts))
+}
 
-	go FlushLog(indexCache, logBuffer, indexBuffer)
-	go FlushIndex(indexCache, indexBuffer, done)
+// newFlushTicker ticks every FlushInterval, it is nil when periodic flushes
+// are off.
+func newFlushTicker(opts Options) Ticker {
+	if opts.FlushInterval <= 0 {
+		return nil
+	}
 
-	return &KvStore{offset, cache, indexCache, indexBuffer, logBuffer, done}
+	return opts.Clock.NewTicker(opts.FlushInterval)
 }
 
-func FlushIndex(initCache Cache, indexBuffer chan KvPair, done chan bool) {
-	path := filepath.Join(".", STORAGE_DIR)
+func flushIndex(initCache Cache, indexBuffer chan KvPair, done chan bool,
+	opts Options, journal *FlushJournal, ticker Ticker) {
+	path := opts.Dir
 	swap_path := filepath.Join(path, INDEX_SWAP_FILE)
 	path = filepath.Join(path, INDEX_FILE)
+	logPath := opts.path(INDEX_LOG_FILE)
 	var pairs []KvPair = make([]KvPair, 0, 100)
+	// The first flush writes a full checkpoint, taking in any index log
+	// left from before, and after that one every IndexLogBatches flushes.
+	batches := 0
+	flushedOffset := checkpointOffset(initCache, path, opts)
+	var tick <-chan time.Time
+	if ticker != nil {
+		defer ticker.Stop()
+		tick = ticker.C()
+	}
+
 	for {
-		kvPair, ok := <-indexBuffer
-		pairs = append(pairs, kvPair)
+		ok, ticked := true, false
+		var requested chan error
+		select {
+		case kvPair, open := <-indexBuffer:
+			ok = open
+			if ok && kvPair.Done != nil && !kvPair.Checkpoint {
+				kvPair.Done <- nil
+				continue
+			}
+			if ok && kvPair.Done != nil {
+				requested = kvPair.Done
+			} else if ok {
+				pairs = append(pairs, kvPair)
+			}
+		case <-tick:
+			ticked = true
+		}
 
-		if len(pairs) == INDEX_FLUSH_THRESHOLD || !ok {
-			log.Info("Creating checkpoint for index.")
+		if len(pairs) == INDEX_FLUSH_THRESHOLD || !ok || (ticked && len(pairs) > 0) ||
+			requested != nil {
+			opts.Logger.Info("Creating checkpoint for index.")
+			start := opts.Clock.Now()
+			_, span := opts.startSpan(context.Background(), SPAN_FLUSH_INDEX)
+			span.SetAttribute("pairs", len(pairs))
 
 			if fileExists(swap_path) {
-				log.Info("Swap file for index detected removing before creating new tmp index.")
+				opts.Logger.Info("Swap file for index detected removing before creating new tmp index.")
 				err := os.Remove(swap_path)
 
 				if err != nil {
-					log.Fatal("Could not delete detected swap index file.")
+					opts.Logger.Fatal("Could not delete detected swap index file.")
 				}
 			}
 
-			lastOffset, _ := LoadIndexJson(initCache, path)
+			previousOffset := flushedOffset
+			lastOffset := previousOffset
 			for _, pair := range pairs {
-				if !pair.Tomb && pair.Key != "" {
+				if !pair.Tomb {
 					lastOffset = pair.Offset
 				}
 			}
 
-			err := WriteIndex(lastOffset, initCache, swap_path)
-			if err != nil {
-				log.Fatal("Could not open swap temp index file.")
-			}
+			retainFrom := retentionFloor(initCache, opts)
+			batchSize := len(pairs)
+			checkpoint := batches == 0 || batches >= opts.IndexLogBatches || requested != nil
+			span.SetAttribute("checkpoint", checkpoint)
+			if !checkpoint {
+				opts.Logger.Info("Appending changes to index log.")
+				err := appendIndexLog(logPath, lastOffset, changedKeys(pairs, opts), initCache, opts)
+				if err != nil {
+					opts.Logger.Fatal("Could not append to index log. ", err)
+				}
+				batches++
+			} else {
+				err := WriteIndex(lastOffset, initCache, swap_path, opts)
+				if err != nil {
+					opts.Logger.Fatal("Could not open swap temp index file.")
+				}
 
-			pairs = make([]KvPair, 0, 100)
+				if err := removeIndexLog(opts.Dir); err != nil {
+					opts.Logger.Fatal("Could not remove index log. ", err)
+				}
 
-			log.Info("Swapping index file.")
-			err = os.Rename(swap_path, path)
+				opts.Logger.Info("Swapping index file.")
+				err = replaceIndex(swap_path, path)
 
-			if err != nil {
-				log.Fatal("Could not swap index.")
-			}
+				if err != nil {
+					opts.Logger.Fatal("Could not swap index.")
+				}
 
-			log.Info("index items flushed")
+				if table, ok := initCache.(*TableIndex); ok {
+					if err := table.swap(path); err != nil {
+						opts.Logger.Fatal("Could not open swapped index table. ", err)
+					}
+				}
+				batches = 1
+			}
+			pairs = make([]KvPair, 0, 100)
+			flushedOffset = lastOffset
+
+			journal.Record(FlushDecision{start, INDEX_FLUSHER,
+				flushReason(ok, requested != nil, ticked), batchSize, opts.Clock.Now().Sub(start),
+				previousOffset, lastOffset})
+			span.End()
+			applyRetention(retainFrom, lastOffset, opts)
+			opts.Logger.Info("index items flushed")
+			if requested != nil {
+				requested <- nil
+			}
 		}
 
 		if !ok {
-			log.Info("Closing index flushing channel")
+			opts.Logger.Info("Closing index flushing channel")
 			done <- true
 			break
 		}
@@ -245,115 +1013,330 @@ func FlushIndex(initCache Cache, indexBuffer chan KvPair, done chan bool) {
 
 }
 
-func WriteIndex(maxOffset int64, indexCache Cache, filepath string) error {
-	index := Index{maxOffset, make([]KeyOffset, 0, len(indexCache.Keys()))}
+func WriteIndex(maxOffset int64, indexCache Cache, filepath string,
+	opts Options) error {
+	if table, ok := indexCache.(*TableIndex); ok {
+		return table.writeTable(filepath, maxOffset)
+	}
 
-	log.Infof("Last offset is %d", maxOffset)
-	for _, key := range indexCache.Keys() {
+	keys := indexCache.Keys()
+	index := Index{maxOffset, make([]KeyOffset, 0, len(keys))}
+
+	opts.Logger.Infof("Last offset is %d", maxOffset)
+	for _, key := range keys {
 		if key != "" {
 			value, _ := indexCache.Get(key)
-			offsetValue, _ := value.([]int64)
+			offsetValue, _ := unpackOffsets(value)
 			keyOffset := KeyOffset{key, offsetValue}
 			index.KeyOffsets = append(index.KeyOffsets, keyOffset)
 
 		}
 	}
 
-	file, err := json.MarshalIndent(index, "", " ")
+	file, err := EncodeIndex(opts.IndexCodec, index)
 	if err != nil {
-		log.Fatal("Could not open swap temp index file.")
+		opts.Logger.Fatal("Could not encode index.")
 		return err
 	}
 
-	write_err := ioutil.WriteFile(filepath, file, 0644)
+	file, err = opts.Encryption.Encrypt(file)
+	if err != nil {
+		opts.Logger.Fatal("Could not encrypt index.")
+		return err
+	}
+
+	write_err := writeCheckpoint(filepath, file)
 
 	if write_err != nil {
-		log.Fatal("Unable to write cache (index) offset to start.")
+		opts.Logger.Fatal("Unable to write cache (index) offset to start.")
 		return write_err
 	}
 
 	return nil
 }
 
-func FlushLog(indexCache Cache, logBuffer chan Command, indexBuffer chan KvPair) {
-	path := filepath.Join(".", STORAGE_DIR)
-	path = filepath.Join(path, STORAGE_FILE)
+func FlushLog(indexCache Cache, logBuffer chan Command, indexBuffer chan KvPair,
+	opts Options, pending *PendingCommands, journal *FlushJournal,
+	watchers *Watchers, versions *VersionIndex) {
+	flushLog(indexCache, logBuffer, indexBuffer, opts, pending, journal, watchers, versions,
+		newFlushTicker(opts))
+}
+
+func flushLog(indexCache Cache, logBuffer chan Command, indexBuffer chan KvPair,
+	opts Options, pending *PendingCommands, journal *FlushJournal,
+	watchers *Watchers, versions *VersionIndex, ticker Ticker) {
+	path := opts.path(STORAGE_FILE)
 	var commands []Command = make([]Command, 0, 10)
+	var tick <-chan time.Time
+	if ticker != nil {
+		defer ticker.Stop()
+		tick = ticker.C()
+	}
+
 	for {
-		command, ok := <-logBuffer
-		commands = append(commands, command)
+		ok, ticked, waited := true, false, false
+		select {
+		case command, open := <-logBuffer:
+			ok = open
+			if ok && command.Type == SYNC_COMMAND {
+				command.Done <- nil
+				continue
+			}
+			if ok {
+				commands = append(commands, command)
+				waited = command.Mode != WRITE_BACK
+			}
+		case <-tick:
+			ticked = true
+		}
 
-		if len(commands) == LOG_FLUSH_THRESHOLD || !ok {
-			log.Infof("Log items flushing, threshold %d met or shutdown signal given.", LOG_FLUSH_THRESHOLD)
-			flushLock.Lock()
-			for _, cmd := range commands {
-				if cmd.Type == PUT_COMMAND {
-					offset, err := WritePut(path, cmd.Key, cmd.Value)
-					if err != nil {
-						log.Fatal("Could not flush log!")
-					}
+		if len(commands) == LOG_FLUSH_THRESHOLD || !ok || waited || (ticked && len(commands) > 0) {
+			opts.Logger.Infof("Log items flushing, threshold %d met, flush interval %v passed or shutdown signal given.",
+				LOG_FLUSH_THRESHOLD, opts.FlushInterval)
+			start := opts.Clock.Now()
+			_, span := opts.startSpan(context.Background(), SPAN_FLUSH_LOG)
+			firstOffset, lastOffset := int64(-1), int64(-1)
+			events := make([]Event, 0, len(commands))
+			values, encErr := encryptBatch(opts, commands)
+			if encErr != nil {
+				opts.Logger.Fatal("Could not encrypt value for log!")
+			}
 
-					AddIndexItem(indexCache, cmd.Key, offset)
-					indexBuffer <- KvPair{cmd.Key, false, offset}
+			records := make([][]byte, 0, len(commands))
+			for i, cmd := range commands {
+				var record []string
+				switch cmd.Type {
+				case PUT_COMMAND:
+					record = putRecord(cmd.Key, values[i], cmd.Checksum)
+				case DEL_COMMAND:
+					record = deleteRecord(cmd.Key, "")
+				default:
+					continue
 				}
+
+				line, err := formatRecord(operationRecord(expireRecord(stampRecord(record, start), cmd.Expires),
+					cmd.Operation))
+				if err != nil {
+					opts.Logger.Fatal("Could not flush log!")
+				}
+				records = append(records, line)
 			}
-			flushLock.Unlock()
+
+			offsets, err := appendRecords(opts.Backend, path, records, opts.MaxLogSize)
+			if err != nil {
+				opts.Logger.Fatal("Could not flush log!")
+			}
+
+			written := 0
 			for _, cmd := range commands {
-				if cmd.Type == DEL_COMMAND {
-					_, err := WritePut(path, cmd.Key, "")
+				if cmd.Type != PUT_COMMAND && cmd.Type != DEL_COMMAND {
+					continue
+				}
+				offset := offsets[written]
+				written++
+				if firstOffset < 0 {
+					firstOffset = offset
+				}
+				lastOffset = offset
 
-					if err != nil {
-						log.Fatal("Could not flush log!")
-					}
+				unlock := lockIndexKey(indexCache, opts.indexKey(cmd.Key))
+				if cmd.Type == PUT_COMMAND {
+					events = append(events, Event{PUT_COMMAND, cmd.Key, cmd.Value, offset, start,
+						cmd.Operation})
+					addIndexItem(indexCache, cmd.Key, offset, opts)
+					versions.put(cmd.Key, offset)
+					unlock()
+					indexBuffer <- KvPair{cmd.Key, false, offset, nil, false}
+				} else {
+					events = append(events, Event{DEL_COMMAND, cmd.Key, "", offset, start, cmd.Operation})
+					removeIndexItem(indexCache, cmd.Key, opts)
+					versions.remove(cmd.Key)
+					unlock()
+					indexBuffer <- KvPair{cmd.Key, true, 0, nil, false}
+				}
+			}
 
-					indexBuffer <- KvPair{cmd.Key, true, 0}
+			var syncErr error
+			for _, cmd := range commands {
+				if cmd.Mode == WRITE_THROUGH_SYNC {
+					syncErr = opts.Backend.Sync(path)
+					break
 				}
 			}
 
+			for _, cmd := range commands {
+				if cmd.Done != nil {
+					cmd.Done <- syncErr
+				}
+			}
+
+			pending.Done(written)
+			for _, event := range events {
+				watchers.Publish(event)
+			}
+			if written > 0 {
+				journal.Record(FlushDecision{start, LOG_FLUSHER,
+					flushReason(ok, waited, ticked), written,
+					opts.Clock.Now().Sub(start), firstOffset, lastOffset})
+			}
+			span.SetAttribute("records", written)
+			span.SetAttribute("reason", flushReason(ok, waited, ticked))
+			endSpan(span, syncErr)
+
 			commands = make([]Command, 0, 10)
-			log.Info("Log items flushed")
+			opts.Logger.Info("Log items flushed")
 		}
 
 		if !ok {
+			watchers.Close()
 			close(indexBuffer)
-			log.Info("Shutting down, closed indexBuffer channel.")
+			opts.Logger.Info("Shutting down, closed indexBuffer channel.")
 			break
 		}
 	}
 }
 
 func WriteDelete(filePath string, key string, value string) (offset int64, err error) {
-	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
-	defer file.Close()
+	return writeRecord(filePath, deleteRecord(key, value))
+}
+
+func deleteRecord(key string, value string) []string {
+	return []string{key, value, TOMB_FLAG}
+}
+
+// WritePut appends a put record, checksum is an optional fourth column
+// checked against the value when it is read back. Empty values always get a
+// checksum so they are not read as legacy deletes, see isTombstone.
+func WritePut(filePath string, key string, value string, checksum string) (offset int64, err error) {
+	return writeRecord(filePath, putRecord(key, value, checksum))
+}
+
+// putRecord lays out the fields of a put record, value is already encrypted.
+func putRecord(key string, value string, checksum string) []string {
+	if value == "" && checksum == "" {
+		checksum = formatChecksum(Checksum(nil))
+	}
+
+	flag := PUT_FLAG
+	if !lineSafe(value) {
+		value = base64.StdEncoding.EncodeToString([]byte(value))
+		flag = BINARY_FLAG
+	}
+
+	if checksum == "" {
+		return []string{key, value, flag}
+	}
+
+	return []string{key, value, flag, checksum}
+}
+
+// stampRecord appends the commit time of a flushed record as a fifth
+// column of unix nanoseconds, leaving the checksum column empty when the
+// record has none.
+func stampRecord(record []string, at time.Time) []string {
+	for len(record) < 4 {
+		record = append(record, "")
+	}
+
+	return append(record, strconv.FormatInt(at.UnixNano(), 10))
+}
+
+// recordTime is the commit time of a data log record, false for records
+// written before they were stamped.
+func recordTime(record []string) (time.Time, bool) {
+	if len(record) < 5 {
+		return time.Time{}, false
+	}
+
+	nanos, err := strconv.ParseInt(record[4], 10, 64)
 	if err != nil {
-		return 0, err
+		return time.Time{}, false
 	}
 
-	length, write_err := file.WriteString(fmt.Sprintf("%s,%s,%s\n", key, value, TOMB_FLAG))
-	fi, statErr := file.Stat()
-	if statErr != nil {
-		return 0, statErr
+	return time.Unix(0, nanos), true
+}
+
+// isTombstone is whether a data log record is a delete. Deletes used to be
+// written as empty puts, so a record of just key, empty value and empty flag
+// is one too, puts of empty values now carry a checksum.
+func isTombstone(record []string) bool {
+	if len(record) > 2 && record[2] == TOMB_FLAG {
+		return true
 	}
 
-	offset = fi.Size() - int64(length)
-	return offset, write_err
+	return len(record) == 3 && record[1] == "" && record[2] == PUT_FLAG
 }
 
-func WritePut(filePath string, key string, value string) (offset int64, err error) {
-	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
-	defer file.Close()
+// lineSafe is whether a value survives as a single csv line, the data log is
+// read back one line per record.
+func lineSafe(value string) bool {
+	return utf8.ValidString(value) && !strings.ContainsAny(value, "\r\n")
+}
+
+// writeRecord appends a key, value, flag record. The flag column alone marks
+// deletes, values are csv escaped so any string, including TOMB_FLAG, is a
+// legal value.
+func writeRecord(filePath string, record []string) (offset int64, err error) {
+	return appendRecord(FileBackend{}, filePath, record)
+}
+
+func appendRecord(backend Backend, path string, record []string) (offset int64, err error) {
+	line, err := formatRecord(record)
 	if err != nil {
 		return 0, err
 	}
 
-	length, write_err := file.WriteString(fmt.Sprintf("%s,%s,\n", key, value))
-	fi, statErr := file.Stat()
-	if statErr != nil {
-		return 0, statErr
+	return backend.Append(path, line)
+}
+
+// appendRecords writes a batch of formatted records with as few appends as
+// it can, returning the offset of each. A rotating log gets chunks of at
+// most limit bytes, so records still never span two segments.
+func appendRecords(backend Backend, path string, records [][]byte, limit Size) ([]int64, error) {
+	offsets := make([]int64, 0, len(records))
+	for len(records) > 0 {
+		n, length := 0, 0
+		for n < len(records) && (n == 0 || limit <= 0 || Size(length+len(records[n])) <= limit) {
+			length += len(records[n])
+			n++
+		}
+
+		chunk := make([]byte, 0, length)
+		for _, record := range records[:n] {
+			chunk = append(chunk, record...)
+		}
+
+		offset, err := backend.Append(path, chunk)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range records[:n] {
+			offsets = append(offsets, offset)
+			offset += int64(len(record))
+		}
+		records = records[n:]
 	}
 
-	offset = fi.Size() - int64(length)
-	return offset, write_err
+	return offsets, nil
+}
+
+func formatRecord(record []string) ([]byte, error) {
+	var line bytes.Buffer
+	writer := csv.NewWriter(&line)
+	writer.Write(record)
+	writer.Flush()
+	return line.Bytes(), writer.Error()
+}
+
+func syncFile(filePath string) error {
+	file, err := os.OpenFile(filePath, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
 }
 
 func fileExists(filename string) bool {
@@ -364,53 +1347,83 @@ func fileExists(filename string) bool {
 	return !info.IsDir()
 }
 
-func LoadIndex(cache Cache) (lastLineOffset int64, err error) {
-	path := filepath.Join(".", STORAGE_DIR)
-	path = filepath.Join(path, INDEX_FILE)
-	lastLineOffset = 0
+func LoadIndex(cache Cache, opts Options) (lastLineOffset int64, err error) {
+	path := opts.path(INDEX_FILE)
 
 	if fileExists(path) {
-		log.Info("Index data found loading from disk.")
-		storeFile, openErr := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0644)
-		if openErr != nil {
-			return 0, openErr
-		}
-		defer storeFile.Close()
-
-		byteValue, _ := ioutil.ReadAll(storeFile)
-		var index Index
-		json.Unmarshal(byteValue, &index)
+		opts.Logger.Info("Index data found loading from disk.")
+	}
 
-		lastLineOffset = index.LastOffset
+	lastLineOffset, err = LoadIndexFile(cache, path, opts)
+	if err == ErrCorruptIndex || err == ErrCorruptTable {
+		opts.Logger.Error("Index file is corrupt, rebuilding it from the log.")
+		return rebuildIndexData(cache, opts.path(STORAGE_FILE), opts)
+	}
+	if err != nil {
+		return 0, err
 	}
 
+	logged, found, err := replayIndexLog(cache, opts.path(INDEX_LOG_FILE), opts)
 	if err != nil {
 		return 0, err
 	}
+	if found && logged > lastLineOffset {
+		lastLineOffset = logged
+	}
 
-	log.Info("Reading any missing data from log on disk.")
+	opts.Logger.Info("Reading any missing data from log on disk.")
 
-	path = filepath.Join(".", STORAGE_DIR)
-	path = filepath.Join(path, STORAGE_FILE)
-	return LoadIndexData(lastLineOffset, cache, path)
+	path = opts.path(STORAGE_FILE)
+	if lastLineOffset == 0 {
+		return rebuildIndexData(cache, path, opts)
+	}
+	return loadIndexData(lastLineOffset, cache, path, opts)
 }
 
-func LoadIndexJson(cache Cache, filePath string) (lastLineOffset int64, err error) {
-	storeFile, openErr := os.OpenFile(filePath, os.O_CREATE|os.O_RDONLY, 0644)
-	if openErr != nil {
-		return 0, openErr
+// ReadIndexFile decodes the persisted index, a missing or empty file is an
+// empty index and a damaged one ErrCorruptIndex.
+func ReadIndexFile(filePath string, opts Options) (Index, error) {
+	byteValue, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) || len(byteValue) == 0 {
+		return Index{}, nil
+	}
+	if err != nil {
+		return Index{}, err
+	}
+
+	byteValue, err = readCheckpoint(byteValue)
+	if err != nil {
+		return Index{}, err
+	}
+
+	byteValue, err = opts.Encryption.Decrypt(byteValue)
+	if err != nil {
+		return Index{}, err
 	}
-	defer storeFile.Close()
 
-	byteValue, _ := ioutil.ReadAll(storeFile)
-	var index Index
-	json.Unmarshal(byteValue, &index)
+	return DecodeIndex(byteValue)
+}
+
+// LoadIndexFile puts the offsets of the persisted index into cache, returning
+// the log offset the index is up to date with.
+func LoadIndexFile(cache Cache, filePath string, opts Options) (lastLineOffset int64, err error) {
+	if table, ok := cache.(*TableIndex); ok {
+		if opened, lastOffset, err := table.open(filePath); opened || err != nil {
+			opts.Logger.Infof("Opened index table, last offset was %d", lastOffset)
+			return lastOffset, err
+		}
+	}
+
+	index, err := ReadIndexFile(filePath, opts)
+	if err != nil {
+		return 0, err
+	}
 
 	lastLineOffset = index.LastOffset
-	log.Infof("Last offset was %d", lastLineOffset)
+	opts.Logger.Infof("Last offset was %d", lastLineOffset)
 	for _, kv := range index.KeyOffsets {
-		for _, off := range kv.Offsets {
-			AddIndexItem(cache, kv.Key, off)
+		if len(kv.Offsets) > 0 {
+			cache.Add(kv.Key, packOffsets(kv.Offsets))
 		}
 	}
 
@@ -418,138 +1431,227 @@ func LoadIndexJson(cache Cache, filePath string) (lastLineOffset int64, err erro
 }
 
 func ReadKvItem(filePath string, offset int64) (key string, value interface{}, err error) {
-	storeFile, openErr := os.Open(filePath)
+	return ReadKvItemSize(filePath, offset, int(DEFAULT_READ_AHEAD_SIZE))
+}
+
+// ReadKvItemSize reads the record at offset, buffering at most readAhead bytes
+// from the data log.
+func ReadKvItemSize(filePath string, offset int64, readAhead int) (key string, value interface{}, err error) {
+	return readKvItem(FileBackend{}, filePath, offset, readAhead)
+}
+
+func readKvItem(backend Backend, filePath string, offset int64, readAhead int) (key string, value interface{}, err error) {
+	storeFile, openErr := backend.Open(filePath)
 
 	if openErr != nil {
 		return "", nil, openErr
 	}
+	defer storeFile.Close()
 
 	_, seekErr := storeFile.Seek(offset, 0)
 	if seekErr != nil {
-		return "", nil, openErr
+		return "", nil, seekErr
 	}
 
-	reader := csv.NewReader(storeFile)
-	log.Infoln("Reading persistent file.")
-	record, err := reader.Read()
-
+	reader := bufio.NewReaderSize(storeFile, readAhead)
+	key, v, _, _, err := readKvRecord(reader)
 	if err != nil {
-		storeFile.Close()
 		return "", nil, err
 	}
 
-	key = record[0]
+	return key, v, nil
+}
+
+func readKvRecord(reader *bufio.Reader) (key string, value string, checksum string, length int, err error) {
+	line, err := reader.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", "", "", 0, err
+	}
+
+	record, value, err := parseKvRecord(line)
+	if err != nil {
+		return "", "", "", 0, err
+	}
+
+	if len(record) > 3 {
+		checksum = record[3]
+	}
+
+	return record[0], value, checksum, len(line), nil
+}
+
+// parseKvRecord splits a data log line into its fields, also returning the
+// value decoded from its log encoding.
+func parseKvRecord(line string) (record []string, value string, err error) {
+	record, err = csv.NewReader(strings.NewReader(line)).Read()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(record) < 2 {
+		return nil, "", errors.New("Malformed record in data log.")
+	}
+
 	value = record[1]
-	storeFile.Close()
+	if len(record) > 2 && record[2] == BINARY_FLAG {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, "", err
+		}
+		value = string(decoded)
+	}
 
-	return key, value, nil
+	return record, value, nil
 }
 
 func RemoveIndexItem(cache Cache, key string) {
-	path := filepath.Join(".", STORAGE_DIR)
-	path = filepath.Join(path, STORAGE_FILE)
-	partialKey := getPartialKey(key)
+	removeIndexItem(cache, key, DefaultOptions())
+}
+
+// removeIndexItem drops the offset of key, reading the records at the
+// index key's offsets from the data log in opts.Dir to find it.
+func removeIndexItem(cache Cache, key string, opts Options) {
+	path := opts.path(STORAGE_FILE)
+	partialKey := opts.indexKey(key)
 	values, ok := cache.Get(partialKey)
 	newOffsets := make([]int64, 0, 1)
 
 	if partialKey != "" && ok {
-		offsets, check := values.([]int64)
+		offsets, check := unpackOffsets(values)
 		if !check {
-			log.Fatal("could not retrieve offsets from cache to remove index item.")
+			opts.Logger.Fatal("could not retrieve offsets from cache to remove index item.")
 		}
 
 		for _, offset := range offsets {
-			k, _, err := ReadKvItem(path, offset)
+			k, _, err := readKvItem(opts.Backend, path, offset, int(opts.ReadAheadSize))
 			if err != nil {
-				log.Fatal("Could not read kv item")
+				opts.Logger.Fatal("Could not read kv item")
 				break
 			}
 
 			if key == k {
-				log.Infof("Found correct offset for key %s, removing offset %d", key, offset)
+				if opts.logs(LOG_INDEX) {
+					opts.Logger.Debugf("Found correct offset for key %s, removing offset %d", key, offset)
+				}
 				continue
 			} else {
-				log.Infof("Adding checked offset non match key %s, offset %d", key, offset)
+				if opts.logs(LOG_INDEX) {
+					opts.Logger.Debugf("Adding checked offset non match key %s, offset %d", key, offset)
+				}
 				newOffsets = append(newOffsets, offset)
 			}
 		}
 
-		cache.Add(partialKey, newOffsets)
+		cache.Add(partialKey, packOffsets(newOffsets))
 	}
 
 }
 
 func AddIndexItem(cache Cache, key string, offset int64) {
-	partialKey := getPartialKey(key)
+	addIndexItem(cache, key, offset, DefaultOptions())
+}
+
+func addIndexItem(cache Cache, key string, offset int64, opts Options) {
+	partialKey := opts.indexKey(key)
 	values, ok := cache.Get(partialKey)
 
 	if ok {
-		log.Infof("offsets found in index cache for key %s", key)
-		offsets, check := values.([]int64)
+		if opts.logs(LOG_INDEX) {
+			opts.Logger.Debugf("offsets found in index cache for key %s", key)
+		}
+		offsets, check := unpackOffsets(values)
 		if !check {
-			log.Fatal("could not retrieve offsets from cache to add new index item.")
+			opts.Logger.Fatal("could not retrieve offsets from cache to add new index item.")
 		}
 
-		RemoveIndexItem(cache, key)
+		removeIndexItem(cache, key, opts)
 		values, _ = cache.Get(partialKey)
-		offsets, _ = values.([]int64)
+		offsets, _ = unpackOffsets(values)
 
 		offsets = append(offsets, offset)
-		cache.Add(partialKey, offsets)
+		cache.Add(partialKey, packOffsets(offsets))
 	} else {
 
-		log.Infof("offsets not found in index cache for key %s, adding new offset", key)
+		if opts.logs(LOG_INDEX) {
+			opts.Logger.Debugf("offsets not found in index cache for key %s, adding new offset", key)
+		}
 		offsets := make([]int64, 0, 1)
 		offsets = append(offsets, offset)
-		cache.Add(partialKey, offsets)
+		cache.Add(partialKey, packOffsets(offsets))
 	}
 
 }
 
 func LoadIndexData(startingOffset int64, cache Cache, filePath string) (lastLineOffset int64, err error) {
-	storeFile, openErr := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR, 0644)
+	return loadIndexData(startingOffset, cache, filePath, DefaultOptions())
+}
 
+func loadIndexData(startingOffset int64, cache Cache, filePath string,
+	opts Options) (lastLineOffset int64, err error) {
+	storeFile, openErr := opts.Backend.Open(filePath)
+	if os.IsNotExist(openErr) {
+		if opts.RecoveryProgress != nil {
+			opts.RecoveryProgress(startingOffset, startingOffset)
+		}
+		return startingOffset, nil
+	}
 	if openErr != nil {
 		return 0, openErr
 	}
+	defer storeFile.Close()
+
+	if start := logStart(opts.Backend, filePath); startingOffset < start {
+		startingOffset = start
+	}
 
 	var buffer bytes.Buffer
-	var position int64
+	position := startingOffset
 	reader := io.TeeReader(storeFile, &buffer)
 	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
 	_, seekErr := storeFile.Seek(startingOffset, 0)
 	if seekErr != nil {
 		return 0, seekErr
 	}
 
-	log.Infoln("Reading persistent file into cache with offsets.")
+	opts.Logger.Info("Reading persistent file into cache with offsets.")
+	size, _ := opts.Backend.Size(filePath)
+	reported := position
 	for {
 		record, readErr := csvReader.Read()
 		if readErr == io.EOF {
-			log.Info("End of file reached.")
+			opts.Logger.Info("End of file reached.")
 			break
 		}
 
-		if err != nil {
+		if readErr != nil {
 			err = readErr
 			break
 		}
 
 		lineBytes, _ := buffer.ReadBytes('\n')
 		key := record[0]
-		value := record[1]
-		tomb := record[2]
+		tomb := isTombstone(record)
 
-		if value != tomb {
-			AddIndexItem(cache, key, position)
+		if !tomb {
+			addIndexItem(cache, key, position, opts)
 		} else {
-			log.Info("Tombstone detected removing key from index.")
-			cache.Remove(key)
+			if opts.logs(LOG_INDEX) {
+				opts.Logger.Debug("Tombstone detected removing key from index.")
+			}
+			removeIndexItem(cache, key, opts)
 		}
 
 		position += int64(len(lineBytes))
+		if opts.RecoveryProgress != nil && position-reported >= RECOVERY_PROGRESS_BYTES {
+			opts.RecoveryProgress(position, size)
+			reported = position
+		}
 	}
 
-	log.Infoln("Successfully Read persistent file into cache with offsets.")
+	if opts.RecoveryProgress != nil {
+		opts.RecoveryProgress(position, size)
+	}
+	opts.Logger.Info("Successfully Read persistent file into cache with offsets.")
 	return position, err
 }
@@ -0,0 +1,59 @@
+//go:build !windows
+// +build !windows
+
+package kvstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const LOCK_FILE string = "LOCK"
+
+var ErrStoreLocked error = errors.New("Store directory is locked by another open store.")
+
+// lockDir takes an exclusive flock on the directory's lock file, the kernel
+// drops it if the process dies so a crash never leaves the store locked.
+func lockDir(dir string) (*os.File, error) {
+	file, err := os.OpenFile(filepath.Join(dir, LOCK_FILE), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrStoreLocked
+		}
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func unlockDir(file *os.File) error {
+	return file.Close()
+}
+
+// syncDir flushes the entries of dir, making renames in it durable.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+// freeSpace is how many bytes of the disk holding dir are free to use.
+func freeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
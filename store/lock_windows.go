@@ -0,0 +1,42 @@
+package kvstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+const LOCK_FILE string = "LOCK"
+
+var ErrStoreLocked error = errors.New("Store directory is locked by another open store.")
+
+// lockDir creates the directory's lock file, failing if it exists. Unlike
+// flock it outlives a crashed process, the file then has to be removed by
+// hand.
+func lockDir(dir string) (*os.File, error) {
+	file, err := os.OpenFile(filepath.Join(dir, LOCK_FILE), os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+	if os.IsExist(err) {
+		return nil, ErrStoreLocked
+	}
+
+	return file, err
+}
+
+func unlockDir(file *os.File) error {
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(file.Name())
+}
+
+// syncDir does nothing, Windows cannot open a directory to sync it and
+// makes renames durable on its own.
+func syncDir(dir string) error {
+	return nil
+}
+
+// freeSpace is -1, unknown, the free space check is skipped on Windows.
+func freeSpace(dir string) (int64, error) {
+	return -1, nil
+}
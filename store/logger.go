@@ -0,0 +1,83 @@
+package kvstore
+
+import (
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Hot paths that log a Debug line for every record, see Options.LogSampling.
+const (
+	LOG_GET_MISS string = "getMiss"
+	LOG_INDEX    string = "index"
+	LOG_WRITE    string = "write"
+)
+
+// Logger is what the store logs through, a *logrus.Logger satisfies it.
+type Logger interface {
+	Debug(args ...interface{})
+	Debugf(format string, args ...interface{})
+	Info(args ...interface{})
+	Infof(format string, args ...interface{})
+	Error(args ...interface{})
+	Errorf(format string, args ...interface{})
+	Fatal(args ...interface{})
+	Fatalf(format string, args ...interface{})
+}
+
+// NopLogger is the default Logger. It drops everything but fatal errors,
+// which still exit through logrus since the store cannot carry on after them.
+type NopLogger struct{}
+
+func (n NopLogger) Debug(args ...interface{}) {}
+
+func (n NopLogger) Debugf(format string, args ...interface{}) {}
+
+func (n NopLogger) Info(args ...interface{}) {}
+
+func (n NopLogger) Infof(format string, args ...interface{}) {}
+
+func (n NopLogger) Error(args ...interface{}) {}
+
+func (n NopLogger) Errorf(format string, args ...interface{}) {}
+
+func (n NopLogger) Fatal(args ...interface{}) {
+	log.Fatal(args...)
+}
+
+func (n NopLogger) Fatalf(format string, args ...interface{}) {
+	log.Fatalf(format, args...)
+}
+
+type logSampler struct {
+	every  map[string]int
+	counts map[string]*uint64
+}
+
+func newLogSampler(sampling map[string]int) *logSampler {
+	sampler := &logSampler{make(map[string]int, len(sampling)),
+		make(map[string]*uint64, len(sampling))}
+	for op, every := range sampling {
+		sampler.every[op] = every
+		sampler.counts[op] = new(uint64)
+	}
+
+	return sampler
+}
+
+// logs is whether this line of the hot path op is logged.
+func (o Options) logs(op string) bool {
+	if o.sampler == nil {
+		return true
+	}
+
+	every := o.sampler.every[op]
+	switch {
+	case every < 0:
+		return false
+	case every <= 1:
+		return true
+	}
+
+	return atomic.AddUint64(o.sampler.counts[op], 1)%uint64(every) == 1
+}
@@ -0,0 +1,636 @@
+package kvstore
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Storage engines, see Options.Engine.
+const (
+	ENGINE_LOG string = "log"
+	ENGINE_LSM string = "lsm"
+)
+
+const (
+	LSM_DIR                    string = "lsm"
+	LSM_WAL_FILE               string = "wal.csv"
+	LSM_LEVELS_FILE            string = "levels.json"
+	LSM_SEGMENT_EXT            string = ".sst"
+	LSM_LEVEL_FANOUT           int    = 10
+	DEFAULT_MEMTABLE_SIZE      Size   = 4 * MB
+	DEFAULT_LSM_LEVEL_SEGMENTS int    = 4
+)
+
+// EngineStore is a store opened by OpenEngine, whichever engine keeps it.
+type EngineStore interface {
+	ScanStore
+	Shutdown() error
+}
+
+// OpenEngine opens the store kept in dir with the engine Options.Engine
+// names, the data log of KvStore by default, the LsmStore or the HashStore.
+func OpenEngine(dir string, opts ...Option) (EngineStore, error) {
+	options := applyOptions(dir, opts)
+	switch options.Engine {
+	case "", ENGINE_LOG:
+		store, err := OpenKvStoreWithOptions(options)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case ENGINE_LSM:
+		store, err := OpenLsmStore(options)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case ENGINE_HASH:
+		store, err := OpenHashStore(options)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+
+	return nil, fmt.Errorf("Unknown storage engine %q.", options.Engine)
+}
+
+// lsmLevels is the levels file, the segments of each level. Level 0 holds
+// flushed memtables newest first and may overlap, deeper levels are each
+// one sorted run split into segments in key order.
+type lsmLevels struct {
+	Levels [][]*lsmSegment `json:"levels"`
+	// Next is the number of the newest segment file.
+	Next int64 `json:"next"`
+}
+
+// LsmStore keeps keys in a log structured merge tree under Options.Dir/lsm.
+// Writes go to a write ahead log and a sorted memtable, which is flushed to
+// a level 0 segment once it holds Options.MemtableSize bytes. A level holding
+// more than Options.LsmLevelSegments times LSM_LEVEL_FANOUT to the power of
+// its depth segments is merged into the next one in the background.
+//
+// It suits write heavy stores read by range, but it has none of KvStore's
+// caches, indexes, replication or maintenance tools.
+type LsmStore struct {
+	lock     sync.RWMutex
+	options  Options
+	dir      string
+	memtable *memtable
+	wal      *os.File
+	levels   lsmLevels
+	segments int64
+	closed   bool
+	dirLock  *os.File
+	// compactions wakes the compactor, which closes compacted when done.
+	compactions chan struct{}
+	compacted   chan struct{}
+}
+
+// OpenLsmStore opens the LSM store in opts.Dir, replaying the write ahead
+// log into the memtable.
+func OpenLsmStore(opts Options) (*LsmStore, error) {
+	if opts.Logger == nil {
+		opts.Logger = NopLogger{}
+	}
+	if opts.Dir == "" {
+		opts.Dir = DEFAULT_DIR
+	}
+	if opts.Encryption == nil {
+		opts.Encryption = NoEncryption{}
+	}
+	if opts.ReadAheadSize <= 0 {
+		opts.ReadAheadSize = DEFAULT_READ_AHEAD_SIZE
+	}
+	if opts.MemtableSize <= 0 {
+		opts.MemtableSize = DEFAULT_MEMTABLE_SIZE
+	}
+	if opts.LsmLevelSegments <= 0 {
+		opts.LsmLevelSegments = DEFAULT_LSM_LEVEL_SEGMENTS
+	}
+	if opts.MaxKeySize <= 0 {
+		opts.MaxKeySize = DEFAULT_MAX_KEY_SIZE
+	}
+	if opts.MaxValueSize <= 0 {
+		opts.MaxValueSize = DEFAULT_MAX_VALUE_SIZE
+	}
+
+	dir := filepath.Join(opts.Dir, LSM_DIR)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	dirLock, err := lockDir(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &LsmStore{sync.RWMutex{}, opts, dir, newMemtable(), nil, lsmLevels{}, 0,
+		false, dirLock, make(chan struct{}, 1), make(chan struct{})}
+	if err := s.open(); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+
+	go s.compactLevels()
+	s.compactions <- struct{}{}
+	opts.Logger.Infof("Opened LSM store with %d levels.", len(s.levels.Levels))
+	return s, nil
+}
+
+// open loads the levels file, removes segments it does not list, left by a
+// flush or compaction that did not finish, and replays the write ahead log.
+func (s *LsmStore) open() error {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, LSM_LEVELS_FILE))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.levels); err != nil {
+			return err
+		}
+		s.segments = s.levels.Next
+	}
+
+	listed := make(map[string]bool)
+	for _, level := range s.levels.Levels {
+		for _, segment := range level {
+			if err := openSegment(s.dir, segment, s.options); err != nil {
+				return err
+			}
+			listed[segment.Name] = true
+		}
+	}
+
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+LSM_SEGMENT_EXT))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !listed[filepath.Base(name)] {
+			s.options.Logger.Infof("Removing unlisted LSM segment %s.", name)
+			os.Remove(name)
+		}
+	}
+
+	if err := s.replayWal(); err != nil {
+		return err
+	}
+
+	s.wal, err = os.OpenFile(filepath.Join(s.dir, LSM_WAL_FILE),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// replayWal reads the write ahead log into the memtable, stopping at a torn
+// last record.
+func (s *LsmStore) replayWal() error {
+	file, err := os.Open(filepath.Join(s.dir, LSM_WAL_FILE))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	it := &segmentIterator{bufio.NewReaderSize(file, int(s.options.ReadAheadSize)), 0, s.options}
+	for {
+		key, entry, ok, err := it.next()
+		if err != nil {
+			s.options.Logger.Errorf("Stopped replaying the LSM write ahead log at offset %d: %v",
+				it.offset, err)
+			return nil
+		}
+		if !ok {
+			return nil
+		}
+		s.memtable.set(key, entry)
+	}
+}
+
+func (s *LsmStore) Get(key string) (string, error) {
+	key = s.normalizeKey(key)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return "", ErrStoreClosed
+	}
+
+	entry, found, err := s.find(key)
+	if err != nil {
+		return "", err
+	}
+	if !found || entry.deleted {
+		return "", ErrNotInIndex
+	}
+
+	return entry.value, nil
+}
+
+// find looks key up newest first, memtable, level 0 then each deeper level.
+func (s *LsmStore) find(key string) (lsmEntry, bool, error) {
+	if entry, ok := s.memtable.entries[key]; ok {
+		return entry, true, nil
+	}
+
+	for depth, level := range s.levels.Levels {
+		candidates := level
+		if depth > 0 {
+			i := sort.Search(len(level), func(i int) bool { return level[i].Last >= key })
+			if i == len(level) {
+				continue
+			}
+			candidates = level[i : i+1]
+		}
+
+		for _, segment := range candidates {
+			entry, found, err := segment.get(key, s.options)
+			if err != nil || found {
+				return entry, found, err
+			}
+		}
+	}
+
+	return lsmEntry{}, false, nil
+}
+
+func (s *LsmStore) Put(key string, value string) error {
+	if s.options.ReadOnly {
+		return ErrReadOnly
+	}
+	if Size(len(value)) > s.options.MaxValueSize {
+		return ErrValueTooLarge
+	}
+
+	return s.write(key, lsmEntry{value, false})
+}
+
+func (s *LsmStore) Del(key string) error {
+	if s.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return s.write(key, lsmEntry{"", true})
+}
+
+// write logs entry to the write ahead log, then applies it to the memtable,
+// flushing a full memtable.
+func (s *LsmStore) write(key string, entry lsmEntry) error {
+	key = s.normalizeKey(key)
+	if Size(len(key)) > s.options.MaxKeySize {
+		return ErrKeyTooLarge
+	}
+
+	line, err := lsmRecord(key, entry, s.options)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	if _, err := s.wal.Write(line); err != nil {
+		return err
+	}
+	if s.options.WriteMode == WRITE_THROUGH_SYNC {
+		if err := s.wal.Sync(); err != nil {
+			return err
+		}
+	}
+
+	s.memtable.set(key, entry)
+	if s.memtable.size < s.options.MemtableSize {
+		return nil
+	}
+
+	return s.flushMemtable()
+}
+
+// flushMemtable writes the memtable to a new level 0 segment and empties
+// the write ahead log. The caller holds the write lock.
+func (s *LsmStore) flushMemtable() error {
+	if len(s.memtable.keys) == 0 {
+		return nil
+	}
+
+	// One segment per flush however large the memtable grew, so level 0
+	// segments stay ordered by age.
+	writer := &segmentWriter{store: s}
+	for _, key := range s.memtable.keys {
+		if err := writer.add(key, s.memtable.entries[key]); err != nil {
+			writer.abort()
+			return err
+		}
+	}
+	if err := writer.finish(); err != nil {
+		writer.abort()
+		return err
+	}
+
+	levels := s.levels
+	if len(levels.Levels) == 0 {
+		levels.Levels = [][]*lsmSegment{{}}
+	}
+	levels.Levels = append([][]*lsmSegment{}, levels.Levels...)
+	levels.Levels[0] = append(writer.segments, levels.Levels[0]...)
+	if err := s.saveLevels(levels); err != nil {
+		writer.abort()
+		return err
+	}
+	s.levels = levels
+
+	if err := s.wal.Truncate(0); err != nil {
+		return err
+	}
+	s.memtable = newMemtable()
+	if s.closed {
+		return nil
+	}
+
+	select {
+	case s.compactions <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// nextSegmentName numbers a new segment file, for flushes and the
+// compactor alike.
+func (s *LsmStore) nextSegmentName() string {
+	return fmt.Sprintf("%08d%s", atomic.AddInt64(&s.segments, 1), LSM_SEGMENT_EXT)
+}
+
+// saveLevels writes the levels file, replacing the old one whole.
+func (s *LsmStore) saveLevels(levels lsmLevels) error {
+	levels.Next = atomic.LoadInt64(&s.segments)
+	data, err := json.MarshalIndent(levels, "", " ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, LSM_LEVELS_FILE)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// levelLimit is how many segments level depth holds before it is merged
+// into the next level.
+func (s *LsmStore) levelLimit(depth int) int {
+	limit := s.options.LsmLevelSegments
+	for i := 0; i < depth; i++ {
+		limit *= LSM_LEVEL_FANOUT
+	}
+
+	return limit
+}
+
+// compactLevels merges overfull levels into the next one each time it is
+// woken, until the store shuts down.
+func (s *LsmStore) compactLevels() {
+	defer close(s.compacted)
+	for range s.compactions {
+		for {
+			s.lock.RLock()
+			depth := -1
+			for i, level := range s.levels.Levels {
+				if len(level) > s.levelLimit(i) {
+					depth = i
+					break
+				}
+			}
+			closed := s.closed
+			s.lock.RUnlock()
+			if depth < 0 || closed {
+				break
+			}
+
+			if err := s.compactLevel(depth); err != nil {
+				s.options.Logger.Errorf("Could not compact LSM level %d: %v", depth, err)
+				break
+			}
+		}
+	}
+}
+
+// compactLevel merges every segment of level depth with the next level into
+// a new next level. Deletes are dropped once merged into the deepest level.
+func (s *LsmStore) compactLevel(depth int) error {
+	s.lock.RLock()
+	inputs := append([]*lsmSegment{}, s.levels.Levels[depth]...)
+	var next []*lsmSegment
+	if depth+1 < len(s.levels.Levels) {
+		next = s.levels.Levels[depth+1]
+	}
+	deepest := depth+1 >= len(s.levels.Levels)-1
+	s.lock.RUnlock()
+
+	sources := make([]lsmIterator, 0, len(inputs)+len(next))
+	for _, segment := range append(append([]*lsmSegment{}, inputs...), next...) {
+		sources = append(sources, segment.iterator(s.options, 0))
+	}
+	merged, err := newMergedIterator(sources)
+	if err != nil {
+		return err
+	}
+
+	writer := &segmentWriter{store: s, limit: s.options.MemtableSize}
+	for {
+		key, entry, ok, err := merged.next()
+		if err != nil {
+			writer.abort()
+			return err
+		}
+		if !ok {
+			break
+		}
+		if entry.deleted && deepest {
+			continue
+		}
+		if err := writer.add(key, entry); err != nil {
+			writer.abort()
+			return err
+		}
+	}
+	if err := writer.finish(); err != nil {
+		writer.abort()
+		return err
+	}
+
+	s.lock.Lock()
+	levels := lsmLevels{append([][]*lsmSegment{}, s.levels.Levels...), 0}
+	// Flushes may have added level 0 segments since, they stay.
+	kept := make([]*lsmSegment, 0)
+	for _, segment := range levels.Levels[depth] {
+		if !containsSegment(inputs, segment) {
+			kept = append(kept, segment)
+		}
+	}
+	levels.Levels[depth] = kept
+	if depth+1 == len(levels.Levels) {
+		levels.Levels = append(levels.Levels, nil)
+	}
+	levels.Levels[depth+1] = writer.segments
+	if err := s.saveLevels(levels); err != nil {
+		s.lock.Unlock()
+		writer.abort()
+		return err
+	}
+	s.levels.Levels = levels.Levels
+	s.lock.Unlock()
+
+	for _, segment := range append(inputs, next...) {
+		segment.file.Close()
+		os.Remove(segment.file.Name())
+	}
+
+	s.options.Logger.Infof("Compacted %d LSM segments of level %d into %d of level %d.",
+		len(inputs)+len(next), depth, len(writer.segments), depth+1)
+	return nil
+}
+
+func containsSegment(segments []*lsmSegment, segment *lsmSegment) bool {
+	for _, s := range segments {
+		if s == segment {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Range calls fn with each live key from start up to, not including, end in
+// key order, until fn returns false. An empty end reads to the last key. fn
+// must not write to the store.
+func (s *LsmStore) Range(start string, end string, fn func(key string, value string) bool) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	sources := []lsmIterator{s.memtable.iterator(start)}
+	for _, level := range s.levels.Levels {
+		for _, segment := range level {
+			if segment.Last < start || (end != "" && segment.First >= end) {
+				continue
+			}
+			it, err := segment.from(start, s.options)
+			if err != nil {
+				return err
+			}
+			sources = append(sources, it)
+		}
+	}
+
+	merged, err := newMergedIterator(sources)
+	if err != nil {
+		return err
+	}
+	for {
+		key, entry, ok, err := merged.next()
+		if err != nil || !ok || (end != "" && key >= end) {
+			return err
+		}
+		if !entry.deleted && !fn(key, entry.value) {
+			return nil
+		}
+	}
+}
+
+// Scan pages through keys in sorted order like KvStore.Scan.
+func (s *LsmStore) Scan(cursor string, count int) (keys []string, next string, err error) {
+	if count <= 0 {
+		count = DEFAULT_SCAN_COUNT
+	}
+
+	keys = make([]string, 0, count)
+	more := false
+	err = s.Range(cursor, "", func(key string, value string) bool {
+		if cursor != "" && key == cursor {
+			return true
+		}
+		if len(keys) >= count && keys[len(keys)-1] != "" {
+			more = true
+			return false
+		}
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if more {
+		next = keys[len(keys)-1]
+	}
+	return keys, next, nil
+}
+
+// Levels is how many segments each level holds, level 0 first.
+func (s *LsmStore) Levels() []int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	counts := make([]int, len(s.levels.Levels))
+	for i, level := range s.levels.Levels {
+		counts[i] = len(level)
+	}
+
+	return counts
+}
+
+// Shutdown stops compaction and flushes the memtable to a segment.
+func (s *LsmStore) Shutdown() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return ErrStoreClosed
+	}
+	s.closed = true
+	close(s.compactions)
+	s.lock.Unlock()
+	<-s.compacted
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err := s.flushMemtable()
+	s.closeFiles()
+	s.options.Logger.Info("LSM store shut down.")
+	return err
+}
+
+func (s *LsmStore) closeFiles() {
+	if s.wal != nil {
+		s.wal.Close()
+	}
+	for _, level := range s.levels.Levels {
+		for _, segment := range level {
+			if segment.file != nil {
+				segment.file.Close()
+			}
+		}
+	}
+	unlockDir(s.dirLock)
+}
+
+func (s *LsmStore) normalizeKey(key string) string {
+	if s.options.KeyNormalizer == nil {
+		return key
+	}
+
+	return s.options.KeyNormalizer.Normalize(key)
+}
@@ -0,0 +1,372 @@
+package kvstore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// LSM_SPARSE_INTERVAL is how many records of a segment share one entry of
+// its in-memory sparse index, a lookup reads at most that many records.
+const LSM_SPARSE_INTERVAL int = 16
+
+// lsmEntry is the newest write of a key, a value or a delete.
+type lsmEntry struct {
+	value   string
+	deleted bool
+}
+
+// memtable holds the writes not yet flushed to a segment, its keys kept
+// sorted so it is written out, and scanned, in key order.
+type memtable struct {
+	keys    []string
+	entries map[string]lsmEntry
+	size    Size
+}
+
+func newMemtable() *memtable {
+	return &memtable{make([]string, 0), make(map[string]lsmEntry), 0}
+}
+
+func (m *memtable) set(key string, entry lsmEntry) {
+	if _, ok := m.entries[key]; !ok {
+		i := sort.SearchStrings(m.keys, key)
+		m.keys = append(m.keys, "")
+		copy(m.keys[i+1:], m.keys[i:])
+		m.keys[i] = key
+	}
+
+	m.entries[key] = entry
+	m.size += Size(len(key) + len(entry.value))
+}
+
+// lsmIterator walks entries in key order.
+type lsmIterator interface {
+	next() (key string, entry lsmEntry, ok bool, err error)
+}
+
+type memtableIterator struct {
+	table *memtable
+	i     int
+}
+
+// iterator walks the memtable from the first key not before start.
+func (m *memtable) iterator(start string) *memtableIterator {
+	return &memtableIterator{m, sort.SearchStrings(m.keys, start)}
+}
+
+func (m *memtableIterator) next() (string, lsmEntry, bool, error) {
+	if m.i >= len(m.table.keys) {
+		return "", lsmEntry{}, false, nil
+	}
+
+	key := m.table.keys[m.i]
+	m.i++
+	return key, m.table.entries[key], true, nil
+}
+
+// lsmSegment is an immutable file of records sorted by key, written by a
+// memtable flush or a compaction.
+type lsmSegment struct {
+	Name  string `json:"name"`
+	First string `json:"first"`
+	Last  string `json:"last"`
+	Size  int64  `json:"size"`
+	file  *os.File
+	// sparse holds every LSM_SPARSE_INTERVAL-th key with its offset.
+	sparse []sparseKey
+}
+
+type sparseKey struct {
+	key    string
+	offset int64
+}
+
+// openSegment opens a segment of dir and builds its sparse index.
+func openSegment(dir string, segment *lsmSegment, opts Options) error {
+	file, err := os.Open(filepath.Join(dir, segment.Name))
+	if err != nil {
+		return err
+	}
+
+	segment.file = file
+	segment.sparse = make([]sparseKey, 0)
+	it := segment.iterator(opts, 0)
+	for n := 0; ; n++ {
+		offset := it.offset
+		key, _, ok, err := it.next()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if n%LSM_SPARSE_INTERVAL == 0 {
+			segment.sparse = append(segment.sparse, sparseKey{key, offset})
+		}
+	}
+}
+
+// get finds key in the segment, false when the segment has no record of it.
+func (s *lsmSegment) get(key string, opts Options) (lsmEntry, bool, error) {
+	if key < s.First || key > s.Last {
+		return lsmEntry{}, false, nil
+	}
+
+	it := s.iterator(opts, s.seek(key))
+	for {
+		found, entry, ok, err := it.next()
+		if err != nil || !ok || found > key {
+			return lsmEntry{}, false, err
+		}
+		if found == key {
+			return entry, true, nil
+		}
+	}
+}
+
+// seek is the offset of the sparse index entry at or before key.
+func (s *lsmSegment) seek(key string) int64 {
+	i := sort.Search(len(s.sparse), func(i int) bool { return s.sparse[i].key > key }) - 1
+	if i < 0 {
+		return 0
+	}
+
+	return s.sparse[i].offset
+}
+
+type segmentIterator struct {
+	reader *bufio.Reader
+	offset int64
+	opts   Options
+}
+
+func (s *lsmSegment) iterator(opts Options, offset int64) *segmentIterator {
+	section := io.NewSectionReader(s.file, offset, s.Size-offset)
+	return &segmentIterator{bufio.NewReaderSize(section, int(opts.ReadAheadSize)), offset, opts}
+}
+
+// from is an iterator over the segment from the first key not before start.
+func (s *lsmSegment) from(start string, opts Options) (lsmIterator, error) {
+	it := s.iterator(opts, s.seek(start))
+	return skipIterator(it, start)
+}
+
+func (s *segmentIterator) next() (string, lsmEntry, bool, error) {
+	line, err := s.reader.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return "", lsmEntry{}, false, nil
+	}
+	if err != nil && err != io.EOF {
+		return "", lsmEntry{}, false, err
+	}
+	s.offset += int64(len(line))
+
+	key, entry, err := readEntry(line, s.opts)
+	return key, entry, err == nil, err
+}
+
+// readEntry reads the entry of an lsmRecord line, checking its checksum.
+func readEntry(line string, opts Options) (string, lsmEntry, error) {
+	record, value, err := parseKvRecord(line)
+	if err != nil {
+		return "", lsmEntry{}, err
+	}
+	if isTombstone(record) {
+		return record[0], lsmEntry{"", true}, nil
+	}
+
+	plain, err := decryptValue(opts.Encryption, value)
+	if err != nil {
+		return "", lsmEntry{}, err
+	}
+	if len(record) > 3 {
+		if err := verifyChecksum(plain, record[3]); err != nil {
+			return "", lsmEntry{}, fmt.Errorf("Key %s: %v", record[0], err)
+		}
+	}
+
+	return record[0], lsmEntry{plain, false}, nil
+}
+
+// peekedIterator is an iterator whose first entry was already read.
+type peekedIterator struct {
+	lsmIterator
+	key     string
+	entry   lsmEntry
+	ok      bool
+	started bool
+}
+
+func (p *peekedIterator) next() (string, lsmEntry, bool, error) {
+	if !p.started {
+		p.started = true
+		return p.key, p.entry, p.ok, nil
+	}
+
+	return p.lsmIterator.next()
+}
+
+// skipIterator skips the entries of it before start.
+func skipIterator(it lsmIterator, start string) (lsmIterator, error) {
+	for {
+		key, entry, ok, err := it.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok || key >= start {
+			return &peekedIterator{it, key, entry, ok, false}, nil
+		}
+	}
+}
+
+type iteratorHead struct {
+	key   string
+	entry lsmEntry
+	ok    bool
+}
+
+// mergedIterator merges iterators newest first, so of the entries of a key
+// the one from the earliest iterator wins.
+type mergedIterator struct {
+	sources []lsmIterator
+	heads   []iteratorHead
+}
+
+func newMergedIterator(sources []lsmIterator) (*mergedIterator, error) {
+	m := &mergedIterator{sources, make([]iteratorHead, len(sources))}
+	for i := range sources {
+		if err := m.advance(i); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+func (m *mergedIterator) advance(i int) error {
+	key, entry, ok, err := m.sources[i].next()
+	m.heads[i] = iteratorHead{key, entry, ok}
+	return err
+}
+
+func (m *mergedIterator) next() (string, lsmEntry, bool, error) {
+	best := -1
+	for i, head := range m.heads {
+		if head.ok && (best < 0 || head.key < m.heads[best].key) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return "", lsmEntry{}, false, nil
+	}
+
+	key, entry := m.heads[best].key, m.heads[best].entry
+	for i, head := range m.heads {
+		if head.ok && head.key == key {
+			if err := m.advance(i); err != nil {
+				return "", lsmEntry{}, false, err
+			}
+		}
+	}
+
+	return key, entry, true, nil
+}
+
+// lsmRecord lays out the record of an entry in LSM segments and write ahead
+// logs and in hash engine data files.
+func lsmRecord(key string, entry lsmEntry, opts Options) ([]byte, error) {
+	if entry.deleted {
+		return formatRecord([]string{key, "", TOMB_FLAG})
+	}
+
+	value, err := encryptValue(opts.Encryption, entry.value)
+	if err != nil {
+		return nil, err
+	}
+
+	return formatRecord(putRecord(key, value, formatChecksum(Checksum([]byte(entry.value)))))
+}
+
+// segmentWriter writes entries into segments of at most limit bytes each,
+// zero is one segment.
+type segmentWriter struct {
+	store    *LsmStore
+	limit    Size
+	segments []*lsmSegment
+	current  *lsmSegment
+	writer   *bufio.Writer
+	file     *os.File
+}
+
+func (w *segmentWriter) add(key string, entry lsmEntry) error {
+	if w.current == nil {
+		name := w.store.nextSegmentName()
+		file, err := os.Create(filepath.Join(w.store.dir, name))
+		if err != nil {
+			return err
+		}
+		w.file = file
+		w.writer = bufio.NewWriter(file)
+		w.current = &lsmSegment{Name: name, First: key}
+	}
+
+	line, err := lsmRecord(key, entry, w.store.options)
+	if err != nil {
+		return err
+	}
+	if _, err := w.writer.Write(line); err != nil {
+		return err
+	}
+
+	w.current.Last = key
+	w.current.Size += int64(len(line))
+	if w.limit > 0 && Size(w.current.Size) >= w.limit {
+		return w.finish()
+	}
+
+	return nil
+}
+
+// finish syncs and opens the segment being written, if any.
+func (w *segmentWriter) finish() error {
+	if w.current == nil {
+		return nil
+	}
+
+	segment := w.current
+	w.current = nil
+	if err := w.writer.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if err := openSegment(w.store.dir, segment, w.store.options); err != nil {
+		return err
+	}
+
+	w.segments = append(w.segments, segment)
+	return nil
+}
+
+// abort removes the segments written so far.
+func (w *segmentWriter) abort() {
+	if w.current != nil {
+		w.file.Close()
+		os.Remove(w.file.Name())
+	}
+	for _, segment := range w.segments {
+		segment.file.Close()
+		os.Remove(segment.file.Name())
+	}
+}
@@ -0,0 +1,128 @@
+package kvstore
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	MANIFEST_FILE    string = "manifest.json"
+	MANIFEST_VERSION int    = 1
+)
+
+// Manifest records settings a storage directory has to be reopened with.
+type Manifest struct {
+	Version       int    `json:"version"`
+	KeyNormalizer string `json:"keyNormalizer"`
+	// Uuid identifies the store, it is kept for the life of the directory.
+	Uuid string `json:"uuid,omitempty"`
+	// Segments lists the kept segments of a data log that has rotated, the
+	// active one last.
+	Segments []LogSegment `json:"segments,omitempty"`
+	// IndexKeys is how the index keys keys, INDEX_KEYS_PARTIAL or
+	// INDEX_KEYS_XXHASH64.
+	IndexKeys string `json:"indexKeys,omitempty"`
+}
+
+func ReadManifest(dir string) (Manifest, bool, error) {
+	path := filepath.Join(dir, MANIFEST_FILE)
+	if !fileExists(path) {
+		return Manifest{}, false, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Manifest{}, false, err
+	}
+
+	var manifest Manifest
+	err = json.Unmarshal(data, &manifest)
+	return manifest, true, err
+}
+
+func WriteManifest(dir string, manifest Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", " ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, MANIFEST_FILE)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// checkManifest creates the manifest for a new storage directory, or makes
+// sure opts agree with the one already there.
+func checkManifest(dir string, opts Options) (Manifest, error) {
+	manifest, found, err := ReadManifest(dir)
+	if err != nil {
+		return manifest, err
+	}
+
+	normalizer := normalizerName(opts.KeyNormalizer)
+	if !found {
+		uuid, err := newUuid()
+		if err != nil {
+			return manifest, err
+		}
+
+		manifest = Manifest{MANIFEST_VERSION, normalizer, uuid, nil, opts.indexKeys()}
+		return manifest, WriteManifest(dir, manifest)
+	}
+
+	if manifest.KeyNormalizer != normalizer {
+		return manifest, fmt.Errorf("Store keys were normalized with %s, not %s.",
+			manifest.KeyNormalizer, normalizer)
+	}
+
+	// Manifests written before stores had an identity get one now.
+	if manifest.Uuid == "" {
+		if manifest.Uuid, err = newUuid(); err != nil {
+			return manifest, err
+		}
+		if err := WriteManifest(dir, manifest); err != nil {
+			return manifest, err
+		}
+	}
+
+	if manifest.IndexKeys != opts.indexKeys() {
+		return manifest, rekeyIndex(dir, manifest, opts)
+	}
+
+	return manifest, nil
+}
+
+// rekeyIndex removes an index keyed the other way, so opening rebuilds it
+// from the data log, then records the new key scheme.
+func rekeyIndex(dir string, manifest Manifest, opts Options) error {
+	opts.Logger.Infof("Index keys change from %q to %q, rebuilding the index from the data log.",
+		manifest.IndexKeys, opts.indexKeys())
+	for _, name := range []string{INDEX_FILE, INDEX_LOG_FILE} {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	manifest.IndexKeys = opts.indexKeys()
+	return WriteManifest(dir, manifest)
+}
+
+// newUuid makes a random (version 4) UUID.
+func newUuid() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
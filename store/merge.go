@@ -0,0 +1,156 @@
+package kvstore
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"sort"
+)
+
+// Iterator walks the stored keys in sorted order. It merges the commands not
+// flushed yet over the records of the data log, the newest write of a key
+// wins and an unflushed delete hides the key, so it agrees with Get. It
+// sees the store as it was when NewIterator was called.
+type Iterator struct {
+	store    *KvStore
+	memtable []Command
+	disk     []KvPair
+	mem      int
+	pos      int
+	current  string
+	// command is the unflushed write of the current key, offset its record
+	// when it has none.
+	command *Command
+	offset  int64
+	file    BackendFile
+	reader  *bufio.Reader
+}
+
+// NewIterator snapshots the unflushed commands before reading the index, a
+// command flushed in between is then seen in both and the unflushed copy
+// wins, rather than in neither.
+func (k *KvStore) NewIterator() (*Iterator, error) {
+	if err := k.awaitRecovery(context.Background()); err != nil {
+		return nil, err
+	}
+
+	latest := make(map[string]Command)
+	for _, cmd := range k.pending.Snapshot() {
+		if cmd.Type == PUT_COMMAND || cmd.Type == DEL_COMMAND {
+			latest[cmd.Key] = cmd
+		}
+	}
+
+	memtable := make([]Command, 0, len(latest))
+	for _, cmd := range latest {
+		memtable = append(memtable, cmd)
+	}
+	sort.Slice(memtable, func(i, j int) bool { return memtable[i].Key < memtable[j].Key })
+
+	disk, err := k.diskKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Iterator{k, memtable, disk, 0, 0, "", nil, 0, nil, nil}, nil
+}
+
+// diskKeys reads the key of every record the index points at, sorted by key.
+func (k *KvStore) diskKeys() ([]KvPair, error) {
+	offsets := liveOffsets(k.IndexCache)
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	path := k.options.path(STORAGE_FILE)
+	keys, err := readKeysAt(k.options.Backend, path, offsets, int(k.options.ReadAheadSize))
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := make([]KvPair, len(keys))
+	for i, key := range keys {
+		pairs[i] = KvPair{key, false, offsets[i], nil, false}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+
+	return pairs, nil
+}
+
+// Seek moves the iterator so the next call to Next stops at the first key
+// not before key.
+func (it *Iterator) Seek(key string) {
+	it.mem = sort.Search(len(it.memtable), func(i int) bool { return it.memtable[i].Key >= key })
+	it.pos = sort.Search(len(it.disk), func(i int) bool { return it.disk[i].Key >= key })
+}
+
+func (it *Iterator) Next() bool {
+	for {
+		hasMem, hasDisk := it.mem < len(it.memtable), it.pos < len(it.disk)
+		switch {
+		case !hasMem && !hasDisk:
+			return false
+		case hasMem && (!hasDisk || it.memtable[it.mem].Key <= it.disk[it.pos].Key):
+			cmd := &it.memtable[it.mem]
+			it.mem++
+			if hasDisk && it.disk[it.pos].Key == cmd.Key {
+				it.pos++
+			}
+			if cmd.Type == DEL_COMMAND {
+				continue
+			}
+
+			it.current, it.command = cmd.Key, cmd
+			return true
+		default:
+			pair := it.disk[it.pos]
+			it.pos++
+			it.current, it.command, it.offset = pair.Key, nil, pair.Offset
+			return true
+		}
+	}
+}
+
+func (it *Iterator) Key() string {
+	return it.current
+}
+
+// Value reads the current key's value, from the data log unless it has an
+// unflushed write.
+func (it *Iterator) Value() (string, error) {
+	if it.command != nil {
+		return it.command.Value, nil
+	}
+
+	opts := it.store.options
+	if it.file == nil {
+		file, err := opts.Backend.Open(opts.path(STORAGE_FILE))
+		if err != nil {
+			return "", err
+		}
+		it.file = file
+		it.reader = bufio.NewReaderSize(file, int(opts.ReadAheadSize))
+	}
+
+	if _, err := it.file.Seek(it.offset, io.SeekStart); err != nil {
+		return "", err
+	}
+	it.reader.Reset(it.file)
+
+	_, value, checksum, _, err := readKvRecord(it.reader)
+	if err != nil {
+		return "", err
+	}
+
+	if value, err = decryptValue(opts.Encryption, value); err != nil {
+		return "", err
+	}
+
+	return value, verifyChecksum(value, checksum)
+}
+
+func (it *Iterator) Close() error {
+	if it.file == nil {
+		return nil
+	}
+
+	return it.file.Close()
+}
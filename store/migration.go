@@ -0,0 +1,204 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+)
+
+const (
+	MIGRATION_LOCK_STRIPES int = 64
+	MIGRATION_SCAN_COUNT   int = 500
+)
+
+var ErrBackfillRunning error = errors.New("Backfill is already running.")
+
+// ScanStore is a Store whose keys can be paged through like KvStore.Scan.
+type ScanStore interface {
+	Store
+	Scan(cursor string, count int) (keys []string, next string, err error)
+}
+
+type MigrationProgress struct {
+	// Scanned keys of the old store, Copied to the new one and Skipped
+	// because the new one already had them.
+	Scanned int    `json:"scanned"`
+	Copied  int    `json:"copied"`
+	Skipped int    `json:"skipped"`
+	Cursor  string `json:"cursor"`
+	Running bool   `json:"running"`
+	Done    bool   `json:"done"`
+	Err     string `json:"err,omitempty"`
+}
+
+// MigrationStore moves data from Old to New while serving traffic. Writes go
+// to both, reads come from New and fall back to Old for keys not copied yet,
+// and Backfill copies the rest in the background. Once the backfill is done
+// New holds everything and can replace the MigrationStore.
+type MigrationStore struct {
+	Old      ScanStore
+	New      Store
+	stripes  []sync.Mutex
+	lock     sync.Mutex
+	progress MigrationProgress
+}
+
+func NewMigrationStore(old ScanStore, newStore Store) *MigrationStore {
+	return &MigrationStore{old, newStore, make([]sync.Mutex, MIGRATION_LOCK_STRIPES),
+		sync.Mutex{}, MigrationProgress{}}
+}
+
+// lockKey keeps a backfill copy of key from racing a write of it.
+func (m *MigrationStore) lockKey(key string) func() {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	stripe := &m.stripes[hash.Sum32()%uint32(len(m.stripes))]
+	stripe.Lock()
+	return stripe.Unlock
+}
+
+// Put writes Old first, so a failed write never leaves New ahead of it.
+func (m *MigrationStore) Put(key string, value string) error {
+	defer m.lockKey(key)()
+	if err := m.Old.Put(key, value); err != nil {
+		return err
+	}
+
+	return m.New.Put(key, value)
+}
+
+func (m *MigrationStore) Get(key string) (string, error) {
+	value, err := m.New.Get(key)
+	if isNotFound(err) {
+		return m.Old.Get(key)
+	}
+
+	return value, err
+}
+
+func (m *MigrationStore) Del(key string) error {
+	defer m.lockKey(key)()
+	err := m.Old.Del(key)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	if newErr := m.New.Del(key); newErr != nil && !isNotFound(newErr) {
+		return newErr
+	}
+
+	return err
+}
+
+func (m *MigrationStore) Progress() MigrationProgress {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.progress
+}
+
+// CutoverSafe reports whether a backfill has copied every key, after which
+// reads no longer need Old.
+func (m *MigrationStore) CutoverSafe() bool {
+	return m.Progress().Done
+}
+
+// StartBackfill runs Backfill in the background.
+func (m *MigrationStore) StartBackfill(ctx context.Context) error {
+	if err := m.begin(); err != nil {
+		return err
+	}
+
+	go m.run(ctx)
+	return nil
+}
+
+// Backfill copies every key of Old that New does not have, page by page,
+// until ctx is done.
+func (m *MigrationStore) Backfill(ctx context.Context) error {
+	if err := m.begin(); err != nil {
+		return err
+	}
+
+	return m.run(ctx)
+}
+
+func (m *MigrationStore) begin() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.progress.Running {
+		return ErrBackfillRunning
+	}
+
+	m.progress = MigrationProgress{Running: true}
+	return nil
+}
+
+func (m *MigrationStore) run(ctx context.Context) error {
+	err := m.backfill(ctx)
+
+	m.lock.Lock()
+	m.progress.Running = false
+	m.progress.Done = err == nil
+	if err != nil {
+		m.progress.Err = err.Error()
+	}
+	m.lock.Unlock()
+
+	return err
+}
+
+func (m *MigrationStore) backfill(ctx context.Context) error {
+	cursor := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		keys, next, err := m.Old.Scan(cursor, MIGRATION_SCAN_COUNT)
+		if err != nil {
+			return err
+		}
+
+		copied := 0
+		for _, key := range keys {
+			ok, err := m.copyKey(key)
+			if err != nil {
+				return err
+			}
+			if ok {
+				copied++
+			}
+		}
+
+		m.lock.Lock()
+		m.progress.Scanned += len(keys)
+		m.progress.Copied += copied
+		m.progress.Skipped += len(keys) - copied
+		m.progress.Cursor = next
+		m.lock.Unlock()
+
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// copyKey copies key to New unless New has it or it was deleted meanwhile.
+func (m *MigrationStore) copyKey(key string) (bool, error) {
+	defer m.lockKey(key)()
+	if _, err := m.New.Get(key); !isNotFound(err) {
+		return false, err
+	}
+
+	value, err := m.Old.Get(key)
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, m.New.Put(key, value)
+}
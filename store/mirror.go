@@ -0,0 +1,181 @@
+package kvstore
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	DEFAULT_MIRROR_QUEUE_SIZE int = 1024
+	DEFAULT_MIRROR_WORKERS    int = 4
+)
+
+type MirrorOptions struct {
+	// ReadPercent is the share of Gets, from 0 to 100, repeated on the
+	// shadow and compared.
+	ReadPercent float64
+	// MirrorWrites also applies every successful Put and Del to the shadow,
+	// so it keeps up with the primary.
+	MirrorWrites bool
+	// QueueSize bounds the work waiting for the shadow, work that does not
+	// fit is dropped rather than slowing the primary down.
+	QueueSize int
+	Workers   int
+	// OnMismatch is called from a worker for every difference found.
+	OnMismatch func(Mismatch)
+}
+
+// Mismatch is a mirrored operation the shadow answered differently. Errors
+// are compared by whether they mean the key is missing.
+type Mismatch struct {
+	Op         string `json:"op"`
+	Key        string `json:"key"`
+	Primary    string `json:"primary"`
+	Shadow     string `json:"shadow"`
+	PrimaryErr string `json:"primaryErr,omitempty"`
+	ShadowErr  string `json:"shadowErr,omitempty"`
+}
+
+type MirrorStats struct {
+	Mirrored   uint64 `json:"mirrored"`
+	Mismatches uint64 `json:"mismatches"`
+	Dropped    uint64 `json:"dropped"`
+}
+
+type mirrorWork struct {
+	command    Command
+	primary    string
+	primaryErr error
+}
+
+// MirrorStore serves every operation from Primary and repeats some of them
+// on Shadow in the background, so a new engine can be checked against live
+// traffic before it takes over. Work for one key always goes to the same
+// worker, so the shadow sees a key's writes and reads in order.
+type MirrorStore struct {
+	Primary Store
+	Shadow  Store
+	options MirrorOptions
+	queues  []chan mirrorWork
+	wg      sync.WaitGroup
+	stats   MirrorStats
+}
+
+func NewMirrorStore(primary Store, shadow Store, opts MirrorOptions) *MirrorStore {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DEFAULT_MIRROR_QUEUE_SIZE
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = DEFAULT_MIRROR_WORKERS
+	}
+
+	m := &MirrorStore{primary, shadow, opts, make([]chan mirrorWork, opts.Workers),
+		sync.WaitGroup{}, MirrorStats{}}
+	for i := range m.queues {
+		m.queues[i] = make(chan mirrorWork, opts.QueueSize/opts.Workers+1)
+		m.wg.Add(1)
+		go m.work(m.queues[i])
+	}
+
+	return m
+}
+
+func (m *MirrorStore) Get(key string) (string, error) {
+	value, err := m.Primary.Get(key)
+	if rand.Float64()*100 < m.options.ReadPercent {
+		m.mirror(mirrorWork{Command{GET_COMMAND, key, "", "", WRITE_BACK, nil, 0, ""}, value, err})
+	}
+
+	return value, err
+}
+
+func (m *MirrorStore) Put(key string, value string) error {
+	err := m.Primary.Put(key, value)
+	if err == nil && m.options.MirrorWrites {
+		m.mirror(mirrorWork{Command{PUT_COMMAND, key, value, "", WRITE_BACK, nil, 0, ""}, "", nil})
+	}
+
+	return err
+}
+
+func (m *MirrorStore) Del(key string) error {
+	err := m.Primary.Del(key)
+	if err == nil && m.options.MirrorWrites {
+		m.mirror(mirrorWork{Command{DEL_COMMAND, key, "", "", WRITE_BACK, nil, 0, ""}, "", nil})
+	}
+
+	return err
+}
+
+func (m *MirrorStore) Stats() MirrorStats {
+	return MirrorStats{atomic.LoadUint64(&m.stats.Mirrored),
+		atomic.LoadUint64(&m.stats.Mismatches), atomic.LoadUint64(&m.stats.Dropped)}
+}
+
+// Close waits for queued work to reach the shadow. Operations must not be
+// sent after it.
+func (m *MirrorStore) Close() {
+	for _, queue := range m.queues {
+		close(queue)
+	}
+	m.wg.Wait()
+}
+
+func (m *MirrorStore) mirror(work mirrorWork) {
+	hash := fnv.New32a()
+	hash.Write([]byte(work.command.Key))
+	select {
+	case m.queues[hash.Sum32()%uint32(len(m.queues))] <- work:
+	default:
+		atomic.AddUint64(&m.stats.Dropped, 1)
+	}
+}
+
+func (m *MirrorStore) work(queue chan mirrorWork) {
+	defer m.wg.Done()
+	for work := range queue {
+		atomic.AddUint64(&m.stats.Mirrored, 1)
+		command := work.command
+		var value string
+		var err error
+		switch command.Type {
+		case GET_COMMAND:
+			value, err = m.Shadow.Get(command.Key)
+			if sameResult(work.primary, work.primaryErr, value, err) {
+				continue
+			}
+		case PUT_COMMAND:
+			if err = m.Shadow.Put(command.Key, command.Value); err == nil {
+				continue
+			}
+		case DEL_COMMAND:
+			if err = m.Shadow.Del(command.Key); err == nil || isNotFound(err) {
+				continue
+			}
+		}
+
+		atomic.AddUint64(&m.stats.Mismatches, 1)
+		if m.options.OnMismatch != nil {
+			m.options.OnMismatch(Mismatch{command.Type, command.Key, work.primary, value,
+				errorText(work.primaryErr), errorText(err)})
+		}
+	}
+}
+
+func sameResult(primary string, primaryErr error, shadow string, shadowErr error) bool {
+	if primaryErr != nil || shadowErr != nil {
+		return isNotFound(primaryErr) && isNotFound(shadowErr)
+	}
+
+	return primary == shadow
+}
+
+func errorText(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	return err.Error()
+}
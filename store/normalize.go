@@ -0,0 +1,83 @@
+package kvstore
+
+import (
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const NO_NORMALIZER string = "none"
+
+// KeyNormalizer rewrites keys before every Put, Get and Del. Its Name is
+// recorded in the manifest so a store is always reopened with the same
+// normalization.
+type KeyNormalizer interface {
+	Name() string
+	Normalize(key string) string
+}
+
+type LowercaseNormalizer struct{}
+
+func (l LowercaseNormalizer) Name() string {
+	return "lower"
+}
+
+func (l LowercaseNormalizer) Normalize(key string) string {
+	return strings.ToLower(key)
+}
+
+type TrimNormalizer struct{}
+
+func (t TrimNormalizer) Name() string {
+	return "trim"
+}
+
+func (t TrimNormalizer) Normalize(key string) string {
+	return strings.TrimSpace(key)
+}
+
+type NfcNormalizer struct{}
+
+func (n NfcNormalizer) Name() string {
+	return "nfc"
+}
+
+func (n NfcNormalizer) Normalize(key string) string {
+	return norm.NFC.String(key)
+}
+
+// ChainNormalizer applies its normalizers in order.
+type ChainNormalizer []KeyNormalizer
+
+func (c ChainNormalizer) Name() string {
+	names := make([]string, 0, len(c))
+	for _, n := range c {
+		names = append(names, n.Name())
+	}
+
+	return strings.Join(names, "+")
+}
+
+func (c ChainNormalizer) Normalize(key string) string {
+	for _, n := range c {
+		key = n.Normalize(key)
+	}
+
+	return key
+}
+
+func normalizerName(normalizer KeyNormalizer) string {
+	if normalizer == nil {
+		return NO_NORMALIZER
+	}
+
+	return normalizer.Name()
+}
+
+func (k *KvStore) normalizeKey(key string) string {
+	if k.options.KeyNormalizer == nil {
+		return key
+	}
+
+	return k.options.KeyNormalizer.Normalize(key)
+}
@@ -0,0 +1,242 @@
+package kvstore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// MAX_OPERATION_ID_SIZE is the longest operation ID PutOnce and DelOnce take.
+const MAX_OPERATION_ID_SIZE int = 128
+
+var ErrOperationsDisabled error = errors.New("Operation IDs are off, set Options.OperationWindow.")
+var ErrOperationMismatch error = errors.New("Operation ID was used for a different write.")
+var ErrInvalidOperationId error = errors.New("Operation ID is empty, too long or not a single line.")
+
+// operation is a write made under an operation ID, done is closed once it
+// has been made.
+type operation struct {
+	typ  string
+	key  string
+	done chan struct{}
+	err  error
+}
+
+// OperationIds remembers the newest Options.OperationWindow operation IDs
+// written, so PutOnce and DelOnce can skip writes already made. The IDs are
+// kept in the data log records, a restarted store reads them back from it
+// and followers see them in the changes they apply.
+type OperationIds struct {
+	lock   sync.Mutex
+	window int
+	seen   map[string]*operation
+	order  []string
+}
+
+func newOperationIds(window int) *OperationIds {
+	if window <= 0 {
+		return nil
+	}
+
+	return &OperationIds{sync.Mutex{}, window, make(map[string]*operation), make([]string, 0)}
+}
+
+// claim returns the write made under id, true when it was claimed before.
+// Otherwise the caller has claimed it and must finish it.
+func (o *OperationIds) claim(id string, typ string, key string) (*operation, bool, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if op, ok := o.seen[id]; ok {
+		if op.typ != typ || op.key != key {
+			return nil, false, ErrOperationMismatch
+		}
+		return op, true, nil
+	}
+
+	op := &operation{typ, key, make(chan struct{}), nil}
+	o.add(id, op)
+	return op, false, nil
+}
+
+// finish records how a claimed write went, a failed one is forgotten so a
+// retry makes it again.
+func (o *OperationIds) finish(id string, op *operation, err error) {
+	o.lock.Lock()
+	if err != nil && o.seen[id] == op {
+		delete(o.seen, id)
+	}
+	o.lock.Unlock()
+
+	op.err = err
+	close(op.done)
+}
+
+// add remembers op, forgetting the oldest IDs past the window. The caller
+// holds lock.
+func (o *OperationIds) add(id string, op *operation) {
+	o.seen[id] = op
+	o.order = append(o.order, id)
+	for len(o.order) > o.window {
+		oldest := o.order[0]
+		o.order = o.order[1:]
+		if seen, ok := o.seen[oldest]; ok && isDone(seen) {
+			delete(o.seen, oldest)
+		}
+	}
+}
+
+func isDone(op *operation) bool {
+	select {
+	case <-op.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// load reads the operation IDs of the data log's records.
+func (o *OperationIds) load(opts Options) error {
+	if o == nil {
+		return nil
+	}
+
+	path := opts.path(STORAGE_FILE)
+	file, err := opts.Backend.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(logStart(opts.Backend, path), io.SeekStart); err != nil {
+		return err
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	reader := bufio.NewReaderSize(file, int(opts.ReadAheadSize))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line == "" {
+			return nil
+		}
+
+		record, _, parseErr := parseKvRecord(line)
+		if parseErr != nil || recordOperation(record) == "" {
+			continue
+		}
+
+		typ := PUT_COMMAND
+		if isTombstone(record) {
+			typ = DEL_COMMAND
+		}
+		done := make(chan struct{})
+		close(done)
+		o.add(recordOperation(record), &operation{typ, record[0], done, nil})
+	}
+}
+
+// operationRecord adds the operation ID column to a stamped record, after
+// an empty expiry column when the record has none.
+func operationRecord(record []string, id string) []string {
+	if id == "" {
+		return record
+	}
+
+	for len(record) < 6 {
+		record = append(record, "")
+	}
+
+	return append(record, id)
+}
+
+// recordOperation is the operation ID of a data log record, empty when it
+// was written without one.
+func recordOperation(record []string) string {
+	if len(record) < 7 {
+		return ""
+	}
+
+	return record[6]
+}
+
+func checkOperationId(id string) error {
+	if id == "" || len(id) > MAX_OPERATION_ID_SIZE || !lineSafe(id) {
+		return ErrInvalidOperationId
+	}
+
+	return nil
+}
+
+// PutOnce is Put under an operation ID chosen by the caller, a retry with
+// the same ID returns without writing again, once the first write went
+// through. An ID reused for another key or a Del fails with
+// ErrOperationMismatch.
+func (k *KvStore) PutOnce(id string, key string, value string) error {
+	if k.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return k.once(id, PUT_COMMAND, key, func() error {
+		return k.put(context.Background(), key, value, k.options.WriteMode,
+			formatChecksum(Checksum([]byte(value))), 0, id)
+	})
+}
+
+// DelOnce is Del under an operation ID, like PutOnce.
+func (k *KvStore) DelOnce(id string, key string) error {
+	if k.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return k.once(id, DEL_COMMAND, key, func() error {
+		return k.del(context.Background(), key, k.options.WriteMode, 0, id)
+	})
+}
+
+// TracksOperations is whether PutOnce and DelOnce are on.
+func (k *KvStore) TracksOperations() bool {
+	return k.operations != nil
+}
+
+// once makes write unless a write under id was made already. A retry that
+// arrives while the first write is being made waits for it, and makes the
+// write itself if that one failed.
+func (k *KvStore) once(id string, typ string, key string, write func() error) error {
+	if k.operations == nil {
+		return ErrOperationsDisabled
+	}
+	if err := checkOperationId(id); err != nil {
+		return err
+	}
+	// The IDs already in the data log are only known once it is recovered.
+	if err := k.awaitRecovery(context.Background()); err != nil {
+		return err
+	}
+
+	key = k.normalizeKey(key)
+	for {
+		op, seen, err := k.operations.claim(id, typ, key)
+		if err != nil {
+			return err
+		}
+		if !seen {
+			err := write()
+			k.operations.finish(id, op, err)
+			return err
+		}
+
+		<-op.done
+		if op.err == nil {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package kvstore
+
+import (
+	"path/filepath"
+	"time"
+)
+
+const (
+	DEFAULT_READ_TIMEOUT     time.Duration = 5 * time.Second
+	DEFAULT_READ_RETRIES     int           = 2
+	DEFAULT_SHUTDOWN_TIMEOUT time.Duration = 30 * time.Second
+	DEFAULT_READ_AHEAD_SIZE  Size          = 4 * KB
+	DEFAULT_FLUSH_INTERVAL   time.Duration = 100 * time.Millisecond
+	DEFAULT_CACHE_SIZE       int           = 1000
+	DEFAULT_MAX_KEY_SIZE     Size          = 1 * KB
+	DEFAULT_MAX_VALUE_SIZE   Size          = 1 * MB
+	DEFAULT_DIR              string        = "./" + STORAGE_DIR
+	DEFAULT_MIN_FREE_SPACE   Size          = 64 * MB
+	DEFAULT_HEALTH_DEADLINE  time.Duration = 2 * time.Second
+)
+
+// WriteMode decides when Put and Del return. WRITE_BACK returns once the
+// command is buffered, WRITE_THROUGH once it is appended to the data log and
+// WRITE_THROUGH_SYNC once the data log is also fsynced.
+type WriteMode int
+
+const (
+	WRITE_BACK         WriteMode = 0
+	WRITE_THROUGH      WriteMode = 1
+	WRITE_THROUGH_SYNC WriteMode = 2
+)
+
+type Options struct {
+	// Dir holds the data log, index and manifest of the store.
+	Dir string
+	// Engine picks the store OpenEngine opens, ENGINE_LOG (the default),
+	// ENGINE_LSM or ENGINE_HASH. MemtableSize and LsmLevelSegments tune the
+	// LsmStore, the HashStore rotates its data files at MaxLogSize.
+	Engine           string
+	MemtableSize     Size
+	LsmLevelSegments int
+	Encryption       EncryptionProvider
+	// IndexCodec serializes the index file, any registered codec can read
+	// the file back regardless of which one is configured.
+	IndexCodec IndexCodec
+	// IndexKeyHash keys the index by the xxhash64 of each key instead of
+	// its first 15 characters, so long keys sharing a prefix each get their
+	// own entry and a Get reads one record. Changing it rebuilds the index
+	// from the data log on open.
+	IndexKeyHash bool
+	// ReadTimeout bounds each Get that has to go to disk, zero disables it.
+	ReadTimeout time.Duration
+	ReadRetries int
+	// ShutdownTimeout bounds how long Shutdown waits for buffered data to be
+	// saved, zero waits forever.
+	ShutdownTimeout time.Duration
+	// ReadAheadSize is how many bytes a disk read buffers past the record it
+	// wants, larger values help Gets that scan colliding partial keys.
+	ReadAheadSize Size
+	// FlushInterval flushes buffered log and index items that have not reached
+	// their count threshold, zero only flushes on the thresholds.
+	FlushInterval time.Duration
+	// CacheSize is the number of values kept in the read cache, evicted by
+	// CachePolicy (ARC_POLICY, LRU_POLICY or TWO_QUEUE_POLICY).
+	CacheSize   int
+	CachePolicy string
+	// CacheMaxBytes also bounds the cache by key and value bytes, zero
+	// leaves it bounded by CacheSize alone.
+	CacheMaxBytes Size
+	// CompactionSampleSize is how many live records EstimateCompaction reads
+	// to estimate record sizes.
+	CompactionSampleSize int
+	// NegativeCacheSize is how many keys recently found missing are
+	// remembered so repeated misses skip the index and disk, zero disables
+	// it. A Put of the key forgets it.
+	NegativeCacheSize int
+	// KeyNormalizer rewrites keys on every operation, nil keeps them as given.
+	KeyNormalizer KeyNormalizer
+	WriteMode     WriteMode
+	// IndexShards is how many independently locked shards the partial key
+	// index is split into.
+	IndexShards int
+	// JobHistorySize is how many finished jobs are kept for querying.
+	JobHistorySize int
+	// MaxKeySize and MaxValueSize are the largest key and value in bytes Put
+	// accepts.
+	MaxKeySize   Size
+	MaxValueSize Size
+	// BackgroundRecovery returns from NewKvStoreWithOptions before the index
+	// is loaded. Operations until then wait for it, or return ErrRecovering
+	// with FailWhileRecovering.
+	BackgroundRecovery  bool
+	FailWhileRecovering bool
+	// LazyRecovery recovers in the background too, but buffers Puts and
+	// Dels at once, up to LOG_FLUSH_THRESHOLD of them, and answers Gets
+	// from the write buffer and cache. Other Gets wait for the index, or
+	// with ScanWhileRecovering read the whole data log for the key.
+	LazyRecovery        bool
+	ScanWhileRecovering bool
+	// RecoveryProgress, when set, is called as loading the index reads the
+	// data log past the index file, with the log offset reached and the
+	// log's size, every RECOVERY_PROGRESS_BYTES and once done.
+	RecoveryProgress func(offset int64, size int64)
+	// FlushJournalSize is how many recent log and index flushes are kept for
+	// KvStore.FlushJournal, zero disables the journal.
+	FlushJournalSize int
+	// FlushWorkers encrypt a flush batch in parallel, CompactionWorkers read
+	// compaction samples and ReadWorkers split long collision scans. They
+	// default to GOMAXPROCS, CompactionWorkers to half of it.
+	FlushWorkers      int
+	CompactionWorkers int
+	ReadWorkers       int
+	// Clock drives the flush interval and flush journal times, a SimClock
+	// lets them be stepped without sleeping.
+	Clock Clock
+	// Backend holds the data log, FileBackend by default.
+	Backend Backend
+	// MaxLogSize rotates the data log into a new segment once it would grow
+	// past this many bytes, zero never rotates. Sealed segments holding only
+	// overwritten or deleted records are removed once outside both
+	// RetainSegments, a count of the newest sealed segments, and RetainAge.
+	// With neither set every segment is kept.
+	MaxLogSize     Size
+	RetainSegments int
+	RetainAge      time.Duration
+	// IndexMemoryBudget keeps the index on disk as a sorted table (see
+	// TableIndex), reading blocks of it on demand and keeping at most this
+	// many bytes of them in memory. Zero loads the whole index at startup.
+	// Encrypted stores always load it whole.
+	IndexMemoryBudget Size
+	// SparseIndexInterval also keeps the index on disk as a table, with one
+	// key in every SparseIndexInterval held in memory. A lookup reads the
+	// block after that key, so it costs one disk read unless the block is
+	// within IndexMemoryBudget. The data log is not sorted, so this indexes
+	// the index table rather than the log.
+	SparseIndexInterval int
+	// RetainVersions is how many values of each key, the current one
+	// included, KvStore.History can read back and Compact keeps. One or
+	// less keeps only the current value.
+	RetainVersions int
+	// ExpiryScanInterval turns on KvStore.PutWithTTL, with a janitor that
+	// deletes expired keys every interval, ExpiryBatchSize of them at most
+	// (DEFAULT_EXPIRY_BATCH_SIZE when zero). Zero turns expiration off.
+	ExpiryScanInterval time.Duration
+	ExpiryBatchSize    int
+	// WriteBufferSize bounds how many writes may wait to be flushed to the
+	// data log, zero leaves it unbounded. Once it is full Backpressure
+	// decides what a write does: BACKPRESSURE_BLOCK, the default, waits up
+	// to WriteBufferTimeout (zero is forever) for a flush and
+	// BACKPRESSURE_FAIL fails at once. Either way a write turned away
+	// returns ErrWriteBufferFull.
+	WriteBufferSize    int
+	Backpressure       string
+	WriteBufferTimeout time.Duration
+	// MinFreeSpace is the free disk space below which HealthCheck reports
+	// the store unhealthy, zero skips the check. HealthDeadline bounds how
+	// long the log flusher may take to answer a health check.
+	MinFreeSpace   Size
+	HealthDeadline time.Duration
+	// MaxDiskSize caps the bytes the storage directory may take up, zero
+	// leaves it uncapped. Puts past it fail with ErrQuotaExceeded, Dels
+	// still go through. With QuotaPolicy QUOTA_RECLAIM going over also has
+	// the next index checkpoint remove every sealed data log segment with
+	// no live records, whatever RetainSegments and RetainAge say.
+	MaxDiskSize Size
+	QuotaPolicy string
+	// OperationWindow turns on KvStore.PutOnce and DelOnce, which remember
+	// the newest OperationWindow operation IDs to skip writes made already.
+	// Zero turns them off.
+	OperationWindow int
+	// IndexLogBatches is how many index flushes make up a checkpoint cycle,
+	// one full rewrite of the index followed by appends of only the changed
+	// keys to the index log. One or less rewrites the index every flush.
+	IndexLogBatches int
+	// ReadOnly rejects Put and Del with ErrReadOnly, only Apply writes.
+	ReadOnly bool
+	// Logger gets the store's progress and errors, NopLogger by default.
+	Logger Logger
+	// LogSampling thins out the Debug lines logged for every record, keyed
+	// by LOG_GET_MISS, LOG_INDEX or LOG_WRITE. A value of n logs one line in
+	// n, a negative value none, and a missing or zero value every line.
+	LogSampling map[string]int
+	sampler     *logSampler
+	// Tracer gets a span for each Get, Put, Del, log and index flush and
+	// compaction when set, tracing is off by default.
+	Tracer Tracer
+	// SlowThreshold logs each Get, Put and Del slower than it at Info, with
+	// where the value came from and the offsets read. Zero logs none.
+	SlowThreshold time.Duration
+	// PrefixDepth is how many PrefixSeparator delimited parts of a key make
+	// up its prefix for KvStore.PrefixStats, zero turns prefix stats off.
+	PrefixDepth     int
+	PrefixSeparator string
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Dir:                  DEFAULT_DIR,
+		Encryption:           NoEncryption{},
+		IndexCodec:           JsonIndexCodec{},
+		ReadTimeout:          DEFAULT_READ_TIMEOUT,
+		ReadRetries:          DEFAULT_READ_RETRIES,
+		ShutdownTimeout:      DEFAULT_SHUTDOWN_TIMEOUT,
+		ReadAheadSize:        DEFAULT_READ_AHEAD_SIZE,
+		FlushInterval:        DEFAULT_FLUSH_INTERVAL,
+		CacheSize:            DEFAULT_CACHE_SIZE,
+		CachePolicy:          ARC_POLICY,
+		CompactionSampleSize: DEFAULT_COMPACTION_SAMPLE_SIZE,
+		IndexShards:          DEFAULT_INDEX_SHARDS,
+		IndexLogBatches:      DEFAULT_INDEX_LOG_BATCHES,
+		MinFreeSpace:         DEFAULT_MIN_FREE_SPACE,
+		HealthDeadline:       DEFAULT_HEALTH_DEADLINE,
+		MaxKeySize:           DEFAULT_MAX_KEY_SIZE,
+		MaxValueSize:         DEFAULT_MAX_VALUE_SIZE,
+		FlushWorkers:         defaultWorkers(),
+		CompactionWorkers:    defaultCompactionWorkers(),
+		ReadWorkers:          defaultWorkers(),
+		Clock:                RealClock{},
+		Backend:              FileBackend{},
+		Logger:               NopLogger{},
+	}
+}
+
+// Option tunes one setting for NewKvStore.
+type Option func(opts *Options)
+
+func WithCacheSize(size int) Option {
+	return func(opts *Options) {
+		opts.CacheSize = size
+	}
+}
+
+func WithFlushInterval(interval time.Duration) Option {
+	return func(opts *Options) {
+		opts.FlushInterval = interval
+	}
+}
+
+// WithSyncMode sets the WriteMode of Put and Del.
+func WithSyncMode(mode WriteMode) Option {
+	return func(opts *Options) {
+		opts.WriteMode = mode
+	}
+}
+
+func WithLogger(logger Logger) Option {
+	return func(opts *Options) {
+		opts.Logger = logger
+	}
+}
+
+// WithLogSampling logs one in every n Debug lines of the hot path op, see
+// Options.LogSampling.
+func WithLogSampling(op string, n int) Option {
+	return func(opts *Options) {
+		sampling := make(map[string]int, len(opts.LogSampling)+1)
+		for name, every := range opts.LogSampling {
+			sampling[name] = every
+		}
+		sampling[op] = n
+		opts.LogSampling = sampling
+	}
+}
+
+// path is where the store file name lives in Dir.
+func (o Options) path(name string) string {
+	return filepath.Join(o.Dir, name)
+}
@@ -0,0 +1,55 @@
+package kvstore
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// PackedOffsets holds the offsets of a partial key that has several, sorted
+// and delta encoded as uvarints. A key with a single offset is stored as a
+// bare int64 instead, which is the common case and needs no slice at all.
+type PackedOffsets []byte
+
+func packOffsets(offsets []int64) interface{} {
+	if len(offsets) == 1 {
+		return offsets[0]
+	}
+
+	sorted := make([]int64, len(offsets))
+	copy(sorted, offsets)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	packed := make([]byte, 0, 2*len(sorted))
+	var previous int64
+	for _, off := range sorted {
+		packed = appendUvarint(packed, uint64(off-previous))
+		previous = off
+	}
+
+	return PackedOffsets(packed)
+}
+
+// unpackOffsets reads index cache values written by packOffsets.
+func unpackOffsets(value interface{}) ([]int64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return []int64{v}, true
+	case PackedOffsets:
+		offsets := make([]int64, 0, len(v)/2)
+		var previous int64
+		for len(v) > 0 {
+			delta, n := binary.Uvarint(v)
+			if n <= 0 {
+				return nil, false
+			}
+			previous += int64(delta)
+			offsets = append(offsets, previous)
+			v = v[n:]
+		}
+		return offsets, true
+	case []int64:
+		return v, true
+	}
+
+	return nil, false
+}
@@ -0,0 +1,162 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	BACKPRESSURE_BLOCK string = "block"
+	BACKPRESSURE_FAIL  string = "fail"
+)
+
+var ErrWriteBufferFull error = errors.New("Write buffer is full.")
+
+// PendingCommands tracks commands that were accepted by the store but not
+// yet written to the data log, in the order they were buffered. It doubles
+// as a memtable holding the newest unflushed command of each key, so reads
+// see writes the flusher has not reached yet.
+type PendingCommands struct {
+	sync.Mutex
+	commands []Command
+	latest   map[string]Command
+	counts   map[string]int
+	// slots holds a token for each buffered write when the buffer is
+	// bounded, see reserve. blocked and shed count writes that waited for a
+	// slot and writes turned away without one.
+	slots   chan struct{}
+	blocked uint64
+	shed    uint64
+}
+
+func (p *PendingCommands) Add(command Command) {
+	p.Lock()
+	p.commands = append(p.commands, command)
+	p.latest[command.Key] = command
+	p.counts[command.Key]++
+	p.Unlock()
+}
+
+// Done drops the oldest n commands once they have been flushed.
+func (p *PendingCommands) Done(n int) {
+	p.Lock()
+	if n > len(p.commands) {
+		n = len(p.commands)
+	}
+
+	for _, cmd := range p.commands[:n] {
+		p.counts[cmd.Key]--
+		if p.counts[cmd.Key] <= 0 {
+			delete(p.counts, cmd.Key)
+			delete(p.latest, cmd.Key)
+		}
+	}
+	p.commands = p.commands[n:]
+	p.Unlock()
+
+	if p.slots != nil {
+		for i := 0; i < n; i++ {
+			<-p.slots
+		}
+	}
+}
+
+// reserve takes a buffer slot for a write before it is applied, so a write
+// turned away changes nothing. With BACKPRESSURE_FAIL it fails at once when
+// the buffer is full, otherwise it waits for a flush to free a slot, for at
+// most timeout unless timeout is zero.
+func (p *PendingCommands) reserve(mode string, timeout time.Duration) error {
+	if p.slots == nil {
+		return nil
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if mode == BACKPRESSURE_FAIL {
+		atomic.AddUint64(&p.shed, 1)
+		return ErrWriteBufferFull
+	}
+
+	atomic.AddUint64(&p.blocked, 1)
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-expired:
+		atomic.AddUint64(&p.shed, 1)
+		return ErrWriteBufferFull
+	}
+}
+
+// release gives back the slot reserved for a write that was not applied.
+func (p *PendingCommands) release() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
+
+// Lookup returns the newest unflushed command for key.
+func (p *PendingCommands) Lookup(key string) (Command, bool) {
+	p.Lock()
+	cmd, ok := p.latest[key]
+	p.Unlock()
+
+	return cmd, ok
+}
+
+func (p *PendingCommands) Snapshot() []Command {
+	p.Lock()
+	snapshot := make([]Command, len(p.commands))
+	copy(snapshot, p.commands)
+	p.Unlock()
+
+	return snapshot
+}
+
+func NewPendingCommands() *PendingCommands {
+	return &PendingCommands{sync.Mutex{}, make([]Command, 0, LOG_FLUSH_THRESHOLD),
+		make(map[string]Command), make(map[string]int), nil, 0, 0}
+}
+
+// newBoundedPendingCommands buffers at most size writes, zero or less is
+// unbounded. The log flusher may hold LOG_FLUSH_THRESHOLD writes waiting for
+// more, so a smaller buffer is raised to that.
+func newBoundedPendingCommands(size int) *PendingCommands {
+	pending := NewPendingCommands()
+	if size > 0 && size < LOG_FLUSH_THRESHOLD {
+		size = LOG_FLUSH_THRESHOLD
+	}
+	if size > 0 {
+		pending.slots = make(chan struct{}, size)
+	}
+
+	return pending
+}
+
+type ShutdownTimeoutError struct {
+	Unflushed []Command
+}
+
+func (e *ShutdownTimeoutError) Error() string {
+	items := make([]string, 0, len(e.Unflushed))
+	for _, cmd := range e.Unflushed {
+		items = append(items, fmt.Sprintf("%s %s", cmd.Type, cmd.Key))
+	}
+
+	return fmt.Sprintf("Shutdown timed out with %d unflushed commands: [%s]",
+		len(e.Unflushed), strings.Join(items, ", "))
+}
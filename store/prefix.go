@@ -0,0 +1,158 @@
+package kvstore
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DEFAULT_PREFIX_SEPARATOR string = ":"
+
+// PrefixStat sizes up and counts the traffic of the keys under one prefix.
+// Keys and Bytes cover records in the data log, so writes still buffered are
+// left out, and rates are averaged since the store was opened.
+type PrefixStat struct {
+	Prefix    string  `json:"prefix"`
+	Keys      int64   `json:"keys"`
+	Bytes     int64   `json:"bytes"`
+	Reads     uint64  `json:"reads"`
+	Writes    uint64  `json:"writes"`
+	ReadRate  float64 `json:"readRate"`
+	WriteRate float64 `json:"writeRate"`
+}
+
+type prefixCounters struct {
+	reads  uint64
+	writes uint64
+}
+
+// prefixTracker counts reads and writes by key prefix.
+type prefixTracker struct {
+	depth     int
+	separator string
+	started   time.Time
+	counters  sync.Map
+}
+
+func newPrefixTracker(opts Options) *prefixTracker {
+	if opts.PrefixDepth <= 0 {
+		return nil
+	}
+
+	separator := opts.PrefixSeparator
+	if separator == "" {
+		separator = DEFAULT_PREFIX_SEPARATOR
+	}
+
+	return &prefixTracker{opts.PrefixDepth, separator, opts.Clock.Now(), sync.Map{}}
+}
+
+// prefix is the first depth parts of key with their separators, keys with
+// fewer parts fall under the empty prefix.
+func (p *prefixTracker) prefix(key string) string {
+	end := 0
+	for i := 0; i < p.depth; i++ {
+		next := strings.Index(key[end:], p.separator)
+		if next < 0 {
+			return ""
+		}
+		end += next + len(p.separator)
+	}
+
+	return key[:end]
+}
+
+func (p *prefixTracker) forKey(key string) *prefixCounters {
+	prefix := p.prefix(key)
+	if counters, ok := p.counters.Load(prefix); ok {
+		return counters.(*prefixCounters)
+	}
+
+	counters, _ := p.counters.LoadOrStore(prefix, &prefixCounters{})
+	return counters.(*prefixCounters)
+}
+
+func (k *KvStore) countRead(key string) {
+	if k.prefixes != nil {
+		atomic.AddUint64(&k.prefixes.forKey(key).reads, 1)
+	}
+}
+
+func (k *KvStore) countWrite(key string) {
+	if k.prefixes != nil {
+		atomic.AddUint64(&k.prefixes.forKey(key).writes, 1)
+	}
+}
+
+// PrefixStats reports every prefix that has keys or traffic, by prefix,
+// reading the key and length of each live record. It is empty unless
+// Options.PrefixDepth is set.
+func (k *KvStore) PrefixStats() ([]PrefixStat, error) {
+	if k.prefixes == nil {
+		return []PrefixStat{}, nil
+	}
+
+	if err := k.awaitRecovery(context.Background()); err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]*PrefixStat)
+	stat := func(prefix string) *PrefixStat {
+		if _, ok := stats[prefix]; !ok {
+			stats[prefix] = &PrefixStat{Prefix: prefix}
+		}
+		return stats[prefix]
+	}
+
+	offsets := liveOffsets(k.IndexCache)
+	if len(offsets) > 0 {
+		storeFile, err := k.options.Backend.Open(k.options.path(STORAGE_FILE))
+		if err != nil {
+			return nil, err
+		}
+		defer storeFile.Close()
+
+		reader := bufio.NewReaderSize(storeFile, int(k.options.ReadAheadSize))
+		for _, off := range offsets {
+			if _, err := storeFile.Seek(off, io.SeekStart); err != nil {
+				return nil, err
+			}
+			reader.Reset(storeFile)
+
+			key, _, _, length, err := readKvRecord(reader)
+			if err != nil {
+				return nil, err
+			}
+
+			prefix := stat(k.prefixes.prefix(key))
+			prefix.Keys++
+			prefix.Bytes += int64(length)
+		}
+	}
+
+	elapsed := k.options.Clock.Now().Sub(k.prefixes.started).Seconds()
+	k.prefixes.counters.Range(func(key, value interface{}) bool {
+		counters := value.(*prefixCounters)
+		prefix := stat(key.(string))
+		prefix.Reads = atomic.LoadUint64(&counters.reads)
+		prefix.Writes = atomic.LoadUint64(&counters.writes)
+		if elapsed > 0 {
+			prefix.ReadRate = float64(prefix.Reads) / elapsed
+			prefix.WriteRate = float64(prefix.Writes) / elapsed
+		}
+		return true
+	})
+
+	list := make([]PrefixStat, 0, len(stats))
+	for _, prefix := range stats {
+		list = append(list, *prefix)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Prefix < list[j].Prefix })
+
+	return list, nil
+}
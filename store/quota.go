@@ -0,0 +1,123 @@
+package kvstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Quota policies, what a Put does once the store is over Options.MaxDiskSize.
+const (
+	QUOTA_REFUSE  string = "refuse"
+	QUOTA_RECLAIM string = "reclaim"
+)
+
+// QUOTA_REFRESH_INTERVAL is how often the storage directory is measured
+// again, Puts in between count their keys and values against the quota.
+const QUOTA_REFRESH_INTERVAL time.Duration = time.Second
+
+var ErrQuotaExceeded error = errors.New("Store is over its disk quota.")
+
+// diskQuota tracks how many bytes the storage directory takes up, nil when
+// Options.MaxDiskSize is not set.
+type diskQuota struct {
+	dir     string
+	limit   Size
+	clock   Clock
+	lock    sync.Mutex
+	used    int64
+	checked time.Time
+}
+
+func newDiskQuota(opts Options) *diskQuota {
+	if opts.MaxDiskSize <= 0 {
+		return nil
+	}
+
+	return &diskQuota{opts.Dir, opts.MaxDiskSize, opts.Clock, sync.Mutex{}, 0, time.Time{}}
+}
+
+// reserve counts n more bytes against the quota, failing with
+// ErrQuotaExceeded when they would take the store past it.
+func (q *diskQuota) reserve(n int64) error {
+	if q == nil {
+		return nil
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if err := q.refresh(false); err != nil {
+		return err
+	}
+	if Size(q.used+n) > q.limit {
+		return ErrQuotaExceeded
+	}
+
+	q.used += n
+	return nil
+}
+
+// usage is the size of the storage directory, measured at most
+// QUOTA_REFRESH_INTERVAL ago unless fresh.
+func (q *diskQuota) usage(fresh bool) (int64, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	err := q.refresh(fresh)
+	return q.used, err
+}
+
+// refresh measures the storage directory again when due, the caller holds
+// lock.
+func (q *diskQuota) refresh(force bool) error {
+	now := q.clock.Now()
+	if !force && !q.checked.IsZero() && now.Sub(q.checked) < QUOTA_REFRESH_INTERVAL {
+		return nil
+	}
+
+	used, err := dirSize(q.dir)
+	if err != nil {
+		return err
+	}
+
+	q.used, q.checked = used, now
+	return nil
+}
+
+// dirSize is the total size of the files under dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size, err
+}
+
+// checkQuota turns away a put of key and value that would take the store
+// past Options.MaxDiskSize. With QUOTA_RECLAIM it also has the next index
+// checkpoint remove every data log segment left with no live records.
+func (k *KvStore) checkQuota(key string, value string) error {
+	err := k.quota.reserve(int64(len(key) + len(value)))
+	if err != ErrQuotaExceeded || k.options.QuotaPolicy != QUOTA_RECLAIM {
+		return err
+	}
+
+	log, ok := k.options.Backend.(*segmentedLog)
+	if ok && atomic.CompareAndSwapInt32(&log.reclaim, 0, 1) {
+		k.options.Logger.Info("Store is over its disk quota, reclaiming data log segments.")
+	}
+
+	return err
+}
@@ -0,0 +1,113 @@
+package kvstore
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// segmentKey is the newest record of a key within one segment.
+type segmentKey struct {
+	offset int64
+	tomb   bool
+}
+
+// rebuildIndexData indexes the whole data log at filePath into an empty
+// cache. A log rotated into segments is scanned a segment per worker, at
+// most Options.CompactionWorkers at once, then the segments' newest records
+// of each key are merged oldest segment first. Full keys are known by then,
+// so unlike loadIndexData no record is read twice to tell apart keys that
+// share an index key.
+func rebuildIndexData(cache Cache, filePath string, opts Options) (int64, error) {
+	log, ok := opts.Backend.(*segmentedLog)
+	if !ok || log.path != filePath {
+		return loadIndexData(0, cache, filePath, opts)
+	}
+	segments := log.snapshot()
+	if len(segments) < 2 {
+		return loadIndexData(0, cache, filePath, opts)
+	}
+
+	opts.Logger.Infof("Rebuilding the index from %d log segments in parallel.", len(segments))
+	keys := make([]map[string]segmentKey, len(segments))
+	ends := make([]int64, len(segments))
+	var progress sync.Mutex
+	read := segments[0].Base
+	size, _ := opts.Backend.Size(filePath)
+	err := parallelChunks(opts.CompactionWorkers, len(segments), func(start int, end int) error {
+		for i := start; i < end; i++ {
+			var err error
+			keys[i], ends[i], err = scanSegment(log, segments[i].Base, opts)
+			if err != nil {
+				return err
+			}
+
+			if opts.RecoveryProgress != nil {
+				progress.Lock()
+				read += ends[i] - segments[i].Base
+				opts.RecoveryProgress(read, size)
+				progress.Unlock()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	newest := make(map[string]int64)
+	for _, segment := range keys {
+		for key, record := range segment {
+			if record.tomb {
+				delete(newest, key)
+			} else {
+				newest[key] = record.offset
+			}
+		}
+	}
+
+	grouped := make(map[string][]int64, len(newest))
+	for key, offset := range newest {
+		indexKey := opts.indexKey(key)
+		grouped[indexKey] = append(grouped[indexKey], offset)
+	}
+	for indexKey, offsets := range grouped {
+		cache.Add(indexKey, packOffsets(offsets))
+	}
+
+	end := ends[len(ends)-1]
+	if opts.RecoveryProgress != nil {
+		opts.RecoveryProgress(end, end)
+	}
+	return end, nil
+}
+
+// scanSegment reads the newest record of each key in the segment at base,
+// returning the offset it ends at.
+func scanSegment(log *segmentedLog, base int64, opts Options) (map[string]segmentKey, int64, error) {
+	file, err := log.inner.Open(segmentPath(log.path, base))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	keys := make(map[string]segmentKey)
+	reader := bufio.NewReaderSize(file, int(opts.ReadAheadSize))
+	offset := base
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+		if line == "" {
+			return keys, offset, nil
+		}
+
+		record, _, err := parseKvRecord(line)
+		if err != nil {
+			return nil, 0, err
+		}
+		keys[record[0]] = segmentKey{offset, isTombstone(record)}
+		offset += int64(len(line))
+	}
+}
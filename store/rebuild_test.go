@@ -0,0 +1,172 @@
+package kvstore
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeSegmentedStore writes keys rounds times into a store whose data log
+// rotates every maxLogSize bytes, deleting and putting them back in later
+// rounds, then removes the index so the next open rebuilds it from the log.
+// It returns the value each key should read back, none for deleted keys.
+func writeSegmentedStore(t testing.TB, dir string, keys int, rounds int,
+	maxLogSize Size) map[string]string {
+	t.Helper()
+	store, err := OpenKvStore(dir, func(o *Options) { o.MaxLogSize = maxLogSize })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := make(map[string]string)
+	value := strings.Repeat("v", 20)
+	for round := 0; round < rounds; round++ {
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("key%d", i)
+			// Each round deletes a different third of the keys, a key
+			// deleted in one round is put back in the next.
+			if (i+round)%3 == 0 {
+				err = store.Del(key)
+				delete(want, key)
+			} else {
+				want[key] = fmt.Sprintf("%s%d-%d", value, round, i)
+				err = store.Put(key, want[key])
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []string{INDEX_FILE, INDEX_LOG_FILE} {
+		if err := os.Remove(store.options.path(file)); err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+	}
+
+	return want
+}
+
+// segmentedOptions are the options a store in dir would rebuild its index
+// with, on its rotated data log.
+func segmentedOptions(t testing.TB, dir string, workers int) Options {
+	t.Helper()
+	manifest, _, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Segments) < 3 {
+		t.Fatalf("Data log has %d segments, want at least 3.", len(manifest.Segments))
+	}
+
+	opts := DefaultOptions()
+	opts.Dir = dir
+	opts.CompactionWorkers = workers
+	opts.IndexKeyHash = manifest.IndexKeys == INDEX_KEYS_XXHASH64
+	opts.Backend = newSegmentedLog(opts, manifest.Segments)
+	return opts
+}
+
+// indexContents lists each index key with its offsets sorted. Deleting
+// the last key of an index key can leave it with no offsets, which reads
+// the same as no entry, so those are left out.
+func indexContents(t testing.TB, cache Cache) map[string]string {
+	t.Helper()
+	contents := make(map[string]string)
+	for _, key := range cache.Keys() {
+		packed, _ := cache.Get(key)
+		unpacked, ok := unpackOffsets(packed)
+		if !ok {
+			t.Fatalf("Index key %s holds %v.", key, packed)
+		}
+		if len(unpacked) == 0 {
+			continue
+		}
+		offsets := append([]int64(nil), unpacked...)
+		sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+		contents[key] = fmt.Sprint(offsets)
+	}
+
+	return contents
+}
+
+// TestRebuildIndexParallel checks the parallel rebuild of a rotated log, with
+// keys deleted in one segment and put back in a later one, builds the same
+// index as reading the log through in order.
+func TestRebuildIndexParallel(t *testing.T) {
+	dir := t.TempDir()
+	want := writeSegmentedStore(t, dir, 60, 6, 2048)
+
+	serial, err := NewShardedCache(DEFAULT_INDEX_SHARDS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := segmentedOptions(t, dir, 1)
+	serialEnd, err := loadIndexData(0, serial, opts.path(STORAGE_FILE), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := indexContents(t, serial)
+
+	for _, workers := range []int{1, 4} {
+		parallel, err := NewShardedCache(DEFAULT_INDEX_SHARDS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := segmentedOptions(t, dir, workers)
+		end, err := rebuildIndexData(parallel, opts.path(STORAGE_FILE), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if end != serialEnd {
+			t.Errorf("%d workers rebuilt up to offset %d, the serial rebuild to %d.",
+				workers, end, serialEnd)
+		}
+		got := indexContents(t, parallel)
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Errorf("%d workers rebuilt index %v, the serial rebuild %v.", workers, got, expected)
+		}
+	}
+
+	// Without an index file the store rebuilds from offset zero.
+	store, err := OpenKvStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown()
+	for i := 0; i < 60; i++ {
+		checkKey(t, store, fmt.Sprintf("key%d", i), want)
+	}
+}
+
+func BenchmarkRebuildIndex(b *testing.B) {
+	dir := b.TempDir()
+	writeSegmentedStore(b, dir, 5000, 4, 256*KB)
+
+	b.Run("serial", func(b *testing.B) {
+		opts := segmentedOptions(b, dir, 1)
+		for i := 0; i < b.N; i++ {
+			cache, _ := NewShardedCache(DEFAULT_INDEX_SHARDS)
+			if _, err := loadIndexData(0, cache, opts.path(STORAGE_FILE), opts); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		opts := segmentedOptions(b, dir, defaultCompactionWorkers())
+		for i := 0; i < b.N; i++ {
+			cache, _ := NewShardedCache(DEFAULT_INDEX_SHARDS)
+			if _, err := rebuildIndexData(cache, opts.path(STORAGE_FILE), opts); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
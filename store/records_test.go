@@ -0,0 +1,156 @@
+package kvstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// Keys and values that look like a tombstone flag, an empty column or a
+// column separator in the data log.
+var awkwardStrings = []string{TOMB_FLAG, "", ",", "Tomb,", ",Tomb,,"}
+
+// reopen shuts store down and opens it again, first removing the index when
+// rebuild is set so the data log is replayed from the start.
+func reopen(t *testing.T, store *KvStore, rebuild bool) *KvStore {
+	t.Helper()
+	dir := store.Dir()
+	if err := store.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if rebuild {
+		for _, file := range []string{INDEX_FILE, INDEX_LOG_FILE} {
+			if err := os.Remove(store.options.path(file)); err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	store, err := OpenKvStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// TestAwkwardRoundTrip puts each awkward string as the value of every awkward
+// key, then checks they read back after a restart from the index and one
+// replaying the whole log.
+func TestAwkwardRoundTrip(t *testing.T) {
+	store, err := OpenKvStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { store.Shutdown() }()
+
+	want := make(map[string]string)
+	for _, value := range awkwardStrings {
+		for _, key := range awkwardStrings {
+			want[key] = value
+			if err := store.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, rebuild := range []bool{false, true} {
+			store = reopen(t, store, rebuild)
+			for _, key := range awkwardStrings {
+				checkKey(t, store, key, want)
+			}
+			checkScan(t, store, want)
+		}
+	}
+
+	for _, key := range awkwardStrings[:2] {
+		delete(want, key)
+		if err := store.Del(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, rebuild := range []bool{false, true} {
+		store = reopen(t, store, rebuild)
+		for _, key := range awkwardStrings {
+			checkKey(t, store, key, want)
+		}
+		checkScan(t, store, want)
+	}
+}
+
+// checkScan checks Len counts the keys of want and Scan pages through all of
+// them, for several page sizes.
+func checkScan(t *testing.T, store *KvStore, want map[string]string) {
+	t.Helper()
+	expected := make([]string, 0, len(want))
+	for key := range want {
+		expected = append(expected, key)
+	}
+	sort.Strings(expected)
+
+	if n, err := store.Len(); err != nil || n != len(want) {
+		t.Errorf("Len() = %d, %v, want %d.", n, err, len(want))
+	}
+	for _, count := range []int{1, 2, 10} {
+		keys := make([]string, 0)
+		cursor := ""
+		for {
+			page, next, err := store.Scan(cursor, count)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, page...)
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		if fmt.Sprintf("%q", keys) != fmt.Sprintf("%q", expected) {
+			t.Errorf("Scan pages of %d found %q, want %q.", count, keys, expected)
+		}
+	}
+}
+
+// baselineLog is a data log written before tombstone flags and checksums,
+// when deletes were puts of an empty value.
+const baselineLog = `deleted,value,
+deleted,,
+revived,,
+revived,value,
+Tomb,Tomb,
+",",",",
+empty,"",
+`
+
+// TestBaselineTombstones checks deletes written as empty puts stay deletes,
+// while puts of an empty value made now read back as empty.
+func TestBaselineTombstones(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, STORAGE_FILE)
+	if err := ioutil.WriteFile(path, []byte(baselineLog), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenKvStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { store.Shutdown() }()
+
+	want := map[string]string{"revived": "value", TOMB_FLAG: TOMB_FLAG, ",": ","}
+	keys := []string{"deleted", "revived", TOMB_FLAG, ",", "empty", "now empty"}
+	for _, key := range keys {
+		checkKey(t, store, key, want)
+	}
+
+	want["now empty"] = ""
+	if err := store.Put("now empty", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, rebuild := range []bool{false, true} {
+		store = reopen(t, store, rebuild)
+		for _, key := range keys {
+			checkKey(t, store, key, want)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package kvstore
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Report is what Repair found in a data log.
+type Report struct {
+	// Records is how many records were kept and Dropped how many were
+	// removed for bad framing or a checksum mismatch.
+	Records int `json:"records"`
+	Dropped int `json:"dropped"`
+	// TruncatedBytes is the length of a torn record cut off the end.
+	TruncatedBytes int64 `json:"truncatedBytes"`
+	// Keys is how many live keys the rebuilt index holds.
+	Keys int `json:"keys"`
+}
+
+// Repair checks the data log in the storage directory dir, written with the
+// default options, and rebuilds its index. The store must not be open.
+func Repair(dir string) (Report, error) {
+	return RepairWithOptions(dir, DefaultOptions())
+}
+
+// RepairWithOptions reads every record of the data log, dropping records
+// that do not parse or whose value does not match its checksum and cutting
+// off a torn record at the end. The log is rewritten only when records in
+// the middle were dropped, or the log had rotated, when its segments are
+// joined into one file again. The index is then rebuilt from the whole log.
+func RepairWithOptions(dir string, opts Options) (Report, error) {
+	if opts.Encryption == nil {
+		opts.Encryption = NoEncryption{}
+	}
+	if opts.IndexCodec == nil {
+		opts.IndexCodec = JsonIndexCodec{}
+	}
+	if opts.Logger == nil {
+		opts.Logger = NopLogger{}
+	}
+	if opts.Backend == nil {
+		opts.Backend = FileBackend{}
+	}
+	opts.Dir = dir
+
+	lock, err := lockDir(dir)
+	if err != nil {
+		return Report{}, err
+	}
+	defer unlockDir(lock)
+
+	logPath := filepath.Join(dir, STORAGE_FILE)
+	file, err := openLocalLog(dir)
+	if err != nil {
+		return Report{}, err
+	}
+
+	report := Report{}
+	good := make([]string, 0)
+	live := make(map[string]bool)
+	var offset, kept int64
+	reader := bufio.NewReader(file)
+	for {
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			file.Close()
+			return report, readErr
+		}
+
+		if !strings.HasSuffix(line, "\n") {
+			report.TruncatedBytes = int64(len(line))
+			break
+		}
+
+		record, ok := checkRecord(line, opts)
+		offset += int64(len(line))
+		if !ok {
+			opts.Logger.Infof("Dropping damaged record ending at offset %d.", offset)
+			report.Dropped++
+			continue
+		}
+
+		report.Records++
+		kept += int64(len(line))
+		good = append(good, line)
+		if isTombstone(record) {
+			delete(live, record[0])
+		} else {
+			live[record[0]] = true
+		}
+	}
+	file.Close()
+
+	switch {
+	case file.rotated():
+		if err := rewriteLog(logPath, good); err != nil {
+			return report, err
+		}
+		if err := file.flatten(dir); err != nil {
+			return report, err
+		}
+	case report.Dropped > 0:
+		if err := rewriteLog(logPath, good); err != nil {
+			return report, err
+		}
+	case report.TruncatedBytes > 0:
+		if err := os.Truncate(logPath, kept); err != nil {
+			return report, err
+		}
+	}
+
+	report.Keys = len(live)
+	return report, rebuildIndex(dir, logPath, opts)
+}
+
+// RebuildIndex throws away the index of the storage directory dir, written
+// with the default options, and writes a new one from the data log. The
+// store must not be open.
+func RebuildIndex(dir string) (Report, error) {
+	return RebuildIndexWithOptions(dir, DefaultOptions())
+}
+
+// RebuildIndexWithOptions never reads the index file, so it recovers an
+// index that is damaged or was written in a format this build cannot read.
+// Unlike Repair it leaves the data log as it is, a log that rotated is read
+// across its kept segments.
+func RebuildIndexWithOptions(dir string, opts Options) (Report, error) {
+	if opts.Encryption == nil {
+		opts.Encryption = NoEncryption{}
+	}
+	if opts.IndexCodec == nil {
+		opts.IndexCodec = JsonIndexCodec{}
+	}
+	if opts.Logger == nil {
+		opts.Logger = NopLogger{}
+	}
+	if opts.Backend == nil {
+		opts.Backend = FileBackend{}
+	}
+	opts.Dir = dir
+
+	lock, err := lockDir(dir)
+	if err != nil {
+		return Report{}, err
+	}
+	defer unlockDir(lock)
+
+	manifest, _, err := ReadManifest(dir)
+	if err != nil {
+		return Report{}, err
+	}
+	if len(manifest.Segments) > 0 {
+		opts.Backend = newSegmentedLog(opts, manifest.Segments)
+	}
+
+	cache, err := NewShardedCache(DEFAULT_INDEX_SHARDS)
+	if err != nil {
+		return Report{}, err
+	}
+
+	logPath := filepath.Join(dir, STORAGE_FILE)
+	if err := rebuildIndexInto(cache, dir, logPath, opts); err != nil {
+		return Report{}, err
+	}
+
+	return Report{Keys: cache.Stats().Size}, nil
+}
+
+// checkRecord parses a data log line and verifies the checksum of puts.
+func checkRecord(line string, opts Options) ([]string, bool) {
+	record, value, err := parseKvRecord(line)
+	if err != nil || len(record) > 7 {
+		return nil, false
+	}
+	if _, ok := recordTime(record); len(record) >= 5 && !ok {
+		return nil, false
+	}
+	if len(record) >= 6 && recordExpires(record) == 0 && !(len(record) == 7 && record[5] == "") {
+		return nil, false
+	}
+	if len(record) == 7 && recordOperation(record) == "" {
+		return nil, false
+	}
+
+	if isTombstone(record) {
+		return record, true
+	}
+
+	if len(record) < 3 || (record[2] != PUT_FLAG && record[2] != BINARY_FLAG) {
+		return nil, false
+	}
+
+	if len(record) >= 4 {
+		plain, err := decryptValue(opts.Encryption, value)
+		if err != nil || verifyChecksum(plain, record[3]) != nil {
+			return nil, false
+		}
+	}
+
+	return record, true
+}
+
+func rewriteLog(logPath string, lines []string) error {
+	swap := logPath + ".repair"
+	file, err := os.Create(swap)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	for _, line := range lines {
+		writer.WriteString(line)
+	}
+
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(swap, logPath)
+}
+
+// rebuildIndex replaces the index file with one read from the whole log.
+func rebuildIndex(dir string, logPath string, opts Options) error {
+	cache, err := NewShardedCache(DEFAULT_INDEX_SHARDS)
+	if err != nil {
+		return err
+	}
+
+	return rebuildIndexInto(cache, dir, logPath, opts)
+}
+
+func rebuildIndexInto(cache Cache, dir string, logPath string, opts Options) error {
+	manifest, _, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	opts.IndexKeyHash = manifest.IndexKeys == INDEX_KEYS_XXHASH64
+
+	end, err := rebuildIndexData(cache, logPath, opts)
+	if err != nil {
+		return err
+	}
+
+	swap := filepath.Join(dir, INDEX_SWAP_FILE)
+	if err := WriteIndex(end, cache, swap, opts); err != nil {
+		return err
+	}
+
+	if err := removeIndexLog(dir); err != nil {
+		return err
+	}
+
+	return replaceIndex(swap, filepath.Join(dir, INDEX_FILE))
+}
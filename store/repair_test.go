@@ -0,0 +1,41 @@
+package kvstore
+
+import (
+	"testing"
+)
+
+// TestRepairAndCompactZeroOptions runs Repair and Compact with Options left
+// mostly unset, which they fill in with defaults.
+func TestRepairAndCompactZeroOptions(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenKvStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Put("a", "1")
+	store.Put("a", "2")
+	store.Put("b", "3")
+	store.Del("b")
+	if err := store.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RepairWithOptions(dir, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Compact(dir, Options{Encryption: NoEncryption{}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenKvStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Shutdown()
+	if value, err := store.Get("a"); err != nil || value != "2" {
+		t.Errorf("Get(a) = %q, %v, want 2.", value, err)
+	}
+	if _, err := store.Get("b"); err == nil {
+		t.Error("Deleted key b came back.")
+	}
+}
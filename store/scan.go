@@ -0,0 +1,194 @@
+package kvstore
+
+import (
+	"bufio"
+	"context"
+	"io"
+)
+
+const DEFAULT_SCAN_COUNT int = 10
+
+// MGet reads several keys at once. Keys that are not stored are left out of
+// the result rather than failing the whole call.
+func (k *KvStore) MGet(keys []string) (map[string]string, error) {
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		value, err := k.Get(key)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		values[key] = value
+	}
+
+	return values, nil
+}
+
+func (k *KvStore) Exists(key string) (bool, error) {
+	_, err := k.Get(key)
+	if isNotFound(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Scan pages through stored keys in sorted order. The cursor is the last key
+// of the previous page, an empty cursor starts from the beginning and an
+// empty next cursor means there are no more keys. The empty key, when
+// stored, is first and never ends a page, so with a count of one the first
+// page holds it and the key after it.
+func (k *KvStore) Scan(cursor string, count int) (keys []string, next string, err error) {
+	if count <= 0 {
+		count = DEFAULT_SCAN_COUNT
+	}
+
+	it, err := k.NewIterator()
+	if err != nil {
+		return nil, "", err
+	}
+	defer it.Close()
+
+	it.Seek(cursor)
+	keys = make([]string, 0, count)
+	for (len(keys) < count || keys[len(keys)-1] == "") && it.Next() {
+		// Pages after the first start at the key that ended the last one.
+		if cursor != "" && it.Key() == cursor {
+			continue
+		}
+		keys = append(keys, it.Key())
+	}
+
+	if len(keys) >= count && it.Next() {
+		next = keys[len(keys)-1]
+	}
+
+	return keys, next, nil
+}
+
+// liveKeys lists every full key through an Iterator.
+func (k *KvStore) liveKeys() ([]string, error) {
+	it, err := k.NewIterator()
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	keys := make([]string, 0, len(it.disk)+len(it.memtable))
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+
+	return keys, nil
+}
+
+// Keys lists every stored key in sorted order.
+func (k *KvStore) Keys() ([]string, error) {
+	return k.liveKeys()
+}
+
+// Len counts the stored keys.
+func (k *KvStore) Len() (int, error) {
+	count := 0
+	err := k.KeysIter(func(key string) bool {
+		count++
+		return true
+	})
+
+	return count, err
+}
+
+// KeysIter calls fn with every stored key, in no particular order, reading
+// one record at a time rather than collecting them. It stops early when fn
+// returns false.
+func (k *KvStore) KeysIter(fn func(key string) bool) error {
+	if err := k.awaitRecovery(context.Background()); err != nil {
+		return err
+	}
+
+	unflushed := make(map[string]bool)
+	for _, cmd := range k.pending.Snapshot() {
+		if cmd.Type == PUT_COMMAND || cmd.Type == DEL_COMMAND {
+			unflushed[cmd.Key] = cmd.Type == PUT_COMMAND
+		}
+	}
+
+	offsets := liveOffsets(k.IndexCache)
+	if len(offsets) > 0 {
+		path := k.options.path(STORAGE_FILE)
+		storeFile, err := k.options.Backend.Open(path)
+		if err != nil {
+			return err
+		}
+		defer storeFile.Close()
+
+		reader := bufio.NewReaderSize(storeFile, int(k.options.ReadAheadSize))
+		for _, off := range offsets {
+			if _, err := storeFile.Seek(off, io.SeekStart); err != nil {
+				return err
+			}
+			reader.Reset(storeFile)
+
+			key, _, _, _, err := readKvRecord(reader)
+			if err != nil {
+				return err
+			}
+			if _, ok := unflushed[key]; ok {
+				continue
+			}
+			if !fn(key) {
+				return nil
+			}
+		}
+	}
+
+	for key, put := range unflushed {
+		if put && !fn(key) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// ReadKeysAt reads the key of the record at each offset through one file
+// handle.
+func ReadKeysAt(path string, offsets []int64, readAhead int) ([]string, error) {
+	return readKeysAt(FileBackend{}, path, offsets, readAhead)
+}
+
+func readKeysAt(backend Backend, path string, offsets []int64, readAhead int) ([]string, error) {
+	keys := make([]string, 0, len(offsets))
+	if len(offsets) == 0 {
+		return keys, nil
+	}
+
+	storeFile, err := backend.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer storeFile.Close()
+
+	reader := bufio.NewReaderSize(storeFile, readAhead)
+	for _, off := range offsets {
+		if _, err := storeFile.Seek(off, io.SeekStart); err != nil {
+			return nil, err
+		}
+		reader.Reset(storeFile)
+
+		key, _, _, _, err := readKvRecord(reader)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func isNotFound(err error) bool {
+	return err == ErrNotInIndex || err == ErrKeyNotFound
+}
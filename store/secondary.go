@@ -0,0 +1,291 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const SECONDARY_INDEX_PREFIX string = "secondary_index_"
+
+var ErrUnknownIndex error = errors.New("Secondary index not registered.")
+var ErrIndexExists error = errors.New("Secondary index already registered.")
+var ErrInvalidIndexName error = errors.New("Secondary index names may only use letters, digits, - and _.")
+
+var indexNamePattern *regexp.Regexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Extractor pulls the indexed fields out of a value, a value without the
+// field returns none.
+type Extractor func(value string) []string
+
+// JsonPathExtractor indexes the field at a dot separated path in JSON object
+// values, e.g. "address.city". Arrays at the path index every element.
+func JsonPathExtractor(path string) Extractor {
+	steps := strings.Split(path, ".")
+	return func(value string) []string {
+		var doc interface{}
+		if err := json.Unmarshal([]byte(value), &doc); err != nil {
+			return nil
+		}
+
+		for _, step := range steps {
+			object, ok := doc.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			doc, ok = object[step]
+			if !ok {
+				return nil
+			}
+		}
+
+		if list, ok := doc.([]interface{}); ok {
+			fields := make([]string, 0, len(list))
+			for _, item := range list {
+				fields = append(fields, jsonField(item))
+			}
+			return fields
+		}
+
+		return []string{jsonField(doc)}
+	}
+}
+
+func jsonField(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// SecondaryIndex maps extracted field values back to the primary keys whose
+// values hold them.
+type SecondaryIndex struct {
+	sync.RWMutex
+	Name    string
+	extract Extractor
+	entries map[string]map[string]bool
+	fields  map[string][]string
+}
+
+// secondaryIndexFile is the saved form of a SecondaryIndex. LogSize is the
+// data log size it was saved at, any other size means writes happened since
+// and the index is rebuilt instead.
+type secondaryIndexFile struct {
+	LogSize int64               `json:"logSize"`
+	Entries map[string][]string `json:"entries"`
+}
+
+func newSecondaryIndex(name string, extract Extractor) *SecondaryIndex {
+	return &SecondaryIndex{sync.RWMutex{}, name, extract,
+		make(map[string]map[string]bool), make(map[string][]string)}
+}
+
+// update reindexes key under value, a delete passes a nil value.
+func (s *SecondaryIndex) update(key string, value *string) {
+	s.Lock()
+	s.reindex(key, value)
+	s.Unlock()
+}
+
+func (s *SecondaryIndex) reindex(key string, value *string) {
+	for _, field := range s.fields[key] {
+		delete(s.entries[field], key)
+		if len(s.entries[field]) == 0 {
+			delete(s.entries, field)
+		}
+	}
+	delete(s.fields, key)
+
+	if value == nil {
+		return
+	}
+
+	fields := s.extract(*value)
+	for _, field := range fields {
+		if s.entries[field] == nil {
+			s.entries[field] = make(map[string]bool)
+		}
+		s.entries[field][key] = true
+	}
+
+	if len(fields) > 0 {
+		s.fields[key] = fields
+	}
+}
+
+func (s *SecondaryIndex) query(field string) []string {
+	s.RLock()
+	keys := make([]string, 0, len(s.entries[field]))
+	for key := range s.entries[field] {
+		keys = append(keys, key)
+	}
+	s.RUnlock()
+	sort.Strings(keys)
+
+	return keys
+}
+
+func secondaryIndexPath(name string, opts Options) string {
+	return opts.path(SECONDARY_INDEX_PREFIX + name + ".json")
+}
+
+func dataLogSize(opts Options) int64 {
+	size, err := opts.Backend.Size(opts.path(STORAGE_FILE))
+	if err != nil {
+		return 0
+	}
+
+	return size
+}
+
+// load reads the saved index, reporting false when it is missing or behind
+// the data log.
+func (s *SecondaryIndex) load(opts Options) bool {
+	data, err := ioutil.ReadFile(secondaryIndexPath(s.Name, opts))
+	if err != nil {
+		return false
+	}
+
+	data, err = opts.Encryption.Decrypt(data)
+	if err != nil {
+		return false
+	}
+
+	var file secondaryIndexFile
+	if err := json.Unmarshal(data, &file); err != nil || file.LogSize != dataLogSize(opts) {
+		return false
+	}
+
+	for field, keys := range file.Entries {
+		s.entries[field] = make(map[string]bool, len(keys))
+		for _, key := range keys {
+			s.entries[field][key] = true
+			s.fields[key] = append(s.fields[key], field)
+		}
+	}
+
+	return true
+}
+
+func (s *SecondaryIndex) save(opts Options) error {
+	s.RLock()
+	file := secondaryIndexFile{dataLogSize(opts), make(map[string][]string, len(s.entries))}
+	for field, keys := range s.entries {
+		for key := range keys {
+			file.Entries[field] = append(file.Entries[field], key)
+		}
+	}
+	s.RUnlock()
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	data, err = opts.Encryption.Encrypt(data)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(secondaryIndexPath(s.Name, opts), data, 0644)
+}
+
+// RegisterIndex starts maintaining a secondary index named name over every
+// value. Extractors are not persisted, so indexes are registered again after
+// each restart and load their saved file when it is still current.
+func (k *KvStore) RegisterIndex(name string, extract Extractor) error {
+	if !indexNamePattern.MatchString(name) {
+		return ErrInvalidIndexName
+	}
+
+	// The index stays locked until it is loaded or built, so writes made in
+	// the meantime are applied after it.
+	index := newSecondaryIndex(name, extract)
+	index.Lock()
+	k.indexLock.Lock()
+	if _, ok := k.secondaryIndexes[name]; ok {
+		k.indexLock.Unlock()
+		index.Unlock()
+		return ErrIndexExists
+	}
+	k.secondaryIndexes[name] = index
+	k.indexLock.Unlock()
+
+	if index.load(k.options) {
+		index.Unlock()
+		k.options.Logger.Infof("Loaded secondary index %s from disk.", name)
+		return nil
+	}
+
+	k.options.Logger.Infof("Building secondary index %s.", name)
+	err := k.buildIndex(index)
+	index.Unlock()
+	if err != nil {
+		k.indexLock.Lock()
+		delete(k.secondaryIndexes, name)
+		k.indexLock.Unlock()
+	}
+
+	return err
+}
+
+// buildIndex indexes every live key, the caller holds the index lock.
+func (k *KvStore) buildIndex(index *SecondaryIndex) error {
+	keys, err := k.liveKeys()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		value, err := k.Get(key)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Could not build secondary index %s: %v", index.Name, err)
+		}
+
+		index.reindex(key, &value)
+	}
+
+	return nil
+}
+
+// QueryByIndex returns the keys, sorted, whose values hold field in the named
+// index.
+func (k *KvStore) QueryByIndex(name string, field string) ([]string, error) {
+	k.indexLock.RLock()
+	index, ok := k.secondaryIndexes[name]
+	k.indexLock.RUnlock()
+	if !ok {
+		return nil, ErrUnknownIndex
+	}
+
+	return index.query(field), nil
+}
+
+func (k *KvStore) updateIndexes(key string, value *string) {
+	k.indexLock.RLock()
+	defer k.indexLock.RUnlock()
+	for _, index := range k.secondaryIndexes {
+		index.update(key, value)
+	}
+}
+
+func (k *KvStore) saveIndexes() {
+	k.indexLock.RLock()
+	defer k.indexLock.RUnlock()
+	for name, index := range k.secondaryIndexes {
+		if err := index.save(k.options); err != nil {
+			k.options.Logger.Errorf("Could not save secondary index %s: %v", name, err)
+		}
+	}
+}
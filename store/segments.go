@@ -0,0 +1,468 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrSegmentRemoved error = errors.New("Data log segment was removed by retention.")
+
+// LogSegment is one file of a rotated data log. Offsets run on across
+// segments, a segment holds the records from its Base up to the next
+// segment's Base. Sealed is when it stopped taking appends, zero for the
+// active segment.
+type LogSegment struct {
+	Base   int64     `json:"base"`
+	Sealed time.Time `json:"sealed"`
+}
+
+// segmentPath is the file of the segment starting at base, the first
+// segment keeps the data log's own name.
+func segmentPath(path string, base int64) string {
+	if base == 0 {
+		return path
+	}
+
+	return strings.TrimSuffix(path, filepath.Ext(path)) + "." +
+		strconv.FormatInt(base, 10) + filepath.Ext(path)
+}
+
+// isSegmentFile is whether name is the file of a rotated segment.
+func isSegmentFile(name string) bool {
+	ext := filepath.Ext(STORAGE_FILE)
+	prefix := strings.TrimSuffix(STORAGE_FILE, ext) + "."
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+		return false
+	}
+
+	base, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext), 10, 64)
+	return err == nil && base > 0
+}
+
+func hasSegmentFiles(dir string) bool {
+	files, _ := ioutil.ReadDir(dir)
+	for _, file := range files {
+		if isSegmentFile(file.Name()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// segmentedLog is the Backend of a store whose data log rotates once it
+// passes Options.MaxLogSize. It hands out one continuous log made of the
+// segments and passes every other file through to the Backend under it.
+type segmentedLog struct {
+	inner    Backend
+	path     string
+	opts     Options
+	lock     sync.RWMutex
+	segments []LogSegment
+	// pins holds off removing segments while a backup copies them.
+	pins int32
+	// reclaim is set when the store goes over its disk quota, the next
+	// removal then ignores the retention policy.
+	reclaim int32
+}
+
+func newSegmentedLog(opts Options, segments []LogSegment) *segmentedLog {
+	if len(segments) == 0 {
+		segments = []LogSegment{{0, time.Time{}}}
+	}
+
+	return &segmentedLog{opts.Backend, opts.path(STORAGE_FILE), opts, sync.RWMutex{},
+		segments, 0, 0}
+}
+
+func (l *segmentedLog) snapshot() []LogSegment {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return append([]LogSegment(nil), l.segments...)
+}
+
+func (l *segmentedLog) Open(path string) (BackendFile, error) {
+	if path != l.path {
+		return l.inner.Open(path)
+	}
+
+	segments := l.snapshot()
+	if len(segments) == 1 && segments[0].Base == 0 {
+		return l.inner.Open(path)
+	}
+
+	return &segmentedFile{l, segments, make([]BackendFile, len(segments)), 0}, nil
+}
+
+// Append seals the active segment first when data would take it past
+// MaxLogSize, a record never spans two segments.
+func (l *segmentedLog) Append(path string, data []byte) (int64, error) {
+	if path != l.path {
+		return l.inner.Append(path, data)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	active := l.segments[len(l.segments)-1]
+	size, err := l.inner.Size(segmentPath(path, active.Base))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	if l.opts.MaxLogSize > 0 && size > 0 && Size(size+int64(len(data))) > l.opts.MaxLogSize {
+		l.segments[len(l.segments)-1].Sealed = l.opts.Clock.Now()
+		active = LogSegment{active.Base + size, time.Time{}}
+		l.segments = append(l.segments, active)
+		if err := l.saveSegments(); err != nil {
+			return 0, err
+		}
+		l.opts.Logger.Infof("Rotated data log, new segment starts at offset %d.", active.Base)
+	}
+
+	offset, err := l.inner.Append(segmentPath(path, active.Base), data)
+	return active.Base + offset, err
+}
+
+// Size is the offset the next record will be written at.
+func (l *segmentedLog) Size(path string) (int64, error) {
+	if path != l.path {
+		return l.inner.Size(path)
+	}
+
+	l.lock.RLock()
+	active := l.segments[len(l.segments)-1]
+	l.lock.RUnlock()
+	if active.Base == 0 {
+		return l.inner.Size(path)
+	}
+
+	size, err := l.inner.Size(segmentPath(path, active.Base))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	return active.Base + size, nil
+}
+
+func (l *segmentedLog) Sync(path string) error {
+	if path != l.path {
+		return l.inner.Sync(path)
+	}
+
+	l.lock.RLock()
+	active := l.segments[len(l.segments)-1]
+	l.lock.RUnlock()
+	return l.inner.Sync(segmentPath(path, active.Base))
+}
+
+func (l *segmentedLog) Remove(path string) error {
+	return l.inner.Remove(path)
+}
+
+// saveSegments records the segments in the manifest, the caller holds lock.
+func (l *segmentedLog) saveSegments() error {
+	manifest, _, err := ReadManifest(l.opts.Dir)
+	if err != nil {
+		return err
+	}
+
+	manifest.Segments = l.segments
+	return WriteManifest(l.opts.Dir, manifest)
+}
+
+// start is the offset of the oldest record still kept.
+func (l *segmentedLog) start() int64 {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.segments[0].Base
+}
+
+// removeExpired deletes sealed segments, oldest first, that are outside the
+// retention policy: not among the newest RetainSegments and sealed more than
+// RetainAge ago. It stops at the first segment still needed, one with a live
+// record below minLive or with records past checkpoint, the offset restarts
+// replay the log from. With neither policy set every segment is kept, unless
+// the store went over its disk quota and reclaim is set.
+func (l *segmentedLog) removeExpired(minLive int64, checkpoint int64) error {
+	reclaim := atomic.LoadInt32(&l.reclaim) == 1
+	if l.opts.RetainSegments <= 0 && l.opts.RetainAge <= 0 && !reclaim {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if atomic.LoadInt32(&l.pins) > 0 {
+		return nil
+	}
+	if reclaim {
+		atomic.StoreInt32(&l.reclaim, 0)
+	}
+	now := l.opts.Clock.Now()
+	sealed := len(l.segments) - 1
+	removed := 0
+	for ; removed < sealed; removed++ {
+		segment, end := l.segments[removed], l.segments[removed+1].Base
+		newest := sealed-removed <= l.opts.RetainSegments
+		young := l.opts.RetainAge > 0 && now.Sub(segment.Sealed) < l.opts.RetainAge
+		if (!reclaim && (newest || young)) || end > minLive || end > checkpoint {
+			break
+		}
+
+		err := l.inner.Remove(segmentPath(l.path, segment.Base))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		l.opts.Logger.Infof("Removed data log segment %d to %d.", segment.Base, end)
+	}
+
+	if removed == 0 {
+		return nil
+	}
+
+	l.segments = append([]LogSegment(nil), l.segments[removed:]...)
+	return l.saveSegments()
+}
+
+// retentionFloor is the lowest offset the index holds, taken before an
+// index checkpoint is written. Records appended later are above it, so no
+// offset in the checkpoint or the index after it is below it.
+func retentionFloor(indexCache Cache, opts Options) int64 {
+	var minLive int64 = math.MaxInt64
+	if _, ok := opts.Backend.(*segmentedLog); !ok {
+		return minLive
+	}
+
+	for _, offset := range liveOffsets(indexCache) {
+		if offset < minLive {
+			minLive = offset
+		}
+	}
+
+	return minLive
+}
+
+// applyRetention removes expired segments after an index checkpoint at
+// lastOffset, a no-op unless the data log rotates.
+func applyRetention(minLive int64, lastOffset int64, opts Options) {
+	log, ok := opts.Backend.(*segmentedLog)
+	if !ok {
+		return
+	}
+
+	if err := log.removeExpired(minLive, lastOffset); err != nil {
+		opts.Logger.Errorf("Could not remove expired log segments: %v", err)
+	}
+}
+
+// logStart is the offset the data log at path starts at, past segments
+// already removed.
+func logStart(backend Backend, path string) int64 {
+	if log, ok := backend.(*segmentedLog); ok && log.path == path {
+		return log.start()
+	}
+
+	return 0
+}
+
+// segmentedFile reads a snapshot of the segments as one file, opening each
+// segment when it is first read.
+type segmentedFile struct {
+	log      *segmentedLog
+	segments []LogSegment
+	files    []BackendFile
+	offset   int64
+}
+
+func (f *segmentedFile) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		i := sort.Search(len(f.segments), func(i int) bool {
+			return f.segments[i].Base > pos
+		}) - 1
+		if i < 0 {
+			return n, ErrSegmentRemoved
+		}
+
+		file, err := f.segment(i)
+		if err != nil {
+			return n, err
+		}
+		if file == nil {
+			return n, io.EOF
+		}
+
+		want := p[n:]
+		last := i == len(f.segments)-1
+		if !last && f.segments[i+1].Base-pos < int64(len(want)) {
+			want = want[:f.segments[i+1].Base-pos]
+		}
+
+		read, err := file.ReadAt(want, pos-f.segments[i].Base)
+		n += read
+		if err == io.EOF && !last && read == len(want) {
+			err = nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// segment opens segment i, nil when it is the active segment and nothing has
+// been appended to it yet.
+func (f *segmentedFile) segment(i int) (BackendFile, error) {
+	if f.files[i] != nil {
+		return f.files[i], nil
+	}
+
+	file, err := f.log.inner.Open(segmentPath(f.log.path, f.segments[i].Base))
+	switch {
+	case os.IsNotExist(err) && i == len(f.segments)-1:
+		return nil, nil
+	case os.IsNotExist(err):
+		return nil, ErrSegmentRemoved
+	case err != nil:
+		return nil, err
+	}
+
+	f.files[i] = file
+	return file, nil
+}
+
+func (f *segmentedFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *segmentedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		size, err := f.log.Size(f.log.path)
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, fmt.Errorf("Unknown seek whence %d.", whence)
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("Negative seek offset %d.", offset)
+	}
+
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *segmentedFile) Close() error {
+	var err error
+	for _, file := range f.files {
+		if file != nil {
+			if closeErr := file.Close(); closeErr != nil {
+				err = closeErr
+			}
+		}
+	}
+
+	return err
+}
+
+// localLog reads the kept segments of the data log in dir, in order, for the
+// offline Repair and Compact.
+type localLog struct {
+	io.Reader
+	files    []*os.File
+	segments []LogSegment
+}
+
+func openLocalLog(dir string) (*localLog, error) {
+	manifest, _, err := ReadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := manifest.Segments
+	if len(segments) == 0 {
+		segments = []LogSegment{{0, time.Time{}}}
+	}
+
+	log := &localLog{nil, make([]*os.File, 0, len(segments)), segments}
+	readers := make([]io.Reader, 0, len(segments))
+	path := filepath.Join(dir, STORAGE_FILE)
+	for i, segment := range segments {
+		file, err := os.Open(segmentPath(path, segment.Base))
+		if os.IsNotExist(err) && i > 0 && i == len(segments)-1 {
+			break
+		}
+		if err != nil {
+			log.Close()
+			return nil, err
+		}
+
+		log.files = append(log.files, file)
+		readers = append(readers, file)
+	}
+
+	log.Reader = io.MultiReader(readers...)
+	return log, nil
+}
+
+// rotated is whether the log is more than its first segment, it then has to
+// be rewritten into one file by flatten.
+func (l *localLog) rotated() bool {
+	return len(l.segments) > 1 || l.segments[0].Base > 0
+}
+
+func (l *localLog) Close() error {
+	for _, file := range l.files {
+		file.Close()
+	}
+
+	return nil
+}
+
+// flatten drops the segments from the manifest and removes their files, once
+// the log has been rewritten into the first segment's file.
+func (l *localLog) flatten(dir string) error {
+	manifest, _, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+
+	manifest.Segments = nil
+	if err := WriteManifest(dir, manifest); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, STORAGE_FILE)
+	for _, segment := range l.segments {
+		if segment.Base == 0 {
+			continue
+		}
+
+		err := os.Remove(segmentPath(path, segment.Base))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
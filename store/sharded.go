@@ -0,0 +1,127 @@
+package kvstore
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+const DEFAULT_INDEX_SHARDS int = 32
+
+// KeyLocker is implemented by caches that can hold off readers of a key
+// while its entry is rewritten.
+type KeyLocker interface {
+	LockKey(key string)
+	UnlockKey(key string)
+	RLockKey(key string)
+	RUnlockKey(key string)
+}
+
+type indexShard struct {
+	update sync.RWMutex
+	cache  Cache
+}
+
+// ShardedCache spreads keys over shards by hash so the flusher updating one
+// key does not block reads of keys in other shards.
+type ShardedCache struct {
+	shards []*indexShard
+}
+
+func (s *ShardedCache) shard(key string) *indexShard {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return s.shards[hash.Sum32()%uint32(len(s.shards))]
+}
+
+func (s *ShardedCache) Add(key string, value interface{}) {
+	s.shard(key).cache.Add(key, value)
+}
+
+func (s *ShardedCache) Get(key string) (value interface{}, ok bool) {
+	return s.shard(key).cache.Get(key)
+}
+
+func (s *ShardedCache) Remove(key string) {
+	s.shard(key).cache.Remove(key)
+}
+
+func (s *ShardedCache) Keys() []string {
+	keys := make([]string, 0)
+	for _, shard := range s.shards {
+		for _, key := range shard.cache.Keys() {
+			if key != "" {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	return keys
+}
+
+func (s *ShardedCache) Stats() CacheStats {
+	var total CacheStats
+	for _, shard := range s.shards {
+		stats := shard.cache.Stats()
+		total.Hits += stats.Hits
+		total.Misses += stats.Misses
+		total.Evictions += stats.Evictions
+		total.Size += stats.Size
+	}
+
+	return total
+}
+
+func (s *ShardedCache) LockKey(key string) {
+	s.shard(key).update.Lock()
+}
+
+func (s *ShardedCache) UnlockKey(key string) {
+	s.shard(key).update.Unlock()
+}
+
+func (s *ShardedCache) RLockKey(key string) {
+	s.shard(key).update.RLock()
+}
+
+func (s *ShardedCache) RUnlockKey(key string) {
+	s.shard(key).update.RUnlock()
+}
+
+func NewShardedCache(shards int) (Cache, error) {
+	if shards <= 0 {
+		shards = DEFAULT_INDEX_SHARDS
+	}
+
+	sharded := &ShardedCache{make([]*indexShard, 0, shards)}
+	for i := 0; i < shards; i++ {
+		cache, err := NewSimpleCache()
+		if err != nil {
+			return nil, err
+		}
+		sharded.shards = append(sharded.shards, &indexShard{sync.RWMutex{}, cache})
+	}
+
+	return sharded, nil
+}
+
+// lockIndexKey locks a key for an index update when the cache supports it,
+// returning the matching unlock.
+func lockIndexKey(cache Cache, key string) func() {
+	locker, ok := cache.(KeyLocker)
+	if !ok {
+		return func() {}
+	}
+
+	locker.LockKey(key)
+	return func() { locker.UnlockKey(key) }
+}
+
+func rlockIndexKey(cache Cache, key string) func() {
+	locker, ok := cache.(KeyLocker)
+	if !ok {
+		return func() {}
+	}
+
+	locker.RLockKey(key)
+	return func() { locker.RUnlockKey(key) }
+}
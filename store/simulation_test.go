@@ -0,0 +1,154 @@
+package kvstore
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSimulation(t *testing.T, opts ...Option) *Simulation {
+	t.Helper()
+	sim, err := NewSimulation(t.TempDir(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sim.Shutdown() })
+
+	return sim
+}
+
+func advance(t *testing.T, sim *Simulation, d time.Duration) {
+	t.Helper()
+	if err := sim.Advance(d); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// flushTimes is how long after SimulationStart each flush of flusher in the
+// journal happened.
+func flushTimes(store *KvStore, flusher string) []time.Duration {
+	times := make([]time.Duration, 0)
+	for _, decision := range store.FlushJournal() {
+		if decision.Flusher == flusher {
+			times = append(times, decision.Time.Sub(SimulationStart))
+		}
+	}
+
+	return times
+}
+
+func withJournal(o *Options) { o.FlushJournalSize = 64 }
+
+// TestSimulationPeriodicFlush checks a buffered put reaches the data log and
+// the index on the first flush tick after it, not before.
+func TestSimulationPeriodicFlush(t *testing.T) {
+	sim := newTestSimulation(t, withJournal)
+	if err := sim.Store.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	advance(t, sim, DEFAULT_FLUSH_INTERVAL-time.Millisecond)
+	info, err := sim.Store.Describe("key")
+	if err != nil || info.Source != SOURCE_PENDING || info.Offset != -1 {
+		t.Fatalf("Describe before the flush tick = %+v, %v, want it pending.", info, err)
+	}
+
+	advance(t, sim, time.Millisecond)
+	info, err = sim.Store.Describe("key")
+	if err != nil || info.Source == SOURCE_PENDING || info.Offset != 0 {
+		t.Fatalf("Describe after the flush tick = %+v, %v, want it at offset 0.", info, err)
+	}
+	if !info.Modified.Equal(SimulationStart.Add(DEFAULT_FLUSH_INTERVAL)) {
+		t.Errorf("Modified = %v, want the flush tick.", info.Modified)
+	}
+
+	// The log flusher ticks first, so the index takes the put in on the
+	// same tick.
+	want := fmt.Sprint([]time.Duration{DEFAULT_FLUSH_INTERVAL})
+	for _, flusher := range []string{LOG_FLUSHER, INDEX_FLUSHER} {
+		if got := fmt.Sprint(flushTimes(sim.Store, flusher)); got != want {
+			t.Errorf("%s flushes at %s, want %s.", flusher, got, want)
+		}
+	}
+	for _, decision := range sim.Store.FlushJournal() {
+		if decision.Reason != REASON_INTERVAL || decision.BatchSize != 1 {
+			t.Errorf("Flush %+v, want one item flushed on the interval.", decision)
+		}
+	}
+
+	// Ticks with nothing buffered flush nothing.
+	advance(t, sim, time.Minute)
+	if got := len(sim.Store.FlushJournal()); got != 2 {
+		t.Errorf("Journal has %d flushes after idle ticks, want 2.", got)
+	}
+}
+
+// TestSimulationExpiry checks a TTL key stops reading back when it expires
+// and the janitor writes its delete on the scan after.
+func TestSimulationExpiry(t *testing.T) {
+	sim := newTestSimulation(t, withJournal, func(o *Options) {
+		o.ExpiryScanInterval = time.Second
+	})
+	if err := sim.Store.PutWithTTL("session", "value", 10500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	advance(t, sim, 10*time.Second)
+	if value, err := sim.Store.Get("session"); err != nil || value != "value" {
+		t.Fatalf("Get before expiry = %q, %v, want value.", value, err)
+	}
+
+	advance(t, sim, 500*time.Millisecond)
+	if value, err := sim.Store.Get("session"); err == nil {
+		t.Fatalf("Get after expiry = %q, want it gone.", value)
+	}
+
+	// The janitor scans at 11s, its delete is flushed on the next tick.
+	advance(t, sim, time.Second)
+	want := fmt.Sprint([]time.Duration{DEFAULT_FLUSH_INTERVAL, 11*time.Second + DEFAULT_FLUSH_INTERVAL})
+	if got := fmt.Sprint(flushTimes(sim.Store, LOG_FLUSHER)); got != want {
+		t.Errorf("Log flushes at %s, want %s.", got, want)
+	}
+	if _, expiring := sim.Store.expiries.due(sim.Clock.Now(), 1)["session"]; expiring {
+		t.Error("Expired key is still waiting for the janitor.")
+	}
+}
+
+// TestSimulationRetention checks sealed data log segments holding only
+// overwritten records are removed once older than RetainAge, on the next
+// index flush.
+func TestSimulationRetention(t *testing.T) {
+	sim := newTestSimulation(t, WithFlushInterval(time.Second), func(o *Options) {
+		o.MaxLogSize = 200
+		o.RetainAge = time.Hour
+	})
+	store := sim.Store
+	logPath := store.options.path(STORAGE_FILE)
+	value := strings.Repeat("v", 40)
+	for i := 0; i < 20; i++ {
+		if err := store.Put("key", fmt.Sprint(value, i)); err != nil {
+			t.Fatal(err)
+		}
+		advance(t, sim, time.Minute)
+	}
+	if start := logStart(store.options.Backend, logPath); start != 0 {
+		t.Fatalf("Data log starts at %d before any segment is an hour old, want 0.", start)
+	}
+
+	advance(t, sim, time.Hour)
+	if start := logStart(store.options.Backend, logPath); start != 0 {
+		t.Fatalf("Data log starts at %d before an index flush, want 0.", start)
+	}
+
+	if err := store.Put("key", "newest"); err != nil {
+		t.Fatal(err)
+	}
+	advance(t, sim, time.Second)
+	if start := logStart(store.options.Backend, logPath); start == 0 {
+		t.Error("No segment was removed past RetainAge.")
+	}
+	if got, err := store.Get("key"); err != nil || got != "newest" {
+		t.Errorf("Get(key) = %q, %v, want newest.", got, err)
+	}
+}
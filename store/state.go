@@ -0,0 +1,214 @@
+package kvstore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// RECOVERY_PROGRESS_BYTES is how much of the data log loading the index
+// reads between calls of Options.RecoveryProgress.
+const RECOVERY_PROGRESS_BYTES int64 = 1 << 20
+
+// StoreState is where a KvStore is in its lifecycle, it only ever moves
+// forward from STATE_RECOVERING through STATE_SERVING and STATE_DRAINING to
+// STATE_CLOSED.
+type StoreState int32
+
+const (
+	STATE_RECOVERING StoreState = 0
+	STATE_SERVING    StoreState = 1
+	STATE_DRAINING   StoreState = 2
+	STATE_CLOSED     StoreState = 3
+)
+
+var ErrRecovering error = errors.New("Store is recovering its index.")
+
+func (s StoreState) String() string {
+	switch s {
+	case STATE_RECOVERING:
+		return "recovering"
+	case STATE_SERVING:
+		return "serving"
+	case STATE_DRAINING:
+		return "draining"
+	case STATE_CLOSED:
+		return "closed"
+	}
+
+	return "unknown"
+}
+
+func (k *KvStore) State() StoreState {
+	return StoreState(atomic.LoadInt32(&k.state))
+}
+
+func (k *KvStore) setState(state StoreState) {
+	atomic.StoreInt32(&k.state, int32(state))
+}
+
+// awaitRecovery holds an operation back until the index is rebuilt, or fails
+// it with ErrRecovering when Options.FailWhileRecovering is set.
+func (k *KvStore) awaitRecovery(ctx context.Context) error {
+	if k.State() != STATE_RECOVERING {
+		return nil
+	}
+
+	if k.options.FailWhileRecovering {
+		return ErrRecovering
+	}
+
+	select {
+	case <-k.recovered:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// awaitWriteRecovery is awaitRecovery for Puts and Dels, which
+// Options.LazyRecovery buffers at once.
+func (k *KvStore) awaitWriteRecovery(ctx context.Context) error {
+	if k.options.LazyRecovery {
+		return nil
+	}
+
+	return k.awaitRecovery(ctx)
+}
+
+// getRecovering answers a Get while the index loads lazily, from the write
+// buffer or cache, else by scanning the log or once recovered.
+func (k *KvStore) getRecovering(ctx context.Context, key string, span Span) (string, error) {
+	k.closeLock.RLock()
+	closed := k.closed
+	k.closeLock.RUnlock()
+	if closed {
+		return "", ErrStoreClosed
+	}
+
+	normalized := k.normalizeKey(key)
+	if cmd, ok := k.pending.Lookup(normalized); ok {
+		span.SetAttribute("source", SOURCE_PENDING)
+		if cmd.Type == DEL_COMMAND {
+			return "", ErrNotInIndex
+		}
+		return cmd.Value, nil
+	}
+	if value, ok := k.Cache.Get(normalized); ok {
+		span.SetAttribute("source", SOURCE_CACHE)
+		return fmt.Sprintf("%v", value), nil
+	}
+
+	if k.options.ScanWhileRecovering {
+		span.SetAttribute("source", "scan")
+		return k.scanLogFor(normalized)
+	}
+
+	if err := k.awaitRecovery(ctx); err != nil {
+		return "", err
+	}
+	return k.getContext(ctx, key, span)
+}
+
+// scanLogFor reads the whole data log for the newest record of key. The
+// log does not change while the index loads, the flushers wait for it.
+func (k *KvStore) scanLogFor(key string) (string, error) {
+	path := k.options.path(STORAGE_FILE)
+	file, err := k.options.Backend.Open(path)
+	if os.IsNotExist(err) {
+		return "", ErrNotInIndex
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(logStart(k.options.Backend, path), io.SeekStart); err != nil {
+		return "", err
+	}
+
+	var newest []string
+	var value string
+	reader := bufio.NewReaderSize(file, int(k.options.ReadAheadSize))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if line == "" {
+			break
+		}
+
+		record, raw, parseErr := parseKvRecord(line)
+		if parseErr == nil && record[0] == key {
+			newest, value = record, raw
+		}
+	}
+
+	if newest == nil || isTombstone(newest) {
+		return "", ErrNotInIndex
+	}
+
+	plain, err := decryptValue(k.options.Encryption, value)
+	if err != nil {
+		return "", err
+	}
+	if len(newest) > 3 {
+		if err := verifyChecksum(plain, newest[3]); err != nil {
+			return "", err
+		}
+	}
+
+	return plain, nil
+}
+
+// recover rebuilds the partial key index from disk and starts the flushers,
+// nothing reads the index or writes the log until it is done.
+func (k *KvStore) recover() {
+	offset, err := LoadIndex(k.IndexCache, k.options)
+	if err != nil {
+		k.options.Logger.Fatal("Could not load data into offset cache.")
+	}
+	k.LastLineOffset = offset
+	if err := k.versions.load(k.options); err != nil {
+		k.options.Logger.Fatal("Could not load key versions. ", err)
+	}
+	if err := k.expiries.load(k.options); err != nil {
+		k.options.Logger.Fatal("Could not load key expiries. ", err)
+	}
+	if err := k.operations.load(k.options); err != nil {
+		k.options.Logger.Fatal("Could not load operation IDs. ", err)
+	}
+
+	// The tickers are made here, in this order, so a SimClock fires ties
+	// the same way every run, see Simulation.
+	logTicker, indexTicker := newFlushTicker(k.options), newFlushTicker(k.options)
+	var janitorTicker Ticker
+	if k.expiries != nil {
+		janitorTicker = k.options.Clock.NewTicker(k.options.ExpiryScanInterval)
+	}
+
+	atomic.AddInt32(&k.flushers, 2)
+	go func() {
+		defer atomic.AddInt32(&k.flushers, -1)
+		flushLog(k.IndexCache, k.logBufferChannel, k.indexBufferChannel,
+			k.options, k.pending, k.journal, k.watchers, k.versions, logTicker)
+	}()
+	go func() {
+		defer atomic.AddInt32(&k.flushers, -1)
+		flushIndex(k.IndexCache, k.indexBufferChannel, k.shutdownChannel,
+			k.options, k.journal, indexTicker)
+	}()
+
+	atomic.CompareAndSwapInt32(&k.state, int32(STATE_RECOVERING),
+		int32(STATE_SERVING))
+	close(k.recovered)
+	if k.expiries != nil {
+		go k.expireKeys(k.stopJanitor, janitorTicker)
+	}
+	k.options.Logger.Info("Store recovered, serving requests.")
+}
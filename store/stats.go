@@ -0,0 +1,132 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	STATS_VERSION  string = "v1"
+	STATS_V1_PATH  string = "/stats/v1"
+	JSON_MIME_TYPE string = "application/json"
+)
+
+// StatsV1 is the versioned stats document served at STATS_V1_PATH. Fields are
+// only ever added to it, a breaking change gets a new version and path.
+type StatsV1 struct {
+	Version    string             `json:"version"`
+	Timestamp  time.Time          `json:"timestamp"`
+	Store      StoreStatsV1       `json:"store"`
+	Cache      StoreCacheStats    `json:"cache"`
+	Compaction CompactionEstimate `json:"compaction"`
+	Identity   Identity           `json:"identity"`
+}
+
+type StoreStatsV1 struct {
+	LastLineOffset  int64  `json:"lastLineOffset"`
+	PendingCommands int    `json:"pendingCommands"`
+	Closed          bool   `json:"closed"`
+	State           string `json:"state"`
+	// BlockedWrites waited for room in a full write buffer and ShedWrites
+	// were turned away with ErrWriteBufferFull.
+	BlockedWrites uint64 `json:"blockedWrites"`
+	ShedWrites    uint64 `json:"shedWrites"`
+}
+
+func (k *KvStore) StatsV1() (StatsV1, error) {
+	k.closeLock.RLock()
+	closed := k.closed
+	k.closeLock.RUnlock()
+
+	state := k.State()
+	store := StoreStatsV1{0, len(k.pending.Snapshot()), closed, state.String(),
+		atomic.LoadUint64(&k.pending.blocked), atomic.LoadUint64(&k.pending.shed)}
+	if state == STATE_RECOVERING {
+		return StatsV1{STATS_VERSION, k.options.Clock.Now().UTC(), store, k.CacheStats(),
+			CompactionEstimate{}, k.identity}, nil
+	}
+
+	compaction, err := k.EstimateCompaction()
+	if err != nil {
+		return StatsV1{}, err
+	}
+
+	store.LastLineOffset = k.LastLineOffset
+	return StatsV1{STATS_VERSION, k.options.Clock.Now().UTC(), store, k.CacheStats(),
+		compaction, k.identity}, nil
+}
+
+// StoreStats sizes up the data on disk for deciding when to compact.
+// DeadBytes and GarbageRatio come from EstimateCompaction and are estimates.
+// The store keeps one data log, so Segments is 1 once it exists.
+type StoreStats struct {
+	LiveKeys     int64   `json:"liveKeys"`
+	LogBytes     int64   `json:"logBytes"`
+	DeadBytes    int64   `json:"deadBytes"`
+	GarbageRatio float64 `json:"garbageRatio"`
+	Segments     int     `json:"segments"`
+	IndexBytes   int64   `json:"indexBytes"`
+	IndexEntries int     `json:"indexEntries"`
+	// Prefixes is filled in when Options.PrefixDepth is set.
+	Prefixes []PrefixStat `json:"prefixes,omitempty"`
+}
+
+func (k *KvStore) Stats() (StoreStats, error) {
+	estimate, err := k.EstimateCompaction()
+	if err != nil {
+		return StoreStats{}, err
+	}
+
+	stats := StoreStats{estimate.LiveRecords, estimate.LogBytes, estimate.ReclaimableBytes,
+		0, 0, 0, 0, nil}
+	if log, ok := k.options.Backend.(*segmentedLog); ok {
+		stats.Segments = len(log.snapshot())
+	} else if stats.LogBytes > 0 {
+		stats.Segments = 1
+	}
+	if stats.LogBytes > 0 {
+		stats.GarbageRatio = float64(stats.DeadBytes) / float64(stats.LogBytes)
+	}
+
+	for _, name := range []string{INDEX_FILE, INDEX_LOG_FILE} {
+		if info, err := os.Stat(k.options.path(name)); err == nil {
+			stats.IndexBytes += info.Size()
+		} else if !os.IsNotExist(err) {
+			return stats, err
+		}
+	}
+
+	for _, key := range k.IndexCache.Keys() {
+		values, _ := k.IndexCache.Get(key)
+		if offsets, _ := unpackOffsets(values); len(offsets) > 0 {
+			stats.IndexEntries++
+		}
+	}
+
+	stats.Prefixes, err = k.PrefixStats()
+	return stats, err
+}
+
+// StatsHandler serves the StatsV1 document as JSON, mount it at
+// STATS_V1_PATH.
+func (k *KvStore) StatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+
+		stats, err := k.StatsV1()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", JSON_MIME_TYPE)
+		json.NewEncoder(w).Encode(stats)
+	})
+}
@@ -0,0 +1,759 @@
+package kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	TABLE_BLOCK_SIZE   int = 4 * 1024
+	TABLE_TRAILER_SIZE int = 24
+	// tableEntryCost approximates the memory a decoded entry takes beyond
+	// its encoded bytes, for the memory budget.
+	tableEntryCost int64 = 48
+)
+
+var ErrCorruptTable error = errors.New("Index table is corrupt.")
+
+// TableIndexCodec writes the index as a sorted table: blocks of about
+// TABLE_BLOCK_SIZE bytes holding keys in order, each key's offsets encoded
+// like BinaryIndexCodec, then a block index of every block's first key,
+// position and length, then a fixed trailer of the block index position,
+// last offset and key count. A TableIndex reads it a block at a time.
+type TableIndexCodec struct{}
+
+func (t TableIndexCodec) Format() byte {
+	return TABLE_INDEX_FORMAT
+}
+
+func (t TableIndexCodec) Encode(index Index) ([]byte, error) {
+	sorted := make([]KeyOffset, len(index.KeyOffsets))
+	copy(sorted, index.KeyOffsets)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+
+	var buffer bytes.Buffer
+	writer := newTableWriter(&buffer, 0)
+	for _, keyOffset := range sorted {
+		if err := writer.add(keyOffset.Key, keyOffset.Offsets); err != nil {
+			return nil, err
+		}
+	}
+
+	err := writer.finish(index.LastOffset)
+	return buffer.Bytes(), err
+}
+
+func (t TableIndexCodec) Decode(data []byte) (Index, error) {
+	table, err := readTable(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return Index{}, err
+	}
+
+	index := Index{table.lastOffset, make([]KeyOffset, 0, table.count)}
+	for i := range table.blocks {
+		entries, _, err := table.readBlock(i)
+		if err != nil {
+			return Index{}, err
+		}
+		index.KeyOffsets = append(index.KeyOffsets, entries...)
+	}
+
+	return index, nil
+}
+
+// tableWriter streams sorted keys into a table, ending a block after
+// interval keys, or once it reaches TABLE_BLOCK_SIZE bytes when interval is
+// zero.
+type tableWriter struct {
+	writer   io.Writer
+	interval int
+	block    []byte
+	entries  int
+	first    string
+	position int64
+	index    []byte
+	count    uint64
+}
+
+func newTableWriter(writer io.Writer, interval int) *tableWriter {
+	return &tableWriter{writer, interval, make([]byte, 0, TABLE_BLOCK_SIZE), 0, "", 0, nil, 0}
+}
+
+func (t *tableWriter) add(key string, offsets []int64) error {
+	if t.entries == 0 {
+		t.first = key
+	}
+
+	t.block = appendUvarint(t.block, uint64(len(key)))
+	t.block = append(t.block, key...)
+	t.block = appendUvarint(t.block, uint64(len(offsets)))
+	for _, off := range offsets {
+		t.block = appendVarint(t.block, off)
+	}
+	t.entries++
+	t.count++
+
+	if (t.interval > 0 && t.entries >= t.interval) ||
+		(t.interval <= 0 && len(t.block) >= TABLE_BLOCK_SIZE) {
+		return t.flushBlock()
+	}
+
+	return nil
+}
+
+// flushBlock writes the block, led by its entry count, and notes it in the
+// block index.
+func (t *tableWriter) flushBlock() error {
+	if t.entries == 0 {
+		return nil
+	}
+
+	data := appendUvarint(make([]byte, 0, len(t.block)+binary.MaxVarintLen64), uint64(t.entries))
+	data = append(data, t.block...)
+	if _, err := t.writer.Write(data); err != nil {
+		return err
+	}
+
+	t.index = appendUvarint(t.index, uint64(len(t.first)))
+	t.index = append(t.index, t.first...)
+	t.index = appendUvarint(t.index, uint64(t.position))
+	t.index = appendUvarint(t.index, uint64(len(data)))
+	t.position += int64(len(data))
+	t.block, t.entries = t.block[:0], 0
+	return nil
+}
+
+func (t *tableWriter) finish(lastOffset int64) error {
+	if err := t.flushBlock(); err != nil {
+		return err
+	}
+
+	trailer := make([]byte, TABLE_TRAILER_SIZE)
+	binary.BigEndian.PutUint64(trailer[0:], uint64(t.position))
+	binary.BigEndian.PutUint64(trailer[8:], uint64(lastOffset))
+	binary.BigEndian.PutUint64(trailer[16:], t.count)
+	if _, err := t.writer.Write(t.index); err != nil {
+		return err
+	}
+
+	_, err := t.writer.Write(trailer)
+	return err
+}
+
+type tableBlock struct {
+	first  string
+	offset int64
+	length int64
+}
+
+// indexTable is an opened table, only its block index is held in memory.
+type indexTable struct {
+	reader     io.ReaderAt
+	blocks     []tableBlock
+	lastOffset int64
+	count      uint64
+}
+
+// readTable reads the trailer and block index of a table payload of size
+// bytes, which starts at offset zero of reader.
+func readTable(reader io.ReaderAt, size int64) (*indexTable, error) {
+	if size < int64(TABLE_TRAILER_SIZE) {
+		return nil, ErrCorruptTable
+	}
+
+	trailer := make([]byte, TABLE_TRAILER_SIZE)
+	if _, err := reader.ReadAt(trailer, size-int64(TABLE_TRAILER_SIZE)); err != nil {
+		return nil, err
+	}
+
+	start := int64(binary.BigEndian.Uint64(trailer[0:]))
+	if start < 0 || start > size-int64(TABLE_TRAILER_SIZE) {
+		return nil, ErrCorruptTable
+	}
+
+	data := make([]byte, size-int64(TABLE_TRAILER_SIZE)-start)
+	if _, err := reader.ReadAt(data, start); err != nil {
+		return nil, err
+	}
+
+	table := &indexTable{reader, make([]tableBlock, 0), int64(binary.BigEndian.Uint64(trailer[8:])),
+		binary.BigEndian.Uint64(trailer[16:])}
+	for len(data) > 0 {
+		var fields [3]uint64
+		var first []byte
+		for i := range fields {
+			value, n := binary.Uvarint(data)
+			if n <= 0 {
+				return nil, ErrCorruptTable
+			}
+			data = data[n:]
+			fields[i] = value
+
+			if i == 0 {
+				if value > uint64(len(data)) {
+					return nil, ErrCorruptTable
+				}
+				first, data = data[:value], data[value:]
+			}
+		}
+
+		if int64(fields[1]+fields[2]) > start {
+			return nil, ErrCorruptTable
+		}
+		table.blocks = append(table.blocks, tableBlock{string(first), int64(fields[1]),
+			int64(fields[2])})
+	}
+
+	return table, nil
+}
+
+// blockReader decodes the entries of one block in key order.
+type blockReader struct {
+	reader *bytes.Reader
+	count  uint64
+}
+
+func (t *indexTable) openBlock(i int) (*blockReader, error) {
+	block := t.blocks[i]
+	data := make([]byte, block.length)
+	if _, err := t.reader.ReadAt(data, block.offset); err != nil {
+		return nil, err
+	}
+
+	reader := bytes.NewReader(data)
+	count, err := binary.ReadUvarint(reader)
+	if err != nil || count > uint64(len(data)) {
+		return nil, ErrCorruptTable
+	}
+
+	return &blockReader{reader, count}, nil
+}
+
+// next decodes the next entry, false once the block is done.
+func (b *blockReader) next() (KeyOffset, bool, error) {
+	if b.count == 0 {
+		return KeyOffset{}, false, nil
+	}
+	b.count--
+
+	keyLen, err := binary.ReadUvarint(b.reader)
+	if err != nil || keyLen > uint64(b.reader.Len()) {
+		return KeyOffset{}, false, ErrCorruptTable
+	}
+
+	key := make([]byte, keyLen)
+	io.ReadFull(b.reader, key)
+	n, err := binary.ReadUvarint(b.reader)
+	if err != nil || n > uint64(b.reader.Len()) {
+		return KeyOffset{}, false, ErrCorruptTable
+	}
+
+	offsets := make([]int64, 0, n)
+	for k := uint64(0); k < n; k++ {
+		off, err := binary.ReadVarint(b.reader)
+		if err != nil {
+			return KeyOffset{}, false, ErrCorruptTable
+		}
+		offsets = append(offsets, off)
+	}
+
+	return KeyOffset{string(key), offsets}, true, nil
+}
+
+// readBlock decodes block i, returning its entries in key order and roughly
+// how much memory they take.
+func (t *indexTable) readBlock(i int) ([]KeyOffset, int64, error) {
+	block, err := t.openBlock(i)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entries := make([]KeyOffset, 0, block.count)
+	for {
+		entry, ok, err := block.next()
+		if err != nil {
+			return nil, 0, err
+		}
+		if !ok {
+			break
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, t.blocks[i].length + int64(len(entries))*tableEntryCost, nil
+}
+
+// seek scans block i forward for key, stopping at the first key past it
+// and keeping nothing in memory.
+func (t *indexTable) seek(i int, key string) ([]int64, bool, error) {
+	block, err := t.openBlock(i)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for {
+		entry, ok, err := block.next()
+		if err != nil || !ok || entry.Key > key {
+			return nil, false, err
+		}
+		if entry.Key == key {
+			return entry.Offsets, true, nil
+		}
+	}
+}
+
+// find is the block that would hold key, -1 when key sorts before them all.
+func (t *indexTable) find(key string) int {
+	return sort.Search(len(t.blocks), func(i int) bool { return t.blocks[i].first > key }) - 1
+}
+
+type cachedBlock struct {
+	index   int
+	entries []KeyOffset
+	cost    int64
+}
+
+type overlayEntry struct {
+	// value is nil for a key removed since the table was written.
+	value   interface{}
+	version uint64
+}
+
+// TableIndex is an index cache over a sorted index table on disk, so the
+// index of a very large key set need not be loaded at startup. Only the
+// first key of each block stays in memory, a sparse index of the table,
+// and blocks are read when a lookup needs them and kept while they fit in
+// the memory budget. With no budget a lookup scans forward through its
+// block and keeps none of it. Changes since
+// the table was written are held in memory until the next index checkpoint
+// writes a new table with them merged in.
+type TableIndex struct {
+	counters cacheCounters
+	lock     sync.RWMutex
+	file     *os.File
+	table    *indexTable
+	overlay  map[string]overlayEntry
+	version  uint64
+	// written is the overlay as of the table last written, which swap
+	// drops once that table replaces the current one.
+	written map[string]overlayEntry
+	// blockLock guards the blocks read under the budget.
+	blockLock sync.Mutex
+	budget    int64
+	// interval is how many keys a block of a table written here holds, zero
+	// fills blocks to TABLE_BLOCK_SIZE bytes.
+	interval int
+	used     int64
+	lru      *list.List
+	cached   map[int]*list.Element
+	keyLocks []sync.RWMutex
+}
+
+// NewTableIndex caches at most budget bytes of blocks. Tables it writes
+// hold interval keys a block, or TABLE_BLOCK_SIZE bytes when it is zero.
+func NewTableIndex(budget Size, interval int) *TableIndex {
+	return &TableIndex{cacheCounters{}, sync.RWMutex{}, nil, nil, make(map[string]overlayEntry), 0,
+		nil, sync.Mutex{}, int64(budget), interval, 0, list.New(), make(map[int]*list.Element),
+		make([]sync.RWMutex, DEFAULT_INDEX_SHARDS)}
+}
+
+// open reads the block index of the table at path, reporting false when
+// there is no table there to read lazily.
+func (t *TableIndex) open(path string) (bool, int64, error) {
+	file, table, err := openTableFile(path)
+	if file == nil || err != nil {
+		return false, 0, err
+	}
+
+	t.lock.Lock()
+	t.file, t.table = file, table
+	t.lock.Unlock()
+	return true, table.lastOffset, nil
+}
+
+// openTableFile opens an index file written in the table format, returning
+// a nil file when it is missing or in another format.
+func openTableFile(path string) (*os.File, *indexTable, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	start, length, err := checkCheckpointFile(file, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	header := make([]byte, len(INDEX_MAGIC)+1)
+	if _, err := file.ReadAt(header, start); err != nil ||
+		string(header[:len(INDEX_MAGIC)]) != INDEX_MAGIC ||
+		header[len(INDEX_MAGIC)] != TABLE_INDEX_FORMAT {
+		file.Close()
+		return nil, nil, nil
+	}
+
+	payload := io.NewSectionReader(file, start+int64(len(header)), length-int64(len(header)))
+	table, err := readTable(payload, payload.Size())
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return file, table, nil
+}
+
+func (t *TableIndex) Get(key string) (interface{}, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if entry, ok := t.overlay[key]; ok {
+		t.counters.recordGet(entry.value != nil)
+		return entry.value, entry.value != nil
+	}
+
+	if t.table == nil {
+		t.counters.recordGet(false)
+		return nil, false
+	}
+
+	i := t.table.find(key)
+	if i < 0 {
+		t.counters.recordGet(false)
+		return nil, false
+	}
+
+	offsets, found, err := t.lookup(i, key)
+	t.counters.recordGet(found && err == nil)
+	if !found || err != nil {
+		return nil, false
+	}
+
+	return packOffsets(offsets), true
+}
+
+// lookup finds key in block i, through the block cache unless the index is
+// sparse with no budget, when the block is scanned and dropped.
+func (t *TableIndex) lookup(i int, key string) ([]int64, bool, error) {
+	if t.budget <= 0 {
+		return t.table.seek(i, key)
+	}
+
+	entries, err := t.block(i)
+	if err != nil {
+		return nil, false, err
+	}
+
+	j := sort.Search(len(entries), func(j int) bool { return entries[j].Key >= key })
+	if j == len(entries) || entries[j].Key != key {
+		return nil, false, nil
+	}
+
+	return entries[j].Offsets, true, nil
+}
+
+// block returns the entries of block i of the current table, reading it
+// and evicting the least recently used blocks past the budget. The caller
+// holds lock for reading.
+func (t *TableIndex) block(i int) ([]KeyOffset, error) {
+	t.blockLock.Lock()
+	defer t.blockLock.Unlock()
+	if element, ok := t.cached[i]; ok {
+		t.lru.MoveToFront(element)
+		return element.Value.(*cachedBlock).entries, nil
+	}
+
+	entries, cost, err := t.table.readBlock(i)
+	if err != nil {
+		return nil, err
+	}
+
+	t.cached[i] = t.lru.PushFront(&cachedBlock{i, entries, cost})
+	t.used += cost
+	for t.used > t.budget && t.lru.Len() > 1 {
+		oldest := t.lru.Back()
+		evicted := t.lru.Remove(oldest).(*cachedBlock)
+		delete(t.cached, evicted.index)
+		t.used -= evicted.cost
+		atomic.AddUint64(&t.counters.evictions, 1)
+	}
+
+	return entries, nil
+}
+
+func (t *TableIndex) Add(key string, value interface{}) {
+	t.lock.Lock()
+	t.version++
+	t.overlay[key] = overlayEntry{value, t.version}
+	t.lock.Unlock()
+}
+
+func (t *TableIndex) Remove(key string) {
+	t.lock.Lock()
+	t.version++
+	t.overlay[key] = overlayEntry{nil, t.version}
+	t.lock.Unlock()
+}
+
+// Keys reads every block of the table without caching them, so listing the
+// keys does not push lookups' blocks out of the budget.
+func (t *TableIndex) Keys() []string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	keys := make([]string, 0, len(t.overlay))
+	for key, entry := range t.overlay {
+		if entry.value != nil {
+			keys = append(keys, key)
+		}
+	}
+
+	if t.table == nil {
+		return keys
+	}
+
+	for i := range t.table.blocks {
+		entries, _, err := t.table.readBlock(i)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if _, ok := t.overlay[entry.Key]; !ok {
+				keys = append(keys, entry.Key)
+			}
+		}
+	}
+
+	return keys
+}
+
+func (t *TableIndex) Stats() CacheStats {
+	t.lock.RLock()
+	size := len(t.overlay)
+	if t.table != nil {
+		size += int(t.table.count)
+	}
+	t.lock.RUnlock()
+
+	return t.counters.stats(size)
+}
+
+// writeTable writes the current table merged with the overlay to path, in
+// key order. swap makes it the current table once it has been moved into
+// place.
+func (t *TableIndex) writeTable(path string, lastOffset int64) error {
+	t.lock.RLock()
+	table := t.table
+	overlay := make(map[string]overlayEntry, len(t.overlay))
+	for key, entry := range t.overlay {
+		overlay[key] = entry
+	}
+	t.lock.RUnlock()
+
+	changed := make([]string, 0, len(overlay))
+	for key := range overlay {
+		changed = append(changed, key)
+	}
+	sort.Strings(changed)
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	checkpoint, err := newCheckpointWriter(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	buffered := bufio.NewWriter(checkpoint)
+	buffered.WriteString(INDEX_MAGIC)
+	buffered.WriteByte(TABLE_INDEX_FORMAT)
+	writer := newTableWriter(buffered, t.interval)
+	add := func(key string) error {
+		entry := overlay[key]
+		if entry.value == nil {
+			return nil
+		}
+		offsets, _ := unpackOffsets(entry.value)
+		return writer.add(key, offsets)
+	}
+
+	err = t.mergeTable(table, changed, overlay, writer, add)
+	if err == nil {
+		err = writer.finish(lastOffset)
+	}
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err == nil {
+		err = checkpoint.finish()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	t.written = overlay
+	t.lock.Unlock()
+	return nil
+}
+
+// mergeTable feeds writer the keys of table and changed in order, changed
+// keys replacing the table's.
+func (t *TableIndex) mergeTable(table *indexTable, changed []string,
+	overlay map[string]overlayEntry, writer *tableWriter, add func(key string) error) error {
+	next := 0
+	if table != nil {
+		for i := range table.blocks {
+			entries, _, err := table.readBlock(i)
+			if err != nil {
+				return err
+			}
+
+			for _, entry := range entries {
+				for next < len(changed) && changed[next] < entry.Key {
+					if err := add(changed[next]); err != nil {
+						return err
+					}
+					next++
+				}
+
+				if _, ok := overlay[entry.Key]; ok {
+					continue
+				}
+				if err := writer.add(entry.Key, entry.Offsets); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for ; next < len(changed); next++ {
+		if err := add(changed[next]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// swap opens the table writeTable wrote, now moved to path, and drops the
+// overlay entries it holds that have not changed since.
+func (t *TableIndex) swap(path string) error {
+	file, table, err := openTableFile(path)
+	if err != nil {
+		return err
+	}
+	if file == nil {
+		return ErrCorruptTable
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.file != nil {
+		t.file.Close()
+	}
+	t.file, t.table = file, table
+	for key, entry := range t.written {
+		if current, ok := t.overlay[key]; ok && current.version == entry.version {
+			delete(t.overlay, key)
+		}
+	}
+	t.written = nil
+
+	t.blockLock.Lock()
+	t.lru.Init()
+	t.cached = make(map[int]*list.Element)
+	t.used = 0
+	t.blockLock.Unlock()
+	return nil
+}
+
+// lastOffset is the log offset of the open table, false when none is open.
+func (t *TableIndex) lastOffset() (int64, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if t.table == nil {
+		return 0, false
+	}
+
+	return t.table.lastOffset, true
+}
+
+// checkpointOffset is the log offset the index at path is up to date with,
+// taken from the open table rather than decoding the file when it can.
+func checkpointOffset(cache Cache, path string, opts Options) int64 {
+	if table, ok := cache.(*TableIndex); ok {
+		if offset, open := table.lastOffset(); open {
+			return offset
+		}
+	}
+
+	previous, _ := ReadIndexFile(path, opts)
+	return previous.LastOffset
+}
+
+func (k *KvStore) closeIndex() {
+	if table, ok := k.IndexCache.(*TableIndex); ok {
+		table.Close()
+	}
+}
+
+// Close releases the table file.
+func (t *TableIndex) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.file == nil {
+		return nil
+	}
+
+	err := t.file.Close()
+	t.file, t.table = nil, nil
+	return err
+}
+
+func (t *TableIndex) keyLock(key string) *sync.RWMutex {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return &t.keyLocks[hash.Sum32()%uint32(len(t.keyLocks))]
+}
+
+func (t *TableIndex) LockKey(key string) {
+	t.keyLock(key).Lock()
+}
+
+func (t *TableIndex) UnlockKey(key string) {
+	t.keyLock(key).Unlock()
+}
+
+func (t *TableIndex) RLockKey(key string) {
+	t.keyLock(key).RLock()
+}
+
+func (t *TableIndex) RUnlockKey(key string) {
+	t.keyLock(key).RUnlock()
+}
@@ -0,0 +1,120 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Span names, with the attributes each span gets.
+const (
+	// SPAN_GET, SPAN_PUT and SPAN_DEL have a key attribute, gets also a
+	// source of pending, cache or disk and the []int64 offsets of the
+	// partial key read from disk.
+	SPAN_GET string = "kvstore.Get"
+	SPAN_PUT string = "kvstore.Put"
+	SPAN_DEL string = "kvstore.Del"
+	// SPAN_UPDATE is a read and write of one key, like Incr, with the
+	// attributes of a get.
+	SPAN_UPDATE string = "kvstore.Update"
+	// SPAN_FLUSH_LOG has the records and reason of the flush.
+	SPAN_FLUSH_LOG string = "kvstore.FlushLog"
+	// SPAN_FLUSH_INDEX has the pairs flushed and whether it checkpointed.
+	SPAN_FLUSH_INDEX string = "kvstore.FlushIndex"
+	// SPAN_COMPACT has the records read and kept.
+	SPAN_COMPACT string = "kvstore.Compact"
+)
+
+// Tracer starts the spans of store operations, see Options.Tracer. It is
+// shaped like the OpenTelemetry tracing API, so an adapter over an otel
+// trace.Tracer is a few lines and the store does not depend on otel.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(key string, value interface{}) {}
+
+func (nopSpan) RecordError(err error) {}
+
+func (nopSpan) End() {}
+
+// startSpan starts a span when the store traces, a nopSpan otherwise.
+func (o Options) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if o.Tracer == nil {
+		return ctx, nopSpan{}
+	}
+
+	return o.Tracer.Start(ctx, name)
+}
+
+// startOp starts the span of a Get, Put or Del of key. With
+// Options.SlowThreshold set the span also logs the operation when it takes
+// longer, with its attributes, to find keys slowed down by partial key
+// collisions or disk reads.
+func (k *KvStore) startOp(ctx context.Context, name string, key string) (context.Context, Span) {
+	ctx, span := k.options.startSpan(ctx, name)
+	span.SetAttribute("key", key)
+	if k.options.SlowThreshold <= 0 {
+		return ctx, span
+	}
+
+	return ctx, &slowSpan{span, name, k.options.SlowThreshold, k.options.Logger,
+		time.Now(), map[string]interface{}{"key": key}, nil}
+}
+
+// slowSpan keeps the attributes of a span to log them when it is slow.
+type slowSpan struct {
+	Span
+	name       string
+	threshold  time.Duration
+	logger     Logger
+	start      time.Time
+	attributes map[string]interface{}
+	err        error
+}
+
+func (s *slowSpan) SetAttribute(key string, value interface{}) {
+	s.attributes[key] = value
+	s.Span.SetAttribute(key, value)
+}
+
+func (s *slowSpan) RecordError(err error) {
+	s.err = err
+	s.Span.RecordError(err)
+}
+
+func (s *slowSpan) End() {
+	s.Span.End()
+	elapsed := time.Since(s.start)
+	if elapsed <= s.threshold {
+		return
+	}
+
+	message := fmt.Sprintf("Slow %s of key %s took %v", s.name, s.attributes["key"], elapsed)
+	if source, ok := s.attributes["source"]; ok {
+		message += fmt.Sprintf(", from %v", source)
+	}
+	if offsets, ok := s.attributes["offsets"]; ok {
+		message += fmt.Sprintf(", offsets %v", offsets)
+	}
+	if s.err != nil {
+		message += fmt.Sprintf(", failed: %v", s.err)
+	}
+	s.logger.Info(message)
+}
+
+// endSpan records err on span, if any, and ends it.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
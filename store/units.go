@@ -0,0 +1,108 @@
+package kvstore
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Size is a number of bytes. It parses and prints as "512B", "64KB",
+// "1.5MB" or "2GB", units are powers of 1024 and KiB, MiB and GiB are
+// accepted too.
+type Size int64
+
+const (
+	B  Size = 1
+	KB Size = 1024 * B
+	MB Size = 1024 * KB
+	GB Size = 1024 * MB
+	TB Size = 1024 * GB
+)
+
+type sizeUnit struct {
+	suffix string
+	size   Size
+}
+
+// sizeUnits is in matching order, longer suffixes first.
+var sizeUnits []sizeUnit = []sizeUnit{
+	{"TIB", TB}, {"GIB", GB}, {"MIB", MB}, {"KIB", KB},
+	{"TB", TB}, {"GB", GB}, {"MB", MB}, {"KB", KB},
+	{"T", TB}, {"G", GB}, {"M", MB}, {"K", KB}, {"B", B},
+}
+
+func ParseSize(text string) (Size, error) {
+	trimmed := strings.ToUpper(strings.TrimSpace(text))
+	unit := B
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(trimmed, u.suffix) {
+			trimmed = strings.TrimSpace(strings.TrimSuffix(trimmed, u.suffix))
+			unit = u.size
+			break
+		}
+	}
+
+	number, err := strconv.ParseFloat(trimmed, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("Invalid size %q.", text)
+	}
+
+	return Size(number * float64(unit)), nil
+}
+
+// String prints s in the largest unit that divides it exactly.
+func (s Size) String() string {
+	for _, u := range sizeUnits[4:8] {
+		if s != 0 && s%u.size == 0 {
+			return strconv.FormatInt(int64(s/u.size), 10) + u.suffix
+		}
+	}
+
+	return strconv.FormatInt(int64(s), 10) + "B"
+}
+
+// Set lets a Size be a command line flag.
+func (s *Size) Set(text string) error {
+	size, err := ParseSize(text)
+	if err != nil {
+		return err
+	}
+
+	*s = size
+	return nil
+}
+
+func (s Size) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *Size) UnmarshalText(text []byte) error {
+	return s.Set(string(text))
+}
+
+// Duration is a time.Duration that parses and prints as "250ms" or "1m30s"
+// in config files.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(text string) error {
+	duration, err := time.ParseDuration(strings.TrimSpace(text))
+	if err != nil {
+		return fmt.Errorf("Invalid duration %q.", text)
+	}
+
+	*d = Duration(duration)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	return d.Set(string(text))
+}
@@ -0,0 +1,158 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var ErrNotInteger error = errors.New("Value is not an integer.")
+var ErrIntegerOverflow error = errors.New("Increment would overflow the value.")
+var ErrNegativeOffset error = errors.New("Offset must not be negative.")
+
+// Incr adds delta to the integer stored at key and returns the result, a
+// missing key counts as zero. No other write of key comes between the read
+// and the write, so concurrent Incr calls never lose an increment. A value
+// that is not a base 10 int64 fails with ErrNotInteger and is left as is.
+func (k *KvStore) Incr(key string, delta int64) (int64, error) {
+	var result int64
+	_, err := k.update(context.Background(), key, func(value string, found bool) (string, error) {
+		var current int64
+		if found {
+			var err error
+			if current, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return "", ErrNotInteger
+			}
+		}
+		if delta > 0 && current > math.MaxInt64-delta || delta < 0 && current < math.MinInt64-delta {
+			return "", ErrIntegerOverflow
+		}
+
+		result = current + delta
+		return strconv.FormatInt(result, 10), nil
+	})
+
+	return result, err
+}
+
+// Append adds suffix to the end of the value at key, storing it as the value
+// of a missing key, and returns the new length of the value.
+func (k *KvStore) Append(key string, suffix string) (int, error) {
+	value, err := k.update(context.Background(), key, func(value string, found bool) (string, error) {
+		return value + suffix, nil
+	})
+
+	return len(value), err
+}
+
+// SetRange overwrites the value at key from byte offset on with data,
+// growing it as needed, and returns the new length of the value. A value
+// shorter than offset, or a missing key, is padded with zero bytes up to
+// it.
+func (k *KvStore) SetRange(key string, offset int, data string) (int, error) {
+	if offset < 0 {
+		return 0, ErrNegativeOffset
+	}
+	if Size(offset)+Size(len(data)) > k.options.MaxValueSize {
+		return 0, ErrValueTooLarge
+	}
+
+	value, err := k.update(context.Background(), key, func(value string, found bool) (string, error) {
+		if len(value) < offset {
+			value += strings.Repeat("\x00", offset-len(value))
+		}
+		if end := offset + len(data); end < len(value) {
+			return value[:offset] + data + value[end:], nil
+		}
+
+		return value[:offset] + data, nil
+	})
+
+	return len(value), err
+}
+
+// update writes what change makes of the value of key, found is false when
+// key is missing or expired. The key's write lock is held from the read to
+// the write, which Put and Del take too. An error from change leaves the key
+// as it was, a key with a TTL keeps it.
+func (k *KvStore) update(ctx context.Context, key string,
+	change func(value string, found bool) (string, error)) (value string, err error) {
+	if k.options.ReadOnly {
+		return "", ErrReadOnly
+	}
+
+	ctx, span := k.startOp(ctx, SPAN_UPDATE, key)
+	defer func() { endSpan(span, err) }()
+
+	if err := k.awaitRecovery(ctx); err != nil {
+		return "", err
+	}
+
+	value, done, err := k.updateLocked(ctx, key, span, change)
+	if err != nil {
+		return "", err
+	}
+
+	return value, waitForWrite(done)
+}
+
+// updateLocked makes the change of update under the store's close lock and
+// the key's write lock, returning the channel the write's flush result
+// arrives on.
+func (k *KvStore) updateLocked(ctx context.Context, key string, span Span,
+	change func(value string, found bool) (string, error)) (string, chan error, error) {
+	k.closeLock.RLock()
+	defer k.closeLock.RUnlock()
+	if k.closed {
+		return "", nil, ErrStoreClosed
+	}
+
+	key = k.normalizeKey(key)
+	unlock := k.lockWrite(key)
+	defer unlock()
+
+	readCtx := ctx
+	if k.options.ReadTimeout > 0 {
+		var cancel context.CancelFunc
+		readCtx, cancel = context.WithTimeout(ctx, k.options.ReadTimeout)
+		defer cancel()
+	}
+	old, err := k.read(readCtx, key, span)
+	found := err == nil
+	if err != nil && err != ErrNotInIndex && err != ErrKeyNotFound {
+		return "", nil, err
+	}
+
+	value, err := change(old, found)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := k.checkSize(key, value); err != nil {
+		return "", nil, err
+	}
+	if err := k.checkQuota(key, value); err != nil {
+		return "", nil, err
+	}
+	if err := k.pending.reserve(k.options.Backpressure, k.options.WriteBufferTimeout); err != nil {
+		return "", nil, err
+	}
+
+	var expires int64
+	if found {
+		expires = k.expiries.get(key)
+	}
+
+	k.countWrite(key)
+	k.Cache.Add(key, value)
+	if k.negativeCache != nil {
+		k.negativeCache.Remove(key)
+	}
+	k.expiries.set(key, expires)
+	done := k.enqueue(Command{PUT_COMMAND, key, value, formatChecksum(Checksum([]byte(value))),
+		k.options.WriteMode, nil, expires, ""})
+	k.updateIndexes(key, &value)
+
+	return value, done, nil
+}
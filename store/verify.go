@@ -0,0 +1,160 @@
+package kvstore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	PROBLEM_DANGLING     string = "dangling"
+	PROBLEM_UNREADABLE   string = "unreadable"
+	PROBLEM_KEY_MISMATCH string = "keyMismatch"
+	PROBLEM_TOMBSTONE    string = "tombstone"
+	PROBLEM_CHECKSUM     string = "checksum"
+	PROBLEM_DUPLICATE    string = "duplicate"
+)
+
+// Inconsistency is an index offset that does not lead to a live record of a
+// key filed under PartialKey. Key is empty when no record could be read.
+type Inconsistency struct {
+	PartialKey string `json:"partialKey"`
+	Offset     int64  `json:"offset"`
+	Key        string `json:"key"`
+	Problem    string `json:"problem"`
+	Detail     string `json:"detail,omitempty"`
+}
+
+type VerifyReport struct {
+	PartialKeys int             `json:"partialKeys"`
+	Offsets     int             `json:"offsets"`
+	LogSize     int64           `json:"logSize"`
+	Problems    []Inconsistency `json:"problems"`
+}
+
+func (v VerifyReport) Ok() bool {
+	return len(v.Problems) == 0
+}
+
+// Verify reads the record behind every index offset and reports offsets
+// past the end of the data log or not at the start of a record, records
+// that do not parse or fail their checksum, records of a key with another
+// partial key, deletes, and keys indexed at more than one offset.
+func (k *KvStore) Verify() (VerifyReport, error) {
+	if err := k.awaitRecovery(context.Background()); err != nil {
+		return VerifyReport{}, err
+	}
+
+	path := k.options.path(STORAGE_FILE)
+	file, err := k.options.Backend.Open(path)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	defer file.Close()
+
+	size, err := k.options.Backend.Size(path)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+
+	report := VerifyReport{0, 0, size, make([]Inconsistency, 0)}
+	seen := make(map[string]int64)
+	reader := bufio.NewReaderSize(file, int(k.options.ReadAheadSize))
+	for _, partialKey := range k.IndexCache.Keys() {
+		values, ok := k.IndexCache.Get(partialKey)
+		if !ok || partialKey == "" {
+			continue
+		}
+
+		offsets, _ := unpackOffsets(values)
+		if len(offsets) > 0 {
+			report.PartialKeys++
+		}
+		for _, offset := range offsets {
+			report.Offsets++
+			problem := Inconsistency{partialKey, offset, "", "", ""}
+			key, err := k.verifyOffset(file, reader, report.LogSize, partialKey, offset, &problem)
+			if err != nil {
+				return report, err
+			}
+
+			if problem.Problem == "" {
+				if first, ok := seen[key]; ok {
+					problem.Problem = PROBLEM_DUPLICATE
+					problem.Detail = fmt.Sprintf("Also indexed at offset %d.", first)
+				}
+				seen[key] = offset
+			}
+
+			if problem.Problem != "" {
+				report.Problems = append(report.Problems, problem)
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// verifyOffset fills in problem for an offset that does not hold a live
+// record of partialKey, returning the key read there.
+func (k *KvStore) verifyOffset(file BackendFile, reader *bufio.Reader, size int64,
+	partialKey string, offset int64, problem *Inconsistency) (string, error) {
+	if offset < 0 || offset >= size {
+		problem.Problem = PROBLEM_DANGLING
+		problem.Detail = "Offset is past the end of the data log."
+		return "", nil
+	}
+
+	if offset > 0 {
+		previous := make([]byte, 1)
+		if _, err := file.ReadAt(previous, offset-1); err != nil {
+			return "", err
+		}
+		if previous[0] != '\n' {
+			problem.Problem = PROBLEM_DANGLING
+			problem.Detail = "Offset is not at the start of a record."
+			return "", nil
+		}
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return "", err
+	}
+	reader.Reset(file)
+
+	line, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	record, value, err := parseKvRecord(line)
+	if err != nil || !strings.HasSuffix(line, "\n") {
+		problem.Problem = PROBLEM_UNREADABLE
+		if err != nil {
+			problem.Detail = err.Error()
+		}
+		return "", nil
+	}
+
+	key := record[0]
+	problem.Key = key
+	switch {
+	case k.options.indexKey(key) != partialKey:
+		problem.Problem = PROBLEM_KEY_MISMATCH
+	case isTombstone(record):
+		problem.Problem = PROBLEM_TOMBSTONE
+	case len(record) > 3:
+		plain, err := decryptValue(k.options.Encryption, value)
+		if err == nil {
+			err = verifyChecksum(plain, record[3])
+		}
+		if err != nil {
+			problem.Problem = PROBLEM_CHECKSUM
+			problem.Detail = err.Error()
+		}
+	}
+
+	return key, nil
+}
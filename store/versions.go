@@ -0,0 +1,169 @@
+package kvstore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+var ErrNoVersion error = errors.New("Key has no such version.")
+
+// VersionIndex remembers the data log offsets of the newest puts of each
+// key, newest first, so earlier values can be read back until compaction
+// or retention drops them. A delete forgets a key's versions, like
+// compaction does. A nil VersionIndex keeps nothing.
+type VersionIndex struct {
+	lock    sync.RWMutex
+	keep    int
+	offsets map[string][]int64
+}
+
+// NewVersionIndex keeps keep versions of each key, the current one
+// included, and is nil when keep is one or less.
+func NewVersionIndex(keep int) *VersionIndex {
+	if keep <= 1 {
+		return nil
+	}
+
+	return &VersionIndex{sync.RWMutex{}, keep, make(map[string][]int64)}
+}
+
+func (v *VersionIndex) put(key string, offset int64) {
+	if v == nil {
+		return
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	offsets := append([]int64{offset}, v.offsets[key]...)
+	if len(offsets) > v.keep {
+		offsets = offsets[:v.keep]
+	}
+	v.offsets[key] = offsets
+}
+
+func (v *VersionIndex) remove(key string) {
+	if v == nil {
+		return
+	}
+
+	v.lock.Lock()
+	delete(v.offsets, key)
+	v.lock.Unlock()
+}
+
+func (v *VersionIndex) get(key string) []int64 {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return append([]int64(nil), v.offsets[key]...)
+}
+
+// load reads the versions of every key from the whole data log, the index
+// checkpoint only covers the latest.
+func (v *VersionIndex) load(opts Options) error {
+	if v == nil {
+		return nil
+	}
+
+	path := opts.path(STORAGE_FILE)
+	file, err := opts.Backend.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	offset := logStart(opts.Backend, path)
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReaderSize(file, int(opts.ReadAheadSize))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line == "" {
+			return nil
+		}
+
+		if record, _, parseErr := parseKvRecord(line); parseErr == nil {
+			if isTombstone(record) {
+				v.remove(record[0])
+			} else {
+				v.put(record[0], offset)
+			}
+		}
+		offset += int64(len(line))
+	}
+}
+
+// History reads the retained values of key, newest first, so the first is
+// what Get returns. Buffered writes are flushed first so each is its own
+// version. It keeps Options.RetainVersions values at most, just the current
+// one when that is one or less.
+func (k *KvStore) History(key string) ([]string, error) {
+	if k.versions == nil {
+		value, err := k.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		return []string{value}, nil
+	}
+
+	if err := k.flushBuffer(context.Background(), WRITE_THROUGH); err != nil {
+		return nil, err
+	}
+
+	key = k.normalizeKey(key)
+	offsets := k.versions.get(key)
+	if len(offsets) == 0 {
+		return nil, ErrNotInIndex
+	}
+
+	opts := k.options
+	path := opts.path(STORAGE_FILE)
+	start := logStart(opts.Backend, path)
+	file, err := opts.Backend.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values := make([]string, 0, len(offsets))
+	reader := bufio.NewReaderSize(file, int(opts.ReadAheadSize))
+	for _, offset := range offsets {
+		if offset < start {
+			break
+		}
+
+		value, err := readValueAt(file, reader, offset, opts)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+// GetVersion reads the nth newest value of key, zero being the current one,
+// failing with ErrNoVersion when fewer versions are retained.
+func (k *KvStore) GetVersion(key string, n int) (string, error) {
+	values, err := k.History(key)
+	if err != nil {
+		return "", err
+	}
+
+	if n < 0 || n >= len(values) {
+		return "", ErrNoVersion
+	}
+
+	return values[n], nil
+}
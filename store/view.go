@@ -0,0 +1,147 @@
+package kvstore
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+var ErrOffsetRemoved error = errors.New("Log offset is before the oldest data log segment.")
+
+// ReadOnlyStore reads a fixed view of a store.
+type ReadOnlyStore interface {
+	Get(key string) (string, error)
+	Keys() ([]string, error)
+}
+
+// LogView is a store as it was once the data log reached an offset, it only
+// sees the records starting before that offset.
+type LogView struct {
+	store  *KvStore
+	offset int64
+	once   sync.Once
+	// offsets is the record offset of each key's value as of offset.
+	offsets map[string]int64
+	err     error
+}
+
+// At gives a read view of the data as of log offset, for debugging and
+// auditing. The Offset of a watch event views the store just before that
+// write. Writes not yet flushed are not in it. The log is read up to offset on first use, so an
+// offset past its end sees it as it is then, and one before a removed
+// segment or a compaction fails with ErrOffsetRemoved.
+func (k *KvStore) At(offset int64) ReadOnlyStore {
+	return &LogView{k, offset, sync.Once{}, nil, nil}
+}
+
+// load reads the log records before the view's offset, once.
+func (v *LogView) load() error {
+	v.once.Do(func() {
+		v.offsets, v.err = viewOffsets(v.store.options, v.offset)
+	})
+
+	return v.err
+}
+
+func viewOffsets(opts Options, end int64) (map[string]int64, error) {
+	path := opts.path(STORAGE_FILE)
+	offsets := make(map[string]int64)
+	file, err := opts.Backend.Open(path)
+	if os.IsNotExist(err) {
+		return offsets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	offset := logStart(opts.Backend, path)
+	if end < offset {
+		return nil, ErrOffsetRemoved
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReaderSize(file, int(opts.ReadAheadSize))
+	for offset < end {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+
+		if record, _, parseErr := parseKvRecord(line); parseErr == nil {
+			if isTombstone(record) {
+				delete(offsets, record[0])
+			} else {
+				offsets[record[0]] = offset
+			}
+		}
+		offset += int64(len(line))
+	}
+
+	return offsets, nil
+}
+
+func (v *LogView) Get(key string) (string, error) {
+	if err := v.load(); err != nil {
+		return "", err
+	}
+
+	offset, ok := v.offsets[v.store.normalizeKey(key)]
+	if !ok {
+		return "", ErrNotInIndex
+	}
+
+	opts := v.store.options
+	file, err := opts.Backend.Open(opts.path(STORAGE_FILE))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return readValueAt(file, bufio.NewReaderSize(file, int(opts.ReadAheadSize)),
+		offset, opts)
+}
+
+// Keys lists the keys stored as of the view's offset in sorted order.
+func (v *LogView) Keys() ([]string, error) {
+	if err := v.load(); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(v.offsets))
+	for key := range v.offsets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// readValueAt reads, decrypts and checks the value of the put record at
+// offset of file, through reader.
+func readValueAt(file BackendFile, reader *bufio.Reader, offset int64,
+	opts Options) (string, error) {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return "", err
+	}
+	reader.Reset(file)
+
+	_, value, checksum, _, err := readKvRecord(reader)
+	if err != nil {
+		return "", err
+	}
+
+	if value, err = decryptValue(opts.Encryption, value); err != nil {
+		return "", err
+	}
+
+	return value, verifyChecksum(value, checksum)
+}
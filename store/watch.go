@@ -0,0 +1,105 @@
+package kvstore
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const WATCH_BUFFER_SIZE int = 256
+
+// Event is a put or delete of Key, sent to watchers once it is in the data
+// log. Value is empty for deletes. Time is when it was committed, zero for
+// records written before the log held commit times.
+type Event struct {
+	Type   string    `json:"type"`
+	Key    string    `json:"key"`
+	Value  string    `json:"value"`
+	Offset int64     `json:"offset"`
+	Time   time.Time `json:"time"`
+	// Operation is the operation ID the change was made under, if any.
+	Operation string `json:"operation,omitempty"`
+}
+
+type CancelFunc func()
+
+type watch struct {
+	prefix string
+	events chan Event
+}
+
+// Watchers fans committed commands out to watches. A watch that falls
+// WATCH_BUFFER_SIZE events behind is closed rather than holding up flushes, a
+// closed channel tells its consumer it may have missed events.
+type Watchers struct {
+	sync.Mutex
+	next    int
+	watches map[int]*watch
+	closed  bool
+}
+
+func NewWatchers() *Watchers {
+	return &Watchers{sync.Mutex{}, 0, make(map[int]*watch), false}
+}
+
+func (w *Watchers) add(prefix string) (<-chan Event, CancelFunc) {
+	w.Lock()
+	defer w.Unlock()
+
+	events := make(chan Event, WATCH_BUFFER_SIZE)
+	if w.closed {
+		close(events)
+		return events, func() {}
+	}
+
+	id := w.next
+	w.next++
+	w.watches[id] = &watch{prefix, events}
+
+	return events, func() {
+		w.Lock()
+		w.remove(id)
+		w.Unlock()
+	}
+}
+
+func (w *Watchers) remove(id int) {
+	if watch, ok := w.watches[id]; ok {
+		close(watch.events)
+		delete(w.watches, id)
+	}
+}
+
+func (w *Watchers) Publish(event Event) {
+	w.Lock()
+	defer w.Unlock()
+	for id, watch := range w.watches {
+		if !strings.HasPrefix(event.Key, watch.prefix) {
+			continue
+		}
+
+		select {
+		case watch.events <- event:
+		default:
+			w.remove(id)
+		}
+	}
+}
+
+// Close ends every watch, the store calls it once the log is flushed for
+// shutdown.
+func (w *Watchers) Close() {
+	w.Lock()
+	defer w.Unlock()
+	for id := range w.watches {
+		w.remove(id)
+	}
+	w.closed = true
+}
+
+// Watch delivers puts and deletes of keys starting with prefix as they are
+// committed to the data log, until cancel is called or the store shuts down.
+// The prefix is normalized like keys.
+func (k *KvStore) Watch(prefix string) (<-chan Event, CancelFunc) {
+	return k.watchers.add(k.normalizeKey(prefix))
+}
@@ -0,0 +1,134 @@
+package kvstore
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// MIN_READ_CHUNK is the fewest colliding offsets a read worker is given, so
+// short collision scans stay on one goroutine.
+const MIN_READ_CHUNK int = 8
+
+func defaultWorkers() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+func defaultCompactionWorkers() int {
+	if workers := runtime.GOMAXPROCS(0) / 2; workers > 1 {
+		return workers
+	}
+
+	return 1
+}
+
+// parallelChunks splits count items into contiguous chunks run by at most
+// workers goroutines, returning the first error any chunk hit.
+func parallelChunks(workers int, count int, work func(start int, end int) error) error {
+	if workers > count {
+		workers = count
+	}
+
+	if workers <= 1 {
+		return work(0, count)
+	}
+
+	chunk := (count + workers - 1) / workers
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for start := 0; start < count; start += chunk {
+		end := start + chunk
+		if end > count {
+			end = count
+		}
+
+		wg.Add(1)
+		go func(start int, end int) {
+			defer wg.Done()
+			errs <- work(start, end)
+		}(start, end)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readGetParallel splits a long collision scan across read workers, each
+// reading a contiguous run of the sorted offsets.
+func readGetParallel(backend Backend, path string, key string, offsets []int64, readAhead int,
+	workers int) (string, string, error) {
+	if limit := len(offsets) / MIN_READ_CHUNK; workers > limit {
+		workers = limit
+	}
+
+	if workers <= 1 {
+		return readGet(backend, path, key, offsets, readAhead)
+	}
+
+	sorted := make([]int64, len(offsets))
+	copy(sorted, offsets)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var lock sync.Mutex
+	var value, checksum string
+	found := false
+	err := parallelChunks(workers, len(sorted), func(start int, end int) error {
+		v, sum, err := readGet(backend, path, key, sorted[start:end], readAhead)
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		lock.Lock()
+		value, checksum, found = v, sum, true
+		lock.Unlock()
+		return nil
+	})
+
+	if err != nil {
+		return "", "", err
+	}
+
+	if !found {
+		return "", "", ErrKeyNotFound
+	}
+
+	return value, checksum, nil
+}
+
+// encryptBatch encrypts the values of a flush batch across the flush workers,
+// leaving entries for deletes empty.
+func encryptBatch(opts Options, commands []Command) ([]string, error) {
+	workers := opts.FlushWorkers
+	if _, ok := opts.Encryption.(NoEncryption); ok {
+		workers = 1
+	}
+
+	values := make([]string, len(commands))
+	err := parallelChunks(workers, len(commands), func(start int, end int) error {
+		for i := start; i < end; i++ {
+			if commands[i].Type != PUT_COMMAND {
+				continue
+			}
+
+			value, err := encryptValue(opts.Encryption, commands[i].Value)
+			if err != nil {
+				return err
+			}
+			values[i] = value
+		}
+
+		return nil
+	})
+
+	return values, err
+}